@@ -0,0 +1,488 @@
+// ==============================
+// File: cmd/bodyworn-admin/main.go
+// ==============================
+package main
+
+// bodyworn-admin inspects and maintains the storage directory the server runs in.
+//
+//	bodyworn-admin -root /srv/bodyworn users
+//	bodyworn-admin recordings show Recordings/clip.mkv
+//	bodyworn-admin meta set Users/1234 active=false
+//	bodyworn-admin verify -quarantine
+//	bodyworn-admin rotate-credentials
+//	bodyworn-admin accounts add camera-system-1 -role system -connection system1.json
+//	bodyworn-admin tempurl -expires 7d Recordings/clip.mkv
+//	bodyworn-admin retention -within 7d -older-than 90d -prefix Recordings/
+//
+// Run "bodyworn-admin help" for all commands. Changes are made to the files directly,
+// so they publish no events and aren't replicated.
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"BodyWornAPI/server_development_files"
+)
+
+const usage = `usage: bodyworn-admin [-root dir] [-json] command [arguments]
+
+commands:
+  users|devices|systems [list]        list the objects of Users, Devices or System
+  users|devices|systems show ID       show one of them with its metadata
+  recordings [list]                   list recordings with bearer, device and duration
+  recordings show ID|OBJECT           show a recording as /api/recordings does
+  meta show PATH                      show the metadata of an object, container or "" for the account
+  meta set PATH NAME=VALUE...         set metadata items, keeping the others
+  meta rm PATH NAME...                remove metadata items
+  verify [-quarantine]                re-hash every object against its stored checksums
+  regenerate connection|capabilities|all
+                                      write connection.json or System/Capabilities.json again
+  rotate-credentials [-user U] [-key K]
+                                      replace the credentials (a random key by default)
+                                      and regenerate connection.json
+  retention [-within D] [-older-than D] [-prefix P]
+                                      list what expiry, or a retention period, would delete
+  accounts [list]                     list the API accounts
+  accounts add NAME -role R [-key K] [-connection FILE]
+                                      add an admin, reviewer or system account (a random
+                                      key by default), optionally writing its connection file
+  accounts disable|enable|rm NAME     disable, enable or remove an account
+  accounts rotate NAME [-key K] [-connection FILE]
+                                      replace an account's key, revoking its tokens
+  tempurl [-method M] [-expires D] [-ip RANGE] [-filename F] [-inline] [-base URL] OBJECT
+                                      print a link to an object that works without a token
+                                      until it expires, signed with the account's Temp-URL-Key
+`
+
+var asJSON bool
+
+func main() {
+	root := flag.String("root", server.LocalStoragePath, "storage root directory the server runs in")
+	flag.BoolVar(&asJSON, "json", false, "print results as JSON")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fmt.Fprintln(os.Stderr, "\nflags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	server.LocalStoragePath = *root
+	server.SetLogger(&server.DefaultLogger{Out: os.Stderr, MinLevel: server.Error})
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var err error
+	switch cmd, rest := args[0], args[1:]; cmd {
+	case "users":
+		err = parties("Users", rest)
+	case "devices":
+		err = parties("Devices", rest)
+	case "systems":
+		err = parties("System", rest)
+	case "recordings":
+		err = recordings(rest)
+	case "meta":
+		err = meta(rest)
+	case "verify":
+		err = verify(rest)
+	case "regenerate":
+		err = regenerate(rest)
+	case "rotate-credentials":
+		err = rotateCredentials(rest)
+	case "retention":
+		err = retention(rest)
+	case "accounts":
+		err = accounts(rest)
+	case "tempurl":
+		err = tempURL(rest)
+	case "help", "-h", "-help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", cmd)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if errors.Is(err, errUsage) {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+var errUsage = errors.New("usage")
+
+// subcommand returns the action of a "list"/"show" style command, defaulting to list
+func subcommand(args []string) (string, []string) {
+	if len(args) == 0 {
+		return "list", nil
+	}
+	return args[0], args[1:]
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func table() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+// printMetadata prints metadata items sorted by name
+func printMetadata(indent string, items map[string]string) {
+	names := make([]string, 0, len(items))
+	for name := range items {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s%s: %s\n", indent, name, items[name])
+	}
+}
+
+func parties(container string, args []string) error {
+	action, args := subcommand(args)
+	switch {
+	case action == "list" && len(args) == 0:
+		list, err := server.ListParties(container)
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			return printJSON(list)
+		}
+		w := table()
+		fmt.Fprintln(w, "ID\tACTIVE\tMODIFIED\tMETADATA")
+		for _, p := range list {
+			fmt.Fprintf(w, "%s\t%v\t%s\t%d item(s)\n", p.ID, p.Active, p.LastModified[:19], len(p.Metadata))
+		}
+		return w.Flush()
+	case action == "show" && len(args) == 1:
+		p, err := server.LoadParty(container, args[0])
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			return printJSON(p)
+		}
+		fmt.Printf("%s/%s\nactive: %v\nbytes: %d\nmodified: %s\nmetadata:\n", container, p.ID, p.Active, p.Bytes, p.LastModified)
+		printMetadata("  ", p.Metadata)
+		return nil
+	}
+	return errUsage
+}
+
+func partyID(p *server.RecordingParty) string {
+	if p == nil {
+		return "-"
+	}
+	if !p.Found {
+		return p.ID + " (unknown)"
+	}
+	return p.ID
+}
+
+func recordings(args []string) error {
+	action, args := subcommand(args)
+	switch {
+	case action == "list" && len(args) == 0:
+		list, err := server.ListRecordings()
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			return printJSON(list)
+		}
+		w := table()
+		fmt.Fprintln(w, "OBJECT\tBYTES\tDURATION\tBEARER\tDEVICE\tMODIFIED")
+		for _, r := range list {
+			duration := "-"
+			if r.DurationSeconds != nil {
+				duration = (time.Duration(*r.DurationSeconds * float64(time.Second))).Round(time.Second).String()
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", r.Object, r.Bytes, duration, partyID(r.Bearer), partyID(r.Device), r.LastModified[:19])
+		}
+		return w.Flush()
+	case action == "show" && len(args) == 1:
+		r, err := server.LoadRecording(args[0])
+		if err != nil {
+			return err
+		}
+		return printJSON(r)
+	}
+	return errUsage
+}
+
+func meta(args []string) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	action, path, rest := args[0], args[1], args[2:]
+	var m *server.Metadata
+	var err error
+	switch {
+	case action == "show" && len(rest) == 0:
+		m, err = server.ObjectMetadata(path)
+	case action == "set" && len(rest) > 0:
+		set := &server.Metadata{}
+		for _, arg := range rest {
+			name, value, ok := strings.Cut(arg, "=")
+			if !ok || name == "" {
+				return fmt.Errorf("expected NAME=VALUE, got %q", arg)
+			}
+			set.Set(name, value)
+		}
+		m, err = server.UpdateObjectMetadata(path, set, nil)
+	case action == "rm" && len(rest) > 0:
+		m, err = server.UpdateObjectMetadata(path, nil, rest)
+	default:
+		return errUsage
+	}
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(m.Map())
+	}
+	printMetadata("", m.Map())
+	return nil
+}
+
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	quarantine := fs.Bool("quarantine", false, "move objects failing their checksums to .bodyworn/quarantine")
+	fs.Parse(args)
+	server.ScrubQuarantine = *quarantine
+	server.ScrubBytesPerSecond = 0
+
+	report := server.RunScrub()
+	if asJSON {
+		if err := printJSON(report); err != nil {
+			return err
+		}
+	} else {
+		for _, issue := range report.Issues {
+			line := fmt.Sprintf("%-18s %s", issue.Kind, issue.Path)
+			if issue.Detail != "" {
+				line += "  " + issue.Detail
+			}
+			if issue.Quarantined != "" {
+				line += "  -> " + issue.Quarantined
+			}
+			fmt.Println(line)
+		}
+		fmt.Printf("%d object(s), %d byte(s): %d verified, %d checksum(s) recorded, %d skipped, %d problem(s), %d quarantined\n",
+			report.Objects, report.Bytes, report.Verified, report.Baselined, report.Skipped, len(report.Issues), report.Quarantined)
+	}
+	if report.Error != "" {
+		return errors.New(report.Error)
+	}
+	if report.Counts[server.ScrubChecksumMismatch] > 0 || report.Counts[server.ScrubUnreadable] > 0 {
+		return errors.New("objects failed verification")
+	}
+	return nil
+}
+
+func regenerate(args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	var writers []func() (string, error)
+	switch args[0] {
+	case "connection":
+		writers = append(writers, server.WriteConnectionFile)
+	case "capabilities":
+		writers = append(writers, server.WriteCapabilitiesFile)
+	case "all":
+		writers = append(writers, server.WriteConnectionFile, server.WriteCapabilitiesFile)
+	default:
+		return errUsage
+	}
+	for _, write := range writers {
+		path, err := write()
+		if err != nil {
+			return err
+		}
+		fmt.Println("written:", path)
+	}
+	return nil
+}
+
+func rotateCredentials(args []string) error {
+	fs := flag.NewFlagSet("rotate-credentials", flag.ExitOnError)
+	user := fs.String("user", "", "new user name (default: keep the current one)")
+	key := fs.String("key", "", "new key (default: a random one)")
+	fs.Parse(args)
+
+	creds, err := server.RotateCredentials(*user, *key)
+	if err != nil {
+		return err
+	}
+	path, err := server.WriteConnectionFile()
+	if err != nil {
+		return fmt.Errorf("credentials rotated, but connection.json wasn't regenerated: %w", err)
+	}
+	if asJSON {
+		return printJSON(creds)
+	}
+	fmt.Printf("user: %s\nkey:  %s\nwritten: %s\n", creds.User, creds.Key, path)
+	fmt.Println("The old key no longer authenticates; load the new connection.json into the cameras.")
+	return nil
+}
+
+func retention(args []string) error {
+	fs := flag.NewFlagSet("retention", flag.ExitOnError)
+	within := fs.String("within", "0d", "also list objects whose X-Delete-At falls within this period")
+	olderThan := fs.String("older-than", "", "list objects last modified longer ago than this, e.g. 90d")
+	prefix := fs.String("prefix", "", "only apply -older-than to object paths with this prefix")
+	fs.Parse(args)
+
+	withinD, err := server.ParseDuration(*within)
+	if err != nil {
+		return err
+	}
+	var olderD time.Duration
+	if *olderThan != "" {
+		if olderD, err = server.ParseDuration(*olderThan); err != nil {
+			return err
+		}
+	}
+	candidates, err := server.RetentionDryRun(withinD, olderD, *prefix)
+	if err != nil {
+		return err
+	}
+	if asJSON {
+		return printJSON(candidates)
+	}
+	w := table()
+	fmt.Fprintln(w, "OBJECT\tBYTES\tMODIFIED\tDELETE AT\tREASON")
+	var total int64
+	for _, c := range candidates {
+		at := "-"
+		if c.DeleteAt != nil {
+			at = c.DeleteAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", c.Path, c.Bytes, c.LastModified.Format(time.RFC3339), at, c.Reason)
+		total += c.Bytes
+	}
+	w.Flush()
+	fmt.Printf("dry run: %d object(s), %d byte(s) would be deleted\n", len(candidates), total)
+	return nil
+}
+
+func accounts(args []string) error {
+	action, rest := subcommand(args)
+	if action == "list" {
+		list, err := server.ListAccounts()
+		if err != nil {
+			return err
+		}
+		if asJSON {
+			return printJSON(list)
+		}
+		tw := table()
+		fmt.Fprintln(tw, "NAME\tROLE\tDISABLED\tCREATED\tKEY ROTATED")
+		for _, a := range list {
+			fmt.Fprintf(tw, "%s\t%s\t%t\t%s\t%s\n", a.Name, a.Role, a.Disabled,
+				a.Created.Format(time.RFC3339), a.KeyRotated.Format(time.RFC3339))
+		}
+		return tw.Flush()
+	}
+	if len(rest) == 0 {
+		return errUsage
+	}
+	name := rest[0]
+	switch action {
+	case "add", "rotate":
+		fs := flag.NewFlagSet("accounts "+action, flag.ExitOnError)
+		role := fs.String("role", "", "admin, reviewer or system")
+		key := fs.String("key", "", "key (default: a random one)")
+		connection := fs.String("connection", "", "also write a connection file that signs in as the account")
+		fs.Parse(rest[1:])
+
+		var err error
+		if action == "add" {
+			*key, err = server.AddAccount(name, server.Role(*role), *key)
+		} else {
+			*key, err = server.RotateAccountKey(name, *key)
+		}
+		if err != nil {
+			return err
+		}
+		if *connection != "" {
+			content, err := server.ConnectionFileFor(name, *key)
+			if err == nil {
+				err = os.WriteFile(*connection, content, 0600)
+			}
+			if err != nil {
+				return fmt.Errorf("account saved, but the connection file wasn't written: %w", err)
+			}
+		}
+		if asJSON {
+			return printJSON(map[string]string{"name": name, "key": *key})
+		}
+		fmt.Printf("name: %s\nkey:  %s\n", name, *key)
+		if *connection != "" {
+			fmt.Printf("written: %s\n", *connection)
+		}
+		return nil
+	case "disable", "enable":
+		return server.SetAccountDisabled(name, action == "disable")
+	case "rm":
+		return server.RemoveAccount(name)
+	}
+	return errUsage
+}
+
+func tempURL(args []string) error {
+	fs := flag.NewFlagSet("tempurl", flag.ExitOnError)
+	method := fs.String("method", "GET", "GET, HEAD or PUT")
+	expires := fs.String("expires", "24h", "how long the link works, e.g. 30m, 24h or 7d")
+	ipRange := fs.String("ip", "", "only accept the link from this address or CIDR range")
+	filename := fs.String("filename", "", "file name browsers save the download as")
+	inline := fs.Bool("inline", false, "let browsers show the object instead of saving it")
+	base := fs.String("base", "", "server URL, e.g. https://cd.example.com (default: the address connection.json uses)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errUsage
+	}
+
+	d, err := server.ParseDuration(*expires)
+	if err != nil {
+		return err
+	}
+	until := time.Now().Add(d)
+	link, err := server.TempURL(*base, *method, fs.Arg(0), until, *ipRange)
+	if errors.Is(err, server.ErrNoTempURLKey) {
+		return fmt.Errorf("%w; set one with: bodyworn-admin meta set \"\" Temp-URL-Key=SECRET", err)
+	}
+	if err != nil {
+		return err
+	}
+	if *filename != "" {
+		link += "&filename=" + url.QueryEscape(*filename)
+	}
+	if *inline {
+		link += "&inline"
+	}
+	if asJSON {
+		return printJSON(map[string]interface{}{"url": link, "method": strings.ToUpper(*method), "expires": until.UTC()})
+	}
+	fmt.Println(link)
+	return nil
+}
@@ -0,0 +1,122 @@
+// ==============================
+// File: cmd/bodyworn-export/main.go
+// ==============================
+package main
+
+// bodyworn-export builds an evidence package of recordings straight from the storage
+// directory, or verifies a package against its manifest and signature.
+//
+//	bodyworn-export -root /srv/bodyworn -key export.pem -o case-1234.zip Recordings/clip.mkv
+//	bodyworn-export -verify case-1234.zip
+//
+// Recordings are given as object paths or as IDs from /api/recordings.
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"BodyWornAPI/server_development_files"
+)
+
+func main() {
+	root := flag.String("root", server.LocalStoragePath, "storage root directory the server runs in")
+	format := flag.String("format", "", "zip or tar (default: from the -o extension, else zip)")
+	output := flag.String("o", "", "package file to write (default: standard output)")
+	keyPath := flag.String("key", "", "PEM Ed25519 key to sign the manifest with, created if missing")
+	verify := flag.String("verify", "", "verify this package instead of building one")
+	asJSON := flag.Bool("json", false, "print the result as JSON")
+	flag.Parse()
+
+	server.LocalStoragePath = *root
+	server.SetLogger(&server.DefaultLogger{Out: os.Stderr, MinLevel: server.Warning})
+
+	if *verify != "" {
+		os.Exit(verifyPackage(*verify, *asJSON))
+	}
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: bodyworn-export [flags] recording...")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	var key ed25519.PrivateKey
+	if *keyPath != "" {
+		var err error
+		if key, err = server.LoadExportKey(*keyPath); err != nil {
+			fmt.Fprintln(os.Stderr, "export key:", err)
+			os.Exit(1)
+		}
+	}
+	if *format == "" && strings.HasSuffix(*output, ".tar") {
+		*format = "tar"
+	}
+
+	var out io.Writer = os.Stdout
+	var file *os.File
+	if *output != "" {
+		var err error
+		if file, err = os.CreateTemp(filepath.Dir(*output), ".export-*"); err != nil {
+			fmt.Fprintln(os.Stderr, "export failed:", err)
+			os.Exit(1)
+		}
+		defer os.Remove(file.Name())
+		out = file
+	}
+	manifest, err := server.ExportRecordings(out, server.ExportRequest{Recordings: flag.Args(), Format: *format}, key)
+	if err == nil && file != nil {
+		if err = file.Close(); err == nil {
+			err = os.Rename(file.Name(), *output)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "export failed:", err)
+		os.Exit(1)
+	}
+
+	report := os.Stdout
+	if *output == "" {
+		report = os.Stderr
+	}
+	if *asJSON {
+		json.NewEncoder(report).Encode(manifest)
+		return
+	}
+	for _, r := range manifest.Recordings {
+		fmt.Fprintf(report, "%s  %s\n", r.SHA256, r.Object)
+	}
+	fmt.Fprintf(report, "%d recording(s), %d file(s) exported, signed: %v\n", len(manifest.Recordings), len(manifest.Files), key != nil)
+}
+
+func verifyPackage(path string, asJSON bool) int {
+	v, err := server.VerifyExport(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "verify failed:", err)
+		return 1
+	}
+	if asJSON {
+		json.NewEncoder(os.Stdout).Encode(v)
+	} else {
+		fmt.Printf("%d recording(s), %d file(s), created %s\n", len(v.Manifest.Recordings), len(v.Manifest.Files), v.Manifest.Created.Format("2006-01-02 15:04:05Z"))
+		if v.Signed {
+			fmt.Printf("signed with Ed25519 key %s\n", v.PublicKey)
+		} else {
+			fmt.Println("not signed")
+		}
+		for _, p := range v.Problems {
+			fmt.Println("problem:", p)
+		}
+		if len(v.Problems) == 0 {
+			fmt.Println("OK")
+		}
+	}
+	if len(v.Problems) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,45 @@
+// ==============================
+// File: cmd/bodyworn-migrate/main.go
+// ==============================
+package main
+
+// bodyworn-migrate moves .mkv recordings that older versions of the server stored
+// at the account root into a container, so they are stored like any other object.
+//
+//	bodyworn-migrate -root /srv/bodyworn -container Recordings -dry-run
+//
+// A recording's "container" metadata, when present, takes precedence over -container.
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"BodyWornAPI/server_development_files"
+)
+
+func main() {
+	root := flag.String("root", server.LocalStoragePath, "storage root directory the server runs in")
+	container := flag.String("container", server.LegacyRecordingsContainer, "container for recordings without \"container\" metadata")
+	dryRun := flag.Bool("dry-run", false, "only report what would be moved")
+	asJSON := flag.Bool("json", false, "print the result as JSON")
+	flag.Parse()
+
+	server.LocalStoragePath = *root
+	server.SetLogger(&server.DefaultLogger{Out: os.Stderr, MinLevel: server.Warning})
+
+	results, err := server.MigrateFlattenedRecordings(*container, *dryRun)
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(results)
+	} else {
+		for _, m := range results {
+			fmt.Printf("%-8s %s -> %s\n", m.Status, m.From, m.To)
+		}
+		fmt.Printf("%d recording(s) processed\n", len(results))
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "migration failed:", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,76 @@
+// ==============================
+// File: cmd/bodyworn-sim/main.go
+// ==============================
+package main
+
+// bodyworn-sim plays a body worn system against a content destination, to test it
+// without cameras:
+//
+//	bodyworn-sim -connection connection.json
+//	bodyworn-sim -connection connection.json -users 5 -devices 3 -recordings 10 -length 30s
+//
+// It authenticates with the connection file, checks the System container and
+// Capabilities.json, uploads users, devices and recordings, and prints every answer
+// that differs from what the system expects. The exit status is 1 when there were any.
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"BodyWornAPI/simulator"
+)
+
+func main() {
+	sc := simulator.DefaultScenario
+	connection := flag.String("connection", "connection.json", "connection file of the content destination")
+	flag.IntVar(&sc.Users, "users", sc.Users, "number of users to upload")
+	flag.IntVar(&sc.Devices, "devices", sc.Devices, "number of devices to upload")
+	flag.IntVar(&sc.Recordings, "recordings", sc.Recordings, "number of recordings to upload")
+	flag.DurationVar(&sc.Length, "length", sc.Length, "length of each recording")
+	flag.StringVar(&sc.Container, "container", sc.Container, "container the recordings are uploaded to")
+	flag.BoolVar(&sc.Deactivate, "deactivate", sc.Deactivate, "set the first user and device inactive at the end")
+	verbose := flag.Bool("v", false, "print every request")
+	asJSON := flag.Bool("json", false, "print the report as JSON")
+	flag.Parse()
+
+	conn, err := simulator.LoadConnection(*connection)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(2)
+	}
+	sim := simulator.New(conn)
+	if *verbose {
+		sim.Logf = func(format string, args ...interface{}) {
+			fmt.Fprintf(os.Stderr, format+"\n", args...)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, runErr := sim.Run(ctx, sc)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		fmt.Printf("storage URL: %s\nsystem: %s\nuploaded: %d user(s), %d device(s), %d recording(s) in %d request(s)\n",
+			report.StorageURL, report.SystemID, len(report.Users), len(report.Devices), len(report.Recordings), report.Requests)
+		for _, d := range report.Deviations {
+			fmt.Println("deviation:", d)
+		}
+		if report.OK() && runErr == nil {
+			fmt.Println("no deviations")
+		}
+	}
+	if runErr != nil {
+		fmt.Fprintln(os.Stderr, "error:", runErr)
+	}
+	if runErr != nil || !report.OK() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,310 @@
+// Package fmp4 writes fragmented MP4 (ISO BMFF) initialization and media segments
+// for H.264 video and Opus audio, as used by HLS and Media Source Extensions.
+package fmp4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Codecs supported by the writer
+const (
+	CodecH264 = "avc1"
+	CodecOpus = "Opus"
+)
+
+// Track describes one track of the movie
+type Track struct {
+	ID        uint32
+	Codec     string // CodecH264 or CodecOpus
+	Timescale uint32 // ticks per second of the track's timestamps
+
+	// H.264: the AVCDecoderConfigurationRecord (avcC) and picture size
+	AVCConfig     []byte
+	Width, Height uint16
+
+	// Opus: the OpusHead identification header as stored in Matroska and Ogg
+	OpusHead []byte
+}
+
+// Sample is one frame of a fragment
+type Sample struct {
+	Duration          uint32 // in the track's timescale
+	CompositionOffset int32  // presentation minus decode time
+	Keyframe          bool
+	Data              []byte
+}
+
+// Fragment holds consecutive samples of one track
+type Fragment struct {
+	TrackID        uint32
+	BaseDecodeTime uint64 // decode time of the first sample, in the track's timescale
+	Samples        []Sample
+}
+
+// CodecString returns the RFC 6381 codec of the track, e.g. "avc1.64001f" or "opus"
+func (t Track) CodecString() string {
+	switch t.Codec {
+	case CodecH264:
+		if len(t.AVCConfig) >= 4 {
+			return fmt.Sprintf("avc1.%02x%02x%02x", t.AVCConfig[1], t.AVCConfig[2], t.AVCConfig[3])
+		}
+		return "avc1"
+	case CodecOpus:
+		return "opus"
+	}
+	return t.Codec
+}
+
+func (t Track) isVideo() bool {
+	return t.Codec == CodecH264
+}
+
+// box builds an ISO BMFF box
+func box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	out := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(out, uint32(size))
+	copy(out[4:], typ)
+	for _, p := range payload {
+		out = append(out, p...)
+	}
+	return out
+}
+
+// fullBox builds a box with a version and flags header
+func fullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{header}, payload...)...)
+}
+
+// fields encodes big endian integers; each value's Go type picks its width
+func fields(values ...interface{}) []byte {
+	var out []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case uint8:
+			out = append(out, v)
+		case uint16:
+			out = binary.BigEndian.AppendUint16(out, v)
+		case int16:
+			out = binary.BigEndian.AppendUint16(out, uint16(v))
+		case uint32:
+			out = binary.BigEndian.AppendUint32(out, v)
+		case int32:
+			out = binary.BigEndian.AppendUint32(out, uint32(v))
+		case uint64:
+			out = binary.BigEndian.AppendUint64(out, v)
+		case []byte:
+			out = append(out, v...)
+		case string:
+			out = append(out, v...)
+		default:
+			panic(fmt.Sprintf("fmp4: unsupported field type %T", v))
+		}
+	}
+	return out
+}
+
+var unityMatrix = fields(
+	uint32(0x00010000), uint32(0), uint32(0),
+	uint32(0), uint32(0x00010000), uint32(0),
+	uint32(0), uint32(0), uint32(0x40000000),
+)
+
+// InitSegment returns the ftyp and moov boxes describing tracks
+func InitSegment(tracks []Track) ([]byte, error) {
+	ftyp := box("ftyp", fields("iso6", uint32(0), "iso6", "iso5", "mp41"))
+
+	nextID := uint32(1)
+	var traks, trexs []byte
+	for _, t := range tracks {
+		trak, err := trakBox(t)
+		if err != nil {
+			return nil, err
+		}
+		traks = append(traks, trak...)
+		trexs = append(trexs, fullBox("trex", 0, 0, fields(t.ID, uint32(1), uint32(0), uint32(0), uint32(0)))...)
+		if t.ID >= nextID {
+			nextID = t.ID + 1
+		}
+	}
+	mvhd := fullBox("mvhd", 0, 0, fields(
+		uint32(0), uint32(0), uint32(1000), uint32(0), // times, timescale, duration
+		uint32(0x00010000), uint16(0x0100), uint16(0), uint32(0), uint32(0),
+		unityMatrix, make([]byte, 24), nextID,
+	))
+	moov := box("moov", mvhd, traks, box("mvex", trexs))
+	return append(ftyp, moov...), nil
+}
+
+func trakBox(t Track) ([]byte, error) {
+	entry, err := sampleEntry(t)
+	if err != nil {
+		return nil, err
+	}
+	volume, handler, name := uint16(0x0100), "soun", "SoundHandler"
+	var width, height uint32
+	mediaHeader := fullBox("smhd", 0, 0, fields(uint16(0), uint16(0)))
+	if t.isVideo() {
+		volume, handler, name = 0, "vide", "VideoHandler"
+		width, height = uint32(t.Width)<<16, uint32(t.Height)<<16
+		mediaHeader = fullBox("vmhd", 0, 1, fields(uint16(0), uint16(0), uint16(0), uint16(0)))
+	}
+
+	tkhd := fullBox("tkhd", 0, 3, fields(
+		uint32(0), uint32(0), t.ID, uint32(0), uint32(0), // times, track, reserved, duration
+		uint32(0), uint32(0), uint16(0), uint16(0), volume, uint16(0),
+		unityMatrix, width, height,
+	))
+	mdhd := fullBox("mdhd", 0, 0, fields(uint32(0), uint32(0), t.Timescale, uint32(0), uint16(0x55C4), uint16(0)))
+	hdlr := fullBox("hdlr", 0, 0, fields(uint32(0), handler, uint32(0), uint32(0), uint32(0), name, uint8(0)))
+	dinf := box("dinf", fullBox("dref", 0, 0, fields(uint32(1)), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, fields(uint32(1)), entry),
+		fullBox("stts", 0, 0, fields(uint32(0))),
+		fullBox("stsc", 0, 0, fields(uint32(0))),
+		fullBox("stsz", 0, 0, fields(uint32(0), uint32(0))),
+		fullBox("stco", 0, 0, fields(uint32(0))),
+	)
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", mediaHeader, dinf, stbl))), nil
+}
+
+func sampleEntry(t Track) ([]byte, error) {
+	switch t.Codec {
+	case CodecH264:
+		if len(t.AVCConfig) < 7 {
+			return nil, fmt.Errorf("fmp4: track %d has no avcC configuration", t.ID)
+		}
+		compressor := make([]byte, 32)
+		return box("avc1", fields(
+			make([]byte, 6), uint16(1), // reserved, data reference index
+			uint16(0), uint16(0), make([]byte, 12),
+			t.Width, t.Height,
+			uint32(0x00480000), uint32(0x00480000), uint32(0), uint16(1),
+			compressor, uint16(0x0018), int16(-1),
+		), box("avcC", t.AVCConfig)), nil
+	case CodecOpus:
+		dops, channels, err := opusSpecificBox(t.OpusHead)
+		if err != nil {
+			return nil, err
+		}
+		return box("Opus", fields(
+			make([]byte, 6), uint16(1),
+			uint32(0), uint32(0), // reserved
+			uint16(channels), uint16(16), uint16(0), uint16(0),
+			uint32(48000)<<16,
+		), dops), nil
+	}
+	return nil, fmt.Errorf("fmp4: unsupported codec %q", t.Codec)
+}
+
+// opusSpecificBox converts the little endian OpusHead into the big endian dOps box
+func opusSpecificBox(head []byte) ([]byte, uint8, error) {
+	if len(head) < 19 || string(head[:8]) != "OpusHead" {
+		return nil, 0, fmt.Errorf("fmp4: invalid OpusHead")
+	}
+	channels := head[9]
+	payload := fields(
+		uint8(0), channels,
+		binary.LittleEndian.Uint16(head[10:]),
+		binary.LittleEndian.Uint32(head[12:]),
+		int16(binary.LittleEndian.Uint16(head[16:])),
+		head[18],
+	)
+	if head[18] != 0 {
+		if len(head) < 21+int(channels) {
+			return nil, 0, fmt.Errorf("fmp4: OpusHead channel mapping truncated")
+		}
+		payload = append(payload, head[19:21+int(channels)]...)
+	}
+	return box("dOps", payload), channels, nil
+}
+
+// Sample flags: sync samples depend on nothing, others depend on earlier samples
+const (
+	flagsKeyframe    = 0x02000000
+	flagsNonKeyframe = 0x01010000
+)
+
+// MediaSegment returns a moof and mdat pair holding fragments; seq numbers the segment
+func MediaSegment(seq uint32, fragments []Fragment) []byte {
+	build := func(dataOffset uint32) []byte {
+		trafs := []byte{}
+		offset := dataOffset
+		for _, f := range fragments {
+			trafs = append(trafs, trafBox(f, offset)...)
+			for _, s := range f.Samples {
+				offset += uint32(len(s.Data))
+			}
+		}
+		return box("moof", fullBox("mfhd", 0, 0, fields(seq)), trafs)
+	}
+	// The moof size doesn't depend on the offsets, so measure it with zero offsets first
+	moofSize := uint32(len(build(0)))
+	moof := build(moofSize + 8)
+
+	var data []byte
+	for _, f := range fragments {
+		for _, s := range f.Samples {
+			data = append(data, s.Data...)
+		}
+	}
+	return append(moof, box("mdat", data)...)
+}
+
+func trafBox(f Fragment, dataOffset uint32) []byte {
+	const (
+		dataOffsetPresent = 0x000001
+		durationPresent   = 0x000100
+		sizePresent       = 0x000200
+		flagsPresent      = 0x000400
+		ctsPresent        = 0x000800
+	)
+	trun := fields(uint32(len(f.Samples)), dataOffset)
+	for _, s := range f.Samples {
+		flags := uint32(flagsNonKeyframe)
+		if s.Keyframe {
+			flags = flagsKeyframe
+		}
+		trun = append(trun, fields(s.Duration, uint32(len(s.Data)), flags, s.CompositionOffset)...)
+	}
+	return box("traf",
+		fullBox("tfhd", 0, 0x020000, fields(f.TrackID)), // default-base-is-moof
+		fullBox("tfdt", 1, 0, fields(f.BaseDecodeTime)),
+		fullBox("trun", 1, dataOffsetPresent|durationPresent|sizePresent|flagsPresent|ctsPresent, trun),
+	)
+}
+
+// OpusPacketDuration returns the number of 48 kHz samples in an Opus packet, from
+// its TOC byte and frame count (RFC 6716 section 3.1), or 0 when it can't be read
+func OpusPacketDuration(packet []byte) uint32 {
+	if len(packet) == 0 {
+		return 0
+	}
+	toc := packet[0]
+	config := toc >> 3
+	var frameSamples uint32
+	switch {
+	case config < 12: // SILK: 10, 20, 40, 60 ms
+		frameSamples = []uint32{480, 960, 1920, 2880}[config%4]
+	case config < 16: // Hybrid: 10, 20 ms
+		frameSamples = []uint32{480, 960}[config%2]
+	default: // CELT: 2.5, 5, 10, 20 ms
+		frameSamples = []uint32{120, 240, 480, 960}[config%4]
+	}
+	frames := uint32(1)
+	switch toc & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		frames = uint32(packet[1] & 0x3F)
+	}
+	return frames * frameSamples
+}
@@ -0,0 +1,213 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// testBox is a parsed box; children are parsed for the container boxes
+type testBox struct {
+	typ      string
+	offset   int // of the box header in the parsed data
+	payload  []byte
+	children []testBox
+}
+
+var containers = map[string]bool{"moov": true, "trak": true, "mdia": true, "minf": true, "stbl": true, "mvex": true, "dinf": true, "moof": true, "traf": true}
+
+// parseBoxes splits data into boxes, checking that their sizes add up
+func parseBoxes(t *testing.T, data []byte, base int) []testBox {
+	t.Helper()
+	var boxes []testBox
+	for pos := 0; pos < len(data); {
+		if len(data)-pos < 8 {
+			t.Fatalf("%d trailing bytes at %d", len(data)-pos, base+pos)
+		}
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		if size < 8 || pos+size > len(data) {
+			t.Fatalf("box %q at %d has size %d, %d bytes left", data[pos+4:pos+8], base+pos, size, len(data)-pos)
+		}
+		b := testBox{typ: string(data[pos+4 : pos+8]), offset: base + pos, payload: data[pos+8 : pos+size]}
+		if containers[b.typ] {
+			b.children = parseBoxes(t, b.payload, base+pos+8)
+		}
+		boxes = append(boxes, b)
+		pos += size
+	}
+	return boxes
+}
+
+// layout renders the box tree as "moov(mvhd trak(...))"
+func layout(boxes []testBox) string {
+	var parts []string
+	for _, b := range boxes {
+		if b.children != nil {
+			parts = append(parts, b.typ+"("+layout(b.children)+")")
+		} else {
+			parts = append(parts, b.typ)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func find(boxes []testBox, path ...string) *testBox {
+	for i := range boxes {
+		if boxes[i].typ == path[0] {
+			if len(path) == 1 {
+				return &boxes[i]
+			}
+			return find(boxes[i].children, path[1:]...)
+		}
+	}
+	return nil
+}
+
+var (
+	avcConfig = []byte{0x01, 0x64, 0x00, 0x1f, 0xff, 0xe1, 0x00, 0x04, 'g', 'A', 'A', 'A', 0x01, 0x00, 0x02, 'h', 'B'}
+	// OpusHead: version 1, 2 channels, pre-skip 312, 48 kHz, gain -1, mapping family 0
+	opusHead = []byte("OpusHead\x01\x02\x38\x01\x80\xbb\x00\x00\xff\xff\x00")
+	tracks   = []Track{
+		{ID: 1, Codec: CodecH264, Timescale: 90000, AVCConfig: avcConfig, Width: 640, Height: 480},
+		{ID: 2, Codec: CodecOpus, Timescale: 48000, OpusHead: opusHead},
+	}
+)
+
+func TestInitSegment(t *testing.T) {
+	init, err := InitSegment(tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boxes := parseBoxes(t, init, 0)
+	trak := "trak(tkhd mdia(mdhd hdlr minf(%s dinf(dref) stbl(stsd stts stsc stsz stco))))"
+	want := "ftyp moov(mvhd " + strings.Replace(trak, "%s", "vmhd", 1) + " " + strings.Replace(trak, "%s", "smhd", 1) + " mvex(trex trex))"
+	if got := layout(boxes); got != want {
+		t.Errorf("layout\n%s\nwant\n%s", got, want)
+	}
+
+	// mvhd's next track ID follows the highest one
+	mvhd := find(boxes, "moov", "mvhd")
+	if next := binary.BigEndian.Uint32(mvhd.payload[len(mvhd.payload)-4:]); next != 3 {
+		t.Errorf("next track ID %d, want 3", next)
+	}
+	video := boxes[1].children[1]
+	if hdlr := find(video.children, "mdia", "hdlr"); !bytes.Contains(hdlr.payload, []byte("vide")) {
+		t.Errorf("video handler %q", hdlr.payload)
+	}
+	if mdhd := find(video.children, "mdia", "mdhd"); binary.BigEndian.Uint32(mdhd.payload[12:]) != 90000 {
+		t.Errorf("video timescale %d", binary.BigEndian.Uint32(mdhd.payload[12:]))
+	}
+	stsd := find(video.children, "mdia", "minf", "stbl", "stsd")
+	if !bytes.Contains(stsd.payload, []byte("avc1")) || !bytes.Contains(stsd.payload, append([]byte("avcC"), avcConfig...)) {
+		t.Errorf("video sample entry % x", stsd.payload)
+	}
+
+	// dOps is the big endian form of the OpusHead
+	audio := boxes[1].children[2]
+	stsd = find(audio.children, "mdia", "minf", "stbl", "stsd")
+	wantDOps := []byte{0, 0, 0, 19, 'd', 'O', 'p', 's', 0, 2, 0x01, 0x38, 0, 0, 0xbb, 0x80, 0xff, 0xff, 0}
+	if !bytes.HasSuffix(stsd.payload, wantDOps) {
+		t.Errorf("audio sample entry % x, want dOps % x", stsd.payload, wantDOps)
+	}
+
+	for _, bad := range []Track{
+		{ID: 1, Codec: CodecH264, AVCConfig: []byte{1, 2}},
+		{ID: 1, Codec: CodecOpus, OpusHead: []byte("OpusHead")},
+		{ID: 1, Codec: CodecOpus, OpusHead: []byte("OpusHead\x01\x02\x38\x01\x80\xbb\x00\x00\x00\x00\x01\x01")},
+		{ID: 1, Codec: "vp09"},
+	} {
+		if _, err := InitSegment([]Track{bad}); err == nil {
+			t.Errorf("track %+v accepted", bad)
+		}
+	}
+}
+
+func TestMediaSegment(t *testing.T) {
+	fragments := []Fragment{
+		{TrackID: 1, BaseDecodeTime: 90000, Samples: []Sample{
+			{Duration: 3600, Keyframe: true, Data: []byte("key")},
+			{Duration: 3600, CompositionOffset: -3600, Data: []byte("delta")},
+		}},
+		{TrackID: 2, BaseDecodeTime: 48000, Samples: []Sample{{Duration: 960, Keyframe: true, Data: []byte("opus")}}},
+	}
+	segment := MediaSegment(7, fragments)
+	boxes := parseBoxes(t, segment, 0)
+	if got, want := layout(boxes), "moof(mfhd traf(tfhd tfdt trun) traf(tfhd tfdt trun)) mdat"; got != want {
+		t.Fatalf("layout %s, want %s", got, want)
+	}
+	if seq := binary.BigEndian.Uint32(find(boxes, "moof", "mfhd").payload[4:]); seq != 7 {
+		t.Errorf("sequence number %d", seq)
+	}
+	if got := string(boxes[1].payload); got != "keydeltaopus" {
+		t.Errorf("mdat %q", got)
+	}
+
+	// Every trun's data offset, counted from the moof, points at its samples in mdat
+	moof := boxes[0]
+	for i, traf := range moof.children[1:] {
+		f := fragments[i]
+		if id := binary.BigEndian.Uint32(find(traf.children, "tfhd").payload[4:]); id != f.TrackID {
+			t.Errorf("traf %d: track %d", i, id)
+		}
+		if base := binary.BigEndian.Uint64(find(traf.children, "tfdt").payload[4:]); base != f.BaseDecodeTime {
+			t.Errorf("traf %d: base decode time %d", i, base)
+		}
+		trun := find(traf.children, "trun").payload
+		count := binary.BigEndian.Uint32(trun[4:])
+		offset := int(binary.BigEndian.Uint32(trun[8:]))
+		if int(count) != len(f.Samples) {
+			t.Fatalf("traf %d: %d samples", i, count)
+		}
+		for j, s := range f.Samples {
+			entry := trun[12+16*j:]
+			size := int(binary.BigEndian.Uint32(entry[4:]))
+			flags := binary.BigEndian.Uint32(entry[8:])
+			cts := int32(binary.BigEndian.Uint32(entry[12:]))
+			if binary.BigEndian.Uint32(entry) != s.Duration || cts != s.CompositionOffset || (flags == flagsKeyframe) != s.Keyframe {
+				t.Errorf("traf %d sample %d: duration %d, flags %x, cts %d", i, j, binary.BigEndian.Uint32(entry), flags, cts)
+			}
+			if got := segment[moof.offset+offset : moof.offset+offset+size]; !bytes.Equal(got, s.Data) {
+				t.Errorf("traf %d sample %d: data %q, want %q", i, j, got, s.Data)
+			}
+			offset += size
+		}
+	}
+}
+
+func TestCodecString(t *testing.T) {
+	for _, tc := range []struct {
+		track Track
+		want  string
+	}{
+		{tracks[0], "avc1.64001f"},
+		{Track{Codec: CodecH264}, "avc1"},
+		{tracks[1], "opus"},
+	} {
+		if got := tc.track.CodecString(); got != tc.want {
+			t.Errorf("%s: %q, want %q", tc.track.Codec, got, tc.want)
+		}
+	}
+}
+
+func TestOpusPacketDuration(t *testing.T) {
+	for _, tc := range []struct {
+		packet []byte
+		want   uint32
+	}{
+		{nil, 0},
+		{[]byte{0x00}, 480},        // SILK 10 ms
+		{[]byte{0x18}, 2880},       // SILK 60 ms
+		{[]byte{0x68}, 960},        // hybrid 20 ms
+		{[]byte{0x80}, 120},        // CELT 2.5 ms
+		{[]byte{0xfc}, 960},        // CELT 20 ms, stereo
+		{[]byte{0xfd}, 1920},       // two frames
+		{[]byte{0xfe}, 1920},       // two frames of different sizes
+		{[]byte{0xff, 0x03}, 2880}, // three frames, counted
+		{[]byte{0xff}, 0},          // frame count missing
+	} {
+		if got := OpusPacketDuration(tc.packet); got != tc.want {
+			t.Errorf("% x: %d, want %d", tc.packet, got, tc.want)
+		}
+	}
+}
@@ -3,5 +3,3 @@ module BodyWornAPI
 go 1.23.0
 
 toolchain go1.23.8
-
-require golang.org/x/text v0.23.0
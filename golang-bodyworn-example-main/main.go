@@ -4,27 +4,90 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"BodyWornAPI/server_development_files"
 )
 
-const (
-	port = ":8080"
-)
-
 func main() {
-	log.Println("Starting Axis Body Worn API Server on port", port)
+	listen := flag.String("listen", ":8080", "address to listen on")
+	logFormat := flag.String("log-format", "text", "log output format: text or json")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warning or error")
+	minFreeMB := flag.Uint64("health-min-free-mb", 1024, "free space in MB below which /readyz fails")
+	reserveMB := flag.Uint64("upload-reserve-mb", 512, "free space in MB always kept in reserve; larger uploads get 507 Insufficient Storage")
+	warningMB := flag.Uint64("disk-warning-mb", 10240, "free space in MB below which a low storage warning is raised")
+	criticalMB := flag.Uint64("disk-critical-mb", 2048, "free space in MB below which a critical storage error is raised")
+	lowPriority := flag.String("low-priority-uploads", "", "comma separated path patterns (e.g. \"Users/*,Archive/\") paused while storage is low")
+	webhooksFile := flag.String("webhooks", "", "JSON file listing webhooks to notify of storage events")
+	exportKey := flag.String("export-key", "", "PEM Ed25519 key evidence packages are signed with, created if missing")
+	replicationFile := flag.String("replication", "", "JSON file listing remote Swift accounts to replicate every change to")
+	reconcileInterval := flag.Duration("replication-reconcile", time.Hour, "how often replicas are compared with this server by ETag (0 disables)")
+	tieringFile := flag.String("tiering", "", "JSON file with the cold storage path and the policies that move objects there")
+	tieringInterval := flag.Duration("tiering-interval", time.Hour, "how often tier policies are applied (0 only on POST /api/tiering/run)")
+	scrubInterval := flag.Duration("scrub-interval", 24*time.Hour, "how often every object is re-hashed against its stored checksums (0 only on POST /api/scrub/run)")
+	scrubQuarantine := flag.Bool("scrub-quarantine", false, "move objects failing their checksums to .bodyworn/quarantine")
+	scrubRateMB := flag.Int64("scrub-rate-mb", 64, "MB per second the scrubber reads at most (0 for no limit)")
+	expirerInterval := flag.Duration("expirer-interval", 30*time.Second, "how often objects past their X-Delete-At are removed")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 60*time.Second, "how long to let in-flight uploads finish after SIGINT/SIGTERM")
+	corsOrigins := flag.String("cors-origins", "", "comma separated origins (or *) browsers may call every endpoint from")
+	tokenLifetime := flag.Duration("token-lifetime", 24*time.Hour, "how long tokens issued by /auth/v1.0 are valid")
+	flag.Parse()
 
 	// Initialize logger
-	server.SetLogger(&server.DefaultLogger{})
+	format, err := server.ParseFormat(*logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	level, err := server.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	logger := &server.DefaultLogger{Format: format, MinLevel: level}
+	server.SetLogger(logger)
+	server.HealthMinFreeBytes = *minFreeMB << 20
+	server.UploadReserveBytes = *reserveMB << 20
+	server.DiskWarningBytes = *warningMB << 20
+	server.DiskCriticalBytes = *criticalMB << 20
+	server.TokenLifetime = *tokenLifetime
+	if *corsOrigins != "" {
+		server.CORSOrigins = strings.Split(*corsOrigins, ",")
+	}
+	if *lowPriority != "" {
+		server.PauseLowPriority = true
+		server.LowPriorityPatterns = strings.Split(*lowPriority, ",")
+	}
+
+	logger.Log(server.Info, "starting Axis Body Worn API Server", "listen", *listen)
 
 	// Initialize file structure and required objects
-	server.CreateRequiredContainersAndObjects()
+	if err := server.CreateRequiredContainersAndObjects(); err != nil {
+		logger.Log(server.Error, "failed to initialize storage", "error", err)
+		os.Exit(1)
+	}
+
+	if err := server.StartAuditLog(); err != nil {
+		logger.Log(server.Error, "failed to open audit log", "error", err)
+		os.Exit(1)
+	}
+	if *exportKey != "" {
+		if server.ExportKey, err = server.LoadExportKey(*exportKey); err != nil {
+			logger.Log(server.Error, "failed to load export key", "error", err)
+			os.Exit(1)
+		}
+	}
 
 	// Serve the static index page
 	http.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -39,26 +102,158 @@ func main() {
 		})
 	})
 
+	// Prometheus metrics, which name containers, replicas and webhook URLs, for reviewers
+	http.HandleFunc("/metrics", server.RequireRole(server.MetricsHandler, server.RoleReviewer))
+
+	// Health and readiness probes
+	http.HandleFunc("/healthz", server.HealthzHandler)
+	http.HandleFunc("/readyz", server.ReadyzHandler)
+
 	// Authentication endpoint
 	http.HandleFunc("/auth/v1.0", server.AuthHandler)
 
-	// Storage + root file listing handler
-	http.HandleFunc(fmt.Sprintf("/v1.0/%s/", server.StorageAccount), func(w http.ResponseWriter, r *http.Request) {
-		path := strings.TrimPrefix(r.URL.Path, fmt.Sprintf("/v1.0/%s/", server.StorageAccount))
+	// Keystone v3 authentication, sharing the tokens of /auth/v1.0
+	http.HandleFunc("/v3", server.KeystoneHandler)
+	http.HandleFunc("/v3/", server.KeystoneHandler)
 
-		if path == "" && r.Method == http.MethodGet {
-			// Handle GET /v1.0/<account>/ — return list of root files
-			server.HandleListRootFiles(w, r)
-			return
-		}
+	// API accounts and their roles, for admins
+	accounts := server.RequireRole(server.AccountsHandler)
+	http.HandleFunc("/api/accounts", accounts)
+	http.HandleFunc("/api/accounts/", accounts)
 
-		// Handle standard Swift-style storage operations
-		server.StorageHandler(w, r)
-	})
+	// Recordings joined with their metadata, bearer, device and system
+	recordings := server.RequireRole(server.RecordingsAPIHandler, server.RoleReviewer)
+	http.HandleFunc("/api/recordings", recordings)
+	http.HandleFunc("/api/recordings/", recordings)
+
+	// Evidence packages of recordings
+	exports := server.RequireRole(server.ExportsHandler, server.RoleReviewer)
+	http.HandleFunc("/api/exports", exports)
+	http.HandleFunc("/api/exports/", exports)
+
+	// Replication state and on-demand reconciliation
+	replication := server.RequireRole(server.ReplicationHandler)
+	http.HandleFunc("/api/replication", replication)
+	http.HandleFunc("/api/replication/", replication)
+
+	// Integrity scrub reports and on-demand passes
+	scrub := server.RequireRole(server.ScrubHandler)
+	http.HandleFunc("/api/scrub", scrub)
+	http.HandleFunc("/api/scrub/", scrub)
+
+	// Storage tiering state, policy runs and restores from the cold tier
+	tiering := server.RequireRole(server.TieringHandler)
+	http.HandleFunc("/api/tiering", tiering)
+	http.HandleFunc("/api/tiering/", tiering)
+
+	// Live storage events as Server-Sent Events
+	http.HandleFunc("/events", server.RequireRole(server.EventsHandler, server.RoleReviewer))
+
+	// Swift-style storage operations on the account, its containers and objects
+	http.HandleFunc(fmt.Sprintf("/v1.0/%s", server.StorageAccount), server.StorageHandler)
+	http.HandleFunc(fmt.Sprintf("/v1.0/%s/", server.StorageAccount), server.StorageHandler)
 
 	// Start server
-	if err := http.ListenAndServe(port, nil); err != nil {
-		log.Fatal("Failed to start server:", err)
+	srv := &http.Server{
+		Addr:        *listen,
+		Handler:     server.WithRawHeaders(server.WithRequestLogging(server.WithMetrics(server.WithCORS(http.DefaultServeMux)))),
+		ConnContext: server.RawHeaderConnContext,
 	}
-}
+	srv.RegisterOnShutdown(server.CloseEventStreams)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
+	monitorCtx, stopMonitor := context.WithCancel(context.Background())
+	defer stopMonitor()
+	server.StartDiskMonitor(monitorCtx, time.Minute)
+	if err := server.StartExpirer(monitorCtx, *expirerInterval); err != nil {
+		logger.Log(server.Error, "failed to start object expirer", "error", err)
+		os.Exit(1)
+	}
+	if *webhooksFile != "" {
+		hooks, err := server.LoadWebhooks(*webhooksFile)
+		if err == nil {
+			err = server.StartWebhooks(monitorCtx, hooks)
+		}
+		if err != nil {
+			logger.Log(server.Error, "failed to start webhooks", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	if *replicationFile != "" {
+		targets, err := server.LoadReplicationTargets(*replicationFile)
+		if err == nil {
+			err = server.StartReplication(monitorCtx, targets, *reconcileInterval)
+		}
+		if err != nil {
+			logger.Log(server.Error, "failed to start replication", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	server.ScrubQuarantine = *scrubQuarantine
+	server.ScrubBytesPerSecond = *scrubRateMB << 20
+	server.StartScrubber(monitorCtx, *scrubInterval)
+
+	if *tieringFile != "" {
+		cfg, err := server.LoadTieringConfig(*tieringFile)
+		if err == nil {
+			err = server.StartTiering(monitorCtx, cfg, *tieringInterval)
+		}
+		if err != nil {
+			logger.Log(server.Error, "failed to start storage tiering", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// The listener records raw request headers so metadata keeps its original spelling
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		logger.Log(server.Error, "failed to start server", "error", err)
+		os.Exit(1)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(server.RawHeaderListener(ln))
+	}()
+
+	select {
+	case err := <-serveErr:
+		logger.Log(server.Error, "failed to start server", "error", err)
+		os.Exit(1)
+	case <-ctx.Done():
+	}
+	stop()
+
+	// Stop accepting connections and let in-flight uploads finish
+	logger.Log(server.Info, "shutting down, draining in-flight uploads",
+		"uploads", len(server.InFlightUploads()), "timeout", *shutdownTimeout)
+	server.BeginShutdown()
+
+	drainCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		aborted := server.AbortInFlightUploads()
+		logger.Log(server.Warning, "drain timeout expired, closing remaining connections", "aborted_uploads", len(aborted))
+		srv.Close()
+
+		// Give aborted handlers a moment to discard their partial files
+		waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := server.WaitForUploads(waitCtx); err != nil {
+			logger.Log(server.Warning, "uploads still running after close", "uploads", len(server.InFlightUploads()))
+		}
+		waitCancel()
+	}
+	if err := <-serveErr; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Log(server.Error, "server stopped with error", "error", err)
+	}
+
+	hooksCtx, hooksCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer hooksCancel()
+	if err := server.RunShutdownHooks(hooksCtx); err != nil {
+		logger.Log(server.Error, "shutdown completed with errors", "error", err)
+		os.Exit(1)
+	}
+	logger.Log(server.Info, "shutdown complete")
+}
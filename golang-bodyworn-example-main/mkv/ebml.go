@@ -0,0 +1,238 @@
+// Package mkv reads the parts of Matroska (.mkv) files the server needs: segment
+// information, track descriptions and the timing of the recorded frames. It also
+// writes simple files, for generating test recordings.
+package mkv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Element IDs used by the package, including their length marker bits
+const (
+	IDEBML               = 0x1A45DFA3
+	IDEBMLVersion        = 0x4286
+	IDEBMLReadVersion    = 0x42F7
+	IDEBMLMaxIDLength    = 0x42F2
+	IDEBMLMaxSizeLength  = 0x42F3
+	IDDocType            = 0x4282
+	IDDocTypeVersion     = 0x4287
+	IDDocTypeReadVersion = 0x4285
+	IDSegment            = 0x18538067
+	IDSeekHead           = 0x114D9B74
+	IDInfo               = 0x1549A966
+	IDTimecodeScale      = 0x2AD7B1
+	IDDuration           = 0x4489
+	IDDateUTC            = 0x4461
+	IDTitle              = 0x7BA9
+	IDMuxingApp          = 0x4D80
+	IDWritingApp         = 0x5741
+	IDTracks             = 0x1654AE6B
+	IDTrackEntry         = 0xAE
+	IDTrackNumber        = 0xD7
+	IDTrackUID           = 0x73C5
+	IDTrackType          = 0x83
+	IDCodecID            = 0x86
+	IDCodecPrivate       = 0x63A2
+	IDDefaultDuration    = 0x23E383
+	IDVideo              = 0xE0
+	IDPixelWidth         = 0xB0
+	IDPixelHeight        = 0xBA
+	IDAudio              = 0xE1
+	IDSamplingFreq       = 0xB5
+	IDChannels           = 0x9F
+	IDCluster            = 0x1F43B675
+	IDTimecode           = 0xE7
+	IDSimpleBlock        = 0xA3
+	IDBlockGroup         = 0xA0
+	IDBlock              = 0xA1
+	IDCues               = 0x1C53BB6B
+	IDVoid               = 0xEC
+)
+
+// UnknownSize is the size of elements written without a length, as live recorders do
+const UnknownSize = math.MaxUint64
+
+// ErrNotMatroska is returned when a file doesn't start with an EBML header
+var ErrNotMatroska = errors.New("mkv: not a Matroska file")
+
+// Element is an element header; Offset is where its data starts
+type Element struct {
+	ID     uint32
+	Size   uint64
+	Offset int64
+}
+
+// End returns the offset just past the element, or -1 when its size is unknown
+func (e Element) End() int64 {
+	if e.Size == UnknownSize {
+		return -1
+	}
+	return e.Offset + int64(e.Size)
+}
+
+// readVint reads a variable length integer; keepMarker leaves the length marker in
+// place as element IDs do. It returns the value and the number of bytes read.
+func readVint(r io.Reader, keepMarker bool) (uint64, int, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return 0, 0, err
+	}
+	length := 1
+	for mask := byte(0x80); length <= 8 && b[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 {
+		return 0, 1, fmt.Errorf("mkv: invalid variable length integer 0x%02x", b[0])
+	}
+	if length > 1 {
+		if _, err := io.ReadFull(r, b[1:length]); err != nil {
+			return 0, 1, unexpected(err)
+		}
+	}
+	value := uint64(b[0])
+	if !keepMarker {
+		value &= uint64(0xFF >> length)
+	}
+	allOnes := value == uint64(0xFF>>length)
+	for i := 1; i < length; i++ {
+		value = value<<8 | uint64(b[i])
+		allOnes = allOnes && b[i] == 0xFF
+	}
+	if !keepMarker && allOnes {
+		return UnknownSize, length, nil
+	}
+	return value, length, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Reader walks the elements of a Matroska file
+type Reader struct {
+	r   io.ReadSeeker
+	pos int64
+}
+
+// NewReader returns a Reader positioned at the start of r
+func NewReader(r io.ReadSeeker) *Reader {
+	return &Reader{r: r}
+}
+
+// Pos returns the current offset
+func (r *Reader) Pos() int64 {
+	return r.pos
+}
+
+// SeekTo moves to an absolute offset
+func (r *Reader) SeekTo(offset int64) error {
+	if _, err := r.r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	r.pos = offset
+	return nil
+}
+
+// Next reads the next element header
+func (r *Reader) Next() (Element, error) {
+	id, n, err := readVint(r.r, true)
+	r.pos += int64(n)
+	if err != nil {
+		return Element{}, err
+	}
+	size, n, err := readVint(r.r, false)
+	r.pos += int64(n)
+	if err != nil {
+		return Element{}, unexpected(err)
+	}
+	return Element{ID: uint32(id), Size: size, Offset: r.pos}, nil
+}
+
+// Skip moves past the data of e
+func (r *Reader) Skip(e Element) error {
+	if e.Size == UnknownSize {
+		return fmt.Errorf("mkv: cannot skip element 0x%X of unknown size", e.ID)
+	}
+	return r.SeekTo(e.End())
+}
+
+// Read reads len(p) bytes of element data
+func (r *Reader) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(r.r, p)
+	r.pos += int64(n)
+	return n, unexpected(err)
+}
+
+// maxElementData bounds the elements read into memory
+const maxElementData = 64 << 20
+
+// Bytes returns the data of e
+func (r *Reader) Bytes(e Element) ([]byte, error) {
+	if e.Size > maxElementData {
+		return nil, fmt.Errorf("mkv: element 0x%X too large (%d bytes)", e.ID, e.Size)
+	}
+	buf := make([]byte, e.Size)
+	if _, err := r.Read(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Uint returns the data of e as an unsigned integer
+func (r *Reader) Uint(e Element) (uint64, error) {
+	if e.Size > 8 {
+		return 0, fmt.Errorf("mkv: integer element 0x%X has %d bytes", e.ID, e.Size)
+	}
+	buf, err := r.Bytes(e)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, b := range buf {
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// Int returns the data of e as a signed integer
+func (r *Reader) Int(e Element) (int64, error) {
+	v, err := r.Uint(e)
+	if err != nil || e.Size == 0 {
+		return 0, err
+	}
+	shift := 64 - 8*e.Size
+	return int64(v<<shift) >> shift, nil
+}
+
+// Float returns the data of e as a float
+func (r *Reader) Float(e Element) (float64, error) {
+	buf, err := r.Bytes(e)
+	if err != nil {
+		return 0, err
+	}
+	switch len(buf) {
+	case 0:
+		return 0, nil
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(buf))), nil
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(buf)), nil
+	}
+	return 0, fmt.Errorf("mkv: float element 0x%X has %d bytes", e.ID, len(buf))
+}
+
+// String returns the data of e as a string, without trailing NUL padding
+func (r *Reader) String(e Element) (string, error) {
+	buf, err := r.Bytes(e)
+	for len(buf) > 0 && buf[len(buf)-1] == 0 {
+		buf = buf[:len(buf)-1]
+	}
+	return string(buf), err
+}
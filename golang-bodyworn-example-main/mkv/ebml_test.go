@@ -0,0 +1,277 @@
+package mkv
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+var errInvalid = errors.New("invalid")
+
+func TestReadVint(t *testing.T) {
+	for _, tc := range []struct {
+		in         []byte
+		keepMarker bool
+		value      uint64
+		n          int
+		err        error
+	}{
+		{[]byte{0x81}, false, 1, 1, nil},
+		{[]byte{0x80}, false, 0, 1, nil},
+		{[]byte{0xFE}, false, 126, 1, nil},
+		{[]byte{0xFF}, false, UnknownSize, 1, nil}, // all ones: unknown size
+		{[]byte{0x40, 0x7F}, false, 127, 2, nil},
+		{[]byte{0x7F, 0xFF}, false, UnknownSize, 2, nil},
+		{[]byte{0x7F, 0xFE}, false, 0x3FFE, 2, nil},
+		{[]byte{0x01, 0, 0, 0, 0, 0, 0, 0x01}, false, 1, 8, nil},
+		{[]byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}, false, UnknownSize, 8, nil},
+		// IDs keep their marker, and all ones is just a value
+		{[]byte{0x1A, 0x45, 0xDF, 0xA3}, true, IDEBML, 4, nil},
+		{[]byte{0xFF}, true, 0xFF, 1, nil},
+		{[]byte{0xEC}, true, IDVoid, 1, nil},
+		{[]byte{0x00}, false, 0, 1, errInvalid},
+		{[]byte{0x40}, false, 0, 1, io.ErrUnexpectedEOF},
+		{[]byte{}, false, 0, 0, io.EOF},
+	} {
+		value, n, err := readVint(bytes.NewReader(tc.in), tc.keepMarker)
+		if (err != nil) != (tc.err != nil) || tc.err != errInvalid && !errors.Is(err, tc.err) {
+			t.Errorf("% x: error %v, want %v", tc.in, err, tc.err)
+			continue
+		}
+		if err == nil && (value != tc.value || n != tc.n) {
+			t.Errorf("% x: %d (%d bytes), want %d (%d bytes)", tc.in, value, n, tc.value, tc.n)
+		}
+	}
+}
+
+func TestElementSizes(t *testing.T) {
+	// Sizes at the edges of each length, including the all-ones values that
+	// must be written one byte longer so they don't read as unknown
+	for _, size := range []int{0, 1, 126, 127, 128, 16382, 16383, 16384, 1<<21 - 2, 1<<21 - 1} {
+		e := element(IDVoid, make([]byte, size))
+		r := NewReader(bytes.NewReader(e))
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if got.ID != IDVoid || got.Size != uint64(size) || got.End() != int64(len(e)) {
+			t.Errorf("size %d: read %+v, end %d of %d", size, got, got.End(), len(e))
+		}
+	}
+	for _, id := range []uint32{IDVoid, IDDuration, IDTimecodeScale, IDSegment} {
+		r := NewReader(bytes.NewReader(element(id, nil)))
+		if got, err := r.Next(); err != nil || got.ID != id {
+			t.Errorf("ID 0x%X: read 0x%X, %v", id, got.ID, err)
+		}
+	}
+}
+
+func TestElementValues(t *testing.T) {
+	read := func(e []byte) (*Reader, Element) {
+		r := NewReader(bytes.NewReader(e))
+		el, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r, el
+	}
+	for _, v := range []uint64{0, 1, 255, 256, math.MaxUint32, math.MaxUint64} {
+		r, e := read(uintElement(IDTrackNumber, v))
+		if got, err := r.Uint(e); err != nil || got != v {
+			t.Errorf("uint %d: %d, %v", v, got, err)
+		}
+	}
+	for _, v := range []int64{0, -1, 1, math.MinInt64, math.MaxInt64} {
+		r, e := read(intElement(IDDateUTC, v))
+		if got, err := r.Int(e); err != nil || got != v {
+			t.Errorf("int %d: %d, %v", v, got, err)
+		}
+	}
+	// Short signed integers are sign extended
+	r, e := read(element(IDDateUTC, []byte{0xFF, 0xFE}))
+	if got, _ := r.Int(e); got != -2 {
+		t.Errorf("2-byte int: %d, want -2", got)
+	}
+	r, e = read(element(IDDuration, []byte{0x3F, 0xC0, 0, 0}))
+	if got, err := r.Float(e); err != nil || got != 1.5 {
+		t.Errorf("float32: %v, %v", got, err)
+	}
+	r, e = read(floatElement(IDDuration, 2.25))
+	if got, err := r.Float(e); err != nil || got != 2.25 {
+		t.Errorf("float64: %v, %v", got, err)
+	}
+	r, e = read(element(IDDuration, []byte{1, 2, 3}))
+	if _, err := r.Float(e); err == nil {
+		t.Error("3-byte float accepted")
+	}
+	r, e = read(element(IDTrackNumber, make([]byte, 9)))
+	if _, err := r.Uint(e); err == nil {
+		t.Error("9-byte integer accepted")
+	}
+	r, e = read(element(IDTitle, []byte("title\x00\x00")))
+	if got, _ := r.String(e); got != "title" {
+		t.Errorf("string: %q", got)
+	}
+}
+
+func TestFrames(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		lacing byte
+		data   []byte
+		want   []string
+	}{
+		{"none", 0, []byte("abc"), []string{"abc"}},
+		{"xiph", 1, []byte("\x02\x01\x02abbccc"), []string{"a", "bb", "ccc"}},
+		{"xiph 255", 1, append(append([]byte{0x01, 0xFF, 0x01}, bytes.Repeat([]byte("a"), 256)...), 'b'), []string{string(bytes.Repeat([]byte("a"), 256)), "b"}},
+		{"fixed", 2, []byte("\x02aabbcc"), []string{"aa", "bb", "cc"}},
+		// EBML: first size 2, then +1 (0xC0 is 0 + bias 63 + 1), last takes the rest
+		{"ebml", 3, []byte("\x02\x82\xC0aabbbc"), []string{"aa", "bbb", "c"}},
+		{"ebml negative", 3, []byte("\x02\x83\xBEaaabbc"), []string{"aaa", "bb", "c"}},
+		{"ebml two", 3, []byte("\x01\x81ab"), []string{"a", "b"}},
+		{"empty last", 2, []byte("\x01"), []string{"", ""}},
+	} {
+		frames, err := Block{Lacing: tc.lacing, Data: tc.data}.Frames()
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		var got []string
+		for _, f := range frames {
+			got = append(got, string(f))
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: %q, want %q", tc.name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: %q, want %q", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		lacing byte
+		data   []byte
+	}{
+		{"xiph empty", 1, nil},
+		{"xiph sizes cut off", 1, []byte("\x02\x01")},
+		{"xiph sizes past the data", 1, []byte("\x01\x09a")},
+		{"fixed uneven", 2, []byte("\x02aabbc")},
+		{"ebml sizes cut off", 3, []byte("\x02\x82")},
+		{"ebml invalid size", 3, []byte("\x01\x00a")},
+		{"ebml unknown size", 3, []byte("\x01\xFFa")},
+		{"ebml negative size", 3, []byte("\x02\x81\x80ab")},
+		{"ebml sizes past the data", 3, []byte("\x01\x89a")},
+	} {
+		if frames, err := (Block{Lacing: tc.lacing, Data: tc.data}).Frames(); err == nil {
+			t.Errorf("%s: %q accepted", tc.name, frames)
+		}
+	}
+}
+
+// testFile returns a small recording with a video and an audio track
+func testFile(t *testing.T) []byte {
+	t.Helper()
+	f := &File{
+		TimecodeScale: 1000000,
+		Title:         "test",
+		MuxingApp:     "mkv test",
+		WritingApp:    "mkv test",
+		DateUTC:       time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Tracks: []Track{
+			{Number: 1, Type: TrackVideo, CodecID: "V_MPEG4/ISO/AVC", CodecPrivate: []byte{1, 2, 3}, DefaultDuration: 40 * time.Millisecond, Width: 64, Height: 48},
+			{Number: 2, Type: TrackAudio, CodecID: "A_OPUS", DefaultDuration: 40 * time.Millisecond, SamplingFrequency: 48000, Channels: 1},
+		},
+	}
+	var blocks []Block
+	for i := int64(0); i < 100; i++ {
+		blocks = append(blocks, Block{Track: 1, Timecode: i * 40, Keyframe: i%25 == 0, Data: []byte("frame")})
+		blocks = append(blocks, Block{Track: 2, Timecode: i * 40, Keyframe: true, Lacing: 2, Data: []byte("\x01ab")})
+	}
+	var out bytes.Buffer
+	if err := Write(&out, f, blocks); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestOpenWritten(t *testing.T) {
+	f, err := Open(bytes.NewReader(testFile(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Title != "test" || f.DateUTC.Year() != 2024 || len(f.Tracks) != 2 || f.Tracks[0].Width != 64 || f.Tracks[1].Channels != 1 {
+		t.Errorf("headers: %+v", f)
+	}
+	// No duration was written, so it's measured: last block at 3.96s plus its frame
+	if f.HasDuration() || f.Duration != 4*time.Second {
+		t.Errorf("duration %v (written %v), want 4s measured", f.Duration, f.HasDuration())
+	}
+	var blocks, keyframes, clusters int
+	var cluster int64 = -1
+	err = f.Blocks(func(b Block) error {
+		blocks++
+		if b.Keyframe && b.Track == 1 {
+			keyframes++
+		}
+		if b.Cluster != cluster {
+			cluster = b.Cluster
+			clusters++
+		}
+		if frames, err := b.Frames(); err != nil || b.Track == 2 && len(frames) != 2 {
+			t.Errorf("block at %d: %d frames, %v", b.Timecode, len(frames), err)
+		}
+		return nil
+	})
+	if err != nil || blocks != 200 || keyframes != 4 || clusters != 4 {
+		t.Errorf("%d blocks, %d keyframes, %d clusters, %v", blocks, keyframes, clusters, err)
+	}
+	if _, err := Open(bytes.NewReader([]byte("not a matroska file"))); err != ErrNotMatroska {
+		t.Errorf("plain text: %v", err)
+	}
+}
+
+// walk opens data and reads every block and frame, as the server does
+func walk(data []byte) {
+	f, err := Open(bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	f.Blocks(func(b Block) error {
+		b.Frames()
+		return nil
+	})
+}
+
+func TestTruncatedAndCorrupt(t *testing.T) {
+	data := testFile(t)
+	// Recordings cut off mid-write keep their complete blocks
+	for n := 0; n < len(data); n++ {
+		walk(data[:n])
+	}
+	f, err := Open(bytes.NewReader(data[:len(data)*3/4]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := 0
+	if err := f.Blocks(func(Block) error { blocks++; return nil }); err != nil || blocks == 0 || blocks >= 200 {
+		t.Errorf("truncated file: %d blocks, %v", blocks, err)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		corrupt := append([]byte(nil), data...)
+		for j := 0; j < 4; j++ {
+			corrupt[rnd.Intn(len(corrupt))] = byte(rnd.Intn(256))
+		}
+		walk(corrupt)
+	}
+}
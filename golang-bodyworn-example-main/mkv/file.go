@@ -0,0 +1,430 @@
+package mkv
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// TrackType is the Matroska track type
+type TrackType uint8
+
+const (
+	TrackVideo    TrackType = 1
+	TrackAudio    TrackType = 2
+	TrackSubtitle TrackType = 0x11
+)
+
+func (t TrackType) String() string {
+	switch t {
+	case TrackVideo:
+		return "video"
+	case TrackAudio:
+		return "audio"
+	case TrackSubtitle:
+		return "subtitle"
+	}
+	return fmt.Sprintf("type %d", uint8(t))
+}
+
+// Track describes one track of the file
+type Track struct {
+	Number            uint64
+	Type              TrackType
+	CodecID           string
+	CodecPrivate      []byte
+	DefaultDuration   time.Duration
+	Width, Height     uint64
+	SamplingFrequency float64
+	Channels          uint64
+}
+
+// File is an opened Matroska file
+type File struct {
+	// TimecodeScale is the length of one timecode unit in nanoseconds
+	TimecodeScale uint64
+	// Duration is taken from the segment information, or measured from the
+	// recorded frames when the recorder didn't write one
+	Duration   time.Duration
+	Title      string
+	MuxingApp  string
+	WritingApp string
+	DateUTC    time.Time
+	Tracks     []Track
+
+	r            *Reader
+	segmentEnd   int64 // -1 for unknown size
+	firstCluster int64 // -1 when there are no clusters
+	hasDuration  bool
+}
+
+// Block is a SimpleBlock or Block header. Data holds the frame data, which is
+// laced when Lacing is not zero.
+type Block struct {
+	Track    uint64
+	Timecode int64 // absolute, in TimecodeScale units
+	Keyframe bool
+	Lacing   byte // 0 none, 1 Xiph, 2 fixed size, 3 EBML
+	Data     []byte
+	// Cluster is the offset of the cluster holding the block, for BlocksFrom
+	Cluster int64
+}
+
+// dateEpoch is the Matroska DateUTC origin
+var dateEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// Open reads the headers of a Matroska file. When the segment information has no
+// duration it is measured by walking the clusters.
+func Open(rs io.ReadSeeker) (*File, error) {
+	r := NewReader(rs)
+	header, err := r.Next()
+	if err != nil || header.ID != IDEBML {
+		return nil, ErrNotMatroska
+	}
+	if err := r.Skip(header); err != nil {
+		return nil, err
+	}
+	segment, err := r.Next()
+	if err != nil {
+		return nil, unexpected(err)
+	}
+	if segment.ID != IDSegment {
+		return nil, fmt.Errorf("mkv: expected segment, found element 0x%X", segment.ID)
+	}
+
+	f := &File{TimecodeScale: 1000000, r: r, segmentEnd: segment.End(), firstCluster: -1}
+	var infoDuration float64
+scan:
+	for f.segmentEnd < 0 || r.Pos() < f.segmentEnd {
+		start := r.Pos()
+		e, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch e.ID {
+		case IDInfo:
+			if infoDuration, err = f.readInfo(e); err != nil {
+				return nil, err
+			}
+		case IDTracks:
+			if err := f.readTracks(e); err != nil {
+				return nil, err
+			}
+		case IDCluster:
+			if f.firstCluster < 0 {
+				f.firstCluster = start
+			}
+			if f.Tracks != nil || e.Size == UnknownSize {
+				// Headers come before the media data; don't walk the whole file
+				break scan
+			}
+			if err := r.Skip(e); err != nil {
+				return nil, err
+			}
+		default:
+			if e.Size == UnknownSize {
+				break scan
+			}
+			if err := r.Skip(e); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if infoDuration > 0 {
+		f.hasDuration = true
+		f.Duration = time.Duration(infoDuration * float64(f.TimecodeScale))
+	} else if f.firstCluster >= 0 {
+		if f.Duration, err = f.measureDuration(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (f *File) readInfo(info Element) (duration float64, err error) {
+	r := f.r
+	for r.Pos() < info.End() {
+		e, err := r.Next()
+		if err != nil {
+			return 0, unexpected(err)
+		}
+		switch e.ID {
+		case IDTimecodeScale:
+			if f.TimecodeScale, err = r.Uint(e); err != nil {
+				return 0, err
+			}
+			if f.TimecodeScale == 0 {
+				f.TimecodeScale = 1000000
+			}
+		case IDDuration:
+			if duration, err = r.Float(e); err != nil {
+				return 0, err
+			}
+		case IDDateUTC:
+			ns, err := r.Int(e)
+			if err != nil {
+				return 0, err
+			}
+			f.DateUTC = dateEpoch.Add(time.Duration(ns))
+		case IDTitle:
+			f.Title, err = r.String(e)
+		case IDMuxingApp:
+			f.MuxingApp, err = r.String(e)
+		case IDWritingApp:
+			f.WritingApp, err = r.String(e)
+		default:
+			err = r.Skip(e)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return duration, nil
+}
+
+func (f *File) readTracks(tracks Element) error {
+	r := f.r
+	for r.Pos() < tracks.End() {
+		e, err := r.Next()
+		if err != nil {
+			return unexpected(err)
+		}
+		if e.ID != IDTrackEntry {
+			if err := r.Skip(e); err != nil {
+				return err
+			}
+			continue
+		}
+		t, err := f.readTrack(e)
+		if err != nil {
+			return err
+		}
+		f.Tracks = append(f.Tracks, t)
+	}
+	return nil
+}
+
+func (f *File) readTrack(entry Element) (Track, error) {
+	r := f.r
+	var t Track
+	for r.Pos() < entry.End() {
+		e, err := r.Next()
+		if err != nil {
+			return t, unexpected(err)
+		}
+		var v uint64
+		switch e.ID {
+		case IDTrackNumber:
+			t.Number, err = r.Uint(e)
+		case IDTrackType:
+			v, err = r.Uint(e)
+			t.Type = TrackType(v)
+		case IDCodecID:
+			t.CodecID, err = r.String(e)
+		case IDCodecPrivate:
+			t.CodecPrivate, err = r.Bytes(e)
+		case IDDefaultDuration:
+			v, err = r.Uint(e)
+			t.DefaultDuration = time.Duration(v)
+		case IDVideo, IDAudio:
+			// Descend into the settings; their children are read by this loop
+		case IDPixelWidth:
+			t.Width, err = r.Uint(e)
+		case IDPixelHeight:
+			t.Height, err = r.Uint(e)
+		case IDSamplingFreq:
+			t.SamplingFrequency, err = r.Float(e)
+		case IDChannels:
+			t.Channels, err = r.Uint(e)
+		default:
+			err = r.Skip(e)
+		}
+		if err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+// Track returns the track with the given number
+func (f *File) Track(number uint64) (Track, bool) {
+	for _, t := range f.Tracks {
+		if t.Number == number {
+			return t, true
+		}
+	}
+	return Track{}, false
+}
+
+// ErrStop can be returned by a Blocks callback to end the walk without an error
+var ErrStop = errors.New("mkv: stop")
+
+// Blocks calls fn for every block of the file in storage order. Returning a
+// non-nil error from fn stops the walk and Blocks returns that error.
+func (f *File) Blocks(fn func(Block) error) error {
+	if f.firstCluster < 0 {
+		return nil
+	}
+	return f.BlocksFrom(f.firstCluster, fn)
+}
+
+// BlocksFrom is like Blocks but starts at the cluster at offset, as recorded in Block.Cluster
+func (f *File) BlocksFrom(offset int64, fn func(Block) error) error {
+	err := f.blocksFrom(offset, fn)
+	if err == ErrStop {
+		return nil
+	}
+	return err
+}
+
+func (f *File) blocksFrom(offset int64, fn func(Block) error) error {
+	r := f.r
+	if err := r.SeekTo(offset); err != nil {
+		return err
+	}
+	var clusterTimecode int64
+	cluster := offset
+	for f.segmentEnd < 0 || r.Pos() < f.segmentEnd {
+		start := r.Pos()
+		e, err := r.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// Recordings cut off mid-write still have usable blocks
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch e.ID {
+		case IDCluster:
+			// Descend into the cluster, whatever its size
+			clusterTimecode = 0
+			cluster = start
+		case IDTimecode:
+			v, err := r.Uint(e)
+			if err != nil {
+				return err
+			}
+			clusterTimecode = int64(v)
+		case IDBlockGroup:
+			b, err := f.readBlockGroup(e, clusterTimecode)
+			if err != nil {
+				return blockErr(err)
+			}
+			b.Cluster = cluster
+			if err := fn(b); err != nil {
+				return err
+			}
+		case IDSimpleBlock:
+			b, err := f.readBlock(e, clusterTimecode)
+			if err != nil {
+				return blockErr(err)
+			}
+			b.Cluster = cluster
+			if err := fn(b); err != nil {
+				return err
+			}
+		default:
+			if e.Size == UnknownSize {
+				continue
+			}
+			if err := r.Skip(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// blockErr treats a block truncated by the end of the file as the end of the walk
+func blockErr(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}
+
+func (f *File) readBlockGroup(group Element, clusterTimecode int64) (Block, error) {
+	r := f.r
+	var b Block
+	found, referenced := false, false
+	for r.Pos() < group.End() {
+		e, err := r.Next()
+		if err != nil {
+			return b, unexpected(err)
+		}
+		switch e.ID {
+		case IDBlock:
+			if b, err = f.readBlock(e, clusterTimecode); err != nil {
+				return b, err
+			}
+			found = true
+		case 0xFB: // ReferenceBlock
+			referenced = true
+			err = r.Skip(e)
+		default:
+			err = r.Skip(e)
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+	if !found {
+		return b, fmt.Errorf("mkv: block group at %d has no block", group.Offset)
+	}
+	b.Keyframe = !referenced
+	return b, nil
+}
+
+func (f *File) readBlock(e Element, clusterTimecode int64) (Block, error) {
+	data, err := f.r.Bytes(e)
+	if err != nil {
+		return Block{}, err
+	}
+	track, n, err := readVint(bytes.NewReader(data), false)
+	if err != nil || len(data) < n+3 {
+		return Block{}, fmt.Errorf("mkv: malformed block at %d", e.Offset)
+	}
+	relative := int16(uint16(data[n])<<8 | uint16(data[n+1]))
+	flags := data[n+2]
+	return Block{
+		Track:    track,
+		Timecode: clusterTimecode + int64(relative),
+		Keyframe: flags&0x80 != 0,
+		Lacing:   (flags >> 1) & 0x03,
+		Data:     data[n+3:],
+	}, nil
+}
+
+// measureDuration computes the duration from the first and last block timecodes,
+// adding the default frame duration of the last block's track when known
+func (f *File) measureDuration() (time.Duration, error) {
+	first, last := int64(-1), int64(-1)
+	var lastTrack uint64
+	err := f.Blocks(func(b Block) error {
+		if first < 0 || b.Timecode < first {
+			first = b.Timecode
+		}
+		if b.Timecode >= last {
+			last, lastTrack = b.Timecode, b.Track
+		}
+		return nil
+	})
+	if err != nil || first < 0 {
+		return 0, err
+	}
+	d := time.Duration((last - first) * int64(f.TimecodeScale))
+	if t, ok := f.Track(lastTrack); ok {
+		d += t.DefaultDuration
+	}
+	return d, nil
+}
+
+// HasDuration reports whether the duration was written by the recorder rather than measured
+func (f *File) HasDuration() bool {
+	return f.hasDuration
+}
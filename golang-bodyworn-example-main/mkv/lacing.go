@@ -0,0 +1,88 @@
+package mkv
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Frames splits the block's data into its frames, undoing Xiph, fixed size or EBML lacing
+func (b Block) Frames() ([][]byte, error) {
+	if b.Lacing == 0 {
+		return [][]byte{b.Data}, nil
+	}
+	data := b.Data
+	if len(data) < 1 {
+		return nil, errLacing
+	}
+	count := int(data[0]) + 1
+	data = data[1:]
+	sizes := make([]int, count)
+
+	switch b.Lacing {
+	case 1: // Xiph
+		for i := 0; i < count-1; i++ {
+			for {
+				if len(data) == 0 {
+					return nil, errLacing
+				}
+				v := data[0]
+				data = data[1:]
+				sizes[i] += int(v)
+				if v != 0xFF {
+					break
+				}
+			}
+		}
+	case 2: // fixed size
+		if len(data)%count != 0 {
+			return nil, errLacing
+		}
+		for i := range sizes {
+			sizes[i] = len(data) / count
+		}
+		return split(data, sizes)
+	case 3: // EBML
+		r := bytes.NewReader(data)
+		first, n, err := readVint(r, false)
+		if err != nil {
+			return nil, errLacing
+		}
+		sizes[0] = int(first)
+		consumed := n
+		for i := 1; i < count-1; i++ {
+			raw, n, err := readVint(r, false)
+			if err != nil {
+				return nil, errLacing
+			}
+			// Signed difference to the previous size
+			diff := int(raw) - (1<<(7*n-1) - 1)
+			sizes[i] = sizes[i-1] + diff
+			consumed += n
+		}
+		data = data[consumed:]
+	}
+
+	last := len(data)
+	for _, size := range sizes[:count-1] {
+		last -= size
+	}
+	if last < 0 {
+		return nil, errLacing
+	}
+	sizes[count-1] = last
+	return split(data, sizes)
+}
+
+var errLacing = fmt.Errorf("mkv: malformed lacing")
+
+func split(data []byte, sizes []int) ([][]byte, error) {
+	frames := make([][]byte, len(sizes))
+	for i, size := range sizes {
+		if size < 0 || size > len(data) {
+			return nil, errLacing
+		}
+		frames[i] = data[:size]
+		data = data[size:]
+	}
+	return frames, nil
+}
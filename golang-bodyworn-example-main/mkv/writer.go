@@ -0,0 +1,167 @@
+package mkv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Write writes a Matroska file with the segment information and tracks of f and the
+// given blocks, which must be in timecode order. Blocks are written as SimpleBlocks in
+// clusters that start at every video keyframe, or when a block's timecode no longer
+// fits the 16-bit offset from its cluster. Neither SeekHead nor Cues are written, as
+// recorders that stream their files don't write them either.
+func Write(w io.Writer, f *File, blocks []Block) error {
+	scale := f.TimecodeScale
+	if scale == 0 {
+		scale = 1000000
+	}
+	video := map[uint64]bool{}
+	var tracks []byte
+	for _, t := range f.Tracks {
+		if t.Number == 0 || t.Number > 126 {
+			return fmt.Errorf("mkv: track number %d out of range", t.Number)
+		}
+		video[t.Number] = t.Type == TrackVideo
+		tracks = append(tracks, writeTrack(t)...)
+	}
+
+	info := uintElement(IDTimecodeScale, scale)
+	if f.Duration > 0 {
+		info = append(info, floatElement(IDDuration, float64(f.Duration)/float64(scale))...)
+	}
+	if !f.DateUTC.IsZero() {
+		info = append(info, intElement(IDDateUTC, int64(f.DateUTC.Sub(dateEpoch)))...)
+	}
+	if f.Title != "" {
+		info = append(info, element(IDTitle, []byte(f.Title))...)
+	}
+	info = append(info, element(IDMuxingApp, []byte(f.MuxingApp))...)
+	info = append(info, element(IDWritingApp, []byte(f.WritingApp))...)
+
+	header := element(IDEBML, concat(
+		uintElement(IDEBMLVersion, 1),
+		uintElement(IDEBMLReadVersion, 1),
+		uintElement(IDEBMLMaxIDLength, 4),
+		uintElement(IDEBMLMaxSizeLength, 8),
+		element(IDDocType, []byte("matroska")),
+		uintElement(IDDocTypeVersion, 4),
+		uintElement(IDDocTypeReadVersion, 2),
+	))
+
+	var segment bytes.Buffer
+	segment.Write(element(IDInfo, info))
+	segment.Write(element(IDTracks, tracks))
+	var cluster []byte
+	var clusterTimecode int64
+	flush := func() {
+		if cluster != nil {
+			segment.Write(element(IDCluster, cluster))
+		}
+	}
+	for i, b := range blocks {
+		if i > 0 && b.Timecode < blocks[i-1].Timecode {
+			return errors.New("mkv: blocks out of timecode order")
+		}
+		if _, ok := video[b.Track]; !ok {
+			return fmt.Errorf("mkv: block for unknown track %d", b.Track)
+		}
+		offset := b.Timecode - clusterTimecode
+		if cluster == nil || b.Keyframe && video[b.Track] || offset > math.MaxInt16 {
+			flush()
+			clusterTimecode = b.Timecode
+			cluster = uintElement(IDTimecode, uint64(b.Timecode))
+			offset = 0
+		}
+		flags := b.Lacing << 1
+		if b.Keyframe {
+			flags |= 0x80
+		}
+		data := make([]byte, 4, 4+len(b.Data))
+		data[0] = 0x80 | byte(b.Track)
+		binary.BigEndian.PutUint16(data[1:], uint16(int16(offset)))
+		data[3] = flags
+		cluster = append(cluster, element(IDSimpleBlock, append(data, b.Data...))...)
+	}
+	flush()
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(element(IDSegment, segment.Bytes()))
+	return err
+}
+
+func writeTrack(t Track) []byte {
+	entry := concat(
+		uintElement(IDTrackNumber, t.Number),
+		uintElement(IDTrackUID, t.Number),
+		uintElement(IDTrackType, uint64(t.Type)),
+		element(IDCodecID, []byte(t.CodecID)),
+	)
+	if len(t.CodecPrivate) > 0 {
+		entry = append(entry, element(IDCodecPrivate, t.CodecPrivate)...)
+	}
+	if t.DefaultDuration > 0 {
+		entry = append(entry, uintElement(IDDefaultDuration, uint64(t.DefaultDuration))...)
+	}
+	switch t.Type {
+	case TrackVideo:
+		entry = append(entry, element(IDVideo, concat(uintElement(IDPixelWidth, t.Width), uintElement(IDPixelHeight, t.Height)))...)
+	case TrackAudio:
+		entry = append(entry, element(IDAudio, concat(floatElement(IDSamplingFreq, t.SamplingFrequency), uintElement(IDChannels, t.Channels)))...)
+	}
+	return element(IDTrackEntry, entry)
+}
+
+// element encodes an element with its ID, the size as a variable length integer and data
+func element(id uint32, data []byte) []byte {
+	var out []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(id >> shift); b != 0 || len(out) > 0 {
+			out = append(out, b)
+		}
+	}
+	size := uint64(len(data))
+	n := 1
+	for size >= 1<<(7*n)-1 {
+		n++
+	}
+	for i := n - 1; i >= 0; i-- {
+		b := byte(size >> (8 * i))
+		if i == n-1 {
+			b |= 0x80 >> (n - 1)
+		}
+		out = append(out, b)
+	}
+	return append(out, data...)
+}
+
+func uintElement(id uint32, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	i := 0
+	for i < 7 && buf[i] == 0 {
+		i++
+	}
+	return element(id, buf[i:])
+}
+
+func intElement(id uint32, v int64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	return element(id, buf[:])
+}
+
+func floatElement(id uint32, v float64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], math.Float64bits(v))
+	return element(id, buf[:])
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ContainerInfo is one entry of a JSON account listing, matching Swift's format
+type ContainerInfo struct {
+	Name         string `json:"name"`
+	Count        int64  `json:"count"`
+	Bytes        int64  `json:"bytes"`
+	LastModified string `json:"last_modified"`
+}
+
+// handleAccountRequest implements HEAD, GET and POST on /v1.0/<account>/
+func handleAccountRequest(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodHead:
+		setAccountHeaders(w)
+		w.WriteHeader(http.StatusNoContent)
+		requestLogger(r).Log(Debug, "HEAD: account metadata returned", "account", StorageAccount)
+	case http.MethodGet:
+		handleAccountListing(w, r)
+	case http.MethodPost:
+		handlePostMetadata(w, r, "")
+	default:
+		w.Header().Set("Allow", "HEAD, GET, POST")
+		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
+		requestLogger(r).Log(Info, "unsupported method on account", "method", r.Method)
+	}
+}
+
+// setAccountHeaders adds the X-Account-* usage headers and account metadata
+func setAccountHeaders(w http.ResponseWriter) {
+	containers, objects, bytes := accountUsage()
+	w.Header().Set("X-Account-Container-Count", strconv.FormatInt(containers, 10))
+	w.Header().Set("X-Account-Object-Count", strconv.FormatInt(objects, 10))
+	w.Header().Set("X-Account-Bytes-Used", strconv.FormatInt(bytes, 10))
+	if info, err := os.Stat(filepath.Join(LocalStoragePath, StorageAccount)); err == nil {
+		w.Header().Set("X-Timestamp", fmt.Sprintf("%d.00000", info.ModTime().Unix()))
+	}
+	addMetadataHeaders(w, metaFilePath(""), "X-Account-Meta-")
+}
+
+// listContainers returns the account's containers sorted by name
+func listContainers() ([]ContainerInfo, error) {
+	entries, err := os.ReadDir(filepath.Join(LocalStoragePath, StorageAccount))
+	if err != nil {
+		return nil, err
+	}
+	var containers []ContainerInfo
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		objects, bytes := containerStats(entry.Name())
+		modified := ""
+		if info, err := entry.Info(); err == nil {
+			modified = info.ModTime().UTC().Format("2006-01-02T15:04:05.000000")
+		}
+		containers = append(containers, ContainerInfo{
+			Name:         entry.Name(),
+			Count:        objects,
+			Bytes:        bytes,
+			LastModified: modified,
+		})
+	}
+	sort.Slice(containers, func(i, j int) bool { return containers[i].Name < containers[j].Name })
+	return containers, nil
+}
+
+// filterListing applies Swift's prefix, marker, end_marker, reverse and limit query parameters
+func filterListing(names []string, r *http.Request) ([]int, error) {
+	q := r.URL.Query()
+	prefix := q.Get("prefix")
+	marker := q.Get("marker")
+	endMarker := q.Get("end_marker")
+	reverse := strings.EqualFold(q.Get("reverse"), "true") || q.Get("reverse") == "1"
+
+	limit := 10000
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 10000 {
+			return nil, fmt.Errorf("invalid limit %q", v)
+		}
+		limit = n
+	}
+
+	var idx []int
+	for i, name := range names {
+		if prefix != "" && !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		idx = append(idx, i)
+	}
+	if reverse {
+		for i, j := 0, len(idx)-1; i < j; i, j = i+1, j-1 {
+			idx[i], idx[j] = idx[j], idx[i]
+		}
+	}
+
+	var result []int
+	for _, i := range idx {
+		name := names[i]
+		if marker != "" && ((!reverse && name <= marker) || (reverse && name >= marker)) {
+			continue
+		}
+		if endMarker != "" && ((!reverse && name >= endMarker) || (reverse && name <= endMarker)) {
+			continue
+		}
+		if len(result) == limit {
+			break
+		}
+		result = append(result, i)
+	}
+	return result, nil
+}
+
+// listingFormat picks json or plain from ?format= or the Accept header
+func listingFormat(r *http.Request) string {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "json":
+		return "json"
+	case "plain", "text":
+		return "plain"
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		return "json"
+	}
+	return "plain"
+}
+
+// handleAccountListing returns the containers of the account
+func handleAccountListing(w http.ResponseWriter, r *http.Request) {
+	log := requestLogger(r)
+	containers, err := listContainers()
+	if err != nil {
+		http.Error(w, "Failed to read storage root", http.StatusInternalServerError)
+		log.Log(Error, "failed to list containers", "error", err)
+		return
+	}
+	names := make([]string, len(containers))
+	for i, c := range containers {
+		names[i] = c.Name
+	}
+	selected, err := filterListing(names, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
+	setAccountHeaders(w)
+	if listingFormat(r) == "json" {
+		result := make([]ContainerInfo, 0, len(selected))
+		for _, i := range selected {
+			result = append(result, containers[i])
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(result)
+	} else {
+		if len(selected) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, i := range selected {
+			fmt.Fprintln(w, containers[i].Name)
+		}
+	}
+	log.Log(Debug, "account listing returned", "containers", len(selected))
+}
@@ -0,0 +1,642 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Accounts are the users of the storage API, each with a role. They are kept with
+// hashed keys in .bodyworn/accounts.json, which the server reads again whenever it
+// changes. The connection credentials (AuthUser and AuthPassword, or the rotated ones
+// in credentials.json) keep working as an admin, so a server without accounts behaves
+// as before.
+
+// Role decides what an account may do
+type Role string
+
+const (
+	// RoleAdmin may do anything, including managing accounts
+	RoleAdmin Role = "admin"
+	// RoleReviewer may read everything through GET and HEAD, and nothing else
+	RoleReviewer Role = "reviewer"
+	// RoleSystem is a body worn system: it stores and reads its own objects, creates
+	// containers, and can't see objects stored by other systems
+	RoleSystem Role = "system"
+)
+
+func (r Role) valid() bool {
+	return r == RoleAdmin || r == RoleReviewer || r == RoleSystem
+}
+
+// Account is one user of the storage API
+type Account struct {
+	Name     string    `json:"name"`
+	Role     Role      `json:"role"`
+	KeyHash  string    `json:"key_hash,omitempty"`
+	Disabled bool      `json:"disabled"`
+	Created  time.Time `json:"created"`
+	// KeyRotated invalidates the tokens issued before it
+	KeyRotated time.Time `json:"key_rotated"`
+}
+
+// TokenLifetime is how long an issued token is valid
+var TokenLifetime = 24 * time.Hour
+
+// TokenCookie carries the token of browsers, which can't add X-Auth-Token to links,
+// media and event streams. It is only accepted for GET and HEAD.
+const TokenCookie = "bodyworn_token"
+
+// sysOwner is the system account that stored an object
+const sysOwner = "owner"
+
+// pbkdf2Iterations is the PBKDF2-HMAC-SHA256 work factor for new key hashes
+const pbkdf2Iterations = 210000
+
+var (
+	accountsMu      sync.Mutex
+	accountsCache   map[string]Account
+	accountsModTime time.Time
+
+	errAccountNotFound = errors.New("account not found")
+	errAccountExists   = errors.New("account already exists")
+	errInvalidAccount  = errors.New("invalid account")
+)
+
+func accountsPath() string {
+	return filepath.Join(stateDir(), "accounts.json")
+}
+
+// loadAccounts returns the stored accounts by name; accountsMu must be held
+func loadAccounts() (map[string]Account, error) {
+	info, err := os.Stat(accountsPath())
+	if os.IsNotExist(err) {
+		return map[string]Account{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if accountsCache != nil && info.ModTime().Equal(accountsModTime) {
+		return accountsCache, nil
+	}
+	content, err := os.ReadFile(accountsPath())
+	if err != nil {
+		return nil, err
+	}
+	var list []Account
+	if err := json.Unmarshal(content, &list); err != nil {
+		return nil, fmt.Errorf("%s: %w", accountsPath(), err)
+	}
+	accounts := make(map[string]Account, len(list))
+	for _, a := range list {
+		accounts[a.Name] = a
+	}
+	accountsCache, accountsModTime = accounts, info.ModTime()
+	return accounts, nil
+}
+
+// saveAccounts writes the accounts; accountsMu must be held
+func saveAccounts(accounts map[string]Account) error {
+	list := make([]Account, 0, len(accounts))
+	for _, a := range accounts {
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	content, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(stateDir(), 0755); err != nil {
+		return err
+	}
+	tmp := accountsPath() + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, accountsPath()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// The modification time may not change within its resolution
+	accountsCache = nil
+	return nil
+}
+
+// updateAccounts loads the accounts, lets fn change them and saves them
+func updateAccounts(fn func(map[string]Account) error) error {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	accounts, err := loadAccounts()
+	if err != nil {
+		return err
+	}
+	changed := make(map[string]Account, len(accounts))
+	for name, a := range accounts {
+		changed[name] = a
+	}
+	if err := fn(changed); err != nil {
+		return err
+	}
+	return saveAccounts(changed)
+}
+
+func lookupAccount(name string) (Account, bool) {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	accounts, err := loadAccounts()
+	if err != nil {
+		getLogger().Log(Error, "failed to read accounts", "path", accountsPath(), "error", err)
+		return Account{}, false
+	}
+	a, ok := accounts[name]
+	return a, ok
+}
+
+// ListAccounts returns the stored accounts sorted by name, without their key hashes
+func ListAccounts() ([]Account, error) {
+	accountsMu.Lock()
+	accounts, err := loadAccounts()
+	accountsMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Account, 0, len(accounts))
+	for _, a := range accounts {
+		a.KeyHash = ""
+		list = append(list, a)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+func randomKey() (string, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// AddAccount stores a new account and returns its key, a random one when key is empty
+func AddAccount(name string, role Role, key string) (string, error) {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		return "", fmt.Errorf("%w: name %q", errInvalidAccount, name)
+	}
+	if !role.valid() {
+		return "", fmt.Errorf("%w: role %q, use admin, reviewer or system", errInvalidAccount, role)
+	}
+	if name == currentCredentials().User {
+		return "", fmt.Errorf("%w: %s is the connection credentials' user name", errInvalidAccount, name)
+	}
+	var err error
+	if key == "" {
+		if key, err = randomKey(); err != nil {
+			return "", err
+		}
+	}
+	hash, err := hashKey(key)
+	if err != nil {
+		return "", err
+	}
+	err = updateAccounts(func(accounts map[string]Account) error {
+		if _, ok := accounts[name]; ok {
+			return fmt.Errorf("%w: %s", errAccountExists, name)
+		}
+		now := time.Now().UTC()
+		accounts[name] = Account{Name: name, Role: role, KeyHash: hash, Created: now, KeyRotated: now}
+		return nil
+	})
+	return key, err
+}
+
+// SetAccountDisabled disables or enables an account; disabling revokes its tokens
+func SetAccountDisabled(name string, disabled bool) error {
+	return updateAccounts(func(accounts map[string]Account) error {
+		a, ok := accounts[name]
+		if !ok {
+			return errAccountNotFound
+		}
+		a.Disabled = disabled
+		accounts[name] = a
+		return nil
+	})
+}
+
+// RotateAccountKey replaces an account's key, a random one when key is empty, and
+// revokes its tokens
+func RotateAccountKey(name, key string) (string, error) {
+	var err error
+	if key == "" {
+		if key, err = randomKey(); err != nil {
+			return "", err
+		}
+	}
+	hash, err := hashKey(key)
+	if err != nil {
+		return "", err
+	}
+	err = updateAccounts(func(accounts map[string]Account) error {
+		a, ok := accounts[name]
+		if !ok {
+			return errAccountNotFound
+		}
+		a.KeyHash, a.KeyRotated = hash, time.Now().UTC()
+		accounts[name] = a
+		return nil
+	})
+	return key, err
+}
+
+// RemoveAccount deletes an account, revoking its tokens
+func RemoveAccount(name string) error {
+	return updateAccounts(func(accounts map[string]Account) error {
+		if _, ok := accounts[name]; !ok {
+			return errAccountNotFound
+		}
+		delete(accounts, name)
+		return nil
+	})
+}
+
+// pbkdf2SHA256 derives a key as RFC 8018 describes, with HMAC-SHA256
+func pbkdf2SHA256(password, salt []byte, iterations, length int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var out []byte
+	for block := uint32(1); len(out) < length; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+// hashKey returns "pbkdf2-sha256$<iterations>$<salt>$<hash>" for key
+func hashKey(key string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash := pbkdf2SHA256([]byte(key), salt, pbkdf2Iterations, sha256.Size)
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", pbkdf2Iterations,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// checkKey reports whether key matches a hash written by hashKey
+func checkKey(hash, key string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err1 := base64.RawStdEncoding.DecodeString(parts[2])
+	want, err2 := base64.RawStdEncoding.DecodeString(parts[3])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(key), salt, iterations, len(want)), want) == 1
+}
+
+// Identity is who a request was authenticated as
+type Identity struct {
+	Name string
+	Role Role
+}
+
+// authenticateKey checks a user name and key against the accounts and the connection
+// credentials
+func authenticateKey(user, key string) (*Identity, bool) {
+	if a, ok := lookupAccount(user); ok {
+		if a.Disabled || !checkKey(a.KeyHash, key) {
+			return nil, false
+		}
+		return &Identity{Name: a.Name, Role: a.Role}, true
+	}
+	creds := currentCredentials()
+	if user != creds.User || subtle.ConstantTimeCompare([]byte(key), []byte(creds.Key)) != 1 {
+		return nil, false
+	}
+	return &Identity{Name: creds.User, Role: RoleAdmin}, true
+}
+
+// currentIdentity returns the identity name has now and when its key last changed,
+// or false when the account was disabled or removed
+func currentIdentity(name string) (*Identity, time.Time, bool) {
+	if a, ok := lookupAccount(name); ok {
+		return &Identity{Name: a.Name, Role: a.Role}, a.KeyRotated, !a.Disabled
+	}
+	if creds := currentCredentials(); name == creds.User {
+		return &Identity{Name: name, Role: RoleAdmin}, creds.Rotated, true
+	}
+	return nil, time.Time{}, false
+}
+
+type issuedToken struct {
+	name    string
+	issued  time.Time
+	expires time.Time
+}
+
+var (
+	tokensMu sync.Mutex
+	tokens   = map[string]issuedToken{}
+)
+
+// issueToken returns a new token for id and when it expires
+func issueToken(id *Identity) (string, time.Time, error) {
+	return issueTokenUntil(id, time.Now().Add(TokenLifetime))
+}
+
+// issueTokenUntil is issueToken for a token that expires at expires
+func issueTokenUntil(id *Identity, expires time.Time) (string, time.Time, error) {
+	raw := make([]byte, 24)
+	if _, err := rand.Read(raw); err != nil {
+		return "", time.Time{}, err
+	}
+	token := "tk" + base64.RawURLEncoding.EncodeToString(raw)
+	now := time.Now()
+	issued := issuedToken{name: id.Name, issued: now, expires: expires}
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	for t, it := range tokens {
+		if now.After(it.expires) {
+			delete(tokens, t)
+		}
+	}
+	tokens[token] = issued
+	return token, issued.expires, nil
+}
+
+// tokenIdentity returns the identity of a valid token. Tokens of disabled or removed
+// accounts, and tokens issued before the account's key changed, are no longer valid.
+func tokenIdentity(token string) (*Identity, bool) {
+	id, _, ok := lookupToken(token)
+	return id, ok
+}
+
+// lookupToken is tokenIdentity that also returns when the token was issued and expires
+func lookupToken(token string) (*Identity, issuedToken, bool) {
+	tokensMu.Lock()
+	it, ok := tokens[token]
+	tokensMu.Unlock()
+	if !ok || time.Now().After(it.expires) {
+		return nil, it, false
+	}
+	id, rotated, ok := currentIdentity(it.name)
+	if !ok || it.issued.Before(rotated) {
+		return nil, it, false
+	}
+	return id, it, true
+}
+
+// revokeToken makes a token invalid, reporting whether it was known
+func revokeToken(token string) bool {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	_, ok := tokens[token]
+	delete(tokens, token)
+	return ok
+}
+
+// requestToken returns the token a request carries, from X-Auth-Token or, for GET
+// and HEAD, the TokenCookie cookie
+func requestToken(r *http.Request) string {
+	if token := r.Header.Get("X-Auth-Token"); token != "" {
+		return token
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		if c, err := r.Cookie(TokenCookie); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+type identityKey struct{}
+
+// requestIdentity returns who the request was authenticated as, or nil
+func requestIdentity(r *http.Request) *Identity {
+	id, _ := r.Context().Value(identityKey{}).(*Identity)
+	return id
+}
+
+// authenticateRequest answers 401 and returns false unless the request carries a
+// valid token; otherwise it returns the request with its identity attached
+func authenticateRequest(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	id, ok := tokenIdentity(requestToken(r))
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		requestLogger(r).Log(Info, "request without a valid token", "method", r.Method, "path", r.URL.Path)
+		return r, false
+	}
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, id)), true
+}
+
+// RequireRole wraps a handler so only tokens of the given roles, and admins, reach it
+func RequireRole(next http.HandlerFunc, roles ...Role) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, ok := authenticateRequest(w, r)
+		if !ok {
+			return
+		}
+		id := requestIdentity(r)
+		if id.Role == RoleAdmin {
+			next(w, r)
+			return
+		}
+		for _, role := range roles {
+			if id.Role == role {
+				next(w, r)
+				return
+			}
+		}
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		requestLogger(r).Log(Info, "role not allowed", "user", id.Name, "role", id.Role, "path", r.URL.Path)
+	}
+}
+
+// ownedByOther reports whether a system identity is kept from an object stored by
+// another system. Objects stored before accounts existed, or by admins, have no owner.
+func (id *Identity) ownedByOther(meta *Metadata) bool {
+	if id == nil || id.Role != RoleSystem || meta == nil {
+		return false
+	}
+	owner := meta.SysGet(sysOwner)
+	return owner != "" && owner != id.Name
+}
+
+// canRead reports whether the identity may read the object with the metaPath sidecar
+func (id *Identity) canRead(metaPath string) bool {
+	if id == nil || id.Role != RoleSystem {
+		return true
+	}
+	meta, err := readMetadata(metaPath)
+	return err != nil || !id.ownedByOther(meta)
+}
+
+// authorizeStorage applies the role of the request's identity to a storage request,
+// answering 403 when it isn't allowed
+func authorizeStorage(w http.ResponseWriter, r *http.Request, path string) bool {
+	id := requestIdentity(r)
+	allowed := true
+	switch id.Role {
+	case RoleReviewer:
+		allowed = r.Method == http.MethodGet || r.Method == http.MethodHead
+	case RoleSystem:
+		trimmed := strings.Trim(path, "/")
+		switch {
+		case trimmed == "":
+			// No account metadata, which holds the quotas
+			allowed = r.Method == http.MethodGet || r.Method == http.MethodHead
+		case r.Method == http.MethodPut && isContainerPath(path) && !strings.HasSuffix(path, ".mkv"):
+			// Containers can be created, but without metadata: that holds quotas, temp
+			// URL keys and CORS origins, and a PUT merges it into an existing container
+			set, remove := metadataChanges(r, containerMeta)
+			allowed = set.Len() == 0 && len(remove) == 0
+		case metaKindFor(path) == containerMeta:
+			// Containers can be created and read, but their metadata and quotas
+			// aren't the systems' to change
+			allowed = r.Method == http.MethodGet || r.Method == http.MethodHead
+		case strings.HasSuffix(trimmed, "/active") && r.Method == http.MethodGet:
+			// Filtered by owner
+		default:
+			allowed = id.canRead(resolveObjectPath(r, path) + ".meta")
+		}
+	}
+	if !allowed {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		requestLogger(r).Log(Info, "storage request not allowed", "user", id.Name, "role", id.Role, "method", r.Method, "path", path)
+	}
+	return allowed
+}
+
+// AccountsHandler manages accounts:
+//
+//	GET    /api/accounts                  list accounts
+//	POST   /api/accounts                  add one: {"name", "role", "key"}; the key is random when omitted
+//	GET    /api/accounts/{name}           one account
+//	POST   /api/accounts/{name}/disable   disable it and revoke its tokens
+//	POST   /api/accounts/{name}/enable    enable it again
+//	POST   /api/accounts/{name}/rotate    replace its key: {"key"}, random when omitted
+//	DELETE /api/accounts/{name}           remove it
+//
+// Key hashes are never returned, and keys only by the requests that set them.
+func AccountsHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLogger(r)
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/accounts"), "/")
+	name, sub, _ := strings.Cut(action, "/")
+	by := requestIdentity(r).Name
+
+	var req struct {
+		Name string `json:"name"`
+		Role Role   `json:"role"`
+		Key  string `json:"key"`
+	}
+	if r.Method == http.MethodPost && r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var err error
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		var list []Account
+		if list, err = ListAccounts(); err != nil {
+			break
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"accounts": list})
+		return
+	case name == "" && r.Method == http.MethodPost:
+		var key string
+		if key, err = AddAccount(req.Name, req.Role, req.Key); err != nil {
+			break
+		}
+		log.Log(Info, "account added", "account", req.Name, "role", req.Role, "by", by)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"name": req.Name, "role": string(req.Role), "key": key})
+		return
+	case sub == "" && name != "" && r.Method == http.MethodGet:
+		a, ok := lookupAccount(name)
+		if !ok {
+			err = errAccountNotFound
+			break
+		}
+		a.KeyHash = ""
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a)
+		return
+	case sub == "" && name != "" && r.Method == http.MethodDelete:
+		if err = RemoveAccount(name); err != nil {
+			break
+		}
+		log.Log(Info, "account removed", "account", name, "by", by)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case (sub == "disable" || sub == "enable") && r.Method == http.MethodPost:
+		if err = SetAccountDisabled(name, sub == "disable"); err != nil {
+			break
+		}
+		log.Log(Info, "account "+sub+"d", "account", name, "by", by)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case sub == "rotate" && r.Method == http.MethodPost:
+		var key string
+		if key, err = RotateAccountKey(name, req.Key); err != nil {
+			break
+		}
+		log.Log(Info, "account key rotated", "account", name, "by", by)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"name": name, "key": key})
+		return
+	case sub == "" || sub == "disable" || sub == "enable" || sub == "rotate":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case errors.Is(err, errAccountNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errAccountExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errInvalidAccount):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "Failed to update accounts", http.StatusInternalServerError)
+		log.Log(Error, "failed to update accounts", "error", err)
+	}
+}
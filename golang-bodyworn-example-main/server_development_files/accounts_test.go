@@ -0,0 +1,260 @@
+package server
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAccountRoles(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+
+	reviewer := addTestAccount(t, url, admin, "alice", RoleReviewer)
+	systemA := addTestAccount(t, url, admin, "system-a", RoleSystem)
+	systemB := addTestAccount(t, url, admin, "system-b", RoleSystem)
+	if code, _ := do(t, http.MethodPost, url+"/api/accounts", admin, `{"name":"alice","role":"admin"}`); code != http.StatusConflict {
+		t.Errorf("adding alice again: %d, want 409", code)
+	}
+
+	if code, _ := do(t, http.MethodGet, url+"/api/accounts", reviewer, ""); code != http.StatusForbidden {
+		t.Errorf("reviewer listing accounts: %d, want 403", code)
+	}
+	if code, _ := do(t, http.MethodGet, url+"/api/accounts", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("listing accounts without a token: %d, want 401", code)
+	}
+	code, body := do(t, http.MethodGet, url+"/api/accounts", admin, "")
+	if code != http.StatusOK || strings.Contains(body, "pbkdf2") {
+		t.Errorf("admin listing accounts: %d %s", code, body)
+	}
+
+	if code, _ := do(t, http.MethodPut, storage+"/Recordings", systemA, ""); code != http.StatusCreated {
+		t.Fatalf("system creating a container: %d", code)
+	}
+	if code, _ := do(t, http.MethodPut, storage+"/Recordings/a.mkv", systemA, "video"); code != http.StatusCreated {
+		t.Fatalf("system A storing an object: %d", code)
+	}
+	if code, _ := do(t, http.MethodGet, storage+"/Recordings/a.mkv", systemA, ""); code != http.StatusOK {
+		t.Errorf("system A reading its object: %d", code)
+	}
+	if code, _ := do(t, http.MethodGet, storage+"/Recordings/a.mkv", systemB, ""); code != http.StatusForbidden {
+		t.Errorf("system B reading system A's object: %d, want 403", code)
+	}
+	if code, _ := do(t, http.MethodPut, storage+"/Recordings/a.mkv", systemB, "other"); code != http.StatusForbidden {
+		t.Errorf("system B overwriting system A's object: %d, want 403", code)
+	}
+	if _, body := do(t, http.MethodGet, storage+"/Recordings", systemB, ""); strings.Contains(body, "a.mkv") {
+		t.Errorf("system B's listing shows system A's object: %q", body)
+	}
+	if code, _ := do(t, http.MethodPost, storage+"/Recordings", systemA, ""); code != http.StatusForbidden {
+		t.Errorf("system changing container metadata: %d, want 403", code)
+	}
+
+	if code, _ := do(t, http.MethodPut, storage+"/Recordings/", reviewer, ""); code != http.StatusForbidden {
+		t.Errorf("reviewer creating a container: %d, want 403", code)
+	}
+
+	if code, _ := do(t, http.MethodGet, storage+"/Recordings/a.mkv", reviewer, ""); code != http.StatusOK {
+		t.Errorf("reviewer reading: %d", code)
+	}
+	if code, _ := do(t, http.MethodPut, storage+"/Recordings/b.mkv", reviewer, "video"); code != http.StatusForbidden {
+		t.Errorf("reviewer storing: %d, want 403", code)
+	}
+	if code, _ := do(t, http.MethodDelete, storage+"/Recordings/a.mkv", reviewer, ""); code != http.StatusForbidden {
+		t.Errorf("reviewer deleting: %d, want 403", code)
+	}
+
+	// Browsers send the token as a cookie, which only reads accept
+	req, _ := http.NewRequest(http.MethodGet, storage+"/Recordings/a.mkv", nil)
+	req.AddCookie(&http.Cookie{Name: TokenCookie, Value: reviewer})
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("reading with the cookie: %v %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+	req, _ = http.NewRequest(http.MethodDelete, storage+"/Recordings/a.mkv", nil)
+	req.AddCookie(&http.Cookie{Name: TokenCookie, Value: admin})
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("deleting with the cookie: %v %v, want 401", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+func TestContainerPutMetadata(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	tokens := map[Role]string{
+		RoleAdmin:    admin,
+		RoleReviewer: addTestAccount(t, url, admin, "reviewer", RoleReviewer),
+		RoleSystem:   addTestAccount(t, url, admin, "system", RoleSystem),
+	}
+	request(t, http.MethodPut, storage+"/Existing", admin, map[string]string{"X-Container-Meta-Quota-Count": "10"}, nil)
+
+	// Container metadata holds quotas, temp URL keys and CORS origins, so only admins
+	// may send it, whether the container is new or not
+	headers := []map[string]string{
+		{"X-Container-Meta-Quota-Count": "1000"},
+		{"X-Container-Meta-Quota-Bytes": "1000"},
+		{"X-Container-Meta-Temp-URL-Key": "mine"},
+		{"X-Container-Meta-Access-Control-Allow-Origin": "*"},
+		{"X-Container-Meta-Site": "north"},
+		{"X-Remove-Container-Meta-Quota-Count": "x"},
+		{"x-container-meta-quota-count": ""},
+	}
+	for role, want := range map[Role][2]int{
+		RoleAdmin:    {http.StatusCreated, http.StatusAccepted},
+		RoleReviewer: {http.StatusForbidden, http.StatusForbidden},
+		RoleSystem:   {http.StatusForbidden, http.StatusForbidden},
+	} {
+		for i, header := range headers {
+			if code := request(t, http.MethodPut, storage+fmt.Sprintf("/New-%s-%d", role, i), tokens[role], header, nil); code != want[0] {
+				t.Errorf("%s creating a container with %v: %d, want %d", role, header, code, want[0])
+			}
+			if role == RoleAdmin {
+				continue
+			}
+			if code := request(t, http.MethodPut, storage+"/Existing", tokens[role], header, nil); code != want[1] {
+				t.Errorf("%s PUT of an existing container with %v: %d, want %d", role, header, code, want[1])
+			}
+		}
+	}
+	meta, _ := readMetadata(metaFilePath("Existing"))
+	if got := meta.Map(); len(got) != 1 || got["Quota-Count"] != "10" {
+		t.Errorf("existing container metadata %v", got)
+	}
+
+	// Without metadata, systems create containers and find existing ones as before
+	if code := request(t, http.MethodPut, storage+"/Plain", tokens[RoleSystem], nil, nil); code != http.StatusCreated {
+		t.Errorf("system creating a container: %d", code)
+	}
+	if code := request(t, http.MethodPut, storage+"/Existing", tokens[RoleSystem], map[string]string{"X-Object-Meta-Site": "north"}, nil); code != http.StatusAccepted {
+		t.Errorf("system PUT of an existing container: %d", code)
+	}
+}
+
+func TestAccountRevocation(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	if _, err := AddAccount("bob", RoleReviewer, "bob-key"); err != nil {
+		t.Fatal(err)
+	}
+	token := signIn(t, url, "bob", "bob-key")
+
+	if code, _ := do(t, http.MethodPost, url+"/api/accounts/bob/disable", signIn(t, url, AuthUser, AuthPassword), ""); code != http.StatusNoContent {
+		t.Fatalf("disable: %d", code)
+	}
+	if code, _ := do(t, http.MethodGet, storage, token, ""); code != http.StatusUnauthorized {
+		t.Errorf("disabled account's token: %d, want 401", code)
+	}
+	if _, ok := authenticateKey("bob", "bob-key"); ok {
+		t.Error("disabled account authenticated")
+	}
+	if err := SetAccountDisabled("bob", false); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := do(t, http.MethodGet, storage, token, ""); code != http.StatusOK {
+		t.Errorf("enabled account's token: %d", code)
+	}
+
+	key, err := RotateAccountKey("bob", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := do(t, http.MethodGet, storage, token, ""); code != http.StatusUnauthorized {
+		t.Errorf("token from before the rotation: %d, want 401", code)
+	}
+	if _, ok := authenticateKey("bob", "bob-key"); ok {
+		t.Error("old key authenticated after the rotation")
+	}
+	if code, _ := do(t, http.MethodGet, storage, signIn(t, url, "bob", key), ""); code != http.StatusOK {
+		t.Errorf("token from the new key: %d", code)
+	}
+
+	if err := RemoveAccount("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := authenticateKey("bob", key); ok {
+		t.Error("removed account authenticated")
+	}
+	if err := RemoveAccount("bob"); err != errAccountNotFound {
+		t.Errorf("removing bob again: %v", err)
+	}
+	if _, err := AddAccount(AuthUser, RoleSystem, ""); err == nil {
+		t.Error("added an account with the connection credentials' user name")
+	}
+}
+
+func TestKeyHash(t *testing.T) {
+	hash, err := hashKey("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkKey(hash, "secret") || checkKey(hash, "Secret") || checkKey("", "secret") {
+		t.Errorf("checkKey(%q) disagrees with hashKey", hash)
+	}
+	other, _ := hashKey("secret")
+	if other == hash {
+		t.Error("two hashes of a key share a salt")
+	}
+
+	// RFC 7914 section 11 test vector
+	got := pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1, 64)
+	want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	if hex.EncodeToString(got) != want {
+		t.Errorf("pbkdf2SHA256 = %x, want %s", got, want)
+	}
+}
+
+func TestStoragePathEscape(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	reviewer := addTestAccount(t, url, admin, "ivan", RoleReviewer)
+	system := addTestAccount(t, url, admin, "system", RoleSystem)
+	if _, err := RotateCredentials(AuthUser, "operator-secret"); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := os.ReadFile(credentialsPath())
+
+	// Encoded dot segments reach the handler undecoded by the mux
+	for _, path := range []string{
+		"/..%2F.bodyworn/credentials.json",
+		"/..%2f.bodyworn%2faccounts.json",
+		"/%2e%2e/.bodyworn/credentials.json",
+		"/System/..%2F..%2F.bodyworn%2Fcredentials.json",
+		"/System/%2E%2E%2F%2E%2E%2F.bodyworn/accounts.json",
+		"/.bodyworn",
+		"/System/.hidden",
+		"/System/%2E/Capabilities.json",
+	} {
+		for _, token := range []string{admin, reviewer} {
+			if code, body := do(t, http.MethodGet, storage+path, token, ""); code != http.StatusBadRequest || strings.Contains(body, "operator-secret") || strings.Contains(body, "pbkdf2") {
+				t.Errorf("GET %s: %d %q, want 400", path, code, body)
+			}
+		}
+		if code, _ := do(t, http.MethodPut, storage+path, system, `{"user":"evil","key":"evilkey"}`); code != http.StatusBadRequest {
+			t.Errorf("PUT %s: %d, want 400", path, code)
+		}
+	}
+	if now, _ := os.ReadFile(credentialsPath()); string(now) != string(saved) {
+		t.Errorf("credentials changed to %s", now)
+	}
+	if code := request(t, http.MethodGet, url+"/auth/v1.0", "", map[string]string{"X-Auth-User": "evil", "X-Auth-Key": "evilkey"}, nil); code != http.StatusUnauthorized {
+		t.Errorf("signing in with written credentials: %d, want 401", code)
+	}
+
+	for path, want := range map[string]bool{
+		"": true, "System": true, "System/": true, "System/a.mkv": true, "System/a..mkv": true,
+		"..": false, "System/../../x": false, "System/.meta": false, ".": false, "System/x/..": false,
+	} {
+		if got := validStoragePath(path); got != want {
+			t.Errorf("validStoragePath(%q) = %t, want %t", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Helpers for bodyworn-admin, which works on the storage directory directly rather
+// than through the HTTP API. Changes made this way publish no events.
+
+// Party is a user, device or system object with its metadata
+type Party struct {
+	ID           string            `json:"id"`
+	Active       bool              `json:"active"`
+	Bytes        int64             `json:"bytes"`
+	LastModified string            `json:"last_modified"`
+	Metadata     map[string]string `json:"metadata"`
+}
+
+// partyActive reports whether a Users, Devices or System object counts as active:
+// users and devices with active=true metadata, systems with a connectionid
+func partyActive(container string, meta *Metadata) bool {
+	if container == "System" {
+		_, ok := meta.Get("connectionid")
+		return ok
+	}
+	active, _ := meta.Get("active")
+	return strings.EqualFold(active, "true")
+}
+
+// ListParties returns the objects of the Users, Devices or System container
+func ListParties(container string) ([]Party, error) {
+	objects, err := listObjects(container)
+	if err != nil {
+		return nil, err
+	}
+	parties := make([]Party, 0, len(objects))
+	for _, o := range objects {
+		party, err := LoadParty(container, o.Name)
+		if err != nil {
+			return nil, err
+		}
+		parties = append(parties, *party)
+	}
+	return parties, nil
+}
+
+// LoadParty returns one object of the Users, Devices or System container
+func LoadParty(container, id string) (*Party, error) {
+	fullPath := filepath.Join(LocalStoragePath, StorageAccount, container, id)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	meta, err := readMetadata(fullPath + ".meta")
+	if err != nil {
+		return nil, err
+	}
+	return &Party{
+		ID:           id,
+		Active:       partyActive(container, meta),
+		Bytes:        info.Size(),
+		LastModified: info.ModTime().UTC().Format("2006-01-02T15:04:05.000000"),
+		Metadata:     meta.Map(),
+	}, nil
+}
+
+// ListRecordings returns the aggregate view of every stored recording
+func ListRecordings() ([]*Recording, error) {
+	objects, err := recordingObjects()
+	if err != nil {
+		return nil, err
+	}
+	recordings := make([]*Recording, 0, len(objects))
+	for _, object := range objects {
+		rec, err := loadRecording(object)
+		if err != nil {
+			return nil, fmt.Errorf("recording %s: %w", object, err)
+		}
+		recordings = append(recordings, rec)
+	}
+	return recordings, nil
+}
+
+// LoadRecording returns one recording, given by ID or object path
+func LoadRecording(recording string) (*Recording, error) {
+	objects, err := exportObjects([]string{recording})
+	if err != nil {
+		return nil, err
+	}
+	return loadRecording(objects[0])
+}
+
+// ObjectMetadata returns the metadata of an object, a container or, for "", the account
+func ObjectMetadata(path string) (*Metadata, error) {
+	path = strings.Trim(path, "/")
+	if _, err := os.Stat(filepath.Join(LocalStoragePath, StorageAccount, path)); err != nil {
+		return nil, err
+	}
+	return readMetadata(metaFilePath(path))
+}
+
+// UpdateObjectMetadata sets and removes metadata items of an object, a container or the
+// account. Unlike an object POST it keeps the items that aren't named. Temp URL keys
+// set this way are recorded as the connection credentials'.
+func UpdateObjectMetadata(path string, set *Metadata, remove []string) (*Metadata, error) {
+	meta, err := ObjectMetadata(path)
+	if err != nil {
+		return nil, err
+	}
+	if set == nil {
+		set = &Metadata{}
+	}
+	for _, name := range remove {
+		meta.Delete(name)
+	}
+	for _, item := range set.Items {
+		meta.Set(item.Name, item.Values...)
+	}
+	if metaKindFor(path) != objectMeta {
+		recordTempURLKeySetters(currentCredentials().User, meta, set)
+	}
+	if err := checkMetadataLimits(meta); err != nil {
+		return nil, err
+	}
+	if err := validateQuotaMetadata(meta); err != nil {
+		return nil, err
+	}
+	if err := writeMetadata(metaFilePath(strings.Trim(path, "/")), meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// RunScrub checks every object once and returns the report, as the scheduled scrubber does
+func RunScrub() *ScrubReport {
+	return runScrub(context.Background())
+}
+
+// WriteConnectionFile regenerates connection.json with the current credentials and
+// returns its path
+func WriteConnectionFile() (string, error) {
+	return filepath.Join(LocalStoragePath, ConnectionFile), createLocalConnectionFile()
+}
+
+// ConnectionFileFor returns connection.json content that signs in as an API account,
+// to load into a body worn system with the system role
+func ConnectionFileFor(name, key string) ([]byte, error) {
+	return getConnectionJSON(Credentials{User: name, Key: key})
+}
+
+// WriteCapabilitiesFile regenerates System/Capabilities.json and returns its path
+func WriteCapabilitiesFile() (string, error) {
+	return filepath.Join(LocalStoragePath, StorageAccount, "System", "Capabilities.json"), createLocalCapabilitiesFile()
+}
+
+// RetentionCandidate is an object a retention run would delete
+type RetentionCandidate struct {
+	Path         string     `json:"path"`
+	Bytes        int64      `json:"bytes"`
+	LastModified time.Time  `json:"last_modified"`
+	DeleteAt     *time.Time `json:"delete_at,omitempty"`
+	Reason       string     `json:"reason"` // "x-delete-at" or "older_than"
+}
+
+// RetentionDryRun lists, without deleting anything, the objects the expirer removes
+// within the next within, and the objects below prefix last modified more than
+// olderThan ago when olderThan is set
+func RetentionDryRun(within, olderThan time.Duration, prefix string) ([]RetentionCandidate, error) {
+	root := filepath.Join(LocalStoragePath, StorageAccount)
+	now := time.Now()
+	var candidates []RetentionCandidate
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || strings.HasSuffix(d.Name(), ".meta") {
+			return nil
+		}
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		path := filepath.ToSlash(rel)
+		meta, err := readMetadata(p + ".meta")
+		if err != nil {
+			return nil
+		}
+		c := RetentionCandidate{Path: path, Bytes: info.Size(), LastModified: info.ModTime().UTC()}
+		if at := deleteAt(meta); at > 0 {
+			t := time.Unix(at, 0).UTC()
+			c.DeleteAt = &t
+			if !t.After(now.Add(within)) {
+				c.Reason = "x-delete-at"
+			}
+		}
+		if c.Reason == "" && olderThan > 0 && strings.HasPrefix(path, prefix) && now.Sub(info.ModTime()) > olderThan {
+			c.Reason = "older_than"
+		}
+		if c.Reason != "" {
+			candidates = append(candidates, c)
+		}
+		return nil
+	})
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Path < candidates[j].Path })
+	return candidates, err
+}
+
+// ParseDuration parses a duration written as Go does ("36h") or in days ("30d")
+func ParseDuration(s string) (time.Duration, error) {
+	return parseTierDuration(s)
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The audit log records who did what to which object: every storage event, reads of
+// objects and evidence exports. It is a JSON Lines file under the state directory that
+// is only ever appended to. Each entry carries the SHA-256 of the line before it in
+// "prev", so removing or editing an entry breaks the chain from that point on.
+
+// AuditEntry is one line of the audit log
+type AuditEntry struct {
+	Time      time.Time         `json:"time"`
+	Action    string            `json:"action"` // an event type, object.read or recording.exported
+	Path      string            `json:"path,omitempty"`
+	EventID   string            `json:"event_id,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	Remote    string            `json:"remote,omitempty"`
+	User      string            `json:"user,omitempty"`
+	ETag      string            `json:"etag,omitempty"`
+	Bytes     int64             `json:"bytes,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+	Prev      string            `json:"prev"`
+}
+
+// Audit actions that aren't storage events
+const (
+	AuditObjectRead        = "object.read"
+	AuditRecordingExported = "recording.exported"
+)
+
+var (
+	auditMu   sync.Mutex
+	auditFile *os.File
+	auditPrev string // hash of the last line written
+)
+
+func auditLogPath() string {
+	return filepath.Join(stateDir(), "audit.log")
+}
+
+// StartAuditLog records every published storage event in the audit log
+func StartAuditLog() error {
+	auditMu.Lock()
+	err := openAuditLog()
+	auditMu.Unlock()
+	if err != nil {
+		return err
+	}
+	SubscribeEvents(func(e Event) {
+		recordAudit(AuditEntry{
+			Time:    e.Time,
+			Action:  e.Type,
+			Path:    e.Path,
+			EventID: e.ID,
+			ETag:    e.ETag,
+			Bytes:   e.Bytes,
+			Details: auditEventDetails(e),
+		})
+	})
+	RegisterShutdownHook("audit log", closeAuditLog)
+	return nil
+}
+
+// closeAuditLog syncs and closes the log; entries recorded afterwards open it again
+func closeAuditLog(context.Context) error {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditFile == nil {
+		return nil
+	}
+	err := auditFile.Sync()
+	if cerr := auditFile.Close(); err == nil {
+		err = cerr
+	}
+	auditFile = nil
+	return err
+}
+
+func auditEventDetails(e Event) map[string]string {
+	if e.Reason == "" {
+		return nil
+	}
+	return map[string]string{"reason": e.Reason}
+}
+
+// openAuditLog opens the log for appending and picks up the hash of its last line.
+// auditMu must be held.
+func openAuditLog() error {
+	if auditFile != nil {
+		return nil
+	}
+	if err := os.MkdirAll(stateDir(), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditLogPath(), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	last, err := lastLine(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if last != nil {
+		auditPrev = auditHash(last)
+	}
+	auditFile = f
+	return nil
+}
+
+// lastLine returns the last non-empty line of f, reading only its tail
+func lastLine(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	for size := int64(4096); ; size *= 4 {
+		start := info.Size() - size
+		if start < 0 {
+			start = 0
+		}
+		buf := make([]byte, info.Size()-start)
+		if _, err := f.ReadAt(buf, start); err != nil && err != io.EOF {
+			return nil, err
+		}
+		buf = bytes.TrimRight(buf, "\n")
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			return buf[i+1:], nil
+		}
+		if start == 0 {
+			if len(buf) == 0 {
+				return nil, nil
+			}
+			return buf, nil
+		}
+	}
+}
+
+func auditHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// recordAudit appends e to the audit log, chaining it to the previous entry
+func recordAudit(e AuditEntry) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if err := openAuditLog(); err != nil {
+		getLogger().Log(Error, "failed to open audit log", "path", auditLogPath(), "error", err)
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	e.Prev = auditPrev
+	line, err := json.Marshal(e)
+	if err != nil {
+		getLogger().Log(Error, "failed to encode audit entry", "action", e.Action, "error", err)
+		return
+	}
+	if _, err := auditFile.Write(append(line, '\n')); err != nil {
+		getLogger().Log(Error, "failed to write audit log", "path", auditLogPath(), "error", err)
+		return
+	}
+	auditPrev = auditHash(line)
+}
+
+// auditRequest records an action a client performed on path
+func auditRequest(r *http.Request, action, path string, n int64, details map[string]string) {
+	user := ""
+	if id := requestIdentity(r); id != nil {
+		user = id.Name
+	}
+	recordAudit(AuditEntry{
+		Action:    action,
+		Path:      path,
+		RequestID: RequestID(r.Context()),
+		Remote:    r.RemoteAddr,
+		User:      user,
+		Bytes:     n,
+		Details:   details,
+	})
+}
+
+// auditExcerpt returns the audit log lines, verbatim, whose path is one of paths
+func auditExcerpt(paths map[string]bool) ([][]byte, error) {
+	f, err := os.Open(auditLogPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	for scanner.Scan() {
+		var e struct {
+			Path string `json:"path"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &e) != nil || !paths[e.Path] {
+			continue
+		}
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+	}
+	return lines, scanner.Err()
+}
@@ -1,134 +1,453 @@
 package server
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/fs"
 	"net/http"
+	"sort"
 	"strings"
 
 	"os"
 	"path/filepath"
 )
 
-
-//In OpenStack Swift, the object storage system, the hierarchy is designed to organize and manage large volumes of unstructured data. 
+//In OpenStack Swift, the object storage system, the hierarchy is designed to organize and manage large volumes of unstructured data.
 // The basic structure in Swift follows a three-tier system: Account, Container, and Object.
 
 //Please NOTE, this application is using the concept of OpenStack but it is not an OpenStack application
 //It is using the concept of OpenStack but really is an OS File System application
 
+// LocalStoragePath is the root directory of the application's storage
+var LocalStoragePath = "./"
+
+var errETagMismatch = errors.New("ETag doesn't match the uploaded data")
+
+// sysContentType is the Content-Type an object was uploaded with
+const sysContentType = "content-type"
+
+// storedContentType returns the Content-Type of the object with the metaPath sidecar,
+// defaulting to application/octet-stream like Swift does without one
+func storedContentType(metaPath string) string {
+	if meta, err := readMetadata(metaPath); err == nil {
+		return objectContentType(meta)
+	}
+	return "application/octet-stream"
+}
+
+func objectContentType(meta *Metadata) string {
+	if ct := meta.SysGet(sysContentType); ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
 const (
-	LocalStoragePath   = "./"//root directory of appliaiton
-	StorageAccount   = "WhateverStorageName"//this can be whatevery name you want.  In comparison this could be considered  your account in OpenStack Swift
-	AuthPassword       = "WhateverPassWord"
-	AuthUser           = "WhateverUserName"
-	ConnectionFile     = "connection.json"
+	StorageAccount = "WhateverStorageName" //this can be whatevery name you want.  In comparison this could be considered  your account in OpenStack Swift
+	AuthPassword   = "WhateverPassWord"
+	AuthUser       = "WhateverUserName"
+	ConnectionFile = "connection.json"
 )
 
-
 // CreateRequiredContainersAndObjects ensures required folders and objects are created in OS file system.
-//In comparison the System, Users, Devices would be your Containers in OpenStack
-func CreateRequiredContainersAndObjects() {
-	log.Printf("Function CreateRequiredContainersAndObjects ensures required folders and objects are created in OS file system")
-	createDirIfNotExists(filepath.Join(LocalStoragePath, StorageAccount))
-	createDirIfNotExists(filepath.Join(LocalStoragePath, StorageAccount, "System"))
-	createDirIfNotExists(filepath.Join(LocalStoragePath, StorageAccount, "Users"))
-	createDirIfNotExists(filepath.Join(LocalStoragePath, StorageAccount, "Devices"))
-
-	
-
-	createLocalCapabilitiesFile()
-	createLocalConnectionFile()
+// In comparison the System, Users, Devices would be your Containers in OpenStack
+func CreateRequiredContainersAndObjects() error {
+	getLogger().Debugf("Function CreateRequiredContainersAndObjects ensures required folders and objects are created in OS file system")
+	for _, dir := range []string{
+		filepath.Join(LocalStoragePath, StorageAccount),
+		filepath.Join(LocalStoragePath, StorageAccount, "System"),
+		filepath.Join(LocalStoragePath, StorageAccount, "Users"),
+		filepath.Join(LocalStoragePath, StorageAccount, "Devices"),
+	} {
+		if err := createDirIfNotExists(dir); err != nil {
+			return err
+		}
+	}
+
+	if err := cleanStaleUploads(); err != nil {
+		return err
+	}
+
+	if err := createLocalCapabilitiesFile(); err != nil {
+		return err
+	}
+	return createLocalConnectionFile()
 }
 
 // createDirIfNotExists checks and creates a directory if it doesn't exist
-func createDirIfNotExists(path string) {
-	log.Printf("Function createDirIfNotExists being used to checks and creates a directory if it doesn't exist")
+func createDirIfNotExists(path string) error {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
-		err = os.MkdirAll(path, 0755)
-		if err != nil {
-			log.Fatalf("Failed to create directory %s: %v", path, err)
+		if err := os.MkdirAll(path, 0755); err != nil {
+			getLogger().Log(Error, "failed to create directory", "path", path, "error", err)
+			return fmt.Errorf("create directory %s: %w", path, err)
 		}
-		log.Printf("Directory %s created successfully", path)
+		getLogger().Log(Info, "directory created", "path", path)
 	}
+	return nil
 }
 
-
 // writeFile writes content to a file
-func writeFile(path string, content []byte) {
+func writeFile(path string, content []byte) error {
 	// Check if the path is an existing directory
-	log.Printf("Function writeFile being used to write content to a file")
 	if fileInfo, err := os.Stat(path); err == nil && fileInfo.IsDir() {
-		log.Fatalf("Failed to create file %s: Path is a directory", path)
-		return
+		getLogger().Log(Error, "failed to create file, path is a directory", "path", path)
+		return fmt.Errorf("create file %s: path is a directory", path)
 	}
 
-	file, err := os.Create(path)
-	if err != nil {
-		log.Fatalf("Failed to create file %s: %v", path, err)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		getLogger().Log(Error, "failed to write file", "path", path, "error", err)
+		return fmt.Errorf("write file %s: %w", path, err)
 	}
-	defer file.Close()
-
-	_, err = file.Write(content)
-	if err != nil {
-		log.Fatalf("Failed to write to file %s: %v", path, err)
-	}
-	log.Printf("File %s created successfully", path)
+	getLogger().Log(Info, "file created", "path", path, "bytes", len(content))
+	return nil
 }
 
 // GET handler with Swift-style headers
-func getObject(w http.ResponseWriter, path string) {
-	fullPath := filepath.Join(LocalStoragePath, StorageAccount, path)
-	log.Printf("Function getObject being used to chandler with Swift-style headers")
+func getObject(w http.ResponseWriter, r *http.Request, path string) {
+	log := requestLogger(r)
+	fullPath := resolveObjectPath(r, path)
 	metaPath := fullPath + ".meta"
 
 	info, err := os.Stat(fullPath)
 	if os.IsNotExist(err) {
 		http.Error(w, "Object not found", http.StatusNotFound)
-		log.Printf("GET: Object %s not found", path)
+		log.Log(Info, "GET: object not found", "path", path)
+		return
+	}
+	if info.IsDir() {
+		handleContainerListing(w, r, strings.Trim(path, "/"))
+		return
+	}
+	if !checkObjectExpiry(w, r, path, metaPath) {
 		return
 	}
 
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size()))
 	w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
 	w.Header().Set("ETag", generateETag(fullPath))
-	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Type", storedContentType(metaPath))
 	addMetadataHeaders(w, metaPath, "X-Object-Meta-")
+	addReplicationHeader(w, metaPath)
+	addTierHeader(w, fullPath)
 
 	file, err := os.Open(fullPath)
 	if err != nil {
 		http.Error(w, "Failed to open file", http.StatusInternalServerError)
-		log.Printf("GET: Failed to open object %s", path)
+		log.Log(Error, "GET: failed to open object", "path", path, "error", err)
 		return
 	}
 	defer file.Close()
 
-	io.Copy(w, file)
-	log.Printf("GET: Object %s returned with headers", path)
+	n, err := io.Copy(w, file)
+	metricDownloadBytes.add(float64(n))
+	if err != nil {
+		auditRequest(r, AuditObjectRead, strings.Trim(path, "/"), n, map[string]string{"interrupted": "true"})
+		log.Log(Warning, "GET: object transfer interrupted", "path", path, "bytes", n, "error", err)
+		return
+	}
+	auditRequest(r, AuditObjectRead, strings.Trim(path, "/"), n, nil)
+	objectRead(fullPath)
+	log.Log(Debug, "GET: object returned", "path", path, "bytes", n)
+}
+
+// ObjectInfo is one entry of a JSON container listing, matching Swift's format.
+// Subdir is set instead of the other fields for pseudo-directories when a delimiter is used.
+type ObjectInfo struct {
+	Name         string `json:"name"`
+	Hash         string `json:"hash"`
+	Bytes        int64  `json:"bytes"`
+	ContentType  string `json:"content_type"`
+	LastModified string `json:"last_modified"`
+	Subdir       string `json:"subdir,omitempty"`
+}
+
+// MarshalJSON writes pseudo-directories as {"subdir": ...} only, and objects with all
+// of their fields, zero bytes included
+func (o ObjectInfo) MarshalJSON() ([]byte, error) {
+	if o.Subdir != "" {
+		return json.Marshal(struct {
+			Subdir string `json:"subdir"`
+		}{o.Subdir})
+	}
+	type object ObjectInfo
+	return json.Marshal(object(o))
+}
+
+// listObjects returns the objects of container sorted by name; nested paths use "/"
+func listObjects(container string) ([]ObjectInfo, error) {
+	root := filepath.Join(LocalStoragePath, StorageAccount, container)
+	var objects []ObjectInfo
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || strings.HasSuffix(d.Name(), ".meta") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		info = followLink(p, info)
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, ObjectInfo{
+			Name:         filepath.ToSlash(rel),
+			Bytes:        info.Size(),
+			ContentType:  storedContentType(p + ".meta"),
+			LastModified: info.ModTime().UTC().Format("2006-01-02T15:04:05.000000"),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+	return objects, nil
+}
+
+// handleContainerListing returns the objects of a container, supporting Swift's
+// prefix, delimiter, marker, end_marker, reverse and limit query parameters
+func handleContainerListing(w http.ResponseWriter, r *http.Request, container string) {
+	log := requestLogger(r)
+	objects, err := listObjects(container)
+	if err != nil {
+		http.Error(w, "Failed to read container", http.StatusInternalServerError)
+		log.Log(Error, "failed to list objects", "container", container, "error", err)
+		return
+	}
+	if id := requestIdentity(r); id != nil && id.Role == RoleSystem {
+		visible := objects[:0]
+		for _, o := range objects {
+			if id.canRead(metaFilePath(container + "/" + o.Name)) {
+				visible = append(visible, o)
+			}
+		}
+		objects = visible
+	}
+
+	// Collapse names below the delimiter into subdir entries
+	if delimiter := r.URL.Query().Get("delimiter"); delimiter != "" {
+		prefix := r.URL.Query().Get("prefix")
+		var collapsed []ObjectInfo
+		for _, o := range objects {
+			if !strings.HasPrefix(o.Name, prefix) {
+				continue
+			}
+			if i := strings.Index(o.Name[len(prefix):], delimiter); i >= 0 {
+				subdir := o.Name[:len(prefix)+i+len(delimiter)]
+				if n := len(collapsed); n == 0 || collapsed[n-1].Subdir != subdir {
+					collapsed = append(collapsed, ObjectInfo{Subdir: subdir})
+				}
+				continue
+			}
+			collapsed = append(collapsed, o)
+		}
+		objects = collapsed
+	}
+
+	names := make([]string, len(objects))
+	for i, o := range objects {
+		names[i] = o.Name + o.Subdir
+	}
+	selected, err := filterListing(names, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
+	count, bytes := containerStats(container)
+	w.Header().Set("X-Container-Object-Count", fmt.Sprintf("%d", count))
+	w.Header().Set("X-Container-Bytes-Used", fmt.Sprintf("%d", bytes))
+	addMetadataHeaders(w, metaFilePath(container), "X-Container-Meta-")
+	if listingFormat(r) == "json" {
+		result := make([]ObjectInfo, 0, len(selected))
+		for _, i := range selected {
+			o := objects[i]
+			if o.Subdir == "" {
+				o.Hash = cachedETag(filepath.Join(LocalStoragePath, StorageAccount, container, o.Name))
+			}
+			result = append(result, o)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(result)
+	} else {
+		if len(selected) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, i := range selected {
+			fmt.Fprintln(w, names[i])
+		}
+	}
+	log.Log(Debug, "container listing returned", "container", container, "objects", len(selected))
+}
+
+// deleteObject removes an object, or a container when it is empty, answering 204
+func deleteObject(w http.ResponseWriter, r *http.Request, path string) {
+	log := requestLogger(r)
+	fullPath := resolveObjectPath(r, path)
+	info, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		log.Log(Info, "DELETE: not found", "path", path)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to delete", http.StatusInternalServerError)
+		log.Log(Error, "DELETE: failed to stat", "path", path, "error", err)
+		return
+	}
+
+	if info.IsDir() {
+		container := strings.Trim(path, "/")
+		if objects, _ := storageUsage(fullPath); objects > 0 {
+			http.Error(w, "There was a conflict when trying to complete your request.", http.StatusConflict)
+			log.Log(Info, "DELETE: container not empty", "path", container, "objects", objects)
+			return
+		}
+		if err := os.RemoveAll(fullPath); err != nil {
+			http.Error(w, "Failed to delete container", http.StatusInternalServerError)
+			log.Log(Error, "DELETE: failed to remove container", "path", container, "error", err)
+			return
+		}
+		os.Remove(metaFilePath(container))
+		invalidateContainerStats(container)
+		w.WriteHeader(http.StatusNoContent)
+		log.Log(Info, "container deleted", "path", container)
+		return
+	}
+
+	unlock := lockObject(path)
+	defer unlock()
+	meta, err := readMetadata(fullPath + ".meta")
+	if err != nil {
+		meta = &Metadata{}
+	}
+	if objectExpired(meta) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		log.Log(Info, "DELETE: object already expired", "path", path)
+		return
+	}
+	event := newEvent(EventObjectDeleted, path, fullPath, meta)
+	deactivated, ok := activationEvent(path, fullPath, meta, nil)
+	if err := removeObject(path, fullPath); err != nil {
+		http.Error(w, "Failed to delete object", http.StatusInternalServerError)
+		log.Log(Error, "DELETE: failed to remove object", "path", path, "error", err)
+		return
+	}
+	publishEvent(event)
+	if ok {
+		publishEvent(deactivated)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	log.Log(Info, "object deleted", "path", path)
+}
+
+// isContainerPath reports whether path names a container rather than an object
+func isContainerPath(path string) bool {
+	trimmed := strings.Trim(path, "/")
+	return trimmed != "" && !strings.Contains(trimmed, "/")
+}
+
+// validStoragePath reports whether path stays inside the storage account: no ".",
+// ".." or other dot-prefixed segment, which also keeps hidden files out of reach
+func validStoragePath(path string) bool {
+	for _, segment := range strings.Split(path, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return false
+		}
+	}
+	root := filepath.Join(LocalStoragePath, StorageAccount)
+	full := filepath.Join(root, path)
+	return full == root || strings.HasPrefix(full, root+string(filepath.Separator))
+}
+
+// putContainer creates a container, answering 201 when new and 202 when it already exists
+func putContainer(w http.ResponseWriter, r *http.Request, container string) {
+	log := requestLogger(r)
+	dirPath := filepath.Join(LocalStoragePath, StorageAccount, container)
+	info, err := os.Stat(dirPath)
+	if err == nil && !info.IsDir() {
+		http.Error(w, fmt.Sprintf("%s exists and is not a container", container), http.StatusConflict)
+		log.Log(Info, "container path is an object", "path", container)
+		return
+	}
+	existed := err == nil
+	set, remove := metadataChanges(r, containerMeta)
+	if key, ok := adminMetadataChange(r, containerMeta, set, remove); ok {
+		http.Error(w, "Forbidden: only admins may change "+key, http.StatusForbidden)
+		log.Log(Info, "container metadata not allowed", "path", container, "key", key, "user", requestIdentity(r).Name)
+		return
+	}
+	if err := createDirIfNotExists(dirPath); err != nil {
+		http.Error(w, "Failed to create container", http.StatusInternalServerError)
+		return
+	}
+
+	metadata := requestMetadata(r, containerMeta)
+	if metadata.Len() > 0 {
+		if err := checkMetadataLimits(metadata); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := validateQuotaMetadata(metadata); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		existing, err := readMetadata(metaFilePath(container))
+		if err != nil {
+			existing = &Metadata{}
+		}
+		for _, item := range metadata.Items {
+			existing.Set(item.Name, item.Values...)
+		}
+		recordTempURLKeySetters(requestIdentity(r).Name, existing, metadata)
+		if err := writeMetadata(metaFilePath(container), existing); err != nil {
+			http.Error(w, "Failed to write metadata", http.StatusInternalServerError)
+			log.Log(Error, "failed to write container metadata", "path", container, "error", err)
+			return
+		}
+	}
+
+	if existed {
+		w.WriteHeader(http.StatusAccepted)
+		log.Log(Info, "container already exists", "path", container)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	log.Log(Info, "container created", "path", container)
 }
 
 // putObject stores a file or metadata in local storage
 func putObject(w http.ResponseWriter, r *http.Request, path string) {
+	log := requestLogger(r)
 	filePath := ""
-	metaPath := filepath.Join(LocalStoragePath, StorageAccount, path+".meta")
-	log.Printf("Function putObject is being used stores a file or metadata in local storage")
-
-	if path == "Users" || path == "Devices" || path == "System" {
-		// Handle directories like Users and Devices correctly
-		filePath = filepath.Join(LocalStoragePath, StorageAccount, path)
-		createDirIfNotExists(filePath)
-		w.WriteHeader(http.StatusCreated)
-		log.Printf("Container %s created successfully", path)
-		return
-	} else if strings.HasSuffix(path, ".mkv") {
-		// Store .mkv files in the root directory
-		filePath = filepath.Join(LocalStoragePath, StorageAccount, filepath.Base(path))
-	} else {
-		// Handle all other files normally
-		filePath = filepath.Join(LocalStoragePath, StorageAccount, path)
+
+	if isContainerPath(path) && !strings.HasSuffix(path, ".mkv") {
+		// A single path segment is a container, like Users and Devices
+		putContainer(w, r, strings.Trim(path, "/"))
+		return
 	}
+	// Objects, recordings included, are stored under their container path
+	filePath = filepath.Join(LocalStoragePath, StorageAccount, path)
 
 	dirPath := filepath.Dir(filePath)
 
@@ -138,60 +457,148 @@ func putObject(w http.ResponseWriter, r *http.Request, path string) {
 		err = os.MkdirAll(dirPath, 0755)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to create directory %s", dirPath), http.StatusInternalServerError)
-			log.Printf("Failed to create parent directory %s: %v", dirPath, err)
+			log.Log(Error, "failed to create parent directory", "path", dirPath, "error", err)
 			return
 		}
-		log.Printf("Parent directory %s created successfully", dirPath)
+		log.Log(Info, "parent directory created", "path", dirPath)
 	} else if err == nil && !parentInfo.IsDir() {
 		http.Error(w, fmt.Sprintf("Parent path %s is not a directory", dirPath), http.StatusInternalServerError)
-		log.Printf("Parent path %s is not a directory", dirPath)
+		log.Log(Error, "parent path is not a directory", "path", dirPath)
+		return
+	}
+
+	// Validate metadata before accepting the body
+	metadata := requestMetadata(r, objectMeta)
+	if err := checkMetadataLimits(metadata); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Log(Info, "metadata rejected", "path", path, "error", err)
+		return
+	}
+	if err := applyExpiryHeaders(r, metadata); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Log(Info, "invalid expiry headers", "path", path, "error", err)
+		return
+	}
+
+	// Refuse uploads that would fill the volume before reading the body
+	if !checkUploadSpace(w, r, path) {
 		return
 	}
+	limit, ok := checkQuotas(w, r, path, filePath)
+	if !ok {
+		return
+	}
+	defer limit.release()
 
-	// Create or overwrite the object file
-	file, err := os.Create(filePath)
+	// Stage the body in a temporary file so a failed or aborted upload never
+	// replaces or truncates the existing object
+	if err := os.MkdirAll(uploadTempDir(), 0755); err != nil {
+		http.Error(w, "Failed to create file", http.StatusInternalServerError)
+		log.Log(Error, "failed to create upload directory", "path", uploadTempDir(), "error", err)
+		return
+	}
+	file, err := os.CreateTemp(uploadTempDir(), filepath.Base(filePath)+".*")
 	if err != nil {
 		http.Error(w, "Failed to create file", http.StatusInternalServerError)
-		log.Printf("Failed to create file %s: %v", filePath, err)
+		log.Log(Error, "failed to create file", "path", filePath, "error", err)
 		return
 	}
-	defer file.Close()
+	tempPath := file.Name()
+
+	upload := beginUpload(r, path)
+	defer finishUpload(upload)
+	started := newEvent(EventUploadStarted, path, "", metadata)
+	started.Bytes = r.ContentLength
+	publishEvent(started)
 
-	_, err = io.Copy(file, r.Body)
+	var body io.Reader = upload
+	if limit.remaining >= 0 {
+		body = &quotaReader{r: upload, remaining: limit.remaining}
+	}
+	hash := md5.New()
+	sha := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, hash, sha), body)
+	metricUploadBytes.add(float64(n))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	// Like Swift, an ETag sent with the upload must match the received body
+	if want := strings.Trim(r.Header.Get("ETag"), `"`); err == nil && want != "" && !strings.EqualFold(want, hex.EncodeToString(hash.Sum(nil))) {
+		err = errETagMismatch
+	}
+	// Hold the object's lock until its new metadata is written
+	unlock := lockObject(path)
+	defer unlock()
+	previousCold := coldPath(filePath)
+	if err == nil {
+		err = limit.commit(n, func() error { return os.Rename(tempPath, filePath) })
+	}
 	if err != nil {
-		http.Error(w, "Failed to upload object", http.StatusInternalServerError)
-		log.Printf("Failed to upload object %s: %v", filePath, err)
+		os.Remove(tempPath)
+		failed := newEvent(EventUploadFailed, path, "", metadata)
+		failed.Bytes = n
+		switch {
+		case errors.Is(err, errQuotaExceeded):
+			failed.Reason = "quota_exceeded"
+			metricQuotaRejections.add(1, limit.scope)
+			http.Error(w, "Upload exceeds quota.", http.StatusRequestEntityTooLarge)
+			log.Log(Info, "upload exceeded quota while streaming, partial file discarded", "path", path, "scope", limit.scope, "bytes", n)
+		case errors.Is(err, errETagMismatch):
+			failed.Reason = "etag_mismatch"
+			http.Error(w, "Unprocessable Entity: ETag doesn't match the uploaded data", http.StatusUnprocessableEntity)
+			log.Log(Warning, "upload ETag mismatch, object discarded", "path", path, "bytes", n, "etag", r.Header.Get("ETag"))
+		case isNoSpaceError(err):
+			failed.Reason = "insufficient_storage"
+			metricUploadsRejected.add(1, "insufficient_storage")
+			http.Error(w, "Insufficient Storage", http.StatusInsufficientStorage)
+			log.Log(Error, "storage volume full during upload, partial file discarded", "path", path, "bytes", n)
+		case checkNotShuttingDown() != nil:
+			failed.Reason = "shutdown"
+			http.Error(w, "Failed to upload object", http.StatusInternalServerError)
+			log.Log(Warning, "upload aborted by shutdown, partial file discarded", "path", path, "bytes", n)
+		default:
+			failed.Reason = err.Error()
+			http.Error(w, "Failed to upload object", http.StatusInternalServerError)
+			log.Log(Error, "failed to upload object", "path", filePath, "bytes", n, "error", err)
+		}
+		publishEvent(failed)
 		return
 	}
+	removeColdCopy(path, previousCold)
+	forgetObject(filePath)
 
 	// Log metadata headers
 	logMetadata(r)
 
-// Create metadata after storing objects in Users/, Devices/, or System/
-if strings.HasPrefix(path, "Users/") || strings.HasPrefix(path, "Devices/") || strings.HasPrefix(path, "System/") {
-	metadata := parseMetadata(r)
-	if len(metadata) > 0 {
-		metaContent, err := json.MarshalIndent(metadata, "", "  ")
-		if err == nil {
-			err = os.WriteFile(metaPath, metaContent, 0644)
-			if err == nil {
-				w.WriteHeader(http.StatusCreated)
-				log.Printf("Metadata for %s created successfully", path)
-				log.Printf("Response: %d Created", http.StatusCreated)
-			} else {
-				http.Error(w, "Failed to write metadata", http.StatusInternalServerError)
-				log.Printf("Failed to create metadata for %s: %v", path, err)
-				log.Printf("Response: %d Internal Server Error", http.StatusInternalServerError)
-			}
-		} else {
-			http.Error(w, "Failed to marshal metadata", http.StatusInternalServerError)
-			log.Printf("Failed to marshal metadata for %s: %v", path, err)
-			log.Printf("Response: %d Internal Server Error", http.StatusInternalServerError)
-		}
+	// Like Swift, a PUT replaces the object's metadata; no headers clears it.
+	// The checksums are kept for the scrubber.
+	etag := hex.EncodeToString(hash.Sum(nil))
+	metadata.SysSet(sysETag, etag)
+	metadata.SysSet(sysSHA256, hex.EncodeToString(sha.Sum(nil)))
+	metadata.SysSet(sysContentType, r.Header.Get("Content-Type"))
+	previous, _ := readMetadata(filePath + ".meta")
+	// Objects stored by a system belong to it; others keep their owner
+	if id := requestIdentity(r); id != nil && id.Role == RoleSystem {
+		metadata.SysSet(sysOwner, id.Name)
+	} else if previous != nil {
+		metadata.SysSet(sysOwner, previous.SysGet(sysOwner))
+	}
+	if err := writeMetadata(filePath+".meta", metadata); err != nil {
+		http.Error(w, "Failed to write metadata", http.StatusInternalServerError)
+		log.Log(Error, "failed to create metadata", "path", path, "error", err)
+		return
+	}
+	if metadata.Len() > 0 {
+		log.Log(Info, "metadata created", "path", path, "keys", metadata.Len())
+	}
+	scheduleExpiry(path, metadata)
+	rememberETag(filePath, etag)
+	publishEvent(newEvent(EventObjectCreated, path, filePath, metadata))
+	if e, ok := activationEvent(path, filePath, previous, metadata); ok {
+		publishEvent(e)
 	}
-}
 
-    log.Printf("Function putObject stores a file or metadata in local storage")
+	w.Header().Set("ETag", etag)
 	w.WriteHeader(http.StatusCreated)
-	log.Printf("Object %s uploaded successfully", path)
-}
\ No newline at end of file
+	log.Log(Info, "object uploaded", "path", path, "bytes", n)
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Cross-origin requests follow Swift's CORS support, so browser applications served
+// from elsewhere can use the API. Origins are allowed everywhere by CORSOrigins, and on
+// the storage API also by the account's or container's metadata:
+//
+//	X-Container-Meta-Access-Control-Allow-Origin     space separated origins, or *
+//	X-Container-Meta-Access-Control-Max-Age          seconds browsers may cache a preflight
+//	X-Container-Meta-Access-Control-Expose-Headers   extra response headers to expose
+//
+// and the same with X-Account-Meta- for the whole account. Only admins may change
+// these. Preflight OPTIONS requests are answered without authentication.
+
+// CORSOrigins are the origins allowed on every endpoint; "*" allows any
+var CORSOrigins []string
+
+const (
+	corsAllowOriginKey   = "access-control-allow-origin"
+	corsMaxAgeKey        = "access-control-max-age"
+	corsExposeHeadersKey = "access-control-expose-headers"
+)
+
+// isCORSKey reports whether an account or container metadata key is CORS metadata
+func isCORSKey(key string) bool {
+	return strings.HasPrefix(strings.ToLower(key), "access-control-")
+}
+
+// corsMethods are the methods preflights are answered with
+const corsMethods = "HEAD, GET, PUT, POST, DELETE, OPTIONS"
+
+// corsExposed are always exposed on top of the X- headers of a response
+var corsExposed = []string{"Cache-Control", "Content-Disposition", "Content-Language", "Content-Length",
+	"Content-Type", "ETag", "Expires", "Last-Modified", "Pragma"}
+
+// corsPolicy is what applies to the origin of a request
+type corsPolicy struct {
+	allowed bool
+	maxAge  string
+	expose  []string
+}
+
+// storagePath returns the account-relative path of a storage API request
+func storagePath(r *http.Request) (string, bool) {
+	prefix := fmt.Sprintf("/v1.0/%s", StorageAccount)
+	if r.URL.Path != prefix && !strings.HasPrefix(r.URL.Path, prefix+"/") {
+		return "", false
+	}
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	return path, validStoragePath(path)
+}
+
+func originListed(origins []string, origin string) bool {
+	for _, o := range origins {
+		if o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// corsPolicyFor returns the policy for origin on the request's path. The container's
+// metadata is consulted before the account's for the max age.
+func corsPolicyFor(r *http.Request, origin string) corsPolicy {
+	p := corsPolicy{allowed: originListed(CORSOrigins, origin)}
+	path, ok := storagePath(r)
+	if !ok {
+		return p
+	}
+	metaPaths := []string{metaFilePath("")}
+	if path != "" {
+		metaPaths = []string{metaFilePath(containerOf(path)), metaFilePath("")}
+	}
+	for _, metaPath := range metaPaths {
+		meta, err := readMetadata(metaPath)
+		if err != nil {
+			continue
+		}
+		if v, ok := meta.Get(corsAllowOriginKey); ok && originListed(strings.Fields(v), origin) {
+			p.allowed = true
+		}
+		if v, ok := meta.Get(corsMaxAgeKey); ok && p.maxAge == "" {
+			p.maxAge = v
+		}
+		if v, ok := meta.Get(corsExposeHeadersKey); ok {
+			p.expose = append(p.expose, strings.FieldsFunc(v, func(c rune) bool { return c == ',' || c == ' ' })...)
+		}
+	}
+	return p
+}
+
+// corsWriter adds the CORS response headers once the handler's headers are known
+type corsWriter struct {
+	http.ResponseWriter
+	origin  string
+	expose  []string
+	written bool
+}
+
+func (cw *corsWriter) addHeaders() {
+	if cw.written {
+		return
+	}
+	cw.written = true
+	h := cw.Header()
+	exposed := map[string]bool{}
+	for _, name := range append(append([]string(nil), corsExposed...), cw.expose...) {
+		exposed[http.CanonicalHeaderKey(name)] = true
+	}
+	for name := range h {
+		if strings.HasPrefix(strings.ToLower(name), "x-") {
+			exposed[name] = true
+		}
+	}
+	names := make([]string, 0, len(exposed))
+	for name := range exposed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	h.Set("Access-Control-Allow-Origin", cw.origin)
+	h.Set("Access-Control-Expose-Headers", strings.Join(names, ", "))
+}
+
+func (cw *corsWriter) WriteHeader(code int) {
+	cw.addHeaders()
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *corsWriter) Write(p []byte) (int, error) {
+	cw.addHeaders()
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *corsWriter) Flush() {
+	cw.addHeaders()
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (cw *corsWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// WithCORS answers preflight requests and adds CORS headers to the responses of
+// allowed origins. OPTIONS on the storage API is answered with its methods even
+// without an Origin, as Swift does.
+func WithCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		_, storage := storagePath(r)
+		if r.Method == http.MethodOptions {
+			if origin == "" || r.Header.Get("Access-Control-Request-Method") == "" {
+				if !storage {
+					next.ServeHTTP(w, r)
+					return
+				}
+				w.Header().Set("Allow", corsMethods)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			w.Header().Add("Vary", "Origin")
+			p := corsPolicyFor(r, origin)
+			if !p.allowed {
+				http.Error(w, "Origin not allowed", http.StatusUnauthorized)
+				requestLogger(r).Log(Info, "CORS preflight refused", "origin", origin, "path", r.URL.Path)
+				return
+			}
+			w.Header().Set("Allow", corsMethods)
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", corsMethods)
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+			}
+			if p.maxAge != "" {
+				w.Header().Set("Access-Control-Max-Age", p.maxAge)
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		p := corsPolicyFor(r, origin)
+		if !p.allowed {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&corsWriter{ResponseWriter: w, origin: origin, expose: p.expose}, r)
+	})
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// corsRequest sends a request from origin and returns the response, with its body closed
+func corsRequest(t *testing.T, method, url, origin string, header map[string]string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestCORS(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	const review, other = "https://review.example.com", "https://other.example.com"
+	preflight := func(target, origin string) *http.Response {
+		return corsRequest(t, http.MethodOptions, target, origin, map[string]string{
+			"Access-Control-Request-Method":  "GET",
+			"Access-Control-Request-Headers": "x-auth-token",
+		})
+	}
+
+	if resp := corsRequest(t, http.MethodGet, storage, review, map[string]string{"X-Auth-Token": admin}); resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Error("CORS headers without any allowed origin")
+	}
+	if resp := preflight(storage+"/Recordings/a.mkv", review); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("preflight from an origin that isn't allowed: %s, want 401", resp.Status)
+	}
+	if resp := corsRequest(t, http.MethodOptions, storage, "", nil); resp.StatusCode != http.StatusOK || resp.Header.Get("Allow") == "" {
+		t.Errorf("OPTIONS without an origin: %s, Allow %q", resp.Status, resp.Header.Get("Allow"))
+	}
+
+	// Container metadata allows an origin for that container only
+	do(t, http.MethodPut, storage+"/Recordings", admin, "")
+	do(t, http.MethodPut, storage+"/Users", admin, "")
+	code := request(t, http.MethodPost, storage+"/Recordings", admin, map[string]string{
+		"X-Container-Meta-Access-Control-Allow-Origin":   review + " https://spare.example.com",
+		"X-Container-Meta-Access-Control-Max-Age":        "600",
+		"X-Container-Meta-Access-Control-Expose-Headers": "X-Custom",
+	}, nil)
+	if code != http.StatusNoContent {
+		t.Fatalf("setting CORS metadata: %d", code)
+	}
+	if code := request(t, http.MethodPut, storage+"/Recordings/a.mkv", admin, map[string]string{"X-Object-Meta-UserID": "1234"}, strings.NewReader("video")); code != http.StatusCreated {
+		t.Fatalf("upload: %d", code)
+	}
+
+	resp := preflight(storage+"/Recordings/a.mkv", review)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Origin") != review ||
+		resp.Header.Get("Access-Control-Max-Age") != "600" || resp.Header.Get("Access-Control-Allow-Headers") != "x-auth-token" ||
+		!strings.Contains(resp.Header.Get("Access-Control-Allow-Methods"), "PUT") {
+		t.Errorf("preflight for the container: %s %v", resp.Status, resp.Header)
+	}
+	if resp := preflight(storage+"/Users/1234", review); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("preflight for another container: %s, want 401", resp.Status)
+	}
+	if resp := preflight(storage+"/Recordings/a.mkv", other); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("preflight from another origin: %s, want 401", resp.Status)
+	}
+
+	resp = corsRequest(t, http.MethodGet, storage+"/Recordings/a.mkv", review, map[string]string{"X-Auth-Token": admin})
+	expose := strings.ToLower(resp.Header.Get("Access-Control-Expose-Headers"))
+	if resp.Header.Get("Access-Control-Allow-Origin") != review {
+		t.Errorf("GET from the allowed origin: Access-Control-Allow-Origin %q", resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+	for _, name := range []string{"etag", "x-object-meta-userid", "x-trans-id", "x-custom", "last-modified"} {
+		if !strings.Contains(expose, name) {
+			t.Errorf("%s isn't exposed: %q", name, expose)
+		}
+	}
+	// Browsers can read refusals too
+	if resp := corsRequest(t, http.MethodGet, storage+"/Recordings/a.mkv", review, nil); resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("Access-Control-Allow-Origin") != review {
+		t.Errorf("GET without a token: %s, Access-Control-Allow-Origin %q", resp.Status, resp.Header.Get("Access-Control-Allow-Origin"))
+	}
+
+	// Origins allowed everywhere reach the auth endpoints and can read the token
+	CORSOrigins = []string{other}
+	resp = corsRequest(t, http.MethodOptions, url+"/auth/v1.0", other, map[string]string{
+		"Access-Control-Request-Method":  "GET",
+		"Access-Control-Request-Headers": "x-auth-user, x-auth-key",
+	})
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Access-Control-Allow-Headers") != "x-auth-user, x-auth-key" {
+		t.Errorf("preflight for /auth/v1.0: %s %v", resp.Status, resp.Header)
+	}
+	resp = corsRequest(t, http.MethodGet, url+"/auth/v1.0", other, map[string]string{"X-Auth-User": AuthUser, "X-Auth-Key": AuthPassword})
+	if !strings.Contains(resp.Header.Get("Access-Control-Expose-Headers"), "X-Auth-Token") || resp.Header.Get("Access-Control-Allow-Origin") != other {
+		t.Errorf("GET /auth/v1.0: %v", resp.Header)
+	}
+	if resp := preflight(storage+"/Users/1234", other); resp.StatusCode != http.StatusOK {
+		t.Errorf("preflight from a globally allowed origin: %s", resp.Status)
+	}
+}
+
+func TestCORSMetadataAdminOnly(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	reviewer := addTestAccount(t, url, admin, "grace", RoleReviewer)
+	system := addTestAccount(t, url, admin, "system", RoleSystem)
+	request(t, http.MethodPut, storage+"/Recordings", admin, map[string]string{"X-Container-Meta-Access-Control-Allow-Origin": "https://review.example.com"}, nil)
+
+	for _, token := range []string{reviewer, system} {
+		for _, tc := range []struct {
+			method, path string
+			header       map[string]string
+		}{
+			{http.MethodPost, storage, map[string]string{"X-Account-Meta-Access-Control-Allow-Origin": "*"}},
+			{http.MethodPost, storage + "/Recordings", map[string]string{"X-Container-Meta-Access-Control-Allow-Origin": "*"}},
+			{http.MethodPost, storage + "/Recordings", map[string]string{"X-Container-Meta-Access-Control-Expose-Headers": "X-Auth-Token"}},
+			{http.MethodPost, storage + "/Recordings", map[string]string{"X-Remove-Container-Meta-Access-Control-Allow-Origin": "x"}},
+			{http.MethodPut, storage + "/Recordings", map[string]string{"X-Container-Meta-Access-Control-Allow-Origin": "*"}},
+			{http.MethodPut, storage + "/Other", map[string]string{"X-Container-Meta-Access-Control-Max-Age": "86400"}},
+		} {
+			if code := request(t, tc.method, tc.path, token, tc.header, nil); code != http.StatusForbidden {
+				t.Errorf("%s %s with %v: %d, want 403", tc.method, tc.path, tc.header, code)
+			}
+		}
+	}
+	meta, _ := readMetadata(metaFilePath("Recordings"))
+	if got := meta.Map(); len(got) != 1 || got["Access-Control-Allow-Origin"] != "https://review.example.com" {
+		t.Errorf("container metadata %v", got)
+	}
+	if code := request(t, http.MethodPost, storage+"/Recordings", admin, map[string]string{"X-Container-Meta-Access-Control-Allow-Origin": "*"}, nil); code != http.StatusNoContent {
+		t.Errorf("admin setting CORS metadata: %d", code)
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Credentials are the user name and key clients authenticate with on /auth/v1.0 and
+// that connection.json hands to cameras. AuthUser and AuthPassword apply until they are
+// rotated; rotated credentials are kept in .bodyworn/credentials.json, which the server
+// reads again whenever it changes, so a rotation needs no restart.
+type Credentials struct {
+	User    string    `json:"user"`
+	Key     string    `json:"key"`
+	Rotated time.Time `json:"rotated"`
+}
+
+var (
+	credentialsMu      sync.Mutex
+	credentialsCache   *Credentials
+	credentialsModTime time.Time
+)
+
+func credentialsPath() string {
+	return filepath.Join(stateDir(), "credentials.json")
+}
+
+// currentCredentials returns the rotated credentials, or the built-in ones
+func currentCredentials() Credentials {
+	builtin := Credentials{User: AuthUser, Key: AuthPassword}
+	info, err := os.Stat(credentialsPath())
+	if err != nil {
+		return builtin
+	}
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	if credentialsCache != nil && info.ModTime().Equal(credentialsModTime) {
+		return *credentialsCache
+	}
+	content, err := os.ReadFile(credentialsPath())
+	if err != nil {
+		getLogger().Log(Error, "failed to read credentials", "path", credentialsPath(), "error", err)
+		return builtin
+	}
+	var creds Credentials
+	if err := json.Unmarshal(content, &creds); err != nil || creds.User == "" || creds.Key == "" {
+		getLogger().Log(Error, "invalid credentials file, using built-in credentials", "path", credentialsPath())
+		return builtin
+	}
+	credentialsCache = &creds
+	credentialsModTime = info.ModTime()
+	return creds
+}
+
+// RotateCredentials replaces the credentials. An empty user keeps the current one and
+// an empty key is replaced by a random one.
+func RotateCredentials(user, key string) (*Credentials, error) {
+	creds := Credentials{User: user, Key: key, Rotated: time.Now().UTC()}
+	if creds.User == "" {
+		creds.User = currentCredentials().User
+	}
+	if creds.Key == "" {
+		raw := make([]byte, 24)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		creds.Key = base64.RawURLEncoding.EncodeToString(raw)
+	}
+	if creds.Key == currentCredentials().Key && creds.User == currentCredentials().User {
+		return nil, errors.New("new credentials are the same as the current ones")
+	}
+	content, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(stateDir(), 0755); err != nil {
+		return nil, err
+	}
+	tmp := credentialsPath() + ".tmp"
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, credentialsPath()); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return &creds, nil
+}
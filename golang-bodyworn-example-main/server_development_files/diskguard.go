@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// UploadReserveBytes is kept free on the storage volume; uploads that would eat into it are refused with 507
+	UploadReserveBytes uint64 = 512 << 20
+	// DiskWarningBytes and DiskCriticalBytes raise warnings as free space drops below them
+	DiskWarningBytes  uint64 = 10 << 30
+	DiskCriticalBytes uint64 = 2 << 30
+	// PauseLowPriority rejects uploads matching LowPriorityPatterns with 503 while space is at warning level or worse
+	PauseLowPriority    bool
+	LowPriorityPatterns []string
+)
+
+// diskLevel is how close the storage volume is to full
+type diskLevel int
+
+const (
+	diskOK diskLevel = iota
+	diskWarning
+	diskCritical
+)
+
+func (l diskLevel) String() string {
+	switch l {
+	case diskWarning:
+		return "warning"
+	case diskCritical:
+		return "critical"
+	}
+	return "ok"
+}
+
+var (
+	diskLevelMu      sync.Mutex
+	currentDiskLevel diskLevel
+
+	metricDiskLevel       = newMetricVec()
+	metricDiskLevelEvents = newMetricVec("level")
+	metricUploadsRejected = newMetricVec("reason")
+)
+
+func levelForFree(free uint64) diskLevel {
+	switch {
+	case free < DiskCriticalBytes:
+		return diskCritical
+	case free < DiskWarningBytes:
+		return diskWarning
+	}
+	return diskOK
+}
+
+// updateDiskLevel records the level for free bytes and logs when it changes
+func updateDiskLevel(free uint64) diskLevel {
+	level := levelForFree(free)
+
+	diskLevelMu.Lock()
+	previous := currentDiskLevel
+	currentDiskLevel = level
+	diskLevelMu.Unlock()
+
+	metricDiskLevel.set(float64(level))
+	if level == previous {
+		return level
+	}
+	metricDiskLevelEvents.add(1, level.String())
+	switch level {
+	case diskCritical:
+		getLogger().Log(Error, "storage space critical", "free_bytes", free, "threshold", DiskCriticalBytes)
+	case diskWarning:
+		getLogger().Log(Warning, "storage space low", "free_bytes", free, "threshold", DiskWarningBytes)
+	default:
+		getLogger().Log(Info, "storage space recovered", "free_bytes", free)
+	}
+	return level
+}
+
+// isLowPriorityUpload reports whether objectPath matches one of LowPriorityPatterns
+func isLowPriorityUpload(objectPath string) bool {
+	for _, pattern := range LowPriorityPatterns {
+		if ok, _ := path.Match(pattern, objectPath); ok {
+			return true
+		}
+		if strings.HasSuffix(pattern, "/") && strings.HasPrefix(objectPath, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkUploadSpace decides whether an upload of r's Content-Length fits on the volume.
+// It writes a 507 or 503 response and returns false when the upload must be refused.
+func checkUploadSpace(w http.ResponseWriter, r *http.Request, objectPath string) bool {
+	space, err := diskSpace(filepath.Join(LocalStoragePath, StorageAccount))
+	if err != nil {
+		// Without space information the upload is attempted and ENOSPC handled during the copy
+		return true
+	}
+	level := updateDiskLevel(space.Free)
+
+	needed := UploadReserveBytes
+	if r.ContentLength > 0 {
+		needed += uint64(r.ContentLength)
+	}
+	if space.Free < needed {
+		metricUploadsRejected.add(1, "insufficient_storage")
+		http.Error(w, "Insufficient Storage", http.StatusInsufficientStorage)
+		requestLogger(r).Log(Warning, "upload refused, insufficient storage",
+			"path", objectPath, "content_length", r.ContentLength, "free_bytes", space.Free, "reserve", UploadReserveBytes)
+		return false
+	}
+
+	if PauseLowPriority && level >= diskWarning && isLowPriorityUpload(objectPath) {
+		metricUploadsRejected.add(1, "low_priority_paused")
+		w.Header().Set("Retry-After", "300")
+		http.Error(w, "Low priority uploads paused while storage space is low", http.StatusServiceUnavailable)
+		requestLogger(r).Log(Warning, "low priority upload paused", "path", objectPath, "free_bytes", space.Free, "level", level)
+		return false
+	}
+	return true
+}
+
+// isNoSpaceError reports whether err was caused by the volume filling up
+func isNoSpaceError(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
+
+// StartDiskMonitor checks free space every interval so warnings are raised
+// even when no uploads arrive; it stops when ctx is cancelled
+func StartDiskMonitor(ctx context.Context, interval time.Duration) {
+	check := func() {
+		space, err := diskSpace(filepath.Join(LocalStoragePath, StorageAccount))
+		if err != nil {
+			if !errors.Is(err, errDiskSpaceUnsupported) {
+				getLogger().Log(Warning, "disk monitor failed to read free space", "error", err)
+			}
+			return
+		}
+		updateDiskLevel(space.Free)
+	}
+	check()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				check()
+			}
+		}
+	}()
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// metricValue returns the value of m for labelValues
+func metricValue(m *metricVec, labelValues ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[strings.Join(labelValues, "\xff")]
+}
+
+// startDiskGuardTest serves storage with free space read, restoring the guard's settings afterwards
+func startDiskGuardTest(t *testing.T) (storage, admin string, free uint64) {
+	t.Helper()
+	url := startTestServer(t)
+	space, err := diskSpace(LocalStoragePath)
+	if err != nil {
+		t.Skipf("free space unknown: %v", err)
+	}
+	warning, critical := DiskWarningBytes, DiskCriticalBytes
+	t.Cleanup(func() {
+		DiskWarningBytes, DiskCriticalBytes = warning, critical
+		PauseLowPriority, LowPriorityPatterns = false, nil
+		diskLevelMu.Lock()
+		currentDiskLevel = diskOK
+		diskLevelMu.Unlock()
+	})
+	DiskWarningBytes, DiskCriticalBytes = 0, 0
+	return url + "/v1.0/" + StorageAccount, signIn(t, url, AuthUser, AuthPassword), space.Free
+}
+
+func TestUploadReserve(t *testing.T) {
+	storage, admin, free := startDiskGuardTest(t)
+	rejected := metricValue(metricUploadsRejected, "insufficient_storage")
+
+	// Uploads that would eat into the reserve are refused before anything is written
+	UploadReserveBytes = free + 1<<30
+	if code := request(t, http.MethodPut, storage+"/System/big.mkv", admin, nil, strings.NewReader("video")); code != http.StatusInsufficientStorage {
+		t.Errorf("upload into the reserve: %d, want 507", code)
+	}
+	if _, err := os.Stat(filepath.Join(LocalStoragePath, StorageAccount, "System", "big.mkv")); !os.IsNotExist(err) {
+		t.Errorf("refused upload stored: %v", err)
+	}
+	if entries, _ := os.ReadDir(uploadTempDir()); len(entries) != 0 {
+		t.Errorf("refused upload staged: %v", entries)
+	}
+	if got := metricValue(metricUploadsRejected, "insufficient_storage"); got != rejected+1 {
+		t.Errorf("insufficient_storage rejections %v, want %v", got, rejected+1)
+	}
+
+	// Containers can still be created, and uploads resume once there is room
+	if code := request(t, http.MethodPut, storage+"/Bulk", admin, nil, nil); code != http.StatusCreated {
+		t.Errorf("container while full: %d", code)
+	}
+	UploadReserveBytes = 0
+	if code := request(t, http.MethodPut, storage+"/System/big.mkv", admin, nil, strings.NewReader("video")); code != http.StatusCreated {
+		t.Errorf("upload with room: %d", code)
+	}
+}
+
+func TestLowPriorityShedding(t *testing.T) {
+	storage, admin, free := startDiskGuardTest(t)
+	request(t, http.MethodPut, storage+"/Bulk", admin, nil, nil)
+	LowPriorityPatterns = []string{"Devices/*.log", "Bulk/"}
+	put := func(object string) *http.Response {
+		resp, _ := send(t, http.MethodPut, storage+"/"+object, admin, nil, "content")
+		return resp
+	}
+
+	// Paused only while enabled and space is at warning level or worse
+	DiskWarningBytes = free + 1<<30
+	if resp := put("Bulk/1.mkv"); resp.StatusCode != http.StatusCreated {
+		t.Errorf("low priority upload without pausing: %s", resp.Status)
+	}
+	PauseLowPriority = true
+	paused := metricValue(metricUploadsRejected, "low_priority_paused")
+	for _, object := range []string{"Bulk/2.mkv", "Bulk/sub/3.mkv", "Devices/cam.log"} {
+		if resp := put(object); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "300" {
+			t.Errorf("low priority %s at warning level: %s, Retry-After %q", object, resp.Status, resp.Header.Get("Retry-After"))
+		}
+	}
+	if got := metricValue(metricUploadsRejected, "low_priority_paused"); got != paused+3 {
+		t.Errorf("low_priority_paused rejections %v, want %v", got, paused+3)
+	}
+	for _, object := range []string{"System/a.mkv", "Devices/cam.json", "Devices/sub/cam.log"} {
+		if resp := put(object); resp.StatusCode != http.StatusCreated {
+			t.Errorf("%s at warning level: %s", object, resp.Status)
+		}
+	}
+
+	// Critical space pauses them too; recovery lets them in again
+	DiskWarningBytes, DiskCriticalBytes = free+2<<30, free+1<<30
+	if resp := put("Bulk/4.mkv"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("low priority upload at critical level: %s", resp.Status)
+	}
+	DiskWarningBytes, DiskCriticalBytes = 0, 0
+	if resp := put("Bulk/4.mkv"); resp.StatusCode != http.StatusCreated {
+		t.Errorf("low priority upload after recovery: %s", resp.Status)
+	}
+}
+
+func TestDiskLevels(t *testing.T) {
+	startDiskGuardTest(t)
+	DiskWarningBytes, DiskCriticalBytes = 100, 10
+	for _, tc := range []struct {
+		free uint64
+		want diskLevel
+	}{{1000, diskOK}, {50, diskWarning}, {5, diskCritical}, {100, diskOK}} {
+		critical := metricValue(metricDiskLevelEvents, "critical")
+		if got := updateDiskLevel(tc.free); got != tc.want {
+			t.Errorf("%d bytes free: %s, want %s", tc.free, got, tc.want)
+		}
+		if metricValue(metricDiskLevel) != float64(tc.want) {
+			t.Errorf("%d bytes free: level metric %v", tc.free, metricValue(metricDiskLevel))
+		}
+		if tc.want == diskCritical && metricValue(metricDiskLevelEvents, "critical") != critical+1 {
+			t.Error("change to critical not counted")
+		}
+	}
+}
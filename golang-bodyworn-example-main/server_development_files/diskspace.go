@@ -0,0 +1,11 @@
+package server
+
+import "errors"
+
+// DiskSpace describes the capacity of the volume holding a path
+type DiskSpace struct {
+	Free  uint64 // bytes available to unprivileged users
+	Total uint64
+}
+
+var errDiskSpaceUnsupported = errors.New("disk space reporting is not supported on this platform")
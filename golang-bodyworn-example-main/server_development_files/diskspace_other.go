@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package server
+
+// diskSpace is not implemented on this platform
+func diskSpace(path string) (DiskSpace, error) {
+	return DiskSpace{}, errDiskSpaceUnsupported
+}
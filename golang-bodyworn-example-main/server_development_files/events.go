@@ -0,0 +1,216 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types published when storage changes. object.created marks a completed upload.
+const (
+	EventObjectCreated     = "object.created"
+	EventMetadataUpdated   = "metadata.updated"
+	EventObjectDeleted     = "object.deleted"
+	EventObjectExpired     = "object.expired"
+	EventUploadStarted     = "upload.started"
+	EventUploadFailed      = "upload.failed"
+	EventUserActivated     = "user.activated"
+	EventUserDeactivated   = "user.deactivated"
+	EventDeviceActivated   = "device.activated"
+	EventDeviceDeactivated = "device.deactivated"
+)
+
+// EventHistorySize is how many recent events are kept for clients resuming a stream
+var EventHistorySize = 1000
+
+// Event describes one change to the stored accounts, containers or objects.
+// Path is empty for the account and the container name for containers.
+type Event struct {
+	ID        string            `json:"id"`
+	Type      string            `json:"type"`
+	Time      time.Time         `json:"time"`
+	Account   string            `json:"account"`
+	Container string            `json:"container,omitempty"`
+	Path      string            `json:"path"`
+	ETag      string            `json:"etag,omitempty"`
+	Bytes     int64             `json:"bytes"`
+	Metadata  map[string]string `json:"metadata"`
+	Reason    string            `json:"reason,omitempty"`
+
+	seq uint64 // publication order, used to resume streams
+}
+
+var (
+	eventsMu         sync.Mutex
+	eventSubscribers = map[int]func(Event){}
+	nextSubscriberID int
+	eventSeq         uint64
+	eventHistory     []Event
+	// Published events wait in eventsPending for the dispatcher, which runs while
+	// eventsDispatching is set and signals eventsIdle when it has caught up
+	eventsPending     []Event
+	eventsDispatching bool
+	eventsIdle        = sync.NewCond(&eventsMu)
+)
+
+// SubscribeEvents calls fn for every published event until the returned cancel
+// function is called. Events are handed to subscribers in publication order on the
+// dispatcher's goroutine, after the publishing request has moved on; fn shouldn't
+// block for long, as it holds up the other subscribers.
+func SubscribeEvents(fn func(Event)) (cancel func()) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	id := nextSubscriberID
+	nextSubscriberID++
+	eventSubscribers[id] = fn
+	return func() {
+		eventsMu.Lock()
+		delete(eventSubscribers, id)
+		eventsMu.Unlock()
+	}
+}
+
+// publishEvent records e in the history and queues it for the subscribers
+func publishEvent(e Event) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	eventSeq++
+	e.seq = eventSeq
+	eventHistory = append(eventHistory, e)
+	if over := len(eventHistory) - EventHistorySize; over > 0 {
+		eventHistory = append([]Event(nil), eventHistory[over:]...)
+	}
+	eventsPending = append(eventsPending, e)
+	if !eventsDispatching {
+		eventsDispatching = true
+		go dispatchEvents()
+	}
+	getLogger().Log(Debug, "event published", "type", e.Type, "path", e.Path, "event_id", e.ID)
+}
+
+// dispatchEvents hands the pending events to the subscribers without holding
+// eventsMu, so subscribers doing I/O don't hold up publishers, and returns once
+// there are none left
+func dispatchEvents() {
+	eventsMu.Lock()
+	for len(eventsPending) > 0 {
+		pending := eventsPending
+		eventsPending = nil
+		subscribers := make([]func(Event), 0, len(eventSubscribers))
+		for _, fn := range eventSubscribers {
+			subscribers = append(subscribers, fn)
+		}
+		eventsMu.Unlock()
+		for _, e := range pending {
+			for _, fn := range subscribers {
+				fn(e)
+			}
+		}
+		eventsMu.Lock()
+	}
+	eventsDispatching = false
+	eventsIdle.Broadcast()
+	eventsMu.Unlock()
+}
+
+// flushEvents waits until every published event has been handed to the subscribers
+func flushEvents(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		eventsMu.Lock()
+		for eventsDispatching {
+			eventsIdle.Wait()
+		}
+		eventsMu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("events not delivered: %w", ctx.Err())
+	}
+}
+
+// eventsSince returns the recorded events published after the event with id lastID.
+// found is false when lastID is no longer, or never was, in the history.
+func eventsSince(lastID string) (events []Event, found bool) {
+	eventsMu.Lock()
+	defer eventsMu.Unlock()
+	for i, e := range eventHistory {
+		if e.ID == lastID {
+			return append([]Event(nil), eventHistory[i+1:]...), true
+		}
+	}
+	return nil, false
+}
+
+// newEvent builds an event for path, whose file is at fullPath. Object size is read
+// from the file and the ETag from meta or the file, so events for deletions must be
+// built beforehand.
+func newEvent(eventType, path, fullPath string, meta *Metadata) Event {
+	path = strings.Trim(path, "/")
+	e := Event{
+		ID:       newEventID(),
+		Type:     eventType,
+		Time:     time.Now().UTC(),
+		Account:  StorageAccount,
+		Path:     path,
+		Metadata: map[string]string{},
+	}
+	if path != "" {
+		e.Container = containerOf(path)
+	}
+	if meta != nil {
+		// Only user metadata; the owner, tier and checksums are system metadata
+		e.Metadata = meta.Map()
+		if !strings.Contains(path, "/") {
+			// Account and container metadata hold the temp URL keys, which only admins see
+			withoutTempURLKeys(e.Metadata)
+		}
+	}
+	if info, err := os.Stat(fullPath); err == nil && !info.IsDir() && path != "" {
+		e.Bytes = info.Size()
+		e.ETag = objectETag(fullPath, meta)
+	}
+	return e
+}
+
+func newEventID() string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("ev%x", time.Now().UnixNano())
+	}
+	return "ev" + hex.EncodeToString(buf)
+}
+
+// activationEvent returns the user or device event for a change of path's "active"
+// metadata from before to after, if there is one
+func activationEvent(path, fullPath string, before, after *Metadata) (Event, bool) {
+	var activated, deactivated string
+	switch containerOf(path) {
+	case "Users":
+		activated, deactivated = EventUserActivated, EventUserDeactivated
+	case "Devices":
+		activated, deactivated = EventDeviceActivated, EventDeviceDeactivated
+	default:
+		return Event{}, false
+	}
+	isActive := func(meta *Metadata) bool {
+		v, _ := meta.Get("active")
+		return strings.EqualFold(v, "true")
+	}
+	was, is := before != nil && isActive(before), after != nil && isActive(after)
+	switch {
+	case is && !was:
+		return newEvent(activated, path, fullPath, after), true
+	case was && !is:
+		return newEvent(deactivated, path, fullPath, after), true
+	}
+	return Event{}, false
+}
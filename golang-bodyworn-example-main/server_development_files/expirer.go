@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Objects can be scheduled for deletion like in Swift: X-Delete-At takes a Unix
+// time and X-Delete-After a number of seconds, on PUT or POST; X-Remove-Delete-At
+// cancels it. The time is kept in the object's system metadata and returned as
+// X-Delete-At. Expired objects answer 404 at once and are removed by the expirer.
+
+const sysDeleteAt = "delete-at"
+
+var (
+	expiryMu    sync.Mutex
+	expiryIndex = map[string]int64{} // object path -> Unix time
+)
+
+// Writers of an object's data or sidecar hold its lock, so the expirer can't remove
+// an object that was replaced between reading its deletion time and deleting it
+var (
+	objectLocksMu sync.Mutex
+	objectLocks   = map[string]*objectLock{}
+)
+
+type objectLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockObject waits for the lock of path and returns the function releasing it
+func lockObject(path string) (unlock func()) {
+	path = strings.Trim(path, "/")
+	objectLocksMu.Lock()
+	l, ok := objectLocks[path]
+	if !ok {
+		l = &objectLock{}
+		objectLocks[path] = l
+	}
+	l.refs++
+	objectLocksMu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		objectLocksMu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(objectLocks, path)
+		}
+		objectLocksMu.Unlock()
+	}
+}
+
+// applyExpiryHeaders updates meta from X-Delete-At, X-Delete-After and X-Remove-Delete-At
+func applyExpiryHeaders(r *http.Request, meta *Metadata) error {
+	now := time.Now().Unix()
+	if r.Header.Get("X-Remove-Delete-At") != "" {
+		meta.SysSet(sysDeleteAt, "")
+	}
+	if v := r.Header.Get("X-Delete-After"); v != "" {
+		seconds, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("Non-integer X-Delete-After")
+		}
+		meta.SysSet(sysDeleteAt, strconv.FormatInt(now+seconds, 10))
+	}
+	if v := r.Header.Get("X-Delete-At"); v != "" {
+		at, err := strconv.ParseInt(strings.SplitN(v, ".", 2)[0], 10, 64)
+		if err != nil {
+			return fmt.Errorf("Non-integer X-Delete-At")
+		}
+		if at < now {
+			return fmt.Errorf("X-Delete-At in past")
+		}
+		meta.SysSet(sysDeleteAt, strconv.FormatInt(at, 10))
+	}
+	return nil
+}
+
+// deleteAt returns the scheduled deletion time of an object, or 0
+func deleteAt(meta *Metadata) int64 {
+	at, _ := strconv.ParseInt(meta.SysGet(sysDeleteAt), 10, 64)
+	return at
+}
+
+// objectExpired reports whether the object with meta is past its deletion time
+func objectExpired(meta *Metadata) bool {
+	at := deleteAt(meta)
+	return at > 0 && at <= time.Now().Unix()
+}
+
+// scheduleExpiry records or clears the deletion time of path after its metadata changed
+func scheduleExpiry(path string, meta *Metadata) {
+	path = strings.Trim(path, "/")
+	expiryMu.Lock()
+	defer expiryMu.Unlock()
+	if at := deleteAt(meta); at > 0 {
+		expiryIndex[path] = at
+	} else {
+		delete(expiryIndex, path)
+	}
+}
+
+// rebuildExpiryIndex loads the deletion times of all objects from their sidecars
+func rebuildExpiryIndex() error {
+	root := filepath.Join(LocalStoragePath, StorageAccount)
+	index := map[string]int64{}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".meta") {
+			return nil
+		}
+		objectPath := strings.TrimSuffix(p, ".meta")
+		if info, err := os.Stat(objectPath); err != nil || info.IsDir() {
+			return nil
+		}
+		meta, err := readMetadata(p)
+		if err != nil {
+			getLogger().Log(Warning, "failed to read metadata for expiry", "path", p, "error", err)
+			return nil
+		}
+		if at := deleteAt(meta); at > 0 {
+			rel, err := filepath.Rel(root, objectPath)
+			if err != nil {
+				return err
+			}
+			index[filepath.ToSlash(rel)] = at
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	expiryMu.Lock()
+	expiryIndex = index
+	expiryMu.Unlock()
+	return nil
+}
+
+// removeObject deletes an object and its sidecar and drops it from the expiry index
+func removeObject(path, fullPath string) error {
+	cold := coldPath(fullPath)
+	if err := os.Remove(fullPath); err != nil {
+		return err
+	}
+	removeColdCopy(path, cold)
+	forgetObject(fullPath)
+	if err := os.Remove(fullPath + ".meta"); err != nil && !os.IsNotExist(err) {
+		getLogger().Log(Warning, "failed to remove metadata of deleted object", "path", path, "error", err)
+	}
+	expiryMu.Lock()
+	delete(expiryIndex, strings.Trim(path, "/"))
+	expiryMu.Unlock()
+	invalidateContainerStats(path)
+	return nil
+}
+
+// expireObjects removes every object whose deletion time has passed
+func expireObjects() {
+	now := time.Now().Unix()
+	var due []string
+	expiryMu.Lock()
+	for path, at := range expiryIndex {
+		if at <= now {
+			due = append(due, path)
+		}
+	}
+	expiryMu.Unlock()
+
+	for _, path := range due {
+		expireObject(path)
+	}
+}
+
+// expireObject removes path if it is still expired, holding its lock so a PUT or
+// POST can't replace the object or its deletion time in between
+func expireObject(path string) {
+	unlock := lockObject(path)
+	defer unlock()
+	fullPath := filepath.Join(LocalStoragePath, StorageAccount, path)
+	meta, err := readMetadata(fullPath + ".meta")
+	if err != nil {
+		getLogger().Log(Warning, "failed to read metadata of expiring object", "path", path, "error", err)
+		return
+	}
+	// The object may have been replaced or its expiry changed since it was indexed
+	if !objectExpired(meta) {
+		scheduleExpiry(path, meta)
+		return
+	}
+	event := newEvent(EventObjectExpired, path, fullPath, meta)
+	deactivated, deactivate := activationEvent(path, fullPath, meta, nil)
+	if err := removeObject(path, fullPath); err != nil {
+		if os.IsNotExist(err) {
+			scheduleExpiry(path, &Metadata{})
+			return
+		}
+		getLogger().Log(Error, "failed to delete expired object", "path", path, "error", err)
+		return
+	}
+	publishEvent(event)
+	if deactivate {
+		publishEvent(deactivated)
+	}
+	getLogger().Log(Info, "expired object deleted", "path", path)
+}
+
+// checkExpiryIndex fails when indexed objects were due before cutoff: either the
+// expirer has stopped or the index lists objects it can't remove
+func checkExpiryIndex(cutoff time.Time) error {
+	expiryMu.Lock()
+	defer expiryMu.Unlock()
+	var overdue []string
+	for path, at := range expiryIndex {
+		if at < cutoff.Unix() {
+			overdue = append(overdue, path)
+		}
+	}
+	if len(overdue) == 0 {
+		return nil
+	}
+	sort.Strings(overdue)
+	return fmt.Errorf("%d objects overdue for deletion, e.g. %s", len(overdue), overdue[0])
+}
+
+// StartExpirer indexes the objects scheduled for deletion and removes them once
+// their time has passed, checking every interval until ctx is cancelled
+func StartExpirer(ctx context.Context, interval time.Duration) error {
+	if err := rebuildExpiryIndex(); err != nil {
+		return fmt.Errorf("index expiring objects: %w", err)
+	}
+	expiryMu.Lock()
+	scheduled := len(expiryIndex)
+	expiryMu.Unlock()
+	getLogger().Log(Info, "object expirer started", "scheduled", scheduled, "interval", interval)
+	RegisterReadinessCheck("expiry_index", func() error {
+		return checkExpiryIndex(time.Now().Add(-2*interval - time.Minute))
+	})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			expireObjects()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// checkObjectExpiry answers 404 for an object past its deletion time and returns
+// false; otherwise it adds the object's X-Delete-At header and returns true
+func checkObjectExpiry(w http.ResponseWriter, r *http.Request, path, metaPath string) bool {
+	meta, err := readMetadata(metaPath)
+	if err != nil {
+		return true
+	}
+	if objectExpired(meta) {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		requestLogger(r).Log(Info, "object expired", "path", path, "delete_at", deleteAt(meta))
+		return false
+	}
+	if at := deleteAt(meta); at > 0 {
+		w.Header().Set("X-Delete-At", strconv.FormatInt(at, 10))
+	}
+	return true
+}
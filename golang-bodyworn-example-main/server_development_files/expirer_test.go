@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpirer(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	request(t, http.MethodPut, storage+"/CamA", admin, nil, nil)
+	soon := map[string]string{"X-Delete-At": strconv.FormatInt(time.Now().Unix()+1, 10)}
+	for _, name := range []string{"expired", "replaced", "kept"} {
+		if code := request(t, http.MethodPut, storage+"/CamA/"+name, admin, soon, strings.NewReader("video")); code != http.StatusCreated {
+			t.Fatalf("PUT %s: %d", name, code)
+		}
+	}
+	// Replacing an object or removing its deletion time takes it off the schedule
+	request(t, http.MethodPut, storage+"/CamA/replaced", admin, nil, strings.NewReader("newer"))
+	request(t, http.MethodPost, storage+"/CamA/kept", admin, map[string]string{"X-Remove-Delete-At": "1"}, nil)
+	time.Sleep(1100 * time.Millisecond)
+
+	if code := request(t, http.MethodGet, storage+"/CamA/expired", admin, nil, nil); code != http.StatusNotFound {
+		t.Errorf("GET of an expired object: %d, want 404", code)
+	}
+	expireObjects()
+	dir := filepath.Join(LocalStoragePath, StorageAccount, "CamA")
+	for name, want := range map[string]bool{"expired": false, "expired.meta": false, "replaced": true, "kept": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != want {
+			t.Errorf("%s exists: %v, want %v", name, err == nil, want)
+		}
+	}
+}
+
+func TestExpirerWaitsForWriters(t *testing.T) {
+	startTestServer(t)
+	fullPath := filepath.Join(LocalStoragePath, StorageAccount, "CamA", "clip.mkv")
+	os.MkdirAll(filepath.Dir(fullPath), 0755)
+	os.WriteFile(fullPath, []byte("old"), 0644)
+	meta := &Metadata{}
+	meta.SysSet(sysDeleteAt, strconv.FormatInt(time.Now().Unix()-1, 10))
+	writeMetadata(fullPath+".meta", meta)
+	scheduleExpiry("CamA/clip.mkv", meta)
+
+	// A PUT replacing the object holds its lock while the expirer runs
+	unlock := lockObject("CamA/clip.mkv")
+	done := make(chan struct{})
+	go func() {
+		expireObjects()
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	os.WriteFile(fullPath, []byte("new"), 0644)
+	writeMetadata(fullPath+".meta", &Metadata{})
+	unlock()
+	<-done
+
+	if content, err := os.ReadFile(fullPath); err != nil || string(content) != "new" {
+		t.Errorf("replaced object: %q, %v", content, err)
+	}
+	expiryMu.Lock()
+	_, scheduled := expiryIndex["CamA/clip.mkv"]
+	expiryMu.Unlock()
+	if scheduled {
+		t.Error("replaced object still scheduled")
+	}
+}
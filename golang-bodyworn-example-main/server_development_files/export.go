@@ -0,0 +1,593 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Evidence packages bundle recordings for handing over, e.g. to a court. A package is
+// a ZIP or tar archive holding, for every recording:
+//
+//	<object>                    the original .mkv
+//	<object>.meta.json          its metadata sidecar, as stored
+//	<name>.bookmarks.json       bookmark and GNSS objects stored next to it, with
+//	<name>.gnss.json            their sidecars
+//	<object>.recording.json     the /api/recordings view of the recording
+//	Users/<id>, Devices/<id>,   the bearer, device and system objects it refers to,
+//	System/<id>                 with their sidecars
+//
+// and once for the package:
+//
+//	audit.jsonl                 the audit log lines about any of the objects above
+//	manifest.json               size and SHA-256 of every other file
+//	manifest.sig.json           Ed25519 signature of manifest.json, when a key is set
+
+// ExportRequest selects the recordings of a package
+type ExportRequest struct {
+	Recordings []string `json:"recordings"` // recording IDs or object paths
+	Format     string   `json:"format"`     // "zip" (default) or "tar"
+}
+
+// ExportManifest lists the contents of a package
+type ExportManifest struct {
+	Created    time.Time         `json:"created"`
+	Account    string            `json:"account"`
+	Recordings []ExportRecording `json:"recordings"`
+	Files      []ExportFile      `json:"files"`
+}
+
+// ExportRecording is one recording of a package
+type ExportRecording struct {
+	ID     string `json:"id"`
+	Object string `json:"object"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// ExportFile is one file of a package
+type ExportFile struct {
+	Name   string `json:"name"`
+	Bytes  int64  `json:"bytes"`
+	SHA256 string `json:"sha256"`
+}
+
+// ExportSignature is the content of manifest.sig.json
+type ExportSignature struct {
+	Algorithm string `json:"algorithm"`
+	PublicKey string `json:"public_key"` // base64
+	Signature string `json:"signature"`  // base64 signature of manifest.json
+}
+
+// ExportKey signs the manifests of packages built by the server, when set
+var ExportKey ed25519.PrivateKey
+
+const (
+	exportManifestName  = "manifest.json"
+	exportSignatureName = "manifest.sig.json"
+	exportAuditName     = "audit.jsonl"
+)
+
+var errExportFormat = errors.New("format must be zip or tar")
+
+// LoadExportKey reads a PEM encoded PKCS #8 Ed25519 key, creating it when the file doesn't exist
+func LoadExportKey(path string) (ed25519.PrivateKey, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return nil, err
+		}
+		getLogger().Log(Info, "generated export signing key", "path", path, "public_key", exportPublicKey(key))
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an Ed25519 key", path)
+	}
+	return key, nil
+}
+
+func exportPublicKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+// exportArchive is the container format of a package
+type exportArchive interface {
+	add(name string, size int64, modTime time.Time, compress bool) (io.Writer, error)
+	Close() error
+}
+
+type zipArchive struct{ *zip.Writer }
+
+func (a zipArchive) add(name string, size int64, modTime time.Time, compress bool) (io.Writer, error) {
+	method := zip.Store
+	if compress {
+		method = zip.Deflate
+	}
+	return a.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: modTime})
+}
+
+type tarArchive struct{ *tar.Writer }
+
+func (a tarArchive) add(name string, size int64, modTime time.Time, compress bool) (io.Writer, error) {
+	err := a.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, ModTime: modTime, Typeflag: tar.TypeReg, Format: tar.FormatPAX})
+	return a.Writer, err
+}
+
+func newExportArchive(w io.Writer, format string) (exportArchive, error) {
+	switch format {
+	case "", "zip":
+		return zipArchive{zip.NewWriter(w)}, nil
+	case "tar":
+		return tarArchive{tar.NewWriter(w)}, nil
+	}
+	return nil, errExportFormat
+}
+
+// exportObjects resolves recording IDs and object paths to stored recordings
+func exportObjects(recordings []string) ([]string, error) {
+	if len(recordings) == 0 {
+		return nil, errors.New("no recordings selected")
+	}
+	var objects []string
+	seen := map[string]bool{}
+	for _, r := range recordings {
+		object, ok := recordingObject(r)
+		if !ok {
+			object, ok = recordingObject(recordingID(strings.Trim(r, "/")))
+		}
+		if !ok {
+			return nil, fmt.Errorf("%q is not a recording", r)
+		}
+		info, err := os.Stat(filepath.Join(LocalStoragePath, StorageAccount, object))
+		if err != nil || info.IsDir() {
+			return nil, fmt.Errorf("recording %s: %w", object, os.ErrNotExist)
+		}
+		if !seen[object] {
+			seen[object] = true
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
+// exportBuilder writes files into an archive and records them in the manifest
+type exportBuilder struct {
+	archive  exportArchive
+	manifest ExportManifest
+	added    map[string]bool
+	audited  map[string]bool // object paths whose audit log lines are included
+}
+
+// addFile copies the file at path into the archive as name; missing files are skipped
+func (b *exportBuilder) addFile(name, path string, compress bool) (ExportFile, bool, error) {
+	if b.added[name] {
+		return ExportFile{}, false, nil
+	}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return ExportFile{}, false, nil
+	}
+	if err != nil {
+		return ExportFile{}, false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return ExportFile{}, false, err
+	}
+	w, err := b.archive.add(name, info.Size(), info.ModTime(), compress)
+	if err != nil {
+		return ExportFile{}, false, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), io.LimitReader(file, info.Size()))
+	if err != nil {
+		return ExportFile{}, false, err
+	}
+	if n != info.Size() {
+		return ExportFile{}, false, fmt.Errorf("%s changed while it was exported", name)
+	}
+	f := ExportFile{Name: name, Bytes: n, SHA256: hex.EncodeToString(h.Sum(nil))}
+	b.added[name] = true
+	b.manifest.Files = append(b.manifest.Files, f)
+	return f, true, nil
+}
+
+// addObject adds a stored object and its metadata sidecar
+func (b *exportBuilder) addObject(object string, compress bool) (ExportFile, bool, error) {
+	fullPath := filepath.Join(LocalStoragePath, StorageAccount, object)
+	f, ok, err := b.addFile(object, fullPath, compress)
+	if err != nil || !ok {
+		return f, ok, err
+	}
+	b.audited[object] = true
+	_, _, err = b.addFile(object+".meta.json", fullPath+".meta", true)
+	return f, true, err
+}
+
+// addBytes adds a file built in memory
+func (b *exportBuilder) addBytes(name string, data []byte, manifest bool) error {
+	w, err := b.archive.add(name, int64(len(data)), b.manifest.Created, true)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if manifest {
+		sum := sha256.Sum256(data)
+		b.added[name] = true
+		b.manifest.Files = append(b.manifest.Files, ExportFile{Name: name, Bytes: int64(len(data)), SHA256: hex.EncodeToString(sum[:])})
+	}
+	return nil
+}
+
+// addRecording adds a recording with everything stored about it
+func (b *exportBuilder) addRecording(object string) error {
+	video, ok, err := b.addObject(object, false)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("recording %s: %w", object, os.ErrNotExist)
+	}
+	b.manifest.Recordings = append(b.manifest.Recordings, ExportRecording{
+		ID: recordingID(object), Object: object, Bytes: video.Bytes, SHA256: video.SHA256,
+	})
+
+	for _, suffix := range []string{"bookmarks.json", "gnss.json"} {
+		if _, _, err := b.addObject(strings.TrimSuffix(object, ".mkv")+"."+suffix, true); err != nil {
+			return err
+		}
+	}
+
+	rec, err := loadRecording(object)
+	if err != nil {
+		return err
+	}
+	aggregate, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := b.addBytes(object+".recording.json", aggregate, true); err != nil {
+		return err
+	}
+
+	parties := []struct {
+		container string
+		party     *RecordingParty
+	}{{"Users", rec.Bearer}, {"Devices", rec.Device}, {"System", rec.System}}
+	for _, p := range parties {
+		if p.party == nil || !p.party.Found {
+			continue
+		}
+		if _, _, err := b.addObject(p.container+"/"+p.party.ID, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeExport writes the package of objects to w and returns its manifest and the
+// SHA-256 of manifest.json
+func writeExport(w io.Writer, objects []string, format string, key ed25519.PrivateKey) (*ExportManifest, string, error) {
+	archive, err := newExportArchive(w, format)
+	if err != nil {
+		return nil, "", err
+	}
+	b := &exportBuilder{
+		archive:  archive,
+		manifest: ExportManifest{Created: time.Now().UTC(), Account: StorageAccount, Files: []ExportFile{}},
+		added:    map[string]bool{},
+		audited:  map[string]bool{},
+	}
+	for _, object := range objects {
+		if err := b.addRecording(object); err != nil {
+			return nil, "", err
+		}
+	}
+
+	lines, err := auditExcerpt(b.audited)
+	if err != nil {
+		return nil, "", fmt.Errorf("read audit log: %w", err)
+	}
+	var audit bytes.Buffer
+	for _, line := range lines {
+		audit.Write(line)
+		audit.WriteByte('\n')
+	}
+	if err := b.addBytes(exportAuditName, audit.Bytes(), true); err != nil {
+		return nil, "", err
+	}
+
+	manifest, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return nil, "", err
+	}
+	if err := b.addBytes(exportManifestName, manifest, false); err != nil {
+		return nil, "", err
+	}
+	if key != nil {
+		sig, _ := json.MarshalIndent(ExportSignature{
+			Algorithm: "Ed25519",
+			PublicKey: exportPublicKey(key),
+			Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, manifest)),
+		}, "", "  ")
+		if err := b.addBytes(exportSignatureName, sig, false); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(manifest)
+	return &b.manifest, hex.EncodeToString(sum[:]), nil
+}
+
+// exportAuditEntries returns the audit entries recording that objects were exported
+func exportAuditEntries(objects []string, manifestSum, format string, signed bool) []AuditEntry {
+	if format == "" {
+		format = "zip"
+	}
+	var entries []AuditEntry
+	for _, object := range objects {
+		entries = append(entries, AuditEntry{
+			Action: AuditRecordingExported,
+			Path:   object,
+			Details: map[string]string{
+				"manifest_sha256": manifestSum,
+				"format":          format,
+				"signed":          fmt.Sprint(signed),
+			},
+		})
+	}
+	return entries
+}
+
+// ExportRecordings writes the evidence package of req to w, signing it with key when
+// it isn't nil, and records the export in the audit log
+func ExportRecordings(w io.Writer, req ExportRequest, key ed25519.PrivateKey) (*ExportManifest, error) {
+	objects, err := exportObjects(req.Recordings)
+	if err != nil {
+		return nil, err
+	}
+	manifest, sum, err := writeExport(w, objects, req.Format, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range exportAuditEntries(objects, sum, req.Format, key != nil) {
+		e.Details["via"] = "bodyworn-export"
+		recordAudit(e)
+	}
+	return manifest, nil
+}
+
+// ExportsHandler serves POST /api/exports, which returns the package for a JSON
+// ExportRequest, and GET /api/exports/key with the public key packages are signed with
+func ExportsHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLogger(r)
+	if strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/exports"), "/") == "key" {
+		if ExportKey == nil {
+			http.Error(w, "Exports are not signed", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"algorithm": "Ed25519", "public_key": exportPublicKey(ExportKey)})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ExportRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "Invalid export request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := newExportArchive(io.Discard, req.Format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	objects, err := exportObjects(req.Recordings)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := req.Format
+	if format == "" {
+		format = "zip"
+	}
+	contentType := map[string]string{"zip": "application/zip", "tar": "application/x-tar"}[format]
+	name := fmt.Sprintf("evidence-%s.%s", time.Now().UTC().Format("20060102T150405Z"), format)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+
+	start := time.Now()
+	manifest, sum, err := writeExport(w, objects, format, ExportKey)
+	if err != nil {
+		// The archive is already being sent, so the client sees a truncated download
+		log.Log(Error, "export failed", "recordings", len(objects), "error", err)
+		return
+	}
+	for _, e := range exportAuditEntries(objects, sum, format, ExportKey != nil) {
+		auditRequest(r, e.Action, e.Path, 0, e.Details)
+	}
+	log.Log(Info, "evidence package exported", "recordings", len(objects), "files", len(manifest.Files),
+		"format", format, "signed", ExportKey != nil, "manifest_sha256", sum, "duration_ms", time.Since(start).Milliseconds())
+}
+
+// ExportVerification is the result of checking a package
+type ExportVerification struct {
+	Manifest  *ExportManifest `json:"manifest"`
+	Signed    bool            `json:"signed"`
+	PublicKey string          `json:"public_key,omitempty"`
+	Problems  []string        `json:"problems"`
+}
+
+// VerifyExport checks that every file of the package at path matches the manifest
+// and that the manifest signature, if any, is valid
+func VerifyExport(path string) (*ExportVerification, error) {
+	files := map[string]ExportFile{}
+	var manifestData, sigData []byte
+	visit := func(name string, r io.Reader) error {
+		switch name {
+		case exportManifestName, exportSignatureName:
+			data, err := io.ReadAll(r)
+			if name == exportManifestName {
+				manifestData = data
+			} else {
+				sigData = data
+			}
+			return err
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, r)
+		files[name] = ExportFile{Name: name, Bytes: n, SHA256: hex.EncodeToString(h.Sum(nil))}
+		return err
+	}
+	if err := readExportArchive(path, visit); err != nil {
+		return nil, err
+	}
+	if manifestData == nil {
+		return nil, fmt.Errorf("%s has no %s", path, exportManifestName)
+	}
+
+	v := &ExportVerification{Problems: []string{}}
+	if err := json.Unmarshal(manifestData, &v.Manifest); err != nil {
+		return nil, fmt.Errorf("%s: %w", exportManifestName, err)
+	}
+	for _, want := range v.Manifest.Files {
+		got, ok := files[want.Name]
+		switch {
+		case !ok:
+			v.Problems = append(v.Problems, want.Name+": missing")
+		case got.SHA256 != want.SHA256 || got.Bytes != want.Bytes:
+			v.Problems = append(v.Problems, want.Name+": content differs from the manifest")
+		}
+		delete(files, want.Name)
+	}
+	var extra []string
+	for name := range files {
+		extra = append(extra, name)
+	}
+	sort.Strings(extra)
+	for _, name := range extra {
+		v.Problems = append(v.Problems, name+": not in the manifest")
+	}
+
+	if sigData != nil {
+		var sig ExportSignature
+		if err := json.Unmarshal(sigData, &sig); err != nil {
+			return nil, fmt.Errorf("%s: %w", exportSignatureName, err)
+		}
+		v.Signed, v.PublicKey = true, sig.PublicKey
+		pub, err1 := base64.StdEncoding.DecodeString(sig.PublicKey)
+		signature, err2 := base64.StdEncoding.DecodeString(sig.Signature)
+		if err1 != nil || err2 != nil || len(pub) != ed25519.PublicKeySize || !ed25519.Verify(pub, manifestData, signature) {
+			v.Problems = append(v.Problems, exportSignatureName+": signature doesn't match the manifest")
+		}
+	}
+	return v, nil
+}
+
+// readExportArchive calls visit for every file of a ZIP or tar package
+func readExportArchive(path string, visit func(name string, r io.Reader) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if string(magic) == "PK\x03\x04" {
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		zr, err := zip.NewReader(file, info.Size())
+		if err != nil {
+			return err
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			err = visit(f.Name, rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tr := tar.NewReader(file)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if h.Typeflag == tar.TypeReg {
+			if err := visit(h.Name, tr); err != nil {
+				return err
+			}
+		}
+	}
+}
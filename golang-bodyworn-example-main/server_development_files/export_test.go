@@ -0,0 +1,215 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readTestExport returns the files of the package at path
+func readTestExport(t *testing.T, path string) map[string][]byte {
+	t.Helper()
+	files := map[string][]byte{}
+	err := readExportArchive(path, func(name string, r io.Reader) error {
+		data, err := io.ReadAll(r)
+		files[name] = data
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// writeTestTar writes files as a tar package in the order of names
+func writeTestTar(t *testing.T, path string, names []string, files map[string][]byte) {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg})
+		tw.Write(files[name])
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// storeTestEvidence stores a recording with a GNSS track and a known bearer
+func storeTestEvidence(t *testing.T, url, token string) {
+	t.Helper()
+	storage := url + "/v1.0/" + StorageAccount
+	request(t, http.MethodPut, storage+"/CamA", token, nil, nil)
+	for object, header := range map[string]map[string]string{
+		"Users/u1":            nil,
+		"CamA/clip.mkv":       {"X-Object-Meta-UserID": "u1", "X-Object-Meta-Case": "1234"},
+		"CamA/clip.gnss.json": nil,
+		"CamA/other.mkv":      nil,
+	} {
+		if code := request(t, http.MethodPut, storage+"/"+object, token, header, strings.NewReader("content of "+object)); code != http.StatusCreated {
+			t.Fatalf("PUT %s: %d", object, code)
+		}
+	}
+	recordAudit(AuditEntry{Action: "test.viewed", Path: "CamA/clip.mkv"})
+	recordAudit(AuditEntry{Action: "test.viewed", Path: "CamA/other.mkv"})
+}
+
+func TestExportPackage(t *testing.T) {
+	url := startTestServer(t)
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	storeTestEvidence(t, url, admin)
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	ExportKey = key
+	defer func() { ExportKey = nil }()
+
+	req, _ := http.NewRequest(http.MethodPost, url+"/api/exports", strings.NewReader(`{"recordings":["`+recordingID("CamA/clip.mkv")+`"]}`))
+	req.Header.Set("X-Auth-Token", admin)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/zip" {
+		t.Fatalf("export: %s %s", resp.Status, content)
+	}
+	path := filepath.Join(t.TempDir(), "case.zip")
+	os.WriteFile(path, content, 0644)
+
+	v, err := VerifyExport(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Problems) != 0 || !v.Signed || v.PublicKey != exportPublicKey(key) {
+		t.Errorf("verification: %+v", v)
+	}
+	files := readTestExport(t, path)
+	for _, name := range []string{"CamA/clip.mkv", "CamA/clip.mkv.meta.json", "CamA/clip.gnss.json",
+		"CamA/clip.gnss.json.meta.json", "CamA/clip.mkv.recording.json", "Users/u1", exportAuditName, exportManifestName, exportSignatureName} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("%s not in the package", name)
+		}
+	}
+	if _, ok := files["CamA/other.mkv"]; ok {
+		t.Error("recording that wasn't selected is in the package")
+	}
+	if string(files["CamA/clip.mkv"]) != "content of CamA/clip.mkv" || !strings.Contains(string(files["CamA/clip.mkv.meta.json"]), "1234") {
+		t.Errorf("recording %q, metadata %s", files["CamA/clip.mkv"], files["CamA/clip.mkv.meta.json"])
+	}
+	if audit := string(files[exportAuditName]); !strings.Contains(audit, `"path":"CamA/clip.mkv"`) || strings.Contains(audit, "other.mkv") {
+		t.Errorf("audit excerpt:\n%s", audit)
+	}
+	if len(v.Manifest.Recordings) != 1 || v.Manifest.Recordings[0].SHA256 == "" || v.Manifest.Recordings[0].Object != "CamA/clip.mkv" {
+		t.Errorf("manifest recordings %+v", v.Manifest.Recordings)
+	}
+
+	// The export itself is audited
+	lines, err := auditExcerpt(map[string]bool{"CamA/clip.mkv": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last AuditEntry
+	json.Unmarshal(lines[len(lines)-1], &last)
+	if last.Action != AuditRecordingExported || last.User != AuthUser || last.Details["signed"] != "true" || last.Details["manifest_sha256"] == "" {
+		t.Errorf("export audit entry %+v", last)
+	}
+
+	code, body := do(t, http.MethodGet, url+"/api/exports/key", admin, "")
+	if code != http.StatusOK || !strings.Contains(body, exportPublicKey(key)) {
+		t.Errorf("key: %d %s", code, body)
+	}
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"recordings":["CamA/missing.mkv"]}`, http.StatusNotFound},
+		{`{"recordings":["CamA/clip.mkv"],"format":"rar"}`, http.StatusBadRequest},
+		{`{"recordings":[]}`, http.StatusBadRequest},
+		{`{"recordings":["../etc/passwd.mkv"]}`, http.StatusBadRequest},
+	} {
+		if code, body := do(t, http.MethodPost, url+"/api/exports", admin, tc.body); code != tc.want {
+			t.Errorf("%s: %d %s, want %d", tc.body, code, body, tc.want)
+		}
+	}
+	ExportKey = nil
+	if code, _ := do(t, http.MethodGet, url+"/api/exports/key", admin, ""); code != http.StatusNotFound {
+		t.Errorf("key without signing: %d, want 404", code)
+	}
+}
+
+func TestExportTampering(t *testing.T) {
+	url := startTestServer(t)
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	storeTestEvidence(t, url, admin)
+	keyPath := filepath.Join(t.TempDir(), "export.pem")
+	key, err := LoadExportKey(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "case.tar")
+	out, _ := os.Create(path)
+	if _, err := ExportRecordings(out, ExportRequest{Recordings: []string{"CamA/clip.mkv"}, Format: "tar"}, key); err != nil {
+		t.Fatal(err)
+	}
+	out.Close()
+	files := readTestExport(t, path)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+
+	check := func(label string, files map[string][]byte, want ...string) {
+		t.Helper()
+		tampered := filepath.Join(dir, "tampered.tar")
+		writeTestTar(t, tampered, names, files)
+		v, err := VerifyExport(tampered)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(v.Problems, "; ") != strings.Join(want, "; ") {
+			t.Errorf("%s: %q, want %q", label, v.Problems, want)
+		}
+	}
+	check("untouched", files)
+	all := names
+	names = []string{"extra.txt"}
+	for _, name := range all {
+		if name != "Users/u1" {
+			names = append(names, name)
+		}
+	}
+	check("files removed and added", files, "Users/u1: missing", "extra.txt: not in the manifest")
+	names = all
+
+	edited := map[string][]byte{}
+	for name, data := range files {
+		edited[name] = data
+	}
+	edited["CamA/clip.mkv"] = []byte("content of CamA/clip.mkV")
+	check("edited recording", edited, "CamA/clip.mkv: content differs from the manifest")
+
+	// Editing the manifest breaks its signature
+	var manifest ExportManifest
+	json.Unmarshal(files[exportManifestName], &manifest)
+	edited[exportManifestName] = bytes.Replace(files[exportManifestName], []byte(manifest.Recordings[0].SHA256), []byte(strings.Repeat("0", 64)), -1)
+	edited["CamA/clip.mkv"] = files["CamA/clip.mkv"]
+	check("edited manifest", edited, "CamA/clip.mkv: content differs from the manifest", exportSignatureName+": signature doesn't match the manifest")
+
+	// The key is kept once created
+	if again, err := LoadExportKey(keyPath); err != nil || !again.Equal(key) {
+		t.Errorf("reloaded key differs: %v", err)
+	}
+}
@@ -2,22 +2,22 @@ package server
 
 import (
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net"
 	"os"
 	"path/filepath"
-	
 )
 
 const (
 	LocalConnectionFilePath = "./connection.json"
 )
 
-//this function is used to automatically assign local IP address that will be used in connection file
-func getServerIP() string {
+// this function is used to automatically assign local IP address that will be used in connection file
+func getServerIP() (string, error) {
 	interfaces, err := net.Interfaces()
 	if err != nil {
-		log.Fatalf("Error fetching interfaces: %v", err)
+		return "", fmt.Errorf("fetch interfaces: %w", err)
 	}
 
 	for _, iface := range interfaces {
@@ -25,107 +25,96 @@ func getServerIP() string {
 		if iface.Flags&net.FlagUp != 0 && iface.Name != "lo" {
 			addrs, err := iface.Addrs()
 			if err != nil {
-				log.Fatalf("Error getting addresses for interface %s: %v", iface.Name, err)
+				return "", fmt.Errorf("get addresses for interface %s: %w", iface.Name, err)
 			}
 			for _, addr := range addrs {
 				// Try to find an IPv4 address
 				if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
-					log.Printf("Function getServerIP providing IP address for connection file and authentication requests")
-					return ipnet.IP.String()
+					getLogger().Log(Debug, "server IP selected for connection file", "interface", iface.Name, "ip", ipnet.IP.String())
+					return ipnet.IP.String(), nil
 				}
 			}
 		}
 	}
-	log.Fatal("No valid non-loopback interface found")
-	
-	return ""
-	
+	return "", errors.New("no valid non-loopback interface found")
 }
 
-
-
-
-
 // getCapabilitiesJSON returns Capabilities.json content as a JSON byte slice
 func getCapabilitiesJSON() []byte {
-	log.Printf("Function getCapabilitiesJSON returing Capabilities.json content as a JSON byte slice")
-	
+	getLogger().Debugf("Function getCapabilitiesJSON returing Capabilities.json content as a JSON byte slice")
+
 	capabilities := map[string]interface{}{
 		"StoreAndRead": map[string]bool{
 			"StoreReadSystemID":       true,
-			"StoreUserIDKey":      	   true,
+			"StoreUserIDKey":          true,
 			"StoreBookmarks":          true,
 			"StoreSignedVideo":        true,
 			"StoreGNSSTrackRecording": true,
-			"StoreRejectedContent": true,
+			"StoreRejectedContent":    true,
 		},
 	}
 	file, _ := json.MarshalIndent(capabilities, "", "  ")
 	return file
 }
 
-// getConnectionJSON returns connection.json content as a JSON byte slice
-func getConnectionJSON() []byte {
-	logger.Infof("Generating content for connection.json...")
+// getConnectionJSON returns connection.json content for creds as a JSON byte slice
+func getConnectionJSON(creds Credentials) ([]byte, error) {
+	getLogger().Infof("Generating content for connection.json...")
 
 	// Get the server IP dynamically
-	serverIP := getServerIP()
+	serverIP, err := getServerIP()
+	if err != nil {
+		return nil, err
+	}
 
 	// Update the AuthenticationTokenURI to use the dynamically fetched IP address
 	connection := map[string]interface{}{
-		"ConnectionFileVersion":        "1.0",
-		"SiteName":                     "Axis Body Worn",
-		"ApplicationName":              "BodyWornAPI",
-		"ApplicationVersion":           "1.0",
-		"AuthenticationTokenURI":       []string{"http://" + serverIP + ":8080/auth/v1.0"},
-		"BlobAPIKey":                   AuthPassword,
-		"BlobAPIUserName":              AuthUser,
-		"ContainerType":                "mkv",
-		"WantEncryption":      false,
-		"PublicKey":      "",
-		"PublicKeyId":      "",
-		"FullStoreAndReadSupport":      true,  
+		"ConnectionFileVersion":   "1.0",
+		"SiteName":                "Axis Body Worn",
+		"ApplicationName":         "BodyWornAPI",
+		"ApplicationVersion":      "1.0",
+		"AuthenticationTokenURI":  []string{"http://" + serverIP + ":8080/auth/v1.0"},
+		"BlobAPIKey":              creds.Key,
+		"BlobAPIUserName":         creds.User,
+		"ContainerType":           "mkv",
+		"WantEncryption":          false,
+		"PublicKey":               "",
+		"PublicKeyId":             "",
+		"FullStoreAndReadSupport": true,
 	}
 
 	//Note FullStoreAndReadSupport cannot be true unless using HEAD and GET configure in applcaiton. If you try to load a connection without you will recieve an error
-	// FullStoreAndReadSupport if true will allow you to receive the meta for your system folder providing connectionID and name of the W800 that loaded the connection 
+	// FullStoreAndReadSupport if true will allow you to receive the meta for your system folder providing connectionID and name of the W800 that loaded the connection
 	// file to connect to content destination but if you don't have HEAD support in your application you will receive an error
 
-
-
-
 	// Marshal the connection map to JSON
-	file, _ := json.MarshalIndent(connection, "", "  ")
-	return file
+	return json.MarshalIndent(connection, "", "  ")
 }
 
-
 // createLocalCapabilitiesFile creates Capabilities.json in the local filesystem
-func createLocalCapabilitiesFile() {
-	log.Printf("Function createLocalCapabilitiesFile creatingCapabilities.json in the local filesystem ")
+func createLocalCapabilitiesFile() error {
 	content := getCapabilitiesJSON()
 	capabilitiesPath := filepath.Join(LocalStoragePath, StorageAccount, "System", "Capabilities.json")
-	writeFile(capabilitiesPath, content)
+	return writeFile(capabilitiesPath, content)
 }
 
 // createLocalConnectionFile creates connection.json in the root directory
-func createLocalConnectionFile() {
-	content := getConnectionJSON()
-
-	// Dynamically get the project root directory
-	rootDir, err := os.Getwd()
+func createLocalConnectionFile() error {
+	content, err := getConnectionJSON(currentCredentials())
 	if err != nil {
-		logger.Errorf("Failed to get current directory: %v", err)
-		return
+		getLogger().Errorf("Failed to generate %s: %v", ConnectionFile, err)
+		return err
 	}
 
-	connectionFilePath := filepath.Join(rootDir, "connection.json")
+	// connection.json sits in the root directory, next to the account
+	connectionFilePath := filepath.Join(LocalStoragePath, ConnectionFile)
 
-	logger.Infof("Creating local %s...", ConnectionFile)
+	getLogger().Infof("Creating local %s...", ConnectionFile)
 	err = os.WriteFile(connectionFilePath, content, 0644)
 	if err != nil {
-		logger.Errorf("Failed to create local %s: %v", ConnectionFile, err)
-		return
+		getLogger().Errorf("Failed to create local %s: %v", ConnectionFile, err)
+		return err
 	}
-	logger.Infof("Local %s created successfully at %s", ConnectionFile, connectionFilePath)
-}
\ No newline at end of file
+	getLogger().Infof("Local %s created successfully at %s", ConnectionFile, connectionFilePath)
+	return nil
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// HealthMinFreeBytes is the free space below which the server is reported not ready
+var HealthMinFreeBytes uint64 = 1 << 30
+
+// HealthCheckResult is the outcome of a single check in a /healthz or /readyz response
+type HealthCheckResult struct {
+	Name       string  `json:"name"`
+	Status     string  `json:"status"`
+	Detail     string  `json:"detail,omitempty"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// HealthReport is the JSON body returned by /healthz and /readyz
+type HealthReport struct {
+	Status string              `json:"status"`
+	Checks []HealthCheckResult `json:"checks"`
+}
+
+type namedCheck struct {
+	name  string
+	check func() error
+}
+
+var (
+	readinessChecksMu sync.Mutex
+	readinessChecks   []namedCheck
+)
+
+// RegisterReadinessCheck adds a check, such as an index consistency check, to /readyz.
+// The expirer and the webhook and replication queues register theirs when started.
+func RegisterReadinessCheck(name string, check func() error) {
+	readinessChecksMu.Lock()
+	defer readinessChecksMu.Unlock()
+	readinessChecks = append(readinessChecks, namedCheck{name: name, check: check})
+}
+
+// livenessChecks are cheap checks that tell the orchestrator the process can still
+// serve. Low free space isn't one: restarting the process doesn't free any.
+func livenessChecks() []namedCheck {
+	return []namedCheck{
+		{"storage_writable", checkStorageWritable},
+	}
+}
+
+// allReadinessChecks adds free space, the storage layout checks and any registered checks
+func allReadinessChecks() []namedCheck {
+	checks := append(livenessChecks(),
+		namedCheck{"free_space", checkFreeSpace},
+		namedCheck{"required_containers", checkRequiredContainers},
+		namedCheck{"capabilities", checkCapabilitiesFile},
+		namedCheck{"accepting_requests", checkNotShuttingDown},
+	)
+	readinessChecksMu.Lock()
+	defer readinessChecksMu.Unlock()
+	return append(checks, readinessChecks...)
+}
+
+// checkStorageWritable creates and removes a scratch file in the storage root
+func checkStorageWritable() error {
+	root := filepath.Join(LocalStoragePath, StorageAccount)
+	f, err := os.CreateTemp(root, ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, werr := f.Write([]byte("ok"))
+	cerr := f.Close()
+	rerr := os.Remove(name)
+	return errors.Join(werr, cerr, rerr)
+}
+
+// checkFreeSpace fails when less than HealthMinFreeBytes are available
+func checkFreeSpace() error {
+	space, err := diskSpace(filepath.Join(LocalStoragePath, StorageAccount))
+	if errors.Is(err, errDiskSpaceUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if space.Free < HealthMinFreeBytes {
+		return fmt.Errorf("%d bytes free, below threshold of %d", space.Free, HealthMinFreeBytes)
+	}
+	return nil
+}
+
+// checkRequiredContainers verifies the containers the body worn system expects exist
+func checkRequiredContainers() error {
+	var missing []error
+	for _, container := range []string{"System", "Users", "Devices"} {
+		info, err := os.Stat(filepath.Join(LocalStoragePath, StorageAccount, container))
+		if err != nil {
+			missing = append(missing, fmt.Errorf("container %s: %w", container, err))
+		} else if !info.IsDir() {
+			missing = append(missing, fmt.Errorf("container %s is not a directory", container))
+		}
+	}
+	return errors.Join(missing...)
+}
+
+// checkCapabilitiesFile verifies System/Capabilities.json exists and is valid JSON
+func checkCapabilitiesFile() error {
+	content, err := os.ReadFile(filepath.Join(LocalStoragePath, StorageAccount, "System", "Capabilities.json"))
+	if err != nil {
+		return err
+	}
+	if !json.Valid(content) {
+		return errors.New("Capabilities.json is not valid JSON")
+	}
+	return nil
+}
+
+// runHealthChecks executes checks and builds the report
+func runHealthChecks(checks []namedCheck) HealthReport {
+	report := HealthReport{Status: "ok", Checks: make([]HealthCheckResult, 0, len(checks))}
+	for _, c := range checks {
+		start := time.Now()
+		err := c.check()
+		result := HealthCheckResult{
+			Name:       c.name,
+			Status:     "ok",
+			DurationMs: float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if err != nil {
+			result.Status = "fail"
+			result.Detail = err.Error()
+			report.Status = "fail"
+		}
+		report.Checks = append(report.Checks, result)
+	}
+	return report
+}
+
+func writeHealthReport(w http.ResponseWriter, r *http.Request, report HealthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, c := range report.Checks {
+			if c.Status != "ok" {
+				requestLogger(r).Log(Warning, "health check failed", "path", r.URL.Path, "check", c.Name, "detail", c.Detail)
+			}
+		}
+	}
+	if r.Method != http.MethodHead {
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// HealthzHandler reports whether the server is alive and can still write to storage
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, r, runHealthChecks(livenessChecks()))
+}
+
+// ReadyzHandler reports whether there is room for uploads, the storage layout is
+// complete and the registered indexes and queues are usable
+func ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, r, runHealthChecks(allReadinessChecks()))
+}
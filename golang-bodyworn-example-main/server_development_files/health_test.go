@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// probe calls handler and returns the status and the failed checks
+func probe(t *testing.T, handler http.HandlerFunc) (int, map[string]string) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	var report HealthReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("report %q: %v", w.Body.String(), err)
+	}
+	failed := map[string]string{}
+	for _, c := range report.Checks {
+		if c.Status != "ok" {
+			failed[c.Name] = c.Detail
+		}
+	}
+	if (report.Status == "ok") != (len(failed) == 0) {
+		t.Errorf("status %q with failed checks %v", report.Status, failed)
+	}
+	return w.Code, failed
+}
+
+func TestHealthProbes(t *testing.T) {
+	startTestServer(t)
+	t.Cleanup(func() { shuttingDown.Store(false) })
+	for name, handler := range map[string]http.HandlerFunc{"healthz": HealthzHandler, "readyz": ReadyzHandler} {
+		if code, failed := probe(t, handler); code != http.StatusOK {
+			t.Errorf("%s: %d %v", name, code, failed)
+		}
+	}
+
+	// Low free space makes the server not ready, but not dead: a restart won't help
+	saved := HealthMinFreeBytes
+	HealthMinFreeBytes = 1 << 62
+	if code, failed := probe(t, HealthzHandler); code != http.StatusOK {
+		t.Errorf("healthz with little free space: %d %v", code, failed)
+	}
+	if _, err := diskSpace(LocalStoragePath); err == nil {
+		if code, failed := probe(t, ReadyzHandler); code != http.StatusServiceUnavailable || failed["free_space"] == "" {
+			t.Errorf("readyz with little free space: %d %v", code, failed)
+		}
+	}
+	HealthMinFreeBytes = saved
+
+	os.Remove(filepath.Join(LocalStoragePath, StorageAccount, "System", "Capabilities.json"))
+	BeginShutdown()
+	code, failed := probe(t, ReadyzHandler)
+	if _, ok := failed["capabilities"]; code != http.StatusServiceUnavailable || !ok || failed["accepting_requests"] == "" {
+		t.Errorf("readyz without capabilities while shutting down: %d %v", code, failed)
+	}
+	if code, failed := probe(t, HealthzHandler); code != http.StatusOK {
+		t.Errorf("healthz while shutting down: %d %v", code, failed)
+	}
+
+	// Unwritable storage fails both
+	os.RemoveAll(filepath.Join(LocalStoragePath, StorageAccount))
+	for name, handler := range map[string]http.HandlerFunc{"healthz": HealthzHandler, "readyz": ReadyzHandler} {
+		if code, failed := probe(t, handler); code != http.StatusServiceUnavailable || failed["storage_writable"] == "" {
+			t.Errorf("%s without storage: %d %v", name, code, failed)
+		}
+	}
+}
+
+func TestReadinessChecks(t *testing.T) {
+	startTestServer(t)
+	readinessChecksMu.Lock()
+	saved := readinessChecks
+	readinessChecks = nil
+	readinessChecksMu.Unlock()
+	t.Cleanup(func() {
+		readinessChecksMu.Lock()
+		readinessChecks = saved
+		readinessChecksMu.Unlock()
+	})
+
+	q, err := openDiskQueue(filepath.Join(t.TempDir(), "queue"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RegisterReadinessCheck("test_queue", q.writable)
+	RegisterReadinessCheck("expiry_index", func() error { return checkExpiryIndex(time.Now().Add(-time.Hour)) })
+	if code, failed := probe(t, ReadyzHandler); code != http.StatusOK {
+		t.Errorf("readyz: %d %v", code, failed)
+	}
+	if depth := q.depth(); depth != 0 {
+		t.Errorf("the queue check left %d items", depth)
+	}
+
+	// An expiry index the expirer doesn't keep up with, and a queue that can't be written
+	expiryMu.Lock()
+	expiryIndex["System/late.mkv"] = time.Now().Add(-2 * time.Hour).Unix()
+	expiryIndex["System/soon.mkv"] = time.Now().Add(-time.Minute).Unix()
+	expiryMu.Unlock()
+	os.RemoveAll(q.dir)
+	code, failed := probe(t, ReadyzHandler)
+	if code != http.StatusServiceUnavailable || !strings.Contains(failed["expiry_index"], "1 objects overdue for deletion, e.g. System/late.mkv") || failed["test_queue"] == "" {
+		t.Errorf("readyz: %d %v", code, failed)
+	}
+	if code, failed := probe(t, HealthzHandler); code != http.StatusOK {
+		t.Errorf("healthz with failed readiness checks: %d %v", code, failed)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startTestServer serves a fresh storage directory as main does and returns its URL
+func startTestServer(t *testing.T) string {
+	t.Helper()
+	LocalStoragePath = t.TempDir()
+	UploadReserveBytes = 0
+	CORSOrigins = nil
+	containerStatsMu.Lock()
+	containerStatsCache = make(map[string]containerStat)
+	containerStatsMu.Unlock()
+	expiryMu.Lock()
+	expiryIndex = map[string]int64{}
+	expiryMu.Unlock()
+	auditMu.Lock()
+	if auditFile != nil {
+		auditFile.Close()
+	}
+	auditFile, auditPrev = nil, ""
+	auditMu.Unlock()
+	tieringMu.Lock()
+	tiering, tierLastRun = nil, nil
+	tieringMu.Unlock()
+	scrubMu.Lock()
+	scrubLast = nil
+	scrubMu.Unlock()
+	SetLogger(&DefaultLogger{Out: io.Discard, MinLevel: Error})
+	for _, container := range []string{"System", "Users", "Devices"} {
+		if err := os.MkdirAll(filepath.Join(LocalStoragePath, StorageAccount, container), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := createLocalCapabilitiesFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/auth/v1.0", AuthHandler)
+	mux.HandleFunc("/v3/", KeystoneHandler)
+	mux.HandleFunc("/api/accounts", RequireRole(AccountsHandler))
+	mux.HandleFunc("/api/accounts/", RequireRole(AccountsHandler))
+	mux.HandleFunc("/api/recordings", RequireRole(RecordingsAPIHandler, RoleReviewer))
+	mux.HandleFunc("/api/recordings/", RequireRole(RecordingsAPIHandler, RoleReviewer))
+	exports := RequireRole(ExportsHandler, RoleReviewer)
+	mux.HandleFunc("/api/exports", exports)
+	mux.HandleFunc("/api/exports/", exports)
+	replication := RequireRole(ReplicationHandler)
+	mux.HandleFunc("/api/replication", replication)
+	mux.HandleFunc("/api/replication/", replication)
+	tieringAPI := RequireRole(TieringHandler)
+	mux.HandleFunc("/api/tiering", tieringAPI)
+	mux.HandleFunc("/api/tiering/", tieringAPI)
+	scrub := RequireRole(ScrubHandler)
+	mux.HandleFunc("/api/scrub", scrub)
+	mux.HandleFunc("/api/scrub/", scrub)
+	mux.HandleFunc("/metrics", RequireRole(MetricsHandler, RoleReviewer))
+	mux.HandleFunc("/events", RequireRole(EventsHandler, RoleReviewer))
+	mux.HandleFunc(fmt.Sprintf("/v1.0/%s", StorageAccount), StorageHandler)
+	mux.HandleFunc(fmt.Sprintf("/v1.0/%s/", StorageAccount), StorageHandler)
+	ts := httptest.NewUnstartedServer(WithRawHeaders(WithRequestLogging(WithCORS(mux))))
+	ts.Listener = RawHeaderListener(ts.Listener)
+	ts.Config.ConnContext = RawHeaderConnContext
+	ts.Start()
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+// signIn authenticates as user and returns the token
+func signIn(t *testing.T, url, user, key string) string {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url+"/auth/v1.0", nil)
+	req.Header.Set("X-Auth-User", user)
+	req.Header.Set("X-Auth-Key", key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("sign in as %s: %s", user, resp.Status)
+	}
+	if resp.Header.Get("X-Auth-Token-Expires") == "" {
+		t.Error("no X-Auth-Token-Expires")
+	}
+	return resp.Header.Get("X-Auth-Token")
+}
+
+// do sends a request with token and returns the status and body
+func do(t *testing.T, method, url, token, body string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("X-Auth-Token", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	content, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(content)
+}
+
+// request sends method to url with token, headers and body, returning the status
+func request(t *testing.T, method, url, token string, header map[string]string, body io.Reader) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, body)
+	if token != "" {
+		req.Header.Set("X-Auth-Token", token)
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// send sends method to url with header as given, keeping the spelling of its names,
+// and returns the response with its body read
+func send(t *testing.T, method, url, token string, header http.Header, body string) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if token != "" {
+		req.Header.Set("X-Auth-Token", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	content, _ := io.ReadAll(resp.Body)
+	return resp, string(content)
+}
+
+// addTestAccount adds an account with role through the accounts API and returns a token for it
+func addTestAccount(t *testing.T, url, admin, name string, role Role) string {
+	t.Helper()
+	code, body := do(t, http.MethodPost, url+"/api/accounts", admin, fmt.Sprintf(`{"name":%q,"role":%q,"key":%q}`, name, role, name+"-key"))
+	if code != http.StatusCreated {
+		t.Fatalf("add %s: %d %s", name, code, body)
+	}
+	return signIn(t, url, name, name+"-key")
+}
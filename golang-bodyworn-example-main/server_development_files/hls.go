@@ -0,0 +1,493 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"BodyWornAPI/fmp4"
+	"BodyWornAPI/mkv"
+)
+
+// Recordings are played in browsers through HLS with fragmented MP4 segments, remuxed
+// from the stored .mkv on every request without re-encoding:
+//
+//	/api/recordings/{id}/hls/master.m3u8  multivariant playlist with codecs and resolution
+//	/api/recordings/{id}/hls/index.m3u8   media playlist, one entry per segment
+//	/api/recordings/{id}/hls/init.mp4     initialization segment (ftyp, moov)
+//	/api/recordings/{id}/hls/{n}.m4s      media segment n (moof, mdat)
+//
+// Segments start at video keyframes, so every segment can be played on its own and
+// seeking loads only the segments around the new position. H.264 video and Opus audio
+// are supported; recordings with other codecs are answered with 415.
+
+// HLSSegmentDuration is the shortest segment; segments end at the first video keyframe after it
+var HLSSegmentDuration = 4 * time.Second
+
+// hlsInterleaveSlack is how far past a segment's end blocks are read to find audio
+// stored after the video it plays with
+const hlsInterleaveSlack = 5 * time.Second
+
+// Matroska codec IDs that can be remuxed
+const (
+	codecMKVH264 = "V_MPEG4/ISO/AVC"
+	codecMKVOpus = "A_OPUS"
+)
+
+var errUnsupportedCodec = errors.New("unsupported codec")
+
+// hlsTrack maps a Matroska track to its MP4 track
+type hlsTrack struct {
+	mkv  mkv.Track
+	mp4  fmp4.Track
+	main bool // segments are cut at this track's keyframes
+}
+
+// hlsSegment is a time range of the recording, relative to its first block
+type hlsSegment struct {
+	start, end time.Duration
+	cluster    int64 // first cluster holding blocks of the segment
+}
+
+// hlsIndex is the segmentation of one .mkv, cached by size and modification time
+type hlsIndex struct {
+	size     int64
+	modTime  time.Time
+	tracks   []hlsTrack
+	origin   int64 // timecode of the first block
+	scale    int64 // nanoseconds per timecode
+	segments []hlsSegment
+}
+
+var (
+	hlsIndexMu    sync.Mutex
+	hlsIndexCache = map[string]*hlsIndex{}
+)
+
+// hlsTracks picks the H.264 video and Opus audio tracks of f
+func hlsTracks(f *mkv.File) ([]hlsTrack, error) {
+	var video, audio *mkv.Track
+	for i := range f.Tracks {
+		t := &f.Tracks[i]
+		switch {
+		case t.Type == mkv.TrackVideo && video == nil:
+			video = t
+		case t.Type == mkv.TrackAudio && audio == nil && t.CodecID == codecMKVOpus:
+			audio = t
+		}
+	}
+	var tracks []hlsTrack
+	if video != nil {
+		if video.CodecID != codecMKVH264 {
+			return nil, fmt.Errorf("%w: video %s", errUnsupportedCodec, video.CodecID)
+		}
+		tracks = append(tracks, hlsTrack{mkv: *video, main: true, mp4: fmp4.Track{
+			ID: 1, Codec: fmp4.CodecH264, Timescale: 90000,
+			AVCConfig: video.CodecPrivate, Width: uint16(video.Width), Height: uint16(video.Height),
+		}})
+	}
+	if audio != nil {
+		tracks = append(tracks, hlsTrack{mkv: *audio, main: video == nil, mp4: fmp4.Track{
+			ID: uint32(len(tracks) + 1), Codec: fmp4.CodecOpus, Timescale: 48000,
+			OpusHead: audio.CodecPrivate,
+		}})
+	}
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("%w: no H.264 or Opus track", errUnsupportedCodec)
+	}
+	return tracks, nil
+}
+
+// track returns the index of the Matroska track number in x.tracks, or -1
+func (x *hlsIndex) track(number uint64) int {
+	for i := range x.tracks {
+		if x.tracks[i].mkv.Number == number {
+			return i
+		}
+	}
+	return -1
+}
+
+// blockTime returns a block's time relative to the first block
+func (x *hlsIndex) blockTime(b mkv.Block) time.Duration {
+	return time.Duration((b.Timecode - x.origin) * x.scale)
+}
+
+// duration returns the length of the recording
+func (x *hlsIndex) duration() time.Duration {
+	if len(x.segments) == 0 {
+		return 0
+	}
+	return x.segments[len(x.segments)-1].end
+}
+
+// frameDuration returns the duration of one frame of t, as far as it can be known from the frame itself
+func frameDuration(t *hlsTrack, frame []byte) time.Duration {
+	if t.mp4.Codec == fmp4.CodecOpus {
+		if samples := fmp4.OpusPacketDuration(frame); samples > 0 {
+			return time.Duration(samples) * time.Second / 48000
+		}
+	}
+	return t.mkv.DefaultDuration
+}
+
+// readHLSIndex returns the segmentation of the .mkv at path
+func readHLSIndex(path string, info os.FileInfo) (*hlsIndex, error) {
+	hlsIndexMu.Lock()
+	cached, ok := hlsIndexCache[path]
+	hlsIndexMu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	f, err := mkv.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	tracks, err := hlsTracks(f)
+	if err != nil {
+		return nil, err
+	}
+	x := &hlsIndex{size: info.Size(), modTime: info.ModTime(), tracks: tracks, origin: -1, scale: int64(f.TimecodeScale)}
+
+	// One pass collects the main track's keyframes and the time range of every cluster
+	type clusterSpan struct {
+		offset int64
+		last   int64 // latest timecode in the cluster
+	}
+	var keyframes []int64
+	var clusters []clusterSpan
+	var end int64 // in nanoseconds from timecode 0
+	err = f.Blocks(func(b mkv.Block) error {
+		i := x.track(b.Track)
+		if i < 0 {
+			return nil
+		}
+		t := &x.tracks[i]
+		if x.origin < 0 || b.Timecode < x.origin {
+			x.origin = b.Timecode
+		}
+		if n := len(clusters); n == 0 || clusters[n-1].offset != b.Cluster {
+			clusters = append(clusters, clusterSpan{offset: b.Cluster, last: b.Timecode})
+		} else if b.Timecode > clusters[n-1].last {
+			clusters[n-1].last = b.Timecode
+		}
+		if t.main && b.Keyframe {
+			keyframes = append(keyframes, b.Timecode)
+		}
+		blockEnd := b.Timecode * x.scale
+		if frames, err := b.Frames(); err == nil {
+			for _, frame := range frames {
+				blockEnd += int64(frameDuration(t, frame))
+			}
+		}
+		if blockEnd > end {
+			end = blockEnd
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if x.origin < 0 {
+		return x, nil
+	}
+
+	sort.Slice(keyframes, func(i, j int) bool { return keyframes[i] < keyframes[j] })
+	starts := []time.Duration{0}
+	for _, k := range keyframes {
+		t := time.Duration((k - x.origin) * x.scale)
+		if t-starts[len(starts)-1] >= HLSSegmentDuration {
+			starts = append(starts, t)
+		}
+	}
+	total := time.Duration(end - x.origin*x.scale)
+	for i, start := range starts {
+		seg := hlsSegment{start: start, end: total, cluster: clusters[0].offset}
+		if i+1 < len(starts) {
+			seg.end = starts[i+1]
+		}
+		// Start at the first cluster reaching into the segment; clusters are in time order
+		for _, c := range clusters {
+			if time.Duration((c.last-x.origin)*x.scale) >= start {
+				seg.cluster = c.offset
+				break
+			}
+		}
+		x.segments = append(x.segments, seg)
+	}
+
+	hlsIndexMu.Lock()
+	hlsIndexCache[path] = x
+	hlsIndexMu.Unlock()
+	return x, nil
+}
+
+// ticks converts d to units of timescale without overflowing on long recordings
+func ticks(d time.Duration, timescale uint32) int64 {
+	s := int64(time.Second)
+	return int64(d)/s*int64(timescale) + int64(d)%s*int64(timescale)/s
+}
+
+// hlsSample is a frame selected for a segment
+type hlsSample struct {
+	pts      time.Duration
+	keyframe bool
+	data     []byte
+}
+
+// buildSegment remuxes segment n of the .mkv at path
+func (x *hlsIndex) buildSegment(path string, n int) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	f, err := mkv.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	seg := x.segments[n]
+
+	// The main track takes whole GOPs in storage order: from the keyframe starting the
+	// segment up to the keyframe starting the next. Other tracks take the frames whose
+	// time falls into the segment.
+	samples := make([][]hlsSample, len(x.tracks))
+	mainStarted, mainDone := false, false
+	err = f.BlocksFrom(seg.cluster, func(b mkv.Block) error {
+		i := x.track(b.Track)
+		if i < 0 {
+			return nil
+		}
+		t := &x.tracks[i]
+		at := x.blockTime(b)
+		if at > seg.end+hlsInterleaveSlack {
+			return mkv.ErrStop
+		}
+		if t.main {
+			if mainDone {
+				return nil
+			}
+			if b.Keyframe && at >= seg.start {
+				if mainStarted && at >= seg.end && n+1 < len(x.segments) {
+					mainDone = true
+					return nil
+				}
+				mainStarted = true
+			}
+			if !mainStarted {
+				return nil
+			}
+		}
+		frames, err := b.Frames()
+		if err != nil {
+			return err
+		}
+		for _, frame := range frames {
+			if t.main || at >= seg.start && at < seg.end {
+				samples[i] = append(samples[i], hlsSample{pts: at, keyframe: b.Keyframe, data: frame})
+			}
+			at += frameDuration(t, frame)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var fragments []fmp4.Fragment
+	for i, t := range x.tracks {
+		if len(samples[i]) == 0 {
+			continue
+		}
+		if t.main {
+			fragments = append(fragments, mainFragment(t, samples[i], seg))
+		} else {
+			fragments = append(fragments, sideFragment(t, samples[i], seg))
+		}
+	}
+	return fmp4.MediaSegment(uint32(n+1), fragments), nil
+}
+
+// mainFragment orders the main track's frames by decode time. Matroska stores
+// presentation times only; the decode times are those same times sorted, which is
+// what the encoder's frame reordering produced.
+func mainFragment(t hlsTrack, samples []hlsSample, seg hlsSegment) fmp4.Fragment {
+	ts := t.mp4.Timescale
+	dts := make([]int64, len(samples))
+	for i, s := range samples {
+		dts[i] = ticks(s.pts, ts)
+	}
+	sort.Slice(dts, func(i, j int) bool { return dts[i] < dts[j] })
+
+	fragment := fmp4.Fragment{TrackID: t.mp4.ID, BaseDecodeTime: uint64(dts[0])}
+	end := ticks(seg.end, ts)
+	for i, s := range samples {
+		var duration int64
+		if i+1 < len(dts) {
+			duration = dts[i+1] - dts[i]
+		} else if end > dts[i] {
+			duration = end - dts[i]
+		} else {
+			duration = ticks(t.mkv.DefaultDuration, ts)
+		}
+		fragment.Samples = append(fragment.Samples, fmp4.Sample{
+			Duration:          uint32(duration),
+			CompositionOffset: int32(ticks(s.pts, ts) - dts[i]),
+			Keyframe:          s.keyframe,
+			Data:              s.data,
+		})
+	}
+	return fragment
+}
+
+// sideFragment lays out audio frames back to back from the first one's time
+func sideFragment(t hlsTrack, samples []hlsSample, seg hlsSegment) fmp4.Fragment {
+	ts := t.mp4.Timescale
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].pts < samples[j].pts })
+	fragment := fmp4.Fragment{TrackID: t.mp4.ID, BaseDecodeTime: uint64(ticks(samples[0].pts, ts))}
+	for i, s := range samples {
+		duration := ticks(frameDuration(&t, s.data), ts)
+		if duration == 0 {
+			next := seg.end
+			if i+1 < len(samples) {
+				next = samples[i+1].pts
+			}
+			duration = ticks(next-s.pts, ts)
+		}
+		fragment.Samples = append(fragment.Samples, fmp4.Sample{Duration: uint32(duration), Keyframe: true, Data: s.data})
+	}
+	return fragment
+}
+
+// hlsPlayable reports whether a recording's tracks can be remuxed, for the aggregate view
+func hlsPlayable(tracks []RecordingTrack) bool {
+	playable := false
+	for _, t := range tracks {
+		switch {
+		case t.Type == "video" && t.Codec != codecMKVH264:
+			return false
+		case t.Type == "video" || t.Type == "audio" && t.Codec == codecMKVOpus:
+			playable = true
+		}
+	}
+	return playable
+}
+
+// serveRecordingHLS serves the HLS resource name of the recording stored at object
+func serveRecordingHLS(w http.ResponseWriter, r *http.Request, object, name string) {
+	log := requestLogger(r)
+	videoPath := resolveObjectPath(r, object)
+	info, err := os.Stat(videoPath)
+	if err != nil || info.IsDir() {
+		http.Error(w, "Recording not found", http.StatusNotFound)
+		log.Log(Info, "recording not found", "object", object)
+		return
+	}
+	x, err := readHLSIndex(videoPath, info)
+	if errors.Is(err, errUnsupportedCodec) || errors.Is(err, mkv.ErrNotMatroska) {
+		http.Error(w, "Recording can't be played in the browser: "+err.Error(), http.StatusUnsupportedMediaType)
+		log.Log(Info, "recording not playable", "object", object, "error", err)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read recording", http.StatusInternalServerError)
+		log.Log(Error, "failed to index recording", "object", object, "error", err)
+		return
+	}
+	if len(x.segments) == 0 {
+		http.Error(w, "Recording has no frames", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case name == "master.m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprint(w, x.masterPlaylist())
+	case name == "index.m3u8":
+		w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprint(w, x.mediaPlaylist())
+		objectRead(videoPath)
+	case name == "init.mp4":
+		var tracks []fmp4.Track
+		for _, t := range x.tracks {
+			tracks = append(tracks, t.mp4)
+		}
+		init, err := fmp4.InitSegment(tracks)
+		if err != nil {
+			http.Error(w, "Recording can't be played in the browser: "+err.Error(), http.StatusUnsupportedMediaType)
+			log.Log(Info, "recording not playable", "object", object, "error", err)
+			return
+		}
+		w.Header().Set("Content-Type", "video/mp4")
+		w.Header().Set("Content-Length", strconv.Itoa(len(init)))
+		w.Write(init)
+	case strings.HasSuffix(name, ".m4s"):
+		n, err := strconv.Atoi(strings.TrimSuffix(name, ".m4s"))
+		if err != nil || n < 0 || n >= len(x.segments) {
+			http.Error(w, "Segment not found", http.StatusNotFound)
+			return
+		}
+		segment, err := x.buildSegment(videoPath, n)
+		if err != nil {
+			http.Error(w, "Failed to remux recording", http.StatusInternalServerError)
+			log.Log(Error, "failed to remux segment", "object", object, "segment", n, "error", err)
+			return
+		}
+		w.Header().Set("Content-Type", "video/iso.segment")
+		w.Header().Set("Content-Length", strconv.Itoa(len(segment)))
+		w.Write(segment)
+		log.Log(Debug, "segment remuxed", "object", object, "segment", n, "bytes", len(segment))
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// masterPlaylist announces the single rendition with its codecs, so players can
+// check support before loading segments
+func (x *hlsIndex) masterPlaylist() string {
+	var codecs []string
+	resolution := ""
+	for _, t := range x.tracks {
+		codecs = append(codecs, t.mp4.CodecString())
+		if t.mp4.Codec == fmp4.CodecH264 && t.mp4.Width > 0 {
+			resolution = fmt.Sprintf(",RESOLUTION=%dx%d", t.mp4.Width, t.mp4.Height)
+		}
+	}
+	bandwidth := int64(0)
+	if seconds := x.duration().Seconds(); seconds > 0 {
+		bandwidth = int64(float64(x.size) * 8 / seconds)
+	}
+	return fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-INDEPENDENT-SEGMENTS\n#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS=\"%s\"%s\nindex.m3u8\n",
+		bandwidth, strings.Join(codecs, ","), resolution)
+}
+
+// mediaPlaylist lists the segments with their durations
+func (x *hlsIndex) mediaPlaylist() string {
+	target := 1.0
+	for _, s := range x.segments {
+		target = math.Max(target, math.Ceil((s.end - s.start).Seconds()))
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-TARGETDURATION:%d\n#EXT-X-PLAYLIST-TYPE:VOD\n", int(target))
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-INDEPENDENT-SEGMENTS\n#EXT-X-MAP:URI=\"init.mp4\"\n")
+	for i, s := range x.segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%d.m4s\n", (s.end - s.start).Seconds(), i)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+	return b.String()
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"BodyWornAPI/simulator"
+)
+
+// writeTestRecording stores a simulated recording of length at path
+func writeTestRecording(t *testing.T, path string, length time.Duration) os.FileInfo {
+	t.Helper()
+	data, err := simulator.Recording(length, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestHLSPlaylists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clip.mkv")
+	info := writeTestRecording(t, path, 10*time.Second)
+	x, err := readHLSIndex(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keyframes every 2s and 4s segments: cuts at 0, 4 and 8s
+	wantMedia := `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:4
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4.000,
+0.m4s
+#EXTINF:4.000,
+1.m4s
+#EXTINF:2.000,
+2.m4s
+#EXT-X-ENDLIST
+`
+	if got := x.mediaPlaylist(); got != wantMedia {
+		t.Errorf("media playlist\n%s\nwant\n%s", got, wantMedia)
+	}
+	wantMaster := fmt.Sprintf(`#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-STREAM-INF:BANDWIDTH=%d,CODECS="avc1.64001f,opus",RESOLUTION=640x480
+index.m3u8
+`, info.Size()*8/10)
+	if got := x.masterPlaylist(); got != wantMaster {
+		t.Errorf("master playlist\n%s\nwant\n%s", got, wantMaster)
+	}
+}
+
+func TestHLSSegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clip.mkv")
+	info := writeTestRecording(t, path, 10*time.Second)
+	x, err := readHLSIndex(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each segment holds its GOPs of 25 fps video and the 20ms Opus packets in its time range
+	for n, want := range []struct{ video, audio uint32 }{{100, 200}, {100, 200}, {50, 100}} {
+		segment, err := x.buildSegment(path, n)
+		if err != nil {
+			t.Fatalf("segment %d: %v", n, err)
+		}
+		if string(segment[4:8]) != "moof" {
+			t.Fatalf("segment %d starts with %q", n, segment[4:8])
+		}
+		moofSize := binary.BigEndian.Uint32(segment)
+		if string(segment[moofSize+4:moofSize+8]) != "mdat" {
+			t.Errorf("segment %d: no mdat after the moof", n)
+		}
+		samples := map[uint32]uint32{}
+		starts := map[uint32]uint64{}
+		for pos := uint32(8 + 16); pos < moofSize; {
+			// traf(tfhd(track) tfdt(base) trun(count ...))
+			size := binary.BigEndian.Uint32(segment[pos:])
+			traf := segment[pos+8 : pos+size]
+			track := binary.BigEndian.Uint32(traf[12:])
+			starts[track] = binary.BigEndian.Uint64(traf[16+12:])
+			samples[track] = binary.BigEndian.Uint32(traf[16+20+12:])
+			pos += size
+		}
+		if samples[1] != want.video || samples[2] != want.audio {
+			t.Errorf("segment %d: %d video and %d audio samples, want %d and %d", n, samples[1], samples[2], want.video, want.audio)
+		}
+		if starts[1] != uint64(n)*4*90000 || starts[2] != uint64(n)*4*48000 {
+			t.Errorf("segment %d: starts at %d (video) and %d (audio)", n, starts[1], starts[2])
+		}
+	}
+}
+
+func TestHLSEndpoints(t *testing.T) {
+	url := startTestServer(t)
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	writeTestRecording(t, filepath.Join(LocalStoragePath, StorageAccount, "CamA", "clip.mkv"), 6*time.Second)
+	os.WriteFile(filepath.Join(LocalStoragePath, StorageAccount, "CamA", "other.mkv"), []byte("not a recording"), 0644)
+	base := url + recordingURL("CamA/clip.mkv") + "/hls/"
+
+	for _, tc := range []struct {
+		url  string
+		want int
+		body string
+	}{
+		{base + "master.m3u8", http.StatusOK, "CODECS="},
+		{base + "index.m3u8", http.StatusOK, "1.m4s"},
+		{base + "init.mp4", http.StatusOK, "ftyp"},
+		{base + "1.m4s", http.StatusOK, "moof"},
+		{base + "2.m4s", http.StatusNotFound, ""},
+		{base + "-1.m4s", http.StatusNotFound, ""},
+		{base + "x.ts", http.StatusNotFound, ""},
+		{url + recordingURL("CamA/other.mkv") + "/hls/index.m3u8", http.StatusUnsupportedMediaType, ""},
+		{url + recordingURL("CamA/missing.mkv") + "/hls/index.m3u8", http.StatusNotFound, ""},
+	} {
+		code, body := do(t, http.MethodGet, tc.url, admin, "")
+		if code != tc.want || !strings.Contains(body, tc.body) {
+			t.Errorf("%s: %d, want %d with %q", strings.TrimPrefix(tc.url, url), code, tc.want, tc.body)
+		}
+	}
+}
+
+func TestHLSIndexEviction(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	videoPath := filepath.Join(LocalStoragePath, StorageAccount, "CamA", "clip.mkv")
+	indexed := func() bool {
+		hlsIndexMu.Lock()
+		defer hlsIndexMu.Unlock()
+		_, ok := hlsIndexCache[videoPath]
+		return ok
+	}
+	playlist := func() {
+		t.Helper()
+		writeTestRecording(t, videoPath, 2*time.Second)
+		if code, _ := do(t, http.MethodGet, url+recordingURL("CamA/clip.mkv")+"/hls/index.m3u8", admin, ""); code != http.StatusOK || !indexed() {
+			t.Fatalf("playlist: %d, indexed %v", code, indexed())
+		}
+	}
+
+	playlist()
+	request(t, http.MethodPut, storage+"/CamA/clip.mkv", admin, nil, strings.NewReader("video"))
+	if indexed() {
+		t.Error("index of a replaced recording kept")
+	}
+	playlist()
+	request(t, http.MethodDelete, storage+"/CamA/clip.mkv", admin, nil, nil)
+	if indexed() {
+		t.Error("index of a deleted recording kept")
+	}
+}
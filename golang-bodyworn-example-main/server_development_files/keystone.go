@@ -0,0 +1,225 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Keystone v3 authentication, for OpenStack tooling that doesn't speak /auth/v1.0.
+// Tokens come from the same store and the same credentials as AuthHandler, so either
+// kind works on the storage API. There is a single project, StorageAccount, and the
+// catalog holds only its object-store endpoint.
+
+// keystoneTime is the timestamp format of Keystone's token documents
+const keystoneTime = "2006-01-02T15:04:05.000000Z"
+
+var keystoneDomain = map[string]string{"id": "default", "name": "Default"}
+
+type keystoneAuthRequest struct {
+	Auth struct {
+		Identity struct {
+			Methods  []string `json:"methods"`
+			Password struct {
+				User struct {
+					ID       string `json:"id"`
+					Name     string `json:"name"`
+					Password string `json:"password"`
+				} `json:"user"`
+			} `json:"password"`
+			Token struct {
+				ID string `json:"id"`
+			} `json:"token"`
+		} `json:"identity"`
+		Scope *struct {
+			Project *struct {
+				ID   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"project"`
+		} `json:"scope"`
+	} `json:"auth"`
+}
+
+// keystoneError answers in Keystone's error format
+func keystoneError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": map[string]interface{}{"code": code, "title": http.StatusText(code), "message": message},
+	})
+}
+
+// keystoneToken returns the token document of a token issued to id
+func keystoneToken(r *http.Request, id *Identity, it issuedToken, methods []string) map[string]interface{} {
+	endpoint := fmt.Sprintf("http://%s/v1.0/%s", r.Host, StorageAccount)
+	var endpoints []map[string]string
+	for _, iface := range []string{"public", "internal", "admin"} {
+		endpoints = append(endpoints, map[string]string{
+			"id":        "swift-" + iface,
+			"interface": iface,
+			"region":    "RegionOne",
+			"region_id": "RegionOne",
+			"url":       endpoint,
+		})
+	}
+	return map[string]interface{}{
+		"token": map[string]interface{}{
+			"methods":    methods,
+			"user":       map[string]interface{}{"id": id.Name, "name": id.Name, "domain": keystoneDomain},
+			"project":    map[string]interface{}{"id": StorageAccount, "name": StorageAccount, "domain": keystoneDomain},
+			"roles":      []map[string]string{{"id": string(id.Role), "name": string(id.Role)}},
+			"issued_at":  it.issued.UTC().Format(keystoneTime),
+			"expires_at": it.expires.UTC().Format(keystoneTime),
+			"catalog": []map[string]interface{}{{
+				"id":        "swift",
+				"type":      "object-store",
+				"name":      "swift",
+				"endpoints": endpoints,
+			}},
+		},
+	}
+}
+
+// KeystoneHandler serves the Keystone v3 identity API:
+//
+//	GET    /v3                 version discovery
+//	POST   /v3/auth/tokens     authenticate with the password or token method; the token
+//	                           is returned in X-Subject-Token
+//	GET    /v3/auth/tokens     validate the X-Subject-Token token (HEAD checks it only)
+//	DELETE /v3/auth/tokens     revoke the X-Subject-Token token
+//
+// GET, HEAD and DELETE need a valid X-Auth-Token. Requests may be scoped to the
+// StorageAccount project, or not scoped at all; other projects are refused.
+func KeystoneHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLogger(r)
+	switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/v3"), "/") {
+	case "":
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			keystoneError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"version": map[string]interface{}{
+				"id":          "v3.14",
+				"status":      "stable",
+				"updated":     "2020-04-07T00:00:00Z",
+				"links":       []map[string]string{{"rel": "self", "href": fmt.Sprintf("http://%s/v3/", r.Host)}},
+				"media-types": []map[string]string{{"base": "application/json", "type": "application/vnd.openstack.identity-v3+json"}},
+			},
+		})
+		return
+	case "auth/tokens":
+	default:
+		keystoneError(w, http.StatusNotFound, "Not found")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		id, ok := tokenIdentity(r.Header.Get("X-Auth-Token"))
+		if !ok {
+			keystoneError(w, http.StatusUnauthorized, "The request you have made requires authentication.")
+			return
+		}
+		subject := r.Header.Get("X-Subject-Token")
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			subjectID, it, ok := lookupToken(subject)
+			if !ok {
+				keystoneError(w, http.StatusNotFound, "Could not find token.")
+				return
+			}
+			// Only admins may validate other accounts' tokens
+			if subjectID.Name != id.Name && id.Role != RoleAdmin {
+				keystoneError(w, http.StatusForbidden, "You are not authorized to perform the requested action.")
+				log.Log(Info, "token validation not allowed", "user", id.Name, "subject_user", subjectID.Name)
+				return
+			}
+			w.Header().Set("X-Subject-Token", subject)
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(keystoneToken(r, subjectID, it, []string{"password"}))
+		case http.MethodDelete:
+			// Only admins may revoke other accounts' tokens
+			if subjectID, _, ok := lookupToken(subject); ok && subjectID.Name != id.Name && id.Role != RoleAdmin {
+				keystoneError(w, http.StatusForbidden, "You are not authorized to perform the requested action.")
+				return
+			}
+			if !revokeToken(subject) {
+				keystoneError(w, http.StatusNotFound, "Could not find token.")
+				return
+			}
+			log.Log(Info, "token revoked", "user", id.Name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			keystoneError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+		return
+	}
+
+	var req keystoneAuthRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		keystoneError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if scope := req.Auth.Scope; scope != nil && scope.Project != nil {
+		if p := scope.Project; p.ID != StorageAccount && p.Name != StorageAccount {
+			keystoneError(w, http.StatusUnauthorized, "The only project is "+StorageAccount)
+			return
+		}
+	}
+
+	var (
+		id      *Identity
+		ok      bool
+		methods = req.Auth.Identity.Methods
+		user    string
+		expires = time.Now().Add(TokenLifetime)
+	)
+	switch {
+	case len(methods) == 1 && methods[0] == "password":
+		u := req.Auth.Identity.Password.User
+		user = u.Name
+		if user == "" {
+			user = u.ID
+		}
+		id, ok = authenticateKey(user, u.Password)
+	case len(methods) == 1 && methods[0] == "token":
+		// The new token expires with the one it comes from, so tokens can't be
+		// renewed indefinitely without the key
+		var source issuedToken
+		id, source, ok = lookupToken(req.Auth.Identity.Token.ID)
+		if ok {
+			user = id.Name
+			expires = source.expires
+		}
+	default:
+		keystoneError(w, http.StatusBadRequest, "Use the password or the token method")
+		return
+	}
+	if !ok {
+		keystoneError(w, http.StatusUnauthorized, "The request you have made requires authentication.")
+		metricAuthFailures.add(1)
+		log.Log(Warning, "authentication failed", "user", user, "method", methods[0], "remote_addr", r.RemoteAddr)
+		return
+	}
+
+	token, _, err := issueTokenUntil(id, expires)
+	if err != nil {
+		keystoneError(w, http.StatusInternalServerError, "Failed to issue token")
+		log.Log(Error, "failed to issue token", "user", user, "error", err)
+		return
+	}
+	_, it, _ := lookupToken(token)
+	w.Header().Set("X-Subject-Token", token)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(keystoneToken(r, id, it, methods))
+	log.Log(Info, "authenticated with Keystone v3, token and catalog returned", "user", user, "role", id.Role,
+		"expires", it.expires.UTC().Format(time.RFC3339), "remote_addr", r.RemoteAddr)
+}
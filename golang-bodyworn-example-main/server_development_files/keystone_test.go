@@ -0,0 +1,168 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// keystoneAuth posts a Keystone v3 authentication request and returns the status,
+// X-Subject-Token and token document
+func keystoneAuth(t *testing.T, url, body string) (int, string, map[string]interface{}) {
+	t.Helper()
+	resp, err := http.Post(url+"/v3/auth/tokens", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var doc map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&doc)
+	return resp.StatusCode, resp.Header.Get("X-Subject-Token"), doc
+}
+
+func passwordAuth(user, key, project string) string {
+	return `{"auth": {"identity": {"methods": ["password"], "password": {"user": {"name": "` + user +
+		`", "domain": {"name": "Default"}, "password": "` + key + `"}}}, "scope": {"project": {"name": "` + project +
+		`", "domain": {"name": "Default"}}}}}`
+}
+
+func TestKeystoneAuth(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+
+	code, token, doc := keystoneAuth(t, url, passwordAuth(AuthUser, AuthPassword, StorageAccount))
+	if code != http.StatusCreated || token == "" {
+		t.Fatalf("password auth: %d, token %q", code, token)
+	}
+	catalog := doc["token"].(map[string]interface{})["catalog"].([]interface{})
+	var endpoint string
+	for _, service := range catalog {
+		service := service.(map[string]interface{})
+		if service["type"] != "object-store" {
+			continue
+		}
+		for _, e := range service["endpoints"].([]interface{}) {
+			if e := e.(map[string]interface{}); e["interface"] == "public" {
+				endpoint = e["url"].(string)
+			}
+		}
+	}
+	if endpoint != storage {
+		t.Errorf("object-store endpoint %q, want %q", endpoint, storage)
+	}
+	if code, _ := do(t, http.MethodGet, endpoint, token, ""); code != http.StatusOK {
+		t.Errorf("account GET with the Keystone token: %d", code)
+	}
+
+	if code, _, _ := keystoneAuth(t, url, passwordAuth(AuthUser, "wrong", StorageAccount)); code != http.StatusUnauthorized {
+		t.Errorf("wrong password: %d, want 401", code)
+	}
+	if code, _, _ := keystoneAuth(t, url, passwordAuth(AuthUser, AuthPassword, "other")); code != http.StatusUnauthorized {
+		t.Errorf("other project: %d, want 401", code)
+	}
+	if code, _, _ := keystoneAuth(t, url, `{"auth": {"identity": {"methods": ["totp"]}}}`); code != http.StatusBadRequest {
+		t.Errorf("unsupported method: %d, want 400", code)
+	}
+
+	// Accounts and their roles apply as they do to /auth/v1.0 tokens
+	addTestAccount(t, url, signIn(t, url, AuthUser, AuthPassword), "carol", RoleReviewer)
+	code, reviewer, doc := keystoneAuth(t, url, passwordAuth("carol", "carol-key", StorageAccount))
+	if code != http.StatusCreated {
+		t.Fatalf("reviewer auth: %d", code)
+	}
+	if roles := doc["token"].(map[string]interface{})["roles"].([]interface{}); roles[0].(map[string]interface{})["name"] != "reviewer" {
+		t.Errorf("roles %v, want reviewer", roles)
+	}
+	if code, _ := do(t, http.MethodPut, storage+"/Recordings", reviewer, ""); code != http.StatusForbidden {
+		t.Errorf("reviewer PUT with a Keystone token: %d, want 403", code)
+	}
+
+	code, rescoped, _ := keystoneAuth(t, url, `{"auth": {"identity": {"methods": ["token"], "token": {"id": "`+reviewer+`"}}}}`)
+	if code != http.StatusCreated || rescoped == reviewer {
+		t.Fatalf("token auth: %d", code)
+	}
+
+	// Tokens are shared with /auth/v1.0 in both directions
+	legacy := signIn(t, url, AuthUser, AuthPassword)
+	validate := func(subject string) int {
+		req, _ := http.NewRequest(http.MethodGet, url+"/v3/auth/tokens", nil)
+		req.Header.Set("X-Auth-Token", legacy)
+		req.Header.Set("X-Subject-Token", subject)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := validate(rescoped); code != http.StatusOK {
+		t.Errorf("validating a token: %d", code)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, url+"/v3/auth/tokens", nil)
+	req.Header.Set("X-Auth-Token", reviewer)
+	req.Header.Set("X-Subject-Token", legacy)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("reviewer revoking an admin token: %v %v, want 403", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+	req.Header.Set("X-Auth-Token", rescoped)
+	req.Header.Set("X-Subject-Token", rescoped)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusNoContent {
+		t.Errorf("revoking own token: %v %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+	if code := validate(rescoped); code != http.StatusNotFound {
+		t.Errorf("validating a revoked token: %d, want 404", code)
+	}
+	if code, _ := do(t, http.MethodGet, storage, rescoped, ""); code != http.StatusUnauthorized {
+		t.Errorf("storage request with a revoked token: %d, want 401", code)
+	}
+}
+
+func TestKeystoneTokenScope(t *testing.T) {
+	url := startTestServer(t)
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	addTestAccount(t, url, admin, "heidi", RoleReviewer)
+	_, reviewer, doc := keystoneAuth(t, url, passwordAuth("heidi", "heidi-key", StorageAccount))
+	expiresAt := func(doc map[string]interface{}) interface{} {
+		return doc["token"].(map[string]interface{})["expires_at"]
+	}
+
+	// Tokens from the token method expire with their source, however often renewed
+	time.Sleep(10 * time.Millisecond)
+	code, rescoped, rescopedDoc := keystoneAuth(t, url, `{"auth": {"identity": {"methods": ["token"], "token": {"id": "`+reviewer+`"}}}}`)
+	if code != http.StatusCreated || expiresAt(rescopedDoc) != expiresAt(doc) {
+		t.Errorf("token auth: %d, expires %v, want %v", code, expiresAt(rescopedDoc), expiresAt(doc))
+	}
+	_, again, _ := keystoneAuth(t, url, `{"auth": {"identity": {"methods": ["token"], "token": {"id": "`+rescoped+`"}}}}`)
+	_, source, _ := lookupToken(reviewer)
+	if _, it, ok := lookupToken(again); !ok || !it.expires.Equal(source.expires) {
+		t.Errorf("renewed token expires %v, want %v", it.expires, source.expires)
+	}
+
+	// Only admins validate other accounts' tokens
+	validate := func(method, token, subject string) int {
+		resp, _ := send(t, method, url+"/v3/auth/tokens", token, http.Header{"X-Subject-Token": {subject}}, "")
+		return resp.StatusCode
+	}
+	for _, tc := range []struct {
+		method, token, subject string
+		want                   int
+	}{
+		{http.MethodGet, reviewer, admin, http.StatusForbidden},
+		{http.MethodHead, reviewer, admin, http.StatusForbidden},
+		{http.MethodGet, reviewer, rescoped, http.StatusOK},
+		{http.MethodHead, reviewer, reviewer, http.StatusOK},
+		{http.MethodGet, admin, reviewer, http.StatusOK},
+		{http.MethodGet, reviewer, "unknown", http.StatusNotFound},
+	} {
+		if code := validate(tc.method, tc.token, tc.subject); code != tc.want {
+			t.Errorf("%s of %s's token by %s: %d, want %d", tc.method, tc.subject, tc.token, code, tc.want)
+		}
+	}
+}
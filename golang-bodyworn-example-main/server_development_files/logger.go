@@ -1,8 +1,21 @@
 package server
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 // ServerLogger interface defines logging methods
@@ -16,17 +29,29 @@ type ServerLogger interface {
 	Infof(format string, a ...interface{}) error
 }
 
+// StructuredLogger is a ServerLogger that also logs at Debug level and with key/value
+// fields. Loggers passed to SetLogger that implement it are used as they are; others
+// receive each entry as one formatted line, and no Debug entries.
+type StructuredLogger interface {
+	ServerLogger
+	Debug(v ...interface{}) error
+	Debugf(format string, a ...interface{}) error
+
+	// Log writes msg at level with alternating key/value fields
+	Log(level Level, msg string, keyvals ...interface{}) error
+	// With returns a logger that adds keyvals to every entry it writes
+	With(keyvals ...interface{}) StructuredLogger
+}
+
 var (
 	logger      ServerLogger
-	loggerMutex sync.Mutex
+	loggerMutex sync.RWMutex
 )
 
 func InitLogger() {
-	logger = &DefaultLogger{}
+	SetLogger(&DefaultLogger{})
 }
 
-
-
 // SetLogger allows setting a custom logger
 func SetLogger(l ServerLogger) {
 	loggerMutex.Lock()
@@ -34,15 +59,75 @@ func SetLogger(l ServerLogger) {
 	logger = l
 }
 
-// DefaultLogger provides a default implementation for logging
-type DefaultLogger struct{}
+// getLogger returns the current logger, falling back to DefaultLogger if none was set
+func getLogger() StructuredLogger {
+	loggerMutex.RLock()
+	defer loggerMutex.RUnlock()
+	switch l := logger.(type) {
+	case nil:
+		return &DefaultLogger{}
+	case StructuredLogger:
+		return l
+	default:
+		return &plainLogger{l: l}
+	}
+}
+
+// plainLogger adapts a ServerLogger without structured logging: fields are appended
+// to the message as key=value and Debug entries are dropped
+type plainLogger struct {
+	l      ServerLogger
+	fields []interface{}
+}
+
+func (p *plainLogger) Log(level Level, msg string, keyvals ...interface{}) error {
+	var b strings.Builder
+	b.WriteString(msg)
+	writeTextFields(&b, p.fields)
+	writeTextFields(&b, keyvals)
+	line := b.String()
+	switch level {
+	case Error:
+		return p.l.Error(line)
+	case Warning:
+		return p.l.Warning(line)
+	case Info:
+		return p.l.Info(line)
+	}
+	return nil
+}
+
+func (p *plainLogger) With(keyvals ...interface{}) StructuredLogger {
+	return &plainLogger{l: p.l, fields: append(append([]interface{}(nil), p.fields...), keyvals...)}
+}
 
+func (p *plainLogger) Error(v ...interface{}) error   { return p.Log(Error, fmt.Sprint(v...)) }
+func (p *plainLogger) Warning(v ...interface{}) error { return p.Log(Warning, fmt.Sprint(v...)) }
+func (p *plainLogger) Info(v ...interface{}) error    { return p.Log(Info, fmt.Sprint(v...)) }
+func (p *plainLogger) Debug(v ...interface{}) error   { return nil }
+
+func (p *plainLogger) Errorf(format string, a ...interface{}) error {
+	return p.Log(Error, fmt.Sprintf(format, a...))
+}
+
+func (p *plainLogger) Warningf(format string, a ...interface{}) error {
+	return p.Log(Warning, fmt.Sprintf(format, a...))
+}
+
+func (p *plainLogger) Infof(format string, a ...interface{}) error {
+	return p.Log(Info, fmt.Sprintf(format, a...))
+}
+
+func (p *plainLogger) Debugf(format string, a ...interface{}) error { return nil }
+
+// Level is a syslog style severity, lower values are more severe
 type Level int
 
 const (
 	Error   Level = 3
 	Warning Level = 4
 	Info    Level = 6
+	Debug   Level = 7
 )
 
 // String converts the Level to a string
@@ -54,18 +139,135 @@ func (l Level) String() string {
 		return "Warning"
 	case Info:
 		return "Info"
+	case Debug:
+		return "Debug"
 	}
 	return "Unknown log level"
 }
 
+// ParseLevel converts a level name such as "info" or "warning" to a Level
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "error":
+		return Error, nil
+	case "warning", "warn":
+		return Warning, nil
+	case "info", "":
+		return Info, nil
+	case "debug":
+		return Debug, nil
+	}
+	return Info, fmt.Errorf("unknown log level %q", s)
+}
+
+// Format selects how DefaultLogger renders entries
+type Format int
+
+const (
+	FormatText Format = iota
+	FormatJSON
+)
+
+// ParseFormat converts "text" or "json" to a Format
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "text", "":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return FormatText, fmt.Errorf("unknown log format %q", s)
+}
+
+// DefaultLogger provides a default implementation for logging.
+// The zero value writes text entries at Info level and above to stdout.
+type DefaultLogger struct {
+	Out      io.Writer // defaults to os.Stdout
+	Format   Format
+	MinLevel Level // entries less severe than MinLevel are dropped, zero means Info
+
+	fields []interface{}
+}
+
+// Sync flushes Out to stable storage when it is a file
+func (l DefaultLogger) Sync() error {
+	s, ok := l.Out.(interface{ Sync() error })
+	if !ok {
+		return nil
+	}
+	// Pipes and terminals can't be synced, which is not a failure
+	if err := s.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, errors.ErrUnsupported) {
+		return err
+	}
+	return nil
+}
+
+// FlushLogger syncs the current logger's output if it supports it
+func FlushLogger() error {
+	loggerMutex.RLock()
+	l := logger
+	loggerMutex.RUnlock()
+	if s, ok := l.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// outputMutex serialises writes so entries from concurrent requests don't interleave
+var outputMutex sync.Mutex
+
+func (l DefaultLogger) enabled(level Level) bool {
+	min := l.MinLevel
+	if min == 0 {
+		min = Info
+	}
+	return level <= min
+}
+
 // log prints the log message with the specified level
 func (l DefaultLogger) log(level Level, v ...interface{}) {
-	fmt.Printf("%s: %s", level, fmt.Sprintln(v...))
+	l.Log(level, strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
 }
 
 // logf prints a formatted log message with the specified level
 func (l DefaultLogger) logf(level Level, format string, v ...interface{}) {
-	fmt.Printf("%s: %s\n", level, fmt.Sprintf(format, v...))
+	l.Log(level, fmt.Sprintf(format, v...))
+}
+
+// Log writes a single entry with the logger's fields followed by keyvals
+func (l DefaultLogger) Log(level Level, msg string, keyvals ...interface{}) error {
+	if !l.enabled(level) {
+		return nil
+	}
+	out := l.Out
+	if out == nil {
+		out = os.Stdout
+	}
+
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+
+	var line []byte
+	if l.Format == FormatJSON {
+		line = formatJSONEntry(time.Now(), level, msg, fields)
+	} else {
+		line = formatTextEntry(time.Now(), level, msg, fields)
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	_, err := out.Write(line)
+	return err
+}
+
+// With returns a copy of the logger that adds keyvals to every entry
+func (l DefaultLogger) With(keyvals ...interface{}) StructuredLogger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	l.fields = fields
+	return &l
 }
 
 // Error logs an error message
@@ -86,6 +288,12 @@ func (l DefaultLogger) Info(v ...interface{}) error {
 	return nil
 }
 
+// Debug logs a debug message
+func (l DefaultLogger) Debug(v ...interface{}) error {
+	l.log(Debug, v...)
+	return nil
+}
+
 // Errorf logs an error message with formatting
 func (l DefaultLogger) Errorf(format string, a ...interface{}) error {
 	l.logf(Error, format, a...)
@@ -103,3 +311,242 @@ func (l DefaultLogger) Infof(format string, a ...interface{}) error {
 	l.logf(Info, format, a...)
 	return nil
 }
+
+// Debugf logs a debug message with formatting
+func (l DefaultLogger) Debugf(format string, a ...interface{}) error {
+	l.logf(Debug, format, a...)
+	return nil
+}
+
+// formatTextEntry renders "2006/01/02 15:04:05 Info: msg key=value ..."
+func formatTextEntry(t time.Time, level Level, msg string, fields []interface{}) []byte {
+	var b strings.Builder
+	b.WriteString(t.Format("2006/01/02 15:04:05"))
+	b.WriteByte(' ')
+	b.WriteString(level.String())
+	b.WriteString(": ")
+	b.WriteString(msg)
+	writeTextFields(&b, fields)
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// writeTextFields appends " key=value" for each field, quoting values that need it
+func writeTextFields(b *strings.Builder, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fieldPair(fields, i)
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteByte('=')
+		s := fmt.Sprint(value)
+		if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(s)
+	}
+}
+
+// formatJSONEntry renders one JSON object per line
+func formatJSONEntry(t time.Time, level Level, msg string, fields []interface{}) []byte {
+	entry := make(map[string]interface{}, len(fields)/2+3)
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fieldPair(fields, i)
+		entry[key] = value
+	}
+	entry["time"] = t.UTC().Format(time.RFC3339Nano)
+	entry["level"] = strings.ToLower(level.String())
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		// Fall back to stringified values if something isn't marshalable
+		for k, v := range entry {
+			entry[k] = fmt.Sprint(v)
+		}
+		line, _ = json.Marshal(entry)
+	}
+	return append(line, '\n')
+}
+
+// fieldPair returns the key and value at index i, tolerating odd-length lists
+func fieldPair(fields []interface{}, i int) (string, interface{}) {
+	key := fmt.Sprint(fields[i])
+	if i+1 >= len(fields) {
+		return key, "!MISSING"
+	}
+	switch v := fields[i+1].(type) {
+	case error:
+		return key, v.Error()
+	case time.Duration:
+		return key, v.String()
+	case fmt.Stringer:
+		return key, v.String()
+	default:
+		return key, v
+	}
+}
+
+// SlogLogger adapts a *slog.Logger to StructuredLogger
+type SlogLogger struct {
+	L *slog.Logger
+}
+
+// NewSlogLogger wraps l so it can be passed to SetLogger
+func NewSlogLogger(l *slog.Logger) StructuredLogger {
+	return &SlogLogger{L: l}
+}
+
+func slogLevel(level Level) slog.Level {
+	switch level {
+	case Error:
+		return slog.LevelError
+	case Warning:
+		return slog.LevelWarn
+	case Debug:
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
+// Log writes msg with keyvals through the wrapped slog.Logger
+func (s *SlogLogger) Log(level Level, msg string, keyvals ...interface{}) error {
+	s.L.Log(context.Background(), slogLevel(level), msg, keyvals...)
+	return nil
+}
+
+// With returns an adapter around s.L.With(keyvals...)
+func (s *SlogLogger) With(keyvals ...interface{}) StructuredLogger {
+	return &SlogLogger{L: s.L.With(keyvals...)}
+}
+
+func (s *SlogLogger) Error(v ...interface{}) error   { return s.Log(Error, fmt.Sprint(v...)) }
+func (s *SlogLogger) Warning(v ...interface{}) error { return s.Log(Warning, fmt.Sprint(v...)) }
+func (s *SlogLogger) Info(v ...interface{}) error    { return s.Log(Info, fmt.Sprint(v...)) }
+func (s *SlogLogger) Debug(v ...interface{}) error   { return s.Log(Debug, fmt.Sprint(v...)) }
+
+func (s *SlogLogger) Errorf(format string, a ...interface{}) error {
+	return s.Log(Error, fmt.Sprintf(format, a...))
+}
+
+func (s *SlogLogger) Warningf(format string, a ...interface{}) error {
+	return s.Log(Warning, fmt.Sprintf(format, a...))
+}
+
+func (s *SlogLogger) Infof(format string, a ...interface{}) error {
+	return s.Log(Info, fmt.Sprintf(format, a...))
+}
+
+func (s *SlogLogger) Debugf(format string, a ...interface{}) error {
+	return s.Log(Debug, fmt.Sprintf(format, a...))
+}
+
+// Per-request logging
+
+type requestIDKey struct{}
+
+// RequestID returns the ID assigned to the request by WithRequestLogging
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestLogger returns the global logger tagged with the request's ID
+func requestLogger(r *http.Request) StructuredLogger {
+	l := getLogger()
+	if id := RequestID(r.Context()); id != "" {
+		return l.With("request_id", id)
+	}
+	return l
+}
+
+// newRequestID returns a Swift style transaction ID
+func newRequestID() string {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("tx%x", time.Now().UnixNano())
+	}
+	return "tx" + hex.EncodeToString(buf)
+}
+
+// validRequestID accepts caller supplied IDs that are short and printable
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// responseRecorder captures the status and size of a response
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(code int) {
+	if rec.status == 0 {
+		rec.status = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the recorder
+func (rec *responseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// WithRequestLogging assigns every request an ID (echoed as X-Trans-Id and
+// X-Request-Id) and writes one access log entry when the request completes
+func WithRequestLogging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		id := r.Header.Get("X-Request-Id")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Trans-Id", id)
+		w.Header().Set("X-Request-Id", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+
+		level := Info
+		if rec.status >= 500 {
+			level = Error
+		}
+		requestLogger(r).Log(level, "request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", float64(time.Since(start).Microseconds())/1000,
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// legacyLogger implements only the original ServerLogger methods
+type legacyLogger struct {
+	lines []string
+}
+
+func (l *legacyLogger) add(level string, v ...interface{}) error {
+	l.lines = append(l.lines, level+": "+fmt.Sprint(v...))
+	return nil
+}
+
+func (l *legacyLogger) Error(v ...interface{}) error   { return l.add("Error", v...) }
+func (l *legacyLogger) Warning(v ...interface{}) error { return l.add("Warning", v...) }
+func (l *legacyLogger) Info(v ...interface{}) error    { return l.add("Info", v...) }
+func (l *legacyLogger) Errorf(format string, a ...interface{}) error {
+	return l.add("Error", fmt.Sprintf(format, a...))
+}
+func (l *legacyLogger) Warningf(format string, a ...interface{}) error {
+	return l.add("Warning", fmt.Sprintf(format, a...))
+}
+func (l *legacyLogger) Infof(format string, a ...interface{}) error {
+	return l.add("Info", fmt.Sprintf(format, a...))
+}
+
+func TestLegacyLogger(t *testing.T) {
+	loggerMutex.RLock()
+	previous := logger
+	loggerMutex.RUnlock()
+	legacy := &legacyLogger{}
+	SetLogger(legacy)
+	defer SetLogger(previous)
+
+	log := getLogger().With("request_id", "tx1")
+	log.Log(Warning, "upload refused", "path", "Recordings/a b.mkv", "bytes", 42)
+	log.Log(Debug, "dropped")
+	log.Debugf("dropped %d", 1)
+	getLogger().Infof("plain %s", "line")
+
+	want := []string{
+		`Warning: upload refused request_id=tx1 path="Recordings/a b.mkv" bytes=42`,
+		"Info: plain line",
+	}
+	if strings.Join(legacy.lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("legacy logger got\n%s\nwant\n%s", strings.Join(legacy.lines, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestDefaultLoggerFormats(t *testing.T) {
+	var buf bytes.Buffer
+	l := (&DefaultLogger{Out: &buf, MinLevel: Info}).With("request_id", "tx1")
+	l.Log(Debug, "hidden")
+	l.Log(Info, "stored", "path", "Users/1", "error", fmt.Errorf("disk full"))
+	line := buf.String()
+	if strings.Contains(line, "hidden") || !strings.HasSuffix(line, "Info: stored request_id=tx1 path=Users/1 error=\"disk full\"\n") {
+		t.Errorf("text entry %q", line)
+	}
+
+	buf.Reset()
+	(&DefaultLogger{Out: &buf, Format: FormatJSON}).Log(Error, "failed", "bytes", 3, "odd")
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("JSON entry %q: %v", buf.String(), err)
+	}
+	if entry["level"] != "error" || entry["msg"] != "failed" || entry["bytes"] != float64(3) || entry["odd"] != "!MISSING" {
+		t.Errorf("JSON entry %v", entry)
+	}
+
+	for _, tc := range []struct {
+		in   string
+		want Level
+		err  bool
+	}{{"debug", Debug, false}, {"WARN", Warning, false}, {"", Info, false}, {"loud", Info, true}} {
+		got, err := ParseLevel(tc.in)
+		if got != tc.want || (err != nil) != tc.err {
+			t.Errorf("ParseLevel(%q) = %v, %v", tc.in, got, err)
+		}
+	}
+}
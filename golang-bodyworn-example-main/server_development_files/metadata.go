@@ -5,241 +5,433 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
-
-	"golang.org/x/text/cases"
-	"golang.org/x/text/language"
+	"sync"
+	"time"
 )
 
-// logMetadata prints all X-Container-Meta and X-Object-Meta headers
+// logMetadata logs all X-Container-Meta and X-Object-Meta headers as fields of one entry
 func logMetadata(r *http.Request) {
-	log.Println("---- Metadata Details ----")
-	for k, v := range r.Header {
-		if strings.HasPrefix(strings.ToLower(k), "x-container-meta-") || strings.HasPrefix(strings.ToLower(k), "x-object-meta-") {
-			log.Printf("%s: %s", k, v)
+	var fields []interface{}
+	for _, h := range requestHeaderLines(r) {
+		if strings.HasPrefix(strings.ToLower(h.Name), "x-container-meta-") || strings.HasPrefix(strings.ToLower(h.Name), "x-object-meta-") {
+			fields = append(fields, h.Name, h.Value)
+		}
+	}
+	requestLogger(r).Log(Debug, "metadata headers", append([]interface{}{"path", r.URL.Path}, fields...)...)
+}
+
+// metaFilePath returns the .meta sidecar of an object or container path, or of the account when path is empty
+func metaFilePath(path string) string {
+	if strings.Trim(path, "/") == "" {
+		return filepath.Join(LocalStoragePath, StorageAccount) + ".meta"
+	}
+	return filepath.Join(LocalStoragePath, StorageAccount, path) + ".meta"
+}
+
+// Swift's default metadata constraints
+const (
+	maxMetaNameLength  = 128
+	maxMetaValueLength = 256
+	maxMetaCount       = 90
+	maxMetaOverallSize = 4096
+)
+
+// metaKind describes the headers used for account, container or object metadata
+type metaKind struct {
+	name   string
+	set    string // e.g. "x-object-meta-"
+	remove string // e.g. "x-remove-object-meta-"
+}
+
+var (
+	accountMeta   = metaKind{"account", "x-account-meta-", "x-remove-account-meta-"}
+	containerMeta = metaKind{"container", "x-container-meta-", "x-remove-container-meta-"}
+	objectMeta    = metaKind{"object", "x-object-meta-", "x-remove-object-meta-"}
+)
+
+// metaKindFor returns the metadata kind addressed by path
+func metaKindFor(path string) metaKind {
+	switch {
+	case strings.Trim(path, "/") == "":
+		return accountMeta
+	case isContainerPath(path):
+		if info, err := os.Stat(filepath.Join(LocalStoragePath, StorageAccount, path)); err == nil && info.IsDir() {
+			return containerMeta
+		}
+	}
+	return objectMeta
+}
+
+// metadataChanges splits the request's metadata headers for kind into items to
+// set and keys to delete; empty values and X-Remove-*-Meta-* headers both delete.
+// Only headers with kind's own prefix are accepted, and key names keep the spelling
+// used on the wire when the raw request headers are available.
+func metadataChanges(r *http.Request, kind metaKind) (set *Metadata, remove []string) {
+	set = &Metadata{}
+	for _, h := range requestHeaderLines(r) {
+		lowerName := strings.ToLower(h.Name)
+		switch {
+		case strings.HasPrefix(lowerName, kind.remove):
+			remove = append(remove, h.Name[len(kind.remove):])
+		case strings.HasPrefix(lowerName, kind.set):
+			key := h.Name[len(kind.set):]
+			if h.Value == "" {
+				remove = append(remove, key)
+				continue
+			}
+			if i := set.index(key); i >= 0 {
+				set.Items[i].Values = append(set.Items[i].Values, h.Value)
+			} else {
+				set.Set(key, h.Value)
+			}
+		}
+	}
+	return set, remove
+}
+
+// adminMetadata reports whether an account or container metadata key may only be
+// changed by admins
+func adminMetadata(key string) bool {
+	return isTempURLKey(key) || isCORSKey(key)
+}
+
+// adminMetadataChange returns a key of an account or container metadata change that
+// r's identity may not make
+func adminMetadataChange(r *http.Request, kind metaKind, set *Metadata, remove []string) (string, bool) {
+	if kind == objectMeta || requestIdentity(r).Role == RoleAdmin {
+		return "", false
+	}
+	for _, item := range set.Items {
+		remove = append(remove, item.Name)
+	}
+	for _, key := range remove {
+		if adminMetadata(key) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// requestMetadata returns the metadata to store for a PUT of kind
+func requestMetadata(r *http.Request, kind metaKind) *Metadata {
+	set, _ := metadataChanges(r, kind)
+	requestLogger(r).Log(Debug, "captured metadata", "path", r.URL.Path, "kind", kind.name, "keys", set.Len())
+	return set
+}
+
+// checkMetadataLimits enforces Swift's name, value, count and overall size limits
+func checkMetadataLimits(meta *Metadata) error {
+	if meta.Len() > maxMetaCount {
+		return fmt.Errorf("Too many metadata items; max %d", maxMetaCount)
+	}
+	size := 0
+	for _, item := range meta.Items {
+		if item.Name == "" {
+			return fmt.Errorf("Metadata name cannot be empty")
+		}
+		if len(item.Name) > maxMetaNameLength {
+			return fmt.Errorf("Metadata name too long: %s; max %d", item.Name, maxMetaNameLength)
+		}
+		size += len(item.Name)
+		for _, v := range item.Values {
+			if len(v) > maxMetaValueLength {
+				return fmt.Errorf("Metadata value longer than %d: %s", maxMetaValueLength, item.Name)
+			}
+			size += len(v)
 		}
 	}
-	log.Println("--------------------------")
+	if size > maxMetaOverallSize {
+		return fmt.Errorf("Total metadata too large; max %d", maxMetaOverallSize)
+	}
+	return nil
 }
 
-// handlePostMetadata updates metadata for an object and saves it as a .meta file
+// handlePostMetadata updates account, container or object metadata with Swift semantics:
+// object POSTs replace all object metadata, container and account POSTs merge into the
+// existing metadata, and empty values or X-Remove-*-Meta-* headers delete keys
 func handlePostMetadata(w http.ResponseWriter, r *http.Request, path string) {
-	metaPath := filepath.Join(LocalStoragePath, StorageAccount, path+".meta")
+	log := requestLogger(r)
+	metaPath := metaFilePath(path)
 	objPath := filepath.Join(LocalStoragePath, StorageAccount, path)
+	if path != "" {
+		objPath = resolveObjectPath(r, path)
+		metaPath = objPath + ".meta"
+	}
 
 	if _, err := os.Stat(objPath); os.IsNotExist(err) {
-		http.Error(w, "Object not found", http.StatusNotFound)
-		log.Printf("Attempted to update metadata for non-existent object %s", path)
+		http.Error(w, "Not Found", http.StatusNotFound)
+		log.Log(Info, "metadata update for non-existent path", "path", path)
 		return
 	}
 
-	metadata := parseMetadata(r)
-
-	// Auto-inject filename if this is a file
-	if !strings.HasSuffix(path, "/") && !strings.Contains(path, "/") && strings.Contains(path, ".") {
-		metadata["filename"] = filepath.Base(path)
+	kind := metaKindFor(path)
+	set, remove := metadataChanges(r, kind)
+	if key, ok := adminMetadataChange(r, kind, set, remove); ok {
+		http.Error(w, "Forbidden: only admins may change "+key, http.StatusForbidden)
+		log.Log(Info, "metadata change not allowed", "path", path, "key", key, "user", requestIdentity(r).Name)
+		return
 	}
-
 	logMetadata(r)
 
-	metaContent, err := json.MarshalIndent(metadata, "", "  ")
+	unlock := lockObject(path)
+	defer unlock()
+
+	metadata, err := readMetadata(metaPath)
 	if err != nil {
-		http.Error(w, "Failed to marshal metadata", http.StatusInternalServerError)
-		log.Printf("Failed to marshal metadata for %s: %v", path, err)
+		http.Error(w, "Failed to read metadata", http.StatusInternalServerError)
+		log.Log(Error, "failed to read metadata", "path", path, "error", err)
 		return
 	}
+	previous, _ := readMetadata(metaPath)
+	if kind == objectMeta {
+		if objectExpired(metadata) {
+			http.Error(w, "Not Found", http.StatusNotFound)
+			log.Log(Info, "metadata update for expired object", "path", path)
+			return
+		}
+		// Object POSTs replace user metadata; system metadata is kept, except for a
+		// new Content-Type
+		metadata.Items = nil
+		if ct := r.Header.Get("Content-Type"); ct != "" {
+			metadata.SysSet(sysContentType, ct)
+		}
+		if err := applyExpiryHeaders(r, metadata); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			log.Log(Info, "invalid expiry headers", "path", path, "error", err)
+			return
+		}
+	}
+	for _, key := range remove {
+		metadata.Delete(key)
+	}
+	for _, item := range set.Items {
+		metadata.Set(item.Name, item.Values...)
+	}
+	if kind != objectMeta {
+		recordTempURLKeySetters(requestIdentity(r).Name, metadata, set)
+	}
 
-	if err := os.WriteFile(metaPath, metaContent, 0644); err != nil {
-		http.Error(w, "Failed to write metadata", http.StatusInternalServerError)
-		log.Printf("Failed to write metadata for %s: %v", path, err)
+	if err := checkMetadataLimits(metadata); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Log(Info, "metadata rejected", "path", path, "kind", kind.name, "error", err)
+		return
+	}
+	// Quotas only apply to the account and containers; on objects they're plain metadata
+	if err := validateQuotaMetadata(metadata); kind != objectMeta && err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		log.Log(Info, "invalid quota metadata", "path", path, "error", err)
 		return
 	}
 
-	w.WriteHeader(http.StatusAccepted)
-	log.Printf("Metadata for %s updated successfully", path)
-}
+	if err := writeMetadata(metaPath, metadata); err != nil {
+		http.Error(w, "Failed to write metadata", http.StatusInternalServerError)
+		log.Log(Error, "failed to write metadata", "path", path, "error", err)
+		return
+	}
+	if kind == objectMeta {
+		scheduleExpiry(path, metadata)
+	}
+	publishEvent(newEvent(EventMetadataUpdated, path, objPath, metadata))
+	if e, ok := activationEvent(path, objPath, previous, metadata); ok && kind == objectMeta {
+		publishEvent(e)
+	}
 
-// parseMetadata extracts all "-meta-" headers from request
-func parseMetadata(r *http.Request) map[string]string {
-	metadata := make(map[string]string)
-	for k, v := range r.Header {
-		lowerKey := strings.ToLower(k)
-		if strings.Contains(lowerKey, "-meta-") {
-			parts := strings.SplitN(lowerKey, "-meta-", 2)
-			if len(parts) == 2 {
-				metadata[parts[1]] = v[0]
-			}
-		}
+	// Swift answers 202 for objects and 204 for containers and accounts
+	if kind == objectMeta {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
 	}
-	log.Printf("Captured metadata: %+v", metadata)
-	return metadata
+	log.Log(Info, "metadata updated", "path", path, "kind", kind.name, "set", set.Len(), "removed", len(remove), "keys", metadata.Len())
 }
 
 // handleHeadRequest handles HEAD requests with metadata
 func handleHeadRequest(w http.ResponseWriter, r *http.Request, path string) {
-	fullPath := filepath.Join(LocalStoragePath, StorageAccount, path)
+	log := requestLogger(r)
+	fullPath := resolveObjectPath(r, path)
 	metaPath := fullPath + ".meta"
 
 	info, err := os.Stat(fullPath)
 	if os.IsNotExist(err) {
 		http.Error(w, "Not Found", http.StatusNotFound)
-		log.Printf("HEAD: %s not found", fullPath)
+		log.Log(Info, "HEAD: not found", "path", path)
 		return
 	}
 
 	if info.IsDir() {
-		w.Header().Set("X-Container-Object-Count", countObjects(fullPath))
-		w.Header().Set("X-Container-Bytes-Used", calculateSize(fullPath))
+		objects, bytes := containerStats(path)
+		w.Header().Set("X-Container-Object-Count", fmt.Sprintf("%d", objects))
+		w.Header().Set("X-Container-Bytes-Used", fmt.Sprintf("%d", bytes))
 		addMetadataHeaders(w, metaPath, "X-Container-Meta-")
 		w.WriteHeader(http.StatusNoContent)
-		log.Printf("HEAD: Container metadata returned for %s", fullPath)
+		log.Log(Debug, "HEAD: container metadata returned", "path", path)
 	} else {
+		if !checkObjectExpiry(w, r, path, metaPath) {
+			return
+		}
 		w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size()))
 		w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
 		w.Header().Set("ETag", generateETag(fullPath))
-		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Type", storedContentType(metaPath))
 		addMetadataHeaders(w, metaPath, "X-Object-Meta-")
+		addReplicationHeader(w, metaPath)
+		addTierHeader(w, fullPath)
 		w.WriteHeader(http.StatusOK)
-		log.Printf("HEAD: Object metadata returned for %s", fullPath)
+		log.Log(Debug, "HEAD: object metadata returned", "path", path)
 	}
 }
 
-// addMetadataHeaders adds JSON metadata as HTTP headers
+// addMetadataHeaders adds stored metadata as HTTP headers. The header map is
+// assigned directly so names go out with their stored spelling rather than
+// being canonicalised, and every stored value is sent.
 func addMetadataHeaders(w http.ResponseWriter, metaPath, prefix string) {
-	file, err := os.Open(metaPath)
+	meta, err := readMetadata(metaPath)
 	if err != nil {
+		getLogger().Log(Warning, "failed to read metadata", "path", metaPath, "error", err)
 		return
 	}
-	defer file.Close()
 
-	var meta map[string]string
-	if err := json.NewDecoder(file).Decode(&meta); err != nil {
-		return
-	}
-
-	title := cases.Title(language.English)
-	for k, v := range meta {
-		headerKey := prefix + title.String(k)
-		w.Header().Set(headerKey, v)
-		log.Printf("Added metadata header: %s = %s", headerKey, v)
+	for _, item := range meta.Items {
+		headerKey := prefix + item.Name
+		w.Header()[headerKey] = append([]string(nil), item.Values...)
+		getLogger().Log(Debug, "added metadata header", "header", headerKey, "values", len(item.Values))
 	}
 }
 
 // handleActiveMetadataRequest returns metadata for active devices/users/system or for all recordings
 func handleActiveMetadataRequest(w http.ResponseWriter, r *http.Request, path string) {
+	log := requestLogger(r)
 	parts := strings.Split(strings.Trim(path, "/"), "/")
 	if len(parts) != 2 || parts[1] != "active" {
 		http.Error(w, "Invalid active metadata path", http.StatusBadRequest)
-		log.Printf("Invalid path for active metadata: %s", path)
+		log.Log(Info, "invalid path for active metadata", "path", path)
 		return
 	}
 
 	container := parts[0]
-	containerPath := filepath.Join(LocalStoragePath, StorageAccount)
-	if container != "RecordingsMKV" && container != "RecordingsMetadata" {
-		containerPath = filepath.Join(containerPath, container)
-	}
-
-	files, err := os.ReadDir(containerPath)
-	if err != nil {
-		http.Error(w, "Failed to read directory", http.StatusInternalServerError)
-		log.Printf("Failed to read directory %s: %v", containerPath, err)
-		return
-	}
-
+	id := requestIdentity(r)
 	var result []map[string]interface{}
 
 	switch container {
-	case "RecordingsMKV":
-		for _, file := range files {
-			if strings.HasSuffix(file.Name(), ".mkv") {
-				entry := map[string]interface{}{
-					"filename": file.Name(),
-				}
-				result = append(result, entry)
-			}
+	case "RecordingsMKV", "RecordingsMetadata":
+		// Recordings live in any container; filename is the object path below the account
+		recordings, err := recordingObjects()
+		if err != nil {
+			http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+			log.Log(Error, "failed to list recordings", "error", err)
+			return
 		}
+		for _, object := range recordings {
+			if !id.canRead(metaFilePath(object)) {
+				continue
+			}
+			recordingContainer := ""
+			if i := strings.Index(object, "/"); i >= 0 {
+				recordingContainer = object[:i]
+			}
+			if container == "RecordingsMKV" {
+				result = append(result, map[string]interface{}{
+					"filename":  object,
+					"container": recordingContainer,
+					"recording": recordingURL(object),
+				})
+				continue
+			}
 
-	case "RecordingsMetadata":
-		for _, file := range files {
-			if strings.HasSuffix(file.Name(), ".meta") {
-				metaPath := filepath.Join(containerPath, file.Name())
-				content, err := os.ReadFile(metaPath)
-				if err != nil {
-					log.Printf("Failed to read metadata file %s: %v", metaPath, err)
-					continue
-				}
-				var meta map[string]string
-				if err := json.Unmarshal(content, &meta); err != nil {
-					log.Printf("Failed to parse metadata JSON in %s: %v", metaPath, err)
-					continue
-				}
-				entry := make(map[string]interface{})
-				for k, v := range meta {
-					entry[k] = v
-				}
-				result = append(result, entry)
+			metaPath := metaFilePath(object)
+			if _, err := os.Stat(metaPath); err != nil {
+				continue
+			}
+			meta, err := readMetadata(metaPath)
+			if err != nil {
+				log.Log(Warning, "failed to read metadata file", "path", metaPath, "error", err)
+				continue
+			}
+			entry := make(map[string]interface{})
+			for k, v := range meta.Map() {
+				entry[k] = v
+			}
+			if _, ok := entry["filename"]; !ok {
+				entry["filename"] = object
+			}
+			if _, ok := entry["container"]; !ok {
+				entry["container"] = recordingContainer
 			}
+			result = append(result, entry)
 		}
 
 	case "Devices", "Users", "System":
+		containerPath := filepath.Join(LocalStoragePath, StorageAccount, container)
+		files, err := os.ReadDir(containerPath)
+		if err != nil {
+			http.Error(w, "Failed to read directory", http.StatusInternalServerError)
+			log.Log(Error, "failed to read directory", "path", containerPath, "error", err)
+			return
+		}
 		for _, file := range files {
 			if file.IsDir() || !strings.HasSuffix(file.Name(), ".meta") {
 				continue
 			}
 
 			metaPath := filepath.Join(containerPath, file.Name())
-			content, err := os.ReadFile(metaPath)
+			meta, err := readMetadata(metaPath)
 			if err != nil {
-				log.Printf("Failed to read metadata file %s: %v", metaPath, err)
-				continue
-			}
-			var meta map[string]string
-			if err := json.Unmarshal(content, &meta); err != nil {
-				log.Printf("Failed to parse JSON %s: %v", metaPath, err)
+				log.Log(Warning, "failed to read metadata file", "path", metaPath, "error", err)
 				continue
 			}
 
-			switch container {
-			case "Devices", "Users":
-				if strings.ToLower(meta["active"]) == "true" {
-					entry := make(map[string]interface{})
-					for k, v := range meta {
-						entry[k] = v
-					}
-					result = append(result, entry)
-				}
-			case "System":
-				if _, ok := meta["connectionid"]; ok {
-					entry := make(map[string]interface{})
-					for k, v := range meta {
-						entry[k] = v
-					}
-					result = append(result, entry)
+			if partyActive(container, meta) && !id.ownedByOther(meta) {
+				entry := make(map[string]interface{})
+				for k, v := range meta.Map() {
+					entry[k] = v
 				}
+				result = append(result, entry)
 			}
 		}
 	default:
 		http.Error(w, "Unsupported container", http.StatusBadRequest)
-		log.Printf("Unsupported container: %s", container)
+		log.Log(Info, "unsupported container for active metadata", "container", container)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
-	log.Printf("Active metadata for container %s returned (%d entries)", container, len(result))
+	log.Log(Debug, "active metadata returned", "container", container, "entries", len(result))
 }
 
-
-
 // StorageHandler routes requests for object storage
 func StorageHandler(w http.ResponseWriter, r *http.Request) {
-	prefix := fmt.Sprintf("/v1.0/%s/", StorageAccount)
-	path := strings.TrimPrefix(r.URL.Path, prefix)
+	prefix := fmt.Sprintf("/v1.0/%s", StorageAccount)
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if !validStoragePath(path) {
+		http.Error(w, "Bad Request: invalid path", http.StatusBadRequest)
+		requestLogger(r).Log(Warning, "storage path outside the account refused", "path", path, "remote_addr", r.RemoteAddr)
+		return
+	}
+
+	if isTempURLRequest(r) {
+		var ok bool
+		r, ok = authorizeTempURL(w, r, path)
+		if !ok || !authorizeStorage(w, r, path) {
+			return
+		}
+	} else {
+		var ok bool
+		r, ok = authenticateRequest(w, r)
+		if !ok || !authorizeStorage(w, r, path) {
+			return
+		}
+		w = hideTempURLKeys(w, r, path)
+	}
+
+	if path == "" {
+		handleAccountRequest(w, r)
+		return
+	}
 
 	if strings.HasSuffix(path, "/active") && r.Method == http.MethodGet {
 		handleActiveMetadataRequest(w, r, path)
@@ -250,14 +442,16 @@ func StorageHandler(w http.ResponseWriter, r *http.Request) {
 	case http.MethodPut:
 		putObject(w, r, path)
 	case http.MethodGet:
-		getObject(w, path)
+		getObject(w, r, path)
 	case http.MethodPost:
 		handlePostMetadata(w, r, path)
 	case http.MethodHead:
 		handleHeadRequest(w, r, path)
+	case http.MethodDelete:
+		deleteObject(w, r, path)
 	default:
 		http.Error(w, "Unsupported method", http.StatusMethodNotAllowed)
-		log.Printf("Unsupported method %s for path %s", r.Method, path)
+		requestLogger(r).Log(Info, "unsupported method", "method", r.Method, "path", path)
 	}
 }
 
@@ -274,19 +468,98 @@ func generateETag(path string) string {
 	return fmt.Sprintf("%x", hash.Sum(nil))
 }
 
-func countObjects(path string) string {
-	files, _ := os.ReadDir(path)
-	return fmt.Sprintf("%d", len(files))
+var (
+	etagCacheMu sync.Mutex
+	etagCache   = map[string]etagEntry{}
+)
+
+type etagEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// cachedETag returns the ETag of path, only rehashing it when its size or
+// modification time changed; listings use it to avoid reading every recording
+func cachedETag(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	etagCacheMu.Lock()
+	entry, ok := etagCache[path]
+	etagCacheMu.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.etag
+	}
+	etag := generateETag(path)
+	etagCacheMu.Lock()
+	etagCache[path] = etagEntry{size: info.Size(), modTime: info.ModTime(), etag: etag}
+	etagCacheMu.Unlock()
+	return etag
 }
 
-func calculateSize(path string) string {
-	var total int64
-	_ = filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
-		if err == nil && !info.IsDir() {
-			total += info.Size()
+// objectETag returns the ETag putObject stored in the object's metadata, and only
+// hashes the file at path for objects stored without one
+func objectETag(path string, meta *Metadata) string {
+	if meta != nil {
+		if etag := meta.SysGet(sysETag); etag != "" {
+			return etag
 		}
+	}
+	return cachedETag(path)
+}
+
+// rememberETag caches an ETag computed while the object was written
+func rememberETag(path, etag string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	etagCacheMu.Lock()
+	etagCache[path] = etagEntry{size: info.Size(), modTime: info.ModTime(), etag: etag}
+	etagCacheMu.Unlock()
+}
+
+// forgetObject drops what is cached about the file at path once it is deleted,
+// moved or replaced, so the caches only hold stored objects
+func forgetObject(path string) {
+	etagCacheMu.Lock()
+	delete(etagCache, path)
+	etagCacheMu.Unlock()
+	videoInfoMu.Lock()
+	delete(videoInfoCache, path)
+	videoInfoMu.Unlock()
+	hlsIndexMu.Lock()
+	delete(hlsIndexCache, path)
+	hlsIndexMu.Unlock()
+}
+
+// countObjects counts the objects below path, ignoring .meta sidecars
+func countObjects(path string) int64 {
+	objects, _ := storageUsage(path)
+	return objects
+}
+
+// calculateSize sums the size of the objects below path, ignoring .meta sidecars
+func calculateSize(path string) int64 {
+	_, bytes := storageUsage(path)
+	return bytes
+}
+
+// storageUsage walks path and returns the number and total size of stored objects
+func storageUsage(path string) (objects, bytes int64) {
+	_ = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(info.Name(), ".meta") || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		info = followLink(p, info)
+		objects++
+		bytes += info.Size()
 		return nil
 	})
-	return fmt.Sprintf("%d", total)
+	return objects, bytes
 }
-
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestObjectMetadataPost(t *testing.T) {
+	url := startTestServer(t)
+	object := url + "/v1.0/" + StorageAccount + "/CamA/clip.mkv"
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	request(t, http.MethodPut, url+"/v1.0/"+StorageAccount+"/CamA", admin, nil, nil)
+	put, _ := send(t, http.MethodPut, object, admin, http.Header{
+		"Content-Type":          {"video/x-matroska"},
+		"X-Object-Meta-UserID":  {"u1"},
+		"X-Object-Meta-Station": {"north"},
+	}, "video")
+	if put.StatusCode != http.StatusCreated || put.Header.Get("Etag") == "" {
+		t.Fatalf("PUT: %s, ETag %q", put.Status, put.Header.Get("Etag"))
+	}
+
+	// A POST replaces all user metadata, keeping the content type and checksums
+	resp, _ := send(t, http.MethodPost, object, admin, http.Header{
+		"X-Object-Meta-DeviceID":   {"cam-1"},
+		"X-Object-Meta-Empty":      {""},
+		"X-Container-Meta-Ignored": {"x"},
+	}, "")
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("POST: %s", resp.Status)
+	}
+	resp, _ = send(t, http.MethodHead, object, admin, nil, "")
+	for name, want := range map[string]string{
+		"X-Object-Meta-Deviceid": "cam-1",
+		"X-Object-Meta-Userid":   "",
+		"X-Object-Meta-Station":  "",
+		"X-Object-Meta-Empty":    "",
+		"X-Object-Meta-Ignored":  "",
+		"Content-Type":           "video/x-matroska",
+		"Etag":                   put.Header.Get("Etag"),
+	} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("after POST %s: %q, want %q", name, got, want)
+		}
+	}
+
+	// A new Content-Type replaces the stored one; no headers clears the user metadata
+	send(t, http.MethodPost, object, admin, http.Header{"Content-Type": {"video/webm"}}, "")
+	resp, _ = send(t, http.MethodHead, object, admin, nil, "")
+	if resp.Header.Get("Content-Type") != "video/webm" || resp.Header.Get("X-Object-Meta-Deviceid") != "" {
+		t.Errorf("after second POST: %v", resp.Header)
+	}
+
+	if resp, _ := send(t, http.MethodPost, url+"/v1.0/"+StorageAccount+"/CamA/missing.mkv", admin, nil, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("POST of a missing object: %s", resp.Status)
+	}
+}
+
+func TestContainerMetadataPost(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	send(t, http.MethodPut, storage+"/CamA", admin, http.Header{"X-Container-Meta-Site": {"north"}, "X-Container-Meta-Owner": {"ops"}}, "")
+
+	// Container and account POSTs merge; empty values and X-Remove-* delete
+	for _, tc := range []struct {
+		path   string
+		prefix string
+	}{
+		{"/CamA", "Container"},
+		{"", "Account"},
+	} {
+		send(t, http.MethodPost, storage+tc.path, admin, http.Header{"X-" + tc.prefix + "-Meta-Site": {"north"}, "X-" + tc.prefix + "-Meta-Owner": {"ops"}}, "")
+		resp, _ := send(t, http.MethodPost, storage+tc.path, admin, http.Header{
+			"X-" + tc.prefix + "-Meta-Added":         {"yes"},
+			"X-" + tc.prefix + "-Meta-Owner":         {""},
+			"X-Remove-" + tc.prefix + "-Meta-Site":   {"x"},
+			"X-Remove-" + tc.prefix + "-Meta-Absent": {"x"},
+		}, "")
+		if resp.StatusCode != http.StatusNoContent {
+			t.Errorf("POST %q: %s", tc.path, resp.Status)
+		}
+		send(t, http.MethodPost, storage+tc.path, admin, http.Header{"X-" + tc.prefix + "-Meta-Kept": {"1"}}, "")
+		resp, _ = send(t, http.MethodHead, storage+tc.path, admin, nil, "")
+		prefix := "X-" + tc.prefix + "-Meta-"
+		for name, want := range map[string]string{"Added": "yes", "Kept": "1", "Owner": "", "Site": ""} {
+			if got := resp.Header.Get(prefix + name); got != want {
+				t.Errorf("%q %s: %q, want %q", tc.path, name, got, want)
+			}
+		}
+	}
+}
+
+func TestMetadataLimits(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	request(t, http.MethodPut, storage+"/CamA", admin, nil, nil)
+	request(t, http.MethodPut, storage+"/CamA/clip.mkv", admin, nil, strings.NewReader("video"))
+
+	many := http.Header{}
+	for i := 0; i <= maxMetaCount; i++ {
+		many.Set(fmt.Sprintf("X-Container-Meta-K%d", i), "v")
+	}
+	for _, tc := range []struct {
+		name, path string
+		header     http.Header
+	}{
+		{"name too long", "/CamA/clip.mkv", http.Header{"X-Object-Meta-" + strings.Repeat("n", maxMetaNameLength+1): {"v"}}},
+		{"value too long", "/CamA/clip.mkv", http.Header{"X-Object-Meta-Note": {strings.Repeat("v", maxMetaValueLength+1)}}},
+		{"too many", "/CamA", many},
+		{"too large", "/CamA", http.Header{
+			"X-Container-Meta-A": {strings.Repeat("v", 250)}, "X-Container-Meta-B": {strings.Repeat("v", 250)},
+			"X-Container-Meta-C": {strings.Repeat("v", 250)}, "X-Container-Meta-D": {strings.Repeat("v", 250)},
+			"X-Container-Meta-E": {strings.Repeat("v", 250)}, "X-Container-Meta-F": {strings.Repeat("v", 250)},
+			"X-Container-Meta-G": {strings.Repeat("v", 250)}, "X-Container-Meta-H": {strings.Repeat("v", 250)},
+			"X-Container-Meta-I": {strings.Repeat("v", 250)}, "X-Container-Meta-J": {strings.Repeat("v", 250)},
+			"X-Container-Meta-K": {strings.Repeat("v", 250)}, "X-Container-Meta-L": {strings.Repeat("v", 250)},
+			"X-Container-Meta-M": {strings.Repeat("v", 250)}, "X-Container-Meta-N": {strings.Repeat("v", 250)},
+			"X-Container-Meta-O": {strings.Repeat("v", 250)}, "X-Container-Meta-P": {strings.Repeat("v", 250)},
+			"X-Container-Meta-Q": {strings.Repeat("v", 250)},
+		}},
+	} {
+		if resp, _ := send(t, http.MethodPost, storage+tc.path, admin, tc.header, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: %s, want 400", tc.name, resp.Status)
+		}
+	}
+	if resp, _ := send(t, http.MethodHead, storage+"/CamA/clip.mkv", admin, nil, ""); resp.Header.Get("X-Object-Meta-Note") != "" {
+		t.Error("rejected metadata was stored")
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// .meta sidecars store metadata losslessly: keys keep the spelling the client used
+// (e.g. "connectionID"), repeated headers keep every value, and values that are not
+// valid UTF-8 are stored base64 encoded so their bytes come back unchanged.
+//
+//	{
+//	  "format": 2,
+//	  "items": [
+//	    {"name": "connectionID", "values": ["b2c1..."]},
+//	    {"name": "Raw", "values": ["/w=="], "encoding": "base64"}
+//	  ]
+//	}
+//
+// System metadata kept by the server itself (expiry time, ...) is stored under
+// "sysmeta"; it is never returned as X-*-Meta-* headers and survives metadata POSTs.
+//
+// Sidecars written before format 2 are flat {"key": "value"} objects and are still read.
+
+const metadataFormat = 2
+
+// MetaItem is one metadata key with all of its values
+type MetaItem struct {
+	Name   string
+	Values []string
+}
+
+// Metadata is the ordered set of user metadata of an account, container or object,
+// along with the server's system metadata for it
+type Metadata struct {
+	Items []MetaItem
+	Sys   map[string]string
+}
+
+type metaItemJSON struct {
+	Name     string   `json:"name"`
+	Values   []string `json:"values"`
+	Encoding string   `json:"encoding,omitempty"`
+}
+
+type metadataFileJSON struct {
+	Format int               `json:"format"`
+	Items  []metaItemJSON    `json:"items"`
+	Sys    map[string]string `json:"sysmeta,omitempty"`
+}
+
+func (m *Metadata) index(name string) int {
+	for i, item := range m.Items {
+		if strings.EqualFold(item.Name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Get returns the first value of name, compared case-insensitively like HTTP headers
+func (m *Metadata) Get(name string) (string, bool) {
+	if i := m.index(name); i >= 0 && len(m.Items[i].Values) > 0 {
+		return m.Items[i].Values[0], true
+	}
+	return "", false
+}
+
+// Set replaces name, keeping the new spelling of the key
+func (m *Metadata) Set(name string, values ...string) {
+	item := MetaItem{Name: name, Values: append([]string(nil), values...)}
+	if i := m.index(name); i >= 0 {
+		m.Items[i] = item
+		return
+	}
+	m.Items = append(m.Items, item)
+}
+
+// Delete removes name if present
+func (m *Metadata) Delete(name string) {
+	if i := m.index(name); i >= 0 {
+		m.Items = append(m.Items[:i], m.Items[i+1:]...)
+	}
+}
+
+// Len returns the number of keys
+func (m *Metadata) Len() int {
+	return len(m.Items)
+}
+
+// SysGet returns a system metadata value
+func (m *Metadata) SysGet(key string) string {
+	return m.Sys[key]
+}
+
+// SysSet sets a system metadata value; an empty value removes it
+func (m *Metadata) SysSet(key, value string) {
+	if value == "" {
+		delete(m.Sys, key)
+		return
+	}
+	if m.Sys == nil {
+		m.Sys = make(map[string]string)
+	}
+	m.Sys[key] = value
+}
+
+// Map flattens the metadata for JSON listings, joining repeated values with ", "
+func (m *Metadata) Map() map[string]string {
+	result := make(map[string]string, len(m.Items))
+	for _, item := range m.Items {
+		result[item.Name] = strings.Join(item.Values, ", ")
+	}
+	return result
+}
+
+// readMetadata loads a .meta sidecar; a missing sidecar yields empty metadata
+func readMetadata(metaPath string) (*Metadata, error) {
+	content, err := os.ReadFile(metaPath)
+	if os.IsNotExist(err) {
+		return &Metadata{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	meta, err := decodeMetadata(content)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", metaPath, err)
+	}
+	return meta, nil
+}
+
+func decodeMetadata(content []byte) (*Metadata, error) {
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(content, &probe); err != nil {
+		return nil, err
+	}
+	// A flat sidecar may hold user keys named format or items, e.g. from
+	// X-Object-Meta-Format, but then as strings
+	var format float64
+	isFormat2 := json.Unmarshal(probe["format"], &format) == nil && strings.HasPrefix(string(probe["items"]), "[")
+	if !isFormat2 {
+		// Flat key/value sidecar written by older versions
+		var legacy map[string]string
+		if err := json.Unmarshal(content, &legacy); err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(legacy))
+		for k := range legacy {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		meta := &Metadata{}
+		for _, k := range keys {
+			meta.Items = append(meta.Items, MetaItem{Name: k, Values: []string{legacy[k]}})
+		}
+		return meta, nil
+	}
+
+	var file metadataFileJSON
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, err
+	}
+	meta := &Metadata{Sys: file.Sys}
+	for _, item := range file.Items {
+		values := item.Values
+		if item.Encoding == "base64" {
+			values = make([]string, len(item.Values))
+			for i, v := range item.Values {
+				raw, err := base64.StdEncoding.DecodeString(v)
+				if err != nil {
+					return nil, fmt.Errorf("item %s: %w", item.Name, err)
+				}
+				values[i] = string(raw)
+			}
+		}
+		meta.Items = append(meta.Items, MetaItem{Name: item.Name, Values: values})
+	}
+	return meta, nil
+}
+
+func encodeMetadata(meta *Metadata) ([]byte, error) {
+	file := metadataFileJSON{Format: metadataFormat, Items: []metaItemJSON{}, Sys: meta.Sys}
+	for _, item := range meta.Items {
+		entry := metaItemJSON{Name: item.Name, Values: item.Values}
+		for _, v := range item.Values {
+			if !utf8.ValidString(v) {
+				entry.Encoding = "base64"
+				break
+			}
+		}
+		if entry.Encoding == "base64" {
+			entry.Values = make([]string, len(item.Values))
+			for i, v := range item.Values {
+				entry.Values[i] = base64.StdEncoding.EncodeToString([]byte(v))
+			}
+		}
+		file.Items = append(file.Items, entry)
+	}
+	return json.MarshalIndent(file, "", "  ")
+}
+
+// writeMetadata atomically replaces a .meta sidecar, removing it when meta is empty.
+// Each write stages its own hidden temporary file, so concurrent writers never mix
+// their content and listings don't show the file while it exists.
+func writeMetadata(metaPath string, meta *Metadata) error {
+	if meta.Len() == 0 && len(meta.Sys) == 0 {
+		if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	content, err := encodeMetadata(meta)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(metaPath), "."+filepath.Base(metaPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(content)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, metaPath)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
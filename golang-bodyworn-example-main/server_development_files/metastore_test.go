@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMetadataEncoding(t *testing.T) {
+	meta := &Metadata{}
+	meta.Set("connectionID", "b2c1")
+	meta.Set("Bookmark", "start", "end")
+	meta.Set("Raw", "\xff\x00binary")
+	meta.SysSet(sysETag, "abc")
+
+	content, err := encodeMetadata(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), `"encoding": "base64"`) || strings.Contains(string(content), "binary") {
+		t.Errorf("invalid UTF-8 not base64 encoded: %s", content)
+	}
+	decoded, err := decodeMetadata(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, meta) {
+		t.Errorf("round trip: %+v, want %+v", decoded, meta)
+	}
+
+	// Keys compare case-insensitively; setting one again takes the new spelling
+	if v, ok := decoded.Get("CONNECTIONID"); !ok || v != "b2c1" {
+		t.Errorf("Get: %q, %v", v, ok)
+	}
+	decoded.Set("ConnectionId", "c3d4")
+	decoded.Delete("bookmark")
+	if decoded.Items[0].Name != "ConnectionId" || decoded.Len() != 2 {
+		t.Errorf("after Set and Delete: %+v", decoded.Items)
+	}
+	if got := meta.Map()["Bookmark"]; got != "start, end" {
+		t.Errorf("Map joins values as %q", got)
+	}
+
+	// Sidecars of older versions are flat objects
+	legacy, err := decodeMetadata([]byte(`{"userID": "u1", "deviceID": "cam"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []MetaItem{{"deviceID", []string{"cam"}}, {"userID", []string{"u1"}}}; !reflect.DeepEqual(legacy.Items, want) {
+		t.Errorf("legacy sidecar: %+v", legacy.Items)
+	}
+	// User keys named format or items don't make a flat sidecar look like format 2
+	for content, want := range map[string]map[string]string{
+		`{"format": "mkv", "userID": "u1"}`: {"format": "mkv", "userID": "u1"},
+		`{"format": "2", "items": "[1]"}`:   {"format": "2", "items": "[1]"},
+		`{"items": "3"}`:                    {"items": "3"},
+	} {
+		if legacy, err := decodeMetadata([]byte(content)); err != nil || !reflect.DeepEqual(legacy.Map(), want) {
+			t.Errorf("legacy sidecar %s: %+v, %v", content, legacy, err)
+		}
+	}
+	for _, bad := range []string{`[]`, `{"format": 2, "items": [{"name": "x", "values": ["!"], "encoding": "base64"}]}`} {
+		if _, err := decodeMetadata([]byte(bad)); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+func TestWriteMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "clip.mkv.meta")
+	if meta, err := readMetadata(path); err != nil || meta.Len() != 0 {
+		t.Fatalf("missing sidecar: %+v, %v", meta, err)
+	}
+	meta := &Metadata{}
+	meta.Set("k", "v")
+	if err := writeMetadata(path, meta); err != nil {
+		t.Fatal(err)
+	}
+	// Concurrent writers each stage their own temporary file
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m := &Metadata{}
+			m.Set("writer", fmt.Sprint(i))
+			errs <- writeMetadata(path, m)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent write: %v", err)
+		}
+	}
+	if got, err := readMetadata(path); err != nil || got.Len() != 1 {
+		t.Errorf("after concurrent writes: %+v, %v", got, err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Errorf("sidecar mode: %v %v", info.Mode(), err)
+	}
+	// Empty metadata removes the sidecar
+	if err := writeMetadata(path, &Metadata{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("empty metadata kept the sidecar: %v", err)
+	}
+}
+
+// rawExchange sends a raw HTTP request to the server at url and returns the
+// response's header lines as sent
+func rawExchange(t *testing.T, url, request string) []string {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+func TestMetadataSpellingKept(t *testing.T) {
+	url := startTestServer(t)
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	path := "/v1.0/" + StorageAccount + "/CamA"
+	host := strings.TrimPrefix(url, "http://")
+	rawExchange(t, url, fmt.Sprintf("PUT %s HTTP/1.1\r\nHost: %s\r\nX-Auth-Token: %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", path, host, admin))
+
+	// Repeated headers keep all their values, and names the spelling used on the wire
+	request := fmt.Sprintf("PUT %s/clip.mkv HTTP/1.1\r\nHost: %s\r\nX-Auth-Token: %s\r\n"+
+		"X-Object-Meta-connectionID: b2c1\r\nx-object-meta-Bookmark: start\r\nX-Object-Meta-bookmark: end\r\n"+
+		"Content-Length: 5\r\nConnection: close\r\n\r\nvideo", path, host, admin)
+	if lines := rawExchange(t, url, request); !strings.Contains(lines[0], "201") {
+		t.Fatalf("PUT: %s", lines[0])
+	}
+	lines := rawExchange(t, url, fmt.Sprintf("HEAD %s/clip.mkv HTTP/1.1\r\nHost: %s\r\nX-Auth-Token: %s\r\nConnection: close\r\n\r\n", path, host, admin))
+	var meta []string
+	for _, line := range lines {
+		if strings.HasPrefix(strings.ToLower(line), "x-object-meta-") {
+			meta = append(meta, line)
+		}
+	}
+	// net/http writes the names sorted, and values in their order
+	want := []string{"X-Object-Meta-Bookmark: start", "X-Object-Meta-Bookmark: end", "X-Object-Meta-connectionID: b2c1"}
+	if !reflect.DeepEqual(meta, want) {
+		t.Errorf("HEAD metadata %q, want %q", meta, want)
+	}
+}
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are exposed in the Prometheus text exposition format so any
+// Prometheus compatible scraper can read /metrics without extra dependencies.
+
+// ContainerStatsTTL is how long cached per-container object and byte counts are reused
+var ContainerStatsTTL = 60 * time.Second
+
+// latencyBuckets are the upper bounds, in seconds, of the request duration histogram
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// metricVec is a set of float values keyed by their label values
+type metricVec struct {
+	mu     sync.Mutex
+	labels []string
+	values map[string]float64
+}
+
+func newMetricVec(labels ...string) *metricVec {
+	return &metricVec{labels: labels, values: make(map[string]float64)}
+}
+
+func (m *metricVec) add(delta float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[strings.Join(labelValues, "\xff")] += delta
+}
+
+func (m *metricVec) set(value float64, labelValues ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[strings.Join(labelValues, "\xff")] = value
+}
+
+func (m *metricVec) write(w io.Writer, name, help, kind string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	if len(m.labels) == 0 {
+		fmt.Fprintf(w, "%s %s\n", name, formatMetricValue(m.values[""]))
+		return
+	}
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, formatLabels(m.labels, strings.Split(key, "\xff")), formatMetricValue(m.values[key]))
+	}
+}
+
+// histogramVec tracks cumulative bucket counts per label set
+type histogramVec struct {
+	mu      sync.Mutex
+	labels  []string
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+}
+
+func (h *histogramVec) observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		values := strings.Split(key, "\xff")
+		for i, upper := range h.buckets {
+			labels := formatLabels(append(append([]string{}, h.labels...), "le"), append(append([]string{}, values...), formatMetricValue(upper)))
+			fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, labels, s.counts[i])
+		}
+		labels := formatLabels(append(append([]string{}, h.labels...), "le"), append(append([]string{}, values...), "+Inf"))
+		fmt.Fprintf(w, "%s_bucket{%s} %d\n", name, labels, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, formatLabels(h.labels, values), formatMetricValue(s.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, formatLabels(h.labels, values), s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatLabels(names, values []string) string {
+	parts := make([]string, len(names))
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		parts[i] = fmt.Sprintf("%s=%s", name, strconv.Quote(v))
+	}
+	return strings.Join(parts, ",")
+}
+
+func formatMetricValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	metricRequests        = newMetricVec("method", "code")
+	metricRequestDuration = newHistogramVec(latencyBuckets, "method", "code")
+	metricUploadBytes     = newMetricVec()
+	metricDownloadBytes   = newMetricVec()
+	metricUploadsInFlight = newMetricVec()
+	metricAuthFailures    = newMetricVec()
+)
+
+// metricMethod keeps the method label to a small, fixed set of values
+func metricMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost,
+		http.MethodDelete, http.MethodOptions, "COPY":
+		return method
+	}
+	return "OTHER"
+}
+
+// WithMetrics records request counts and latencies for every request
+func WithMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		method, code := metricMethod(r.Method), strconv.Itoa(rec.status)
+		metricRequests.add(1, method, code)
+		metricRequestDuration.observe(time.Since(start).Seconds(), method, code)
+	})
+}
+
+// Container statistics cache
+
+type containerStat struct {
+	objects  int64
+	bytes    int64
+	computed time.Time
+}
+
+var (
+	containerStatsMu    sync.Mutex
+	containerStatsCache = make(map[string]containerStat)
+)
+
+// containerStats returns the object count and bytes used for a container,
+// recomputing them only when the cached values are older than ContainerStatsTTL
+func containerStats(container string) (objects, bytes int64) {
+	containerStatsMu.Lock()
+	cached, ok := containerStatsCache[container]
+	containerStatsMu.Unlock()
+	if ok && time.Since(cached.computed) < ContainerStatsTTL {
+		return cached.objects, cached.bytes
+	}
+
+	fullPath := filepath.Join(LocalStoragePath, StorageAccount, container)
+	objects, bytes = storageUsage(fullPath)
+	stat := containerStat{objects: objects, bytes: bytes, computed: time.Now()}
+	containerStatsMu.Lock()
+	containerStatsCache[container] = stat
+	containerStatsMu.Unlock()
+	return stat.objects, stat.bytes
+}
+
+// invalidateContainerStats drops the cached statistics of the container holding path
+func invalidateContainerStats(path string) {
+	container := strings.SplitN(strings.Trim(path, "/"), "/", 2)[0]
+	containerStatsMu.Lock()
+	delete(containerStatsCache, container)
+	containerStatsMu.Unlock()
+}
+
+// MetricsHandler serves all metrics in the Prometheus text format
+func MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	metricRequests.write(w, "bodyworn_http_requests_total", "HTTP requests handled, by method and status code.", "counter")
+	metricRequestDuration.write(w, "bodyworn_http_request_duration_seconds", "HTTP request latency in seconds, by method and status code.")
+	metricUploadBytes.write(w, "bodyworn_upload_bytes_total", "Bytes received in object uploads.", "counter")
+	metricDownloadBytes.write(w, "bodyworn_download_bytes_total", "Bytes sent in object downloads.", "counter")
+	metricUploadsInFlight.set(float64(inFlightUploadCount()))
+	metricUploadsInFlight.write(w, "bodyworn_uploads_in_flight", "Object uploads currently in progress.", "gauge")
+	metricAuthFailures.write(w, "bodyworn_auth_failures_total", "Failed authentication attempts.", "counter")
+	metricQuotaRejections.write(w, "bodyworn_quota_rejections_total", "Uploads refused with 413 because of a quota, by scope.", "counter")
+	metricUploadsRejected.write(w, "bodyworn_uploads_rejected_total", "Uploads refused before being stored, by reason.", "counter")
+	metricDiskLevel.write(w, "bodyworn_storage_space_level", "Storage space level: 0=ok, 1=warning, 2=critical.", "gauge")
+	metricDiskLevelEvents.write(w, "bodyworn_storage_space_level_changes_total", "Transitions into each storage space level.", "counter")
+	writeWebhookMetrics(w)
+	writeReplicationMetrics(w)
+	writeTieringMetrics(w)
+	writeScrubMetrics(w)
+
+	containerObjects := newMetricVec("container")
+	containerBytes := newMetricVec("container")
+	rootPath := filepath.Join(LocalStoragePath, StorageAccount)
+	if entries, err := os.ReadDir(rootPath); err == nil {
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			objects, bytes := containerStats(entry.Name())
+			containerObjects.set(float64(objects), entry.Name())
+			containerBytes.set(float64(bytes), entry.Name())
+		}
+	} else {
+		requestLogger(r).Log(Warning, "failed to read storage root for metrics", "path", rootPath, "error", err)
+	}
+	containerObjects.write(w, "bodyworn_container_objects", "Objects stored per container (cached).", "gauge")
+	containerBytes.write(w, "bodyworn_container_bytes", "Bytes stored per container (cached).", "gauge")
+
+	free := newMetricVec()
+	total := newMetricVec()
+	if space, err := diskSpace(rootPath); err == nil {
+		free.set(float64(space.Free))
+		total.set(float64(space.Total))
+		free.write(w, "bodyworn_storage_free_bytes", "Bytes available to the server on the storage volume.", "gauge")
+		total.write(w, "bodyworn_storage_total_bytes", "Total size in bytes of the storage volume.", "gauge")
+	} else {
+		requestLogger(r).Log(Debug, "disk space unavailable for metrics", "path", rootPath, "error", err)
+	}
+}
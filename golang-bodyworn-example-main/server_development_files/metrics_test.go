@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestMetrics(t *testing.T) {
+	h := WithMetrics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	for i := 0; i < 2; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("COPY", "/v1.0/x", nil))
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("BREW", "/v1.0/x", nil))
+
+	rec := httptest.NewRecorder()
+	MetricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`bodyworn_http_requests_total{method="COPY",code="418"} 2`,
+		`bodyworn_http_request_duration_seconds_count{method="COPY",code="418"} 2`,
+		`bodyworn_http_request_duration_seconds_bucket{method="COPY",code="418",le="+Inf"} 2`,
+		`bodyworn_http_request_duration_seconds_count{method="OTHER",code="418"} 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("/metrics lacks %s", want)
+		}
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	h := newHistogramVec([]float64{0.1, 1}, "method")
+	for _, v := range []float64{0.05, 0.5, 5} {
+		h.observe(v, "GET")
+	}
+	var b strings.Builder
+	h.write(&b, "d", "help")
+	for _, want := range []string{
+		`d_bucket{method="GET",le="0.1"} 1`,
+		`d_bucket{method="GET",le="1"} 2`,
+		`d_bucket{method="GET",le="+Inf"} 3`,
+		`d_sum{method="GET"} 5.55`,
+		`d_count{method="GET"} 3`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("histogram lacks %s:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestMetricsAccess(t *testing.T) {
+	url := startTestServer(t)
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	reviewer := addTestAccount(t, url, admin, "monitoring", RoleReviewer)
+	system := addTestAccount(t, url, admin, "dems", RoleSystem)
+	for _, tc := range []struct {
+		name, token string
+		want        int
+	}{
+		{"anonymous", "", http.StatusUnauthorized},
+		{"system", system, http.StatusForbidden},
+		{"reviewer", reviewer, http.StatusOK},
+		{"admin", admin, http.StatusOK},
+	} {
+		code, body := do(t, http.MethodGet, url+"/metrics", tc.token, "")
+		if code != tc.want {
+			t.Errorf("%s: %d, want %d", tc.name, code, tc.want)
+		}
+		if code == http.StatusOK && !strings.Contains(body, "bodyworn_http_requests_total") {
+			t.Errorf("%s: no metrics in %q", tc.name, body)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskQueue is a persistent work queue: every item is a JSON file in dir, written
+// atomically, so queued work survives restarts. Items that keep failing are moved to
+// dir/failed after maxAttempts, or at once when the handler returns a permanentError.
+
+// queueItem is one queued unit of work
+type queueItem struct {
+	ID          string          `json:"id"`
+	Created     time.Time       `json:"created"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"next_attempt"`
+	LastError   string          `json:"last_error,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+}
+
+// permanentError marks a failure that retrying won't fix
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+type diskQueue struct {
+	dir         string
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	// failed, when set, is called with items that won't be retried again
+	failed func(payload json.RawMessage, err error)
+
+	mu     sync.Mutex
+	seq    int64
+	wake   chan struct{}
+	queued int
+}
+
+// openDiskQueue opens or creates the queue stored in dir
+func openDiskQueue(dir string, maxAttempts int) (*diskQueue, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "failed"), 0755); err != nil {
+		return nil, fmt.Errorf("create queue %s: %w", dir, err)
+	}
+	q := &diskQueue{
+		dir:         dir,
+		maxAttempts: maxAttempts,
+		baseDelay:   5 * time.Second,
+		maxDelay:    time.Hour,
+		wake:        make(chan struct{}, 1),
+	}
+	names, err := q.itemNames()
+	if err != nil {
+		return nil, err
+	}
+	q.queued = len(names)
+	return q, nil
+}
+
+// itemNames lists the queued item files in the order they were pushed
+func (q *diskQueue) itemNames() ([]string, error) {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// push stores payload as a new item and wakes the worker
+func (q *diskQueue) push(payload interface{}) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.seq++
+	now := time.Now().UTC()
+	item := queueItem{
+		ID:          fmt.Sprintf("%020d-%06d", now.UnixNano(), q.seq%1000000),
+		Created:     now,
+		NextAttempt: now,
+		Payload:     raw,
+	}
+	q.mu.Unlock()
+
+	if err := q.write(item); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.queued++
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *diskQueue) write(item queueItem) error {
+	content, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(q.dir, item.ID+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writable checks that items can still be pushed, for readiness checks
+func (q *diskQueue) writable() error {
+	f, err := os.CreateTemp(q.dir, ".check-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+// sync makes the queued items durable. They are written and renamed into place as
+// they are pushed, but not synced, so this is what a shutdown waits for.
+func (q *diskQueue) sync() error {
+	names, err := q.itemNames()
+	if err != nil {
+		return err
+	}
+	paths := []string{q.dir, filepath.Join(q.dir, "failed")}
+	for _, name := range names {
+		paths = append(paths, filepath.Join(q.dir, name))
+	}
+	var errs []error
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) {
+			// Delivered meanwhile
+			continue
+		}
+		if err == nil {
+			err = f.Sync()
+			f.Close()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("sync %s: %w", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (q *diskQueue) read(name string) (queueItem, error) {
+	var item queueItem
+	content, err := os.ReadFile(filepath.Join(q.dir, name))
+	if err != nil {
+		return item, err
+	}
+	err = json.Unmarshal(content, &item)
+	return item, err
+}
+
+// depth returns the number of items waiting, including ones backing off
+func (q *diskQueue) depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.queued
+}
+
+// backoff returns the delay before the next attempt, doubling per attempt with jitter
+func (q *diskQueue) backoff(attempts int) time.Duration {
+	d := q.baseDelay
+	for i := 1; i < attempts && d < q.maxDelay; i++ {
+		d *= 2
+	}
+	if d > q.maxDelay {
+		d = q.maxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// run hands due items to handle, oldest first, until ctx is cancelled. Successful
+// items are removed, failed ones are rescheduled or moved to the failed directory.
+func (q *diskQueue) run(ctx context.Context, handle func(context.Context, json.RawMessage) error) {
+	for {
+		next := q.process(ctx, handle)
+		wait := time.Until(next)
+		if next.IsZero() || wait > time.Minute {
+			wait = time.Minute
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// process runs every due item once and returns when the earliest remaining item is due
+func (q *diskQueue) process(ctx context.Context, handle func(context.Context, json.RawMessage) error) time.Time {
+	names, err := q.itemNames()
+	if err != nil {
+		getLogger().Log(Error, "failed to read queue", "queue", q.dir, "error", err)
+		return time.Time{}
+	}
+	var next time.Time
+	for _, name := range names {
+		if ctx.Err() != nil {
+			return next
+		}
+		item, err := q.read(name)
+		if err != nil {
+			getLogger().Log(Error, "unreadable queue item moved aside", "queue", q.dir, "item", name, "error", err)
+			q.finish(name, true)
+			continue
+		}
+		if time.Now().Before(item.NextAttempt) {
+			if next.IsZero() || item.NextAttempt.Before(next) {
+				next = item.NextAttempt
+			}
+			continue
+		}
+
+		err = handle(ctx, item.Payload)
+		if err == nil {
+			q.finish(name, false)
+			continue
+		}
+		if ctx.Err() != nil {
+			// Shutting down; the item stays queued as it was
+			return next
+		}
+		item.Attempts++
+		item.LastError = err.Error()
+		var permanent permanentError
+		if errors.As(err, &permanent) || item.Attempts >= q.maxAttempts {
+			getLogger().Log(Error, "queue item failed permanently", "queue", q.dir, "item", item.ID, "attempts", item.Attempts, "error", err)
+			q.write(item)
+			q.finish(name, true)
+			if q.failed != nil {
+				q.failed(item.Payload, err)
+			}
+			continue
+		}
+		item.NextAttempt = time.Now().Add(q.backoff(item.Attempts)).UTC()
+		if err := q.write(item); err != nil {
+			getLogger().Log(Error, "failed to reschedule queue item", "queue", q.dir, "item", item.ID, "error", err)
+		}
+		getLogger().Log(Warning, "queue item failed, will retry", "queue", q.dir, "item", item.ID,
+			"attempts", item.Attempts, "next_attempt", item.NextAttempt, "error", err)
+		if next.IsZero() || item.NextAttempt.Before(next) {
+			next = item.NextAttempt
+		}
+	}
+	return next
+}
+
+// finish removes an item from the queue, keeping it in the failed directory when failed
+func (q *diskQueue) finish(name string, failed bool) {
+	path := filepath.Join(q.dir, name)
+	var err error
+	if failed {
+		err = os.Rename(path, filepath.Join(q.dir, "failed", name))
+	} else {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		getLogger().Log(Error, "failed to remove queue item", "queue", q.dir, "item", name, "error", err)
+		return
+	}
+	q.mu.Lock()
+	q.queued--
+	q.mu.Unlock()
+}
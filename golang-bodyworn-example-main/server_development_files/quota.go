@@ -0,0 +1,281 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Quotas follow Swift's account_quotas and container_quotas middleware: they are
+// stored as ordinary metadata (X-Account-Meta-Quota-Bytes, X-Container-Meta-Quota-Bytes,
+// X-Container-Meta-Quota-Count) and enforced when objects are uploaded.
+
+const (
+	quotaBytesKey = "quota-bytes"
+	quotaCountKey = "quota-count"
+)
+
+var errQuotaExceeded = errors.New("upload exceeds quota")
+
+var metricQuotaRejections = newMetricVec("scope")
+
+// quota is a byte and object count limit; negative values mean unlimited
+type quota struct {
+	bytes int64
+	count int64
+}
+
+// validateQuotaMetadata rejects quota values that are not non-negative integers
+func validateQuotaMetadata(meta *Metadata) error {
+	for _, key := range []string{quotaBytesKey, quotaCountKey} {
+		v, ok := meta.Get(key)
+		if !ok || v == "" {
+			continue
+		}
+		if n, err := strconv.ParseInt(v, 10, 64); err != nil || n < 0 {
+			return fmt.Errorf("invalid %s value %q", key, v)
+		}
+	}
+	return nil
+}
+
+// readQuota loads the quota stored in a .meta sidecar
+func readQuota(metaPath string) quota {
+	q := quota{bytes: -1, count: -1}
+	meta, err := readMetadata(metaPath)
+	if err != nil {
+		getLogger().Log(Warning, "failed to read quota metadata", "path", metaPath, "error", err)
+		return q
+	}
+	if v, ok := meta.Get(quotaBytesKey); ok {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+			q.bytes = n
+		}
+	}
+	if v, ok := meta.Get(quotaCountKey); ok {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n >= 0 {
+			q.count = n
+		}
+	}
+	return q
+}
+
+// containerOf returns the container segment of an object path
+func containerOf(path string) string {
+	return strings.SplitN(strings.Trim(path, "/"), "/", 2)[0]
+}
+
+// accountUsage sums the cached container statistics and any objects stored at the account root
+func accountUsage() (containers, objects, bytes int64) {
+	root := filepath.Join(LocalStoragePath, StorageAccount)
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return 0, 0, 0
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if entry.IsDir() {
+			o, b := containerStats(name)
+			containers++
+			objects += o
+			bytes += b
+			continue
+		}
+		if strings.HasSuffix(name, ".meta") {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			info = followLink(filepath.Join(root, name), info)
+			objects++
+			bytes += info.Size()
+		}
+	}
+	return containers, objects, bytes
+}
+
+// quotaLimit is the remaining allowance for one upload. Until it is released it holds
+// the upload's declared bytes, and the object it adds, in each quota scope, so
+// concurrent uploads can't together overshoot a quota they each fit in.
+type quotaLimit struct {
+	scope     string
+	remaining int64 // bytes still allowed, negative means unlimited
+
+	path     string
+	scopes   []quotaScope
+	bytes    int64 // reserved in every scope
+	objects  int64
+	existing int64
+}
+
+// quotaScope is the account ("") or a container with a quota
+type quotaScope struct {
+	key string
+	q   quota
+}
+
+type quotaReservation struct {
+	bytes, objects int64
+}
+
+var (
+	// quotaMu serialises quota checks with the uploads that finish, so an upload's
+	// bytes are always counted, as reserved or as stored
+	quotaMu       sync.Mutex
+	quotaReserved = map[string]quotaReservation{}
+)
+
+// usage returns the stored objects and bytes of the scope, plus what other uploads
+// reserved there
+func (s quotaScope) usage() (objects, bytes int64) {
+	if s.key == "" {
+		_, objects, bytes = accountUsage()
+	} else {
+		objects, bytes = containerStats(s.key)
+	}
+	held := quotaReserved[s.key]
+	return objects + held.objects, bytes + held.bytes
+}
+
+func (s quotaScope) name() string {
+	if s.key == "" {
+		return "account"
+	}
+	return "container"
+}
+
+// checkQuotas verifies an upload to objectPath fits in the account and container quotas.
+// It writes a 413 response and returns false when it doesn't; otherwise it returns the
+// tightest remaining byte allowance so bodies without Content-Length can be cut off.
+// The returned limit must be released once the upload is stored or has failed.
+func checkQuotas(w http.ResponseWriter, r *http.Request, objectPath, filePath string) (*quotaLimit, bool) {
+	limit := &quotaLimit{remaining: -1, path: objectPath, objects: 1}
+
+	// Replacing an object frees its current size and doesn't add to the count
+	if info, err := os.Stat(filePath); err == nil && !info.IsDir() {
+		limit.existing = info.Size()
+		limit.objects = 0
+	}
+	if r.ContentLength > 0 {
+		limit.bytes = r.ContentLength
+	}
+
+	if q := readQuota(metaFilePath("")); q.bytes >= 0 || q.count >= 0 {
+		limit.scopes = append(limit.scopes, quotaScope{"", q})
+	}
+	if container := containerOf(objectPath); container != "" && container != strings.Trim(objectPath, "/") {
+		if q := readQuota(metaFilePath(container)); q.bytes >= 0 || q.count >= 0 {
+			limit.scopes = append(limit.scopes, quotaScope{container, q})
+		}
+	}
+	if len(limit.scopes) == 0 {
+		return limit, true
+	}
+
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	for _, s := range limit.scopes {
+		objects, used := s.usage()
+		if s.q.count >= 0 && objects+limit.objects > s.q.count {
+			rejectQuota(w, r, objectPath, s.name(), "count", objects, s.q.count)
+			return limit, false
+		}
+		if s.q.bytes < 0 {
+			continue
+		}
+		remaining := s.q.bytes - (used - limit.existing)
+		if limit.bytes > remaining {
+			rejectQuota(w, r, objectPath, s.name(), "bytes", used, s.q.bytes)
+			return limit, false
+		}
+		if limit.remaining < 0 || remaining < limit.remaining {
+			limit.scope, limit.remaining = s.name(), remaining
+		}
+	}
+	for _, s := range limit.scopes {
+		held := quotaReserved[s.key]
+		held.bytes += limit.bytes
+		held.objects += limit.objects
+		quotaReserved[s.key] = held
+	}
+	return limit, true
+}
+
+// commit stores an upload of n bytes with store, normally the rename of the staged
+// file. Bodies longer than the reserved Content-Length, i.e. chunked uploads, are
+// checked against the quotas again first, as other uploads may have finished since.
+func (l *quotaLimit) commit(n int64, store func() error) error {
+	if len(l.scopes) == 0 {
+		if err := store(); err != nil {
+			return err
+		}
+		invalidateContainerStats(l.path)
+		return nil
+	}
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	if n > l.bytes {
+		for _, s := range l.scopes {
+			_, used := s.usage()
+			if s.q.bytes >= 0 && used-l.bytes-l.existing+n > s.q.bytes {
+				l.scope = s.name()
+				return errQuotaExceeded
+			}
+		}
+	}
+	if err := store(); err != nil {
+		return err
+	}
+	invalidateContainerStats(l.path)
+	return nil
+}
+
+// release gives back what the upload reserved
+func (l *quotaLimit) release() {
+	if len(l.scopes) == 0 {
+		return
+	}
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	for _, s := range l.scopes {
+		held := quotaReserved[s.key]
+		held.bytes -= l.bytes
+		held.objects -= l.objects
+		if held == (quotaReservation{}) {
+			delete(quotaReserved, s.key)
+		} else {
+			quotaReserved[s.key] = held
+		}
+	}
+	l.scopes = nil
+}
+
+func rejectQuota(w http.ResponseWriter, r *http.Request, objectPath, scope, kind string, used, limit int64) {
+	metricQuotaRejections.add(1, scope)
+	http.Error(w, "Upload exceeds quota.", http.StatusRequestEntityTooLarge)
+	requestLogger(r).Log(Info, "upload refused, quota exceeded",
+		"path", objectPath, "scope", scope, "kind", kind, "used", used, "quota", limit, "content_length", r.ContentLength)
+}
+
+// quotaReader fails with errQuotaExceeded once more than remaining bytes are read
+type quotaReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	q.remaining -= int64(n)
+	if q.remaining < 0 {
+		return n, errQuotaExceeded
+	}
+	return n, err
+}
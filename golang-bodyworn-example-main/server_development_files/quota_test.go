@@ -0,0 +1,117 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestQuotaMetadataValidation(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	bad := map[string]string{"X-Container-Meta-Quota-Bytes": "abc"}
+
+	for _, tc := range []struct {
+		method, path string
+		header       map[string]string
+		want         int
+	}{
+		{http.MethodPut, "/Users", bad, http.StatusBadRequest},
+		{http.MethodPost, "/Users", bad, http.StatusBadRequest},
+		{http.MethodPost, "", map[string]string{"X-Account-Meta-Quota-Bytes": "-1"}, http.StatusBadRequest},
+		{http.MethodPost, "/Users", map[string]string{"X-Container-Meta-Quota-Count": "2"}, http.StatusNoContent},
+		// On objects quota names are ordinary metadata, whichever way they are written
+		{http.MethodPut, "/Users/1", map[string]string{"X-Object-Meta-Quota-Bytes": "abc"}, http.StatusCreated},
+		{http.MethodPost, "/Users/1", map[string]string{"X-Object-Meta-Quota-Bytes": "abc"}, http.StatusAccepted},
+	} {
+		if code := request(t, tc.method, storage+tc.path, admin, tc.header, nil); code != tc.want {
+			t.Errorf("%s %s %v: %d, want %d", tc.method, tc.path, tc.header, code, tc.want)
+		}
+	}
+}
+
+func TestQuotaEnforcement(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	request(t, http.MethodPost, storage+"/Users", admin, map[string]string{
+		"X-Container-Meta-Quota-Bytes": "10",
+		"X-Container-Meta-Quota-Count": "2",
+	}, nil)
+
+	put := func(name, body string, chunked bool) int {
+		var r io.Reader = strings.NewReader(body)
+		if chunked {
+			// Hide the length so the body is sent chunked
+			r = io.MultiReader(r)
+		}
+		return request(t, http.MethodPut, storage+"/Users/"+name, admin, nil, r)
+	}
+	for _, tc := range []struct {
+		name, body string
+		chunked    bool
+		want       int
+	}{
+		{"a", "12345678", false, http.StatusCreated},
+		{"b", "12345", false, http.StatusRequestEntityTooLarge},
+		{"b", "12345", true, http.StatusRequestEntityTooLarge},
+		{"a", "1234567890", false, http.StatusCreated}, // replacing frees the old size
+		{"a", "12", false, http.StatusCreated},
+		{"b", "12", true, http.StatusCreated},
+		{"c", "1", false, http.StatusRequestEntityTooLarge}, // count
+	} {
+		if code := put(tc.name, tc.body, tc.chunked); code != tc.want {
+			t.Errorf("PUT %s (%d bytes, chunked %t): %d, want %d", tc.name, len(tc.body), tc.chunked, code, tc.want)
+		}
+	}
+}
+
+func TestQuotaReservations(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	request(t, http.MethodPost, storage+"/Users", admin, map[string]string{"X-Container-Meta-Quota-Bytes": "10"}, nil)
+
+	check := func(name string) (*quotaLimit, bool) {
+		r := httptest.NewRequest(http.MethodPut, "/v1.0/"+StorageAccount+"/Users/"+name, strings.NewReader("123456"))
+		return checkQuotas(httptest.NewRecorder(), r, "Users/"+name, LocalStoragePath+"/"+StorageAccount+"/Users/"+name)
+	}
+
+	// Two uploads that each fit but not together: the second waits for the first
+	first, ok := check("a")
+	if !ok {
+		t.Fatal("first upload refused")
+	}
+	if _, ok := check("b"); ok {
+		t.Fatal("concurrent upload admitted past the reserved bytes")
+	}
+	first.release()
+	second, ok := check("b")
+	if !ok {
+		t.Fatal("upload refused after the reservation was released")
+	}
+	second.release()
+	second.release()
+	if len(quotaReserved) != 0 {
+		t.Errorf("reservations left: %v", quotaReserved)
+	}
+
+	// A chunked upload reserves nothing, so it is checked again when it is stored
+	r := httptest.NewRequest(http.MethodPut, "/v1.0/"+StorageAccount+"/Users/c", io.MultiReader(strings.NewReader("12345")))
+	r.ContentLength = -1
+	chunked, ok := checkQuotas(httptest.NewRecorder(), r, "Users/c", LocalStoragePath+"/"+StorageAccount+"/Users/c")
+	if !ok {
+		t.Fatal("chunked upload refused")
+	}
+	defer chunked.release()
+	if code := request(t, http.MethodPut, storage+"/Users/d", admin, nil, strings.NewReader("12345678")); code != http.StatusCreated {
+		t.Fatalf("PUT d: %d", code)
+	}
+	stored := false
+	if err := chunked.commit(5, func() error { stored = true; return nil }); err != errQuotaExceeded || stored {
+		t.Errorf("commit past the quota: %v, stored %t", err, stored)
+	}
+}
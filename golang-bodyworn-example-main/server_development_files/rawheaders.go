@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// net/http canonicalises header names ("X-Object-Meta-connectionID" arrives as
+// "X-Object-Meta-Connectionid"), which loses the spelling the body worn system used.
+// RawHeaderListener records the bytes of each request's header block so handlers can
+// recover the original names. When the raw block can't be matched to the request
+// (pipelining, TLS, HTTP/2, oversized headers) callers fall back to r.Header.
+
+// maxRawHeaderBuffer bounds how much unread request data a connection keeps
+const maxRawHeaderBuffer = 64 << 10
+
+// RawHeader is a header line exactly as it was received
+type RawHeader struct {
+	Name  string
+	Value string
+}
+
+type rawConnKey struct{}
+type rawHeadersKey struct{}
+
+type rawHeaderListener struct {
+	net.Listener
+}
+
+// RawHeaderListener wraps l so WithRawHeaders can recover original header names.
+// The http.Server using it must set ConnContext to RawHeaderConnContext.
+func RawHeaderListener(l net.Listener) net.Listener {
+	return &rawHeaderListener{Listener: l}
+}
+
+func (l *rawHeaderListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &rawConn{Conn: c, recording: true}, nil
+}
+
+// RawHeaderConnContext makes the recording connection available to WithRawHeaders
+func RawHeaderConnContext(ctx context.Context, c net.Conn) context.Context {
+	if rc, ok := c.(*rawConn); ok {
+		return context.WithValue(ctx, rawConnKey{}, rc)
+	}
+	return ctx
+}
+
+// rawConn copies bytes read while a request header is expected
+type rawConn struct {
+	net.Conn
+	mu        sync.Mutex
+	recording bool
+	buf       []byte
+}
+
+func (c *rawConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		if c.recording {
+			c.buf = append(c.buf, p[:n]...)
+			if len(c.buf) > maxRawHeaderBuffer {
+				// Keep the tail, where the next request line will be
+				c.buf = append([]byte(nil), c.buf[len(c.buf)-maxRawHeaderBuffer/2:]...)
+			}
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// take extracts the header block of r and stops recording until resume is called
+func (c *rawConn) take(r *http.Request) []RawHeader {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	buf := c.buf
+	c.buf = nil
+	c.recording = false
+
+	requestLine := []byte(r.Method + " " + r.RequestURI + " ")
+	start := bytes.LastIndex(buf, requestLine)
+	if start < 0 {
+		return nil
+	}
+	block := buf[start:]
+	end := bytes.Index(block, []byte("\r\n\r\n"))
+	if end < 0 {
+		return nil
+	}
+	lines := strings.Split(string(block[:end]), "\r\n")[1:]
+
+	headers := make([]RawHeader, 0, len(lines))
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return nil
+		}
+		// Reject anything net/http didn't accept as the same header; it moves
+		// Host and Transfer-Encoding out of r.Header
+		canonical := textproto.CanonicalMIMEHeaderKey(name)
+		if _, ok := r.Header[canonical]; !ok && canonical != "Host" && canonical != "Transfer-Encoding" && canonical != "Trailer" {
+			return nil
+		}
+		headers = append(headers, RawHeader{Name: name, Value: strings.Trim(value, " \t")})
+	}
+	return headers
+}
+
+func (c *rawConn) resume() {
+	c.mu.Lock()
+	c.recording = true
+	c.mu.Unlock()
+}
+
+// WithRawHeaders attaches the request's raw header lines to its context
+func WithRawHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, ok := r.Context().Value(rawConnKey{}).(*rawConn)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		defer c.resume()
+		if headers := c.take(r); headers != nil {
+			r = r.WithContext(context.WithValue(r.Context(), rawHeadersKey{}, headers))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestHeaderLines returns r's headers with their original names when they were
+// captured, otherwise the canonical names from r.Header in sorted order
+func requestHeaderLines(r *http.Request) []RawHeader {
+	if headers, ok := r.Context().Value(rawHeadersKey{}).([]RawHeader); ok {
+		return headers
+	}
+	var headers []RawHeader
+	for _, name := range sortedHeaderNames(r.Header) {
+		for _, v := range r.Header[name] {
+			headers = append(headers, RawHeader{Name: name, Value: v})
+		}
+	}
+	return headers
+}
+
+func sortedHeaderNames(h http.Header) []string {
+	names := make([]string, 0, len(h))
+	for k := range h {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,429 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"BodyWornAPI/mkv"
+)
+
+// /api/recordings joins the pieces of a recording that are stored separately: the
+// .mkv object and its metadata, the bearer in Users/, the device in Devices/, the
+// system in System/, and bookmark and GNSS objects stored next to the video as
+// <name>.bookmarks.json and <name>.gnss.json.
+
+// Metadata keys linking a recording to its bearer, device and system, in order of preference
+var (
+	bearerKeys = []string{"userid", "user-id", "user", "bearer", "bearerid"}
+	deviceKeys = []string{"deviceid", "device-id", "device", "cameraid", "serialnumber"}
+	systemKeys = []string{"systemid", "system-id", "system", "connectionid"}
+)
+
+// Recording is the aggregate view of one recording
+type Recording struct {
+	ID              string            `json:"id"`
+	Object          string            `json:"object"`
+	Container       string            `json:"container"`
+	Name            string            `json:"name"`
+	Bytes           int64             `json:"bytes"`
+	ETag            string            `json:"etag"`
+	LastModified    string            `json:"last_modified"`
+	DurationSeconds *float64          `json:"duration_seconds"`
+	Started         string            `json:"started,omitempty"`
+	Tracks          []RecordingTrack  `json:"tracks,omitempty"`
+	Playlist        string            `json:"playlist,omitempty"` // HLS playlist for browser playback
+	Metadata        map[string]string `json:"metadata"`
+	Bearer          *RecordingParty   `json:"bearer"`
+	Device          *RecordingParty   `json:"device"`
+	System          *RecordingParty   `json:"system"`
+	Bookmarks       []Bookmark        `json:"bookmarks"`
+	GNSS            *GNSSSummary      `json:"gnss"`
+}
+
+// RecordingTrack describes one track of the recording's video file
+type RecordingTrack struct {
+	Type   string `json:"type"`
+	Codec  string `json:"codec"`
+	Width  uint64 `json:"width,omitempty"`
+	Height uint64 `json:"height,omitempty"`
+}
+
+// RecordingParty is the user, device or system a recording refers to
+type RecordingParty struct {
+	ID       string            `json:"id"`
+	Found    bool              `json:"found"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Bookmark is a point of interest marked during the recording
+type Bookmark map[string]interface{}
+
+// GNSSPoint is one position fix
+type GNSSPoint struct {
+	Time      string  `json:"time,omitempty"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// GNSSSummary summarises the positions recorded with a recording
+type GNSSSummary struct {
+	Points         int        `json:"points"`
+	Start          GNSSPoint  `json:"start"`
+	End            GNSSPoint  `json:"end"`
+	Bounds         [4]float64 `json:"bounds"` // min latitude, min longitude, max latitude, max longitude
+	DistanceMeters float64    `json:"distance_meters"`
+}
+
+// recordingID encodes an object path as a URL safe recording ID
+func recordingID(object string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(object))
+}
+
+// recordingObject decodes a recording ID, rejecting anything that isn't a recording path
+func recordingObject(id string) (string, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return "", false
+	}
+	object := string(raw)
+	clean := filepath.ToSlash(filepath.Clean(object))
+	if clean != object || strings.HasPrefix(object, "/") || strings.HasPrefix(object, "..") || !strings.HasSuffix(object, ".mkv") {
+		return "", false
+	}
+	return object, true
+}
+
+// videoInfo is what is read from the .mkv itself, cached like ETags by size and modification time
+type videoInfo struct {
+	size     int64
+	modTime  time.Time
+	duration time.Duration
+	known    bool
+	started  time.Time
+	tracks   []RecordingTrack
+}
+
+var (
+	videoInfoMu    sync.Mutex
+	videoInfoCache = map[string]videoInfo{}
+)
+
+func readVideoInfo(path string, info os.FileInfo) videoInfo {
+	videoInfoMu.Lock()
+	cached, ok := videoInfoCache[path]
+	videoInfoMu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached
+	}
+
+	v := videoInfo{size: info.Size(), modTime: info.ModTime()}
+	if file, err := os.Open(path); err == nil {
+		f, err := mkv.Open(file)
+		file.Close()
+		if err != nil {
+			getLogger().Log(Debug, "recording is not a readable Matroska file", "path", path, "error", err)
+		} else {
+			v.duration, v.known, v.started = f.Duration, f.Duration > 0, f.DateUTC
+			for _, t := range f.Tracks {
+				v.tracks = append(v.tracks, RecordingTrack{Type: t.Type.String(), Codec: t.CodecID, Width: t.Width, Height: t.Height})
+			}
+		}
+	}
+	videoInfoMu.Lock()
+	videoInfoCache[path] = v
+	videoInfoMu.Unlock()
+	return v
+}
+
+// firstMetaValue returns the first of keys present in meta
+func firstMetaValue(meta *Metadata, keys []string) string {
+	for _, key := range keys {
+		if v, ok := meta.Get(key); ok && v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// lookupParty returns the object id in container with its metadata
+func lookupParty(container, id string) *RecordingParty {
+	if id == "" {
+		return nil
+	}
+	party := &RecordingParty{ID: id}
+	if strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return party
+	}
+	object := container + "/" + id
+	if _, err := os.Stat(filepath.Join(LocalStoragePath, StorageAccount, object)); err != nil {
+		return party
+	}
+	party.Found = true
+	if meta, err := readMetadata(metaFilePath(object)); err == nil && meta.Len() > 0 {
+		party.Metadata = meta.Map()
+	}
+	return party
+}
+
+// companionPath returns the path of a <name>.<suffix> object stored next to a recording
+func companionPath(videoPath, suffix string) string {
+	return strings.TrimSuffix(videoPath, ".mkv") + "." + suffix
+}
+
+// readBookmarks loads <name>.bookmarks.json and adds one bookmark per "bookmark" metadata value
+func readBookmarks(videoPath string, meta *Metadata) []Bookmark {
+	bookmarks := []Bookmark{}
+	if content, err := os.ReadFile(companionPath(videoPath, "bookmarks.json")); err == nil {
+		var stored []Bookmark
+		if err := json.Unmarshal(content, &stored); err != nil {
+			getLogger().Log(Warning, "failed to parse bookmarks", "path", videoPath, "error", err)
+		}
+		bookmarks = append(bookmarks, stored...)
+	}
+	if i := meta.index("bookmark"); i >= 0 {
+		for _, label := range meta.Items[i].Values {
+			bookmarks = append(bookmarks, Bookmark{"label": label})
+		}
+	}
+	return bookmarks
+}
+
+// readGNSS summarises <name>.gnss.json, a JSON array of fixes with latitude/lat,
+// longitude/lon/lng and an optional time/timestamp
+func readGNSS(videoPath string) *GNSSSummary {
+	content, err := os.ReadFile(companionPath(videoPath, "gnss.json"))
+	if err != nil {
+		return nil
+	}
+	var fixes []map[string]interface{}
+	if err := json.Unmarshal(content, &fixes); err != nil {
+		getLogger().Log(Warning, "failed to parse GNSS track", "path", videoPath, "error", err)
+		return nil
+	}
+
+	var summary *GNSSSummary
+	var previous GNSSPoint
+	for _, fix := range fixes {
+		lat, okLat := numberField(fix, "latitude", "lat")
+		lon, okLon := numberField(fix, "longitude", "lon", "lng")
+		if !okLat || !okLon {
+			continue
+		}
+		point := GNSSPoint{Latitude: lat, Longitude: lon}
+		for _, key := range []string{"time", "timestamp"} {
+			if t, ok := fix[key].(string); ok {
+				point.Time = t
+				break
+			}
+		}
+		if summary == nil {
+			summary = &GNSSSummary{Start: point, Bounds: [4]float64{lat, lon, lat, lon}}
+		} else {
+			summary.DistanceMeters += haversine(previous, point)
+		}
+		summary.Points++
+		summary.End = point
+		summary.Bounds[0] = math.Min(summary.Bounds[0], lat)
+		summary.Bounds[1] = math.Min(summary.Bounds[1], lon)
+		summary.Bounds[2] = math.Max(summary.Bounds[2], lat)
+		summary.Bounds[3] = math.Max(summary.Bounds[3], lon)
+		previous = point
+	}
+	if summary != nil {
+		summary.DistanceMeters = math.Round(summary.DistanceMeters*10) / 10
+	}
+	return summary
+}
+
+func numberField(m map[string]interface{}, keys ...string) (float64, bool) {
+	for _, key := range keys {
+		if v, ok := m[key].(float64); ok {
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// haversine returns the great circle distance between two fixes in meters
+func haversine(a, b GNSSPoint) float64 {
+	const earthRadius = 6371000
+	lat1, lat2 := a.Latitude*math.Pi/180, b.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
+
+// loadRecording builds the aggregate for the recording stored at object
+func loadRecording(object string) (*Recording, error) {
+	videoPath := filepath.Join(LocalStoragePath, StorageAccount, object)
+	info, err := os.Stat(videoPath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, os.ErrNotExist
+	}
+	meta, err := readMetadata(videoPath + ".meta")
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &Recording{
+		ID:           recordingID(object),
+		Object:       object,
+		Name:         filepath.Base(object),
+		Bytes:        info.Size(),
+		ETag:         objectETag(videoPath, meta),
+		LastModified: info.ModTime().UTC().Format("2006-01-02T15:04:05.000000"),
+		Metadata:     meta.Map(),
+		Bearer:       lookupParty("Users", firstMetaValue(meta, bearerKeys)),
+		Device:       lookupParty("Devices", firstMetaValue(meta, deviceKeys)),
+		System:       lookupParty("System", firstMetaValue(meta, systemKeys)),
+		Bookmarks:    readBookmarks(videoPath, meta),
+		GNSS:         readGNSS(videoPath),
+	}
+	if i := strings.Index(object, "/"); i >= 0 {
+		rec.Container = object[:i]
+	}
+	video := readVideoInfo(videoPath, info)
+	if video.known {
+		seconds := math.Round(video.duration.Seconds()*1000) / 1000
+		rec.DurationSeconds = &seconds
+	}
+	if !video.started.IsZero() {
+		rec.Started = video.started.UTC().Format(time.RFC3339)
+	}
+	rec.Tracks = video.tracks
+	if hlsPlayable(video.tracks) {
+		rec.Playlist = recordingURL(object) + "/hls/master.m3u8"
+	}
+	return rec, nil
+}
+
+// partyMatches reports whether a ?bearer=, ?device= or ?system= filter matches party
+func partyMatches(party *RecordingParty, want string) bool {
+	return want == "" || party != nil && party.ID == want
+}
+
+// recordingPartiesMatch reports whether the recording at object matches the ?bearer=,
+// ?device= and ?system= filters, reading only its metadata
+func recordingPartiesMatch(object string, q url.Values) bool {
+	bearer, device, system := q.Get("bearer"), q.Get("device"), q.Get("system")
+	if bearer == "" && device == "" && system == "" {
+		return true
+	}
+	meta, err := readMetadata(metaFilePath(object))
+	if err != nil {
+		return false
+	}
+	return partyMatches(lookupParty("Users", firstMetaValue(meta, bearerKeys)), bearer) &&
+		partyMatches(lookupParty("Devices", firstMetaValue(meta, deviceKeys)), device) &&
+		partyMatches(lookupParty("System", firstMetaValue(meta, systemKeys)), system)
+}
+
+// RecordingsAPIHandler serves GET /api/recordings, GET /api/recordings/{id} and the
+// recording's HLS playlists and segments under /api/recordings/{id}/hls/
+func RecordingsAPIHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLogger(r)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/recordings"), "/")
+	if id == "" {
+		listRecordings(w, r)
+		return
+	}
+	id, resource, _ := strings.Cut(id, "/")
+	object, ok := recordingObject(id)
+	if !ok {
+		http.Error(w, "Recording not found", http.StatusNotFound)
+		log.Log(Info, "invalid recording id", "id", id)
+		return
+	}
+	if resource != "" {
+		name, ok := strings.CutPrefix(resource, "hls/")
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		serveRecordingHLS(w, r, object, name)
+		return
+	}
+	rec, err := loadRecording(object)
+	if os.IsNotExist(err) {
+		http.Error(w, "Recording not found", http.StatusNotFound)
+		log.Log(Info, "recording not found", "object", object)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read recording", http.StatusInternalServerError)
+		log.Log(Error, "failed to read recording", "object", object, "error", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+	log.Log(Debug, "recording returned", "object", object)
+}
+
+// listRecordings returns all recordings, filtered by ?container=, ?bearer=, ?device=
+// and ?system= and paged with the listing parameters used by containers
+func listRecordings(w http.ResponseWriter, r *http.Request) {
+	log := requestLogger(r)
+	objects, err := recordingObjects()
+	if err != nil {
+		http.Error(w, "Failed to list recordings", http.StatusInternalServerError)
+		log.Log(Error, "failed to list recordings", "error", err)
+		return
+	}
+
+	// Filter before paging, so limit and marker count matching recordings only
+	q := r.URL.Query()
+	container := q.Get("container")
+	var filtered []string
+	for _, object := range objects {
+		if container != "" && !strings.HasPrefix(object, container+"/") {
+			continue
+		}
+		if !recordingPartiesMatch(object, q) {
+			continue
+		}
+		filtered = append(filtered, object)
+	}
+	objects = filtered
+	selected, err := filterListing(objects, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
+	recordings := []*Recording{}
+	for _, i := range selected {
+		rec, err := loadRecording(objects[i])
+		if err != nil {
+			log.Log(Warning, "failed to read recording", "object", objects[i], "error", err)
+			continue
+		}
+		recordings = append(recordings, rec)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"recordings": recordings})
+	log.Log(Debug, "recording list returned", "recordings", len(recordings))
+}
+
+// recordingURL returns the API URL of the recording stored at object
+func recordingURL(object string) string {
+	return fmt.Sprintf("/api/recordings/%s", recordingID(object))
+}
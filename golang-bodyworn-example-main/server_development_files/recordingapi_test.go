@@ -0,0 +1,163 @@
+package server
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listTestRecordings returns the objects /api/recordings lists for query
+func listTestRecordings(t *testing.T, url, token, query string) []string {
+	t.Helper()
+	code, body := do(t, http.MethodGet, url+"/api/recordings?"+query, token, "")
+	if code != http.StatusOK {
+		t.Fatalf("list %s: %d %s", query, code, body)
+	}
+	var list struct {
+		Recordings []Recording `json:"recordings"`
+	}
+	if err := json.Unmarshal([]byte(body), &list); err != nil {
+		t.Fatal(err)
+	}
+	objects := []string{}
+	for _, rec := range list.Recordings {
+		objects = append(objects, rec.Object)
+	}
+	return objects
+}
+
+func TestRecordingsListFilters(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	request(t, http.MethodPut, storage+"/CamA", admin, nil, nil)
+	request(t, http.MethodPut, storage+"/CamB", admin, nil, nil)
+	request(t, http.MethodPut, storage+"/Users/u2", admin, nil, nil)
+	for i, object := range []string{"CamA/1.mkv", "CamA/2.mkv", "CamA/3.mkv", "CamA/4.mkv", "CamB/5.mkv"} {
+		bearer := "u1"
+		if i%2 == 1 {
+			bearer = "u2"
+		}
+		header := map[string]string{"X-Object-Meta-UserID": bearer, "X-Object-Meta-DeviceID": "cam-" + object[:4]}
+		if code := request(t, http.MethodPut, storage+"/"+object, admin, header, strings.NewReader("video")); code != http.StatusCreated {
+			t.Fatalf("PUT %s: %d", object, code)
+		}
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{"", "CamA/1.mkv CamA/2.mkv CamA/3.mkv CamA/4.mkv CamB/5.mkv"},
+		{"container=CamB", "CamB/5.mkv"},
+		{"bearer=u2", "CamA/2.mkv CamA/4.mkv"},
+		{"device=cam-CamB", "CamB/5.mkv"},
+		{"bearer=u1&device=cam-CamA", "CamA/1.mkv CamA/3.mkv"},
+		// Paging counts matching recordings only
+		{"bearer=u2&limit=1", "CamA/2.mkv"},
+		{"bearer=u2&limit=1&marker=CamA/2.mkv", "CamA/4.mkv"},
+		{"bearer=u1&limit=2&reverse=true", "CamB/5.mkv CamA/3.mkv"},
+		{"container=CamA&prefix=CamA/3", "CamA/3.mkv"},
+		{"bearer=nobody", ""},
+	} {
+		if got := strings.Join(listTestRecordings(t, url, admin, tc.query), " "); got != tc.want {
+			t.Errorf("%q: %q, want %q", tc.query, got, tc.want)
+		}
+	}
+
+	var rec Recording
+	_, body := do(t, http.MethodGet, url+recordingURL("CamA/2.mkv"), admin, "")
+	if err := json.Unmarshal([]byte(body), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Bearer == nil || rec.Bearer.ID != "u2" || !rec.Bearer.Found || rec.Device == nil || rec.Device.Found {
+		t.Errorf("parties: bearer %+v, device %+v", rec.Bearer, rec.Device)
+	}
+	if code, _ := do(t, http.MethodGet, url+"/api/recordings/"+recordingID("../x.mkv"), admin, ""); code != http.StatusNotFound {
+		t.Errorf("escaping id: %d, want 404", code)
+	}
+}
+
+func TestRecordingETag(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	request(t, http.MethodPut, storage+"/CamA", admin, nil, nil)
+	request(t, http.MethodPut, storage+"/CamA/stored.mkv", admin, nil, strings.NewReader("video"))
+	sum := md5.Sum([]byte("video"))
+	stored := hex.EncodeToString(sum[:])
+
+	// The ETag written with the upload is used without reading the video, so it
+	// survives the file changing behind the server's back
+	videoPath := filepath.Join(LocalStoragePath, StorageAccount, "CamA", "stored.mkv")
+	if err := os.WriteFile(videoPath, []byte("VIDEO"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Recordings stored without one are hashed
+	if err := os.WriteFile(filepath.Join(LocalStoragePath, StorageAccount, "CamA", "copied.mkv"), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum = md5.Sum([]byte("other"))
+	hashed := hex.EncodeToString(sum[:])
+
+	for object, want := range map[string]string{"CamA/stored.mkv": stored, "CamA/copied.mkv": hashed} {
+		var rec Recording
+		_, body := do(t, http.MethodGet, url+recordingURL(object), admin, "")
+		if err := json.Unmarshal([]byte(body), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.ETag != want {
+			t.Errorf("%s: ETag %q, want %q", object, rec.ETag, want)
+		}
+	}
+}
+
+// cachedVideo reports whether the ETag and video info caches hold path
+func cachedVideo(path string) (etag, info bool) {
+	etagCacheMu.Lock()
+	_, etag = etagCache[path]
+	etagCacheMu.Unlock()
+	videoInfoMu.Lock()
+	_, info = videoInfoCache[path]
+	videoInfoMu.Unlock()
+	return etag, info
+}
+
+func TestRecordingCacheEviction(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	videoPath := filepath.Join(LocalStoragePath, StorageAccount, "CamA", "clip.mkv")
+	read := func() {
+		t.Helper()
+		writeTestRecording(t, videoPath, 2*time.Second)
+		if code, body := do(t, http.MethodGet, url+recordingURL("CamA/clip.mkv"), admin, ""); code != http.StatusOK {
+			t.Fatalf("recording: %d %s", code, body)
+		}
+		if etag, info := cachedVideo(videoPath); !etag || !info {
+			t.Fatalf("recording not cached: etag %v, video info %v", etag, info)
+		}
+	}
+
+	// Replacing a recording drops what was read from the old one
+	read()
+	request(t, http.MethodPut, storage+"/CamA/clip.mkv", admin, nil, strings.NewReader("video"))
+	if _, info := cachedVideo(videoPath); info {
+		t.Error("video info of a replaced recording kept")
+	}
+
+	// Deleting it drops everything
+	read()
+	if code := request(t, http.MethodDelete, storage+"/CamA/clip.mkv", admin, nil, nil); code != http.StatusNoContent {
+		t.Fatalf("delete: %d", code)
+	}
+	if etag, info := cachedVideo(videoPath); etag || info {
+		t.Errorf("deleted recording still cached: etag %v, video info %v", etag, info)
+	}
+}
@@ -2,13 +2,17 @@ package server
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
+	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
 func handleListRootFiles(w http.ResponseWriter, r *http.Request) {
+	log := requestLogger(r)
 	if r.Method != http.MethodGet {
 		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
 		return
@@ -18,7 +22,7 @@ func handleListRootFiles(w http.ResponseWriter, r *http.Request) {
 	files, err := os.ReadDir(rootPath)
 	if err != nil {
 		http.Error(w, "Failed to read storage root", http.StatusInternalServerError)
-		log.Printf("Failed to list files in root: %v", err)
+		log.Log(Error, "failed to list files in root", "path", rootPath, "error", err)
 		return
 	}
 
@@ -31,11 +35,153 @@ func handleListRootFiles(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(filenames)
-	log.Printf("Root listing from: %s", rootPath)
-log.Printf("Returned files: %+v", filenames)
-
+	log.Log(Debug, "root listing returned", "path", rootPath, "files", len(filenames))
 }
 
-// Export for use in main.go
+// HandleListRootFiles returns the objects stored directly in the account root.
+//
+// Deprecated: GET on the account now returns the Swift container listing.
 var HandleListRootFiles = handleListRootFiles
 
+// Older versions stored every .mkv upload at the account root under its base name,
+// dropping the container. resolveObjectPath lets those copies still be read through
+// the container MigrateFlattenedRecordings would move them to, until it has.
+
+// LegacyRecordingsContainer is where flattened recordings without "container"
+// metadata belong
+const LegacyRecordingsContainer = "Recordings"
+
+// legacyContainer returns the container a flattened recording belongs to, taken from
+// its "container" metadata when that names a valid container
+func legacyContainer(meta *Metadata, defaultContainer string) string {
+	if v, ok := meta.Get("container"); ok && v != "" && !strings.ContainsAny(v, `/\`) && !strings.HasPrefix(v, ".") {
+		return v
+	}
+	return defaultContainer
+}
+
+// resolveObjectPath returns the file backing path. GET and HEAD of a recording that
+// hasn't been migrated yet fall back to its flattened root copy, but only through
+// the container it belongs to.
+func resolveObjectPath(r *http.Request, path string) string {
+	fullPath := filepath.Join(LocalStoragePath, StorageAccount, path)
+	if !strings.HasSuffix(path, ".mkv") || isContainerPath(path) {
+		return fullPath
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return fullPath
+	}
+	if _, err := os.Stat(fullPath); !os.IsNotExist(err) {
+		return fullPath
+	}
+	container, name, _ := strings.Cut(path, "/")
+	if name != filepath.Base(path) {
+		return fullPath
+	}
+	legacyPath := filepath.Join(LocalStoragePath, StorageAccount, name)
+	if info, err := os.Stat(legacyPath); err != nil || info.IsDir() {
+		return fullPath
+	}
+	meta, err := readMetadata(legacyPath + ".meta")
+	if err != nil || legacyContainer(meta, LegacyRecordingsContainer) != container {
+		return fullPath
+	}
+	requestLogger(r).Log(Warning, "serving flattened recording, run bodyworn-migrate", "path", path, "legacy_path", name)
+	return legacyPath
+}
+
+// recordingObjects returns the object paths of all stored .mkv recordings, relative
+// to the account and sorted, including flattened copies at the account root
+func recordingObjects() ([]string, error) {
+	root := filepath.Join(LocalStoragePath, StorageAccount)
+	var objects []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && p != root {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), ".mkv") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(objects)
+	return objects, nil
+}
+
+// RecordingMigration is one flattened recording moved (or to be moved) into a container
+type RecordingMigration struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Status string `json:"status"` // "moved", "pending" (dry run) or "conflict"
+}
+
+// MigrateFlattenedRecordings moves .mkv recordings stored at the account root by
+// older versions into their container. The container is taken from the recording's
+// "container" metadata when present, otherwise defaultContainer is used. Recordings
+// whose destination already exists are left in place and reported as conflicts.
+// With dryRun nothing is moved.
+func MigrateFlattenedRecordings(defaultContainer string, dryRun bool) ([]RecordingMigration, error) {
+	root := filepath.Join(LocalStoragePath, StorageAccount)
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", root, err)
+	}
+	var results []RecordingMigration
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".mkv") {
+			continue
+		}
+		from := filepath.Join(root, entry.Name())
+		meta, err := readMetadata(from + ".meta")
+		if err != nil {
+			return results, err
+		}
+		container := legacyContainer(meta, defaultContainer)
+		if container == "" {
+			return results, fmt.Errorf("no container for %s: set a default container", entry.Name())
+		}
+
+		m := RecordingMigration{From: entry.Name(), To: container + "/" + entry.Name(), Status: "pending"}
+		to := filepath.Join(root, container, entry.Name())
+		if _, err := os.Stat(to); err == nil {
+			m.Status = "conflict"
+			getLogger().Log(Warning, "recording already exists in container, not migrated", "from", m.From, "to", m.To)
+			results = append(results, m)
+			continue
+		}
+		if dryRun {
+			results = append(results, m)
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Join(root, container), 0755); err != nil {
+			return results, fmt.Errorf("create container %s: %w", container, err)
+		}
+		if err := os.Rename(from, to); err != nil {
+			return results, fmt.Errorf("move %s: %w", m.From, err)
+		}
+		forgetObject(from)
+		if err := os.Rename(from+".meta", to+".meta"); err != nil && !os.IsNotExist(err) {
+			return results, fmt.Errorf("move %s.meta: %w", m.From, err)
+		}
+		invalidateContainerStats(m.To)
+		m.Status = "moved"
+		getLogger().Log(Info, "recording migrated", "from", m.From, "to", m.To)
+		results = append(results, m)
+	}
+	return results, nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFlattened stores name at the account root as older versions did, with
+// "container" metadata when container is set
+func writeFlattened(t *testing.T, name, container string) {
+	t.Helper()
+	root := filepath.Join(LocalStoragePath, StorageAccount)
+	if err := os.MkdirAll(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, name), []byte("mkv"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if container != "" {
+		meta := &Metadata{}
+		meta.Set("container", container)
+		if err := writeMetadata(filepath.Join(root, name)+".meta", meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFlattenedRecordingFallback(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	writeFlattened(t, "a.mkv", "")
+	writeFlattened(t, "b.mkv", "CamB")
+
+	for _, tc := range []struct {
+		method, path string
+		want         int
+	}{
+		{http.MethodGet, "/Recordings/a.mkv", http.StatusOK},
+		{http.MethodHead, "/Recordings/a.mkv", http.StatusOK},
+		{http.MethodGet, "/CamB/b.mkv", http.StatusOK},
+		// Only through the container the recording belongs to
+		{http.MethodGet, "/Other/a.mkv", http.StatusNotFound},
+		{http.MethodGet, "/Recordings/b.mkv", http.StatusNotFound},
+		{http.MethodGet, "/Recordings/sub/a.mkv", http.StatusNotFound},
+		// and never to change it
+		{http.MethodPost, "/Recordings/a.mkv", http.StatusNotFound},
+		{http.MethodDelete, "/Recordings/a.mkv", http.StatusNotFound},
+	} {
+		if code := request(t, tc.method, storage+tc.path, admin, nil, nil); code != tc.want {
+			t.Errorf("%s %s: %d, want %d", tc.method, tc.path, code, tc.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(LocalStoragePath, StorageAccount, "a.mkv")); err != nil {
+		t.Errorf("flattened recording touched: %v", err)
+	}
+}
+
+func TestMigrateFlattenedRecordings(t *testing.T) {
+	startTestServer(t)
+	writeFlattened(t, "a.mkv", "")
+	writeFlattened(t, "b.mkv", "CamB")
+	writeFlattened(t, "c.mkv", "../x")
+	writeFlattened(t, "d.mkv", "CamB")
+	root := filepath.Join(LocalStoragePath, StorageAccount)
+	os.MkdirAll(filepath.Join(root, "CamB"), 0755)
+	os.WriteFile(filepath.Join(root, "CamB", "d.mkv"), []byte("newer"), 0644)
+
+	want := []RecordingMigration{
+		{From: "a.mkv", To: "Recordings/a.mkv", Status: "pending"},
+		{From: "b.mkv", To: "CamB/b.mkv", Status: "pending"},
+		{From: "c.mkv", To: "Recordings/c.mkv", Status: "pending"},
+		{From: "d.mkv", To: "CamB/d.mkv", Status: "conflict"},
+	}
+	check := func(results []RecordingMigration, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(want) {
+			t.Fatalf("got %v, want %v", results, want)
+		}
+		for i := range want {
+			if results[i] != want[i] {
+				t.Errorf("result %d: %v, want %v", i, results[i], want[i])
+			}
+		}
+	}
+
+	check(MigrateFlattenedRecordings(LegacyRecordingsContainer, true))
+	if _, err := os.Stat(filepath.Join(root, "a.mkv")); err != nil {
+		t.Fatalf("dry run moved a.mkv: %v", err)
+	}
+
+	for i := range want[:3] {
+		want[i].Status = "moved"
+	}
+	check(MigrateFlattenedRecordings(LegacyRecordingsContainer, false))
+	for _, moved := range []string{"Recordings/a.mkv", "CamB/b.mkv", "CamB/b.mkv.meta", "Recordings/c.mkv", "d.mkv"} {
+		if _, err := os.Stat(filepath.Join(root, moved)); err != nil {
+			t.Errorf("%s: %v", moved, err)
+		}
+	}
+	if content, _ := os.ReadFile(filepath.Join(root, "CamB", "d.mkv")); string(content) != "newer" {
+		t.Errorf("conflicting recording overwritten: %q", content)
+	}
+
+	writeFlattened(t, "e.mkv", "")
+	if _, err := MigrateFlattenedRecordings("", false); err == nil {
+		t.Error("no error without a container for e.mkv")
+	}
+}
@@ -0,0 +1,774 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replication copies every object and metadata change to remote Swift compatible
+// storage, such as another instance of this server. Changes are taken from the storage
+// events and queued per target under .bodyworn/replication/<name>, so they survive
+// restarts and a target that is down only delays its own copies. The queue holds what
+// changed, not the data: the object is read when it is sent, so the latest version goes.
+//
+// Each object's replication state per target is kept in its system metadata and
+// returned on HEAD and GET as X-Bodyworn-Replication: <target>=<state>, ...
+// A reconciliation job compares the listings of both sides by ETag and queues
+// whatever is missing or different on the target.
+//
+// Targets must not replicate back to this server, or changes would go round forever.
+
+// ReplicationTarget is one remote Swift account, reached through its v1.0 auth endpoint
+type ReplicationTarget struct {
+	Name    string `json:"name"`
+	AuthURL string `json:"auth_url"`
+	User    string `json:"user"`
+	Key     string `json:"key"`
+}
+
+// Replication states kept per object and target
+const (
+	ReplicationPending    = "pending"
+	ReplicationReplicated = "replicated"
+	ReplicationRetrying   = "retrying"
+	ReplicationFailed     = "failed"
+)
+
+// ReplicationMaxAttempts is how often a change is tried before it is given up
+var ReplicationMaxAttempts = 20
+
+// replicationTask is one queued change
+type replicationTask struct {
+	Op      string `json:"op"` // put, post or delete
+	Path    string `json:"path"`
+	EventID string `json:"event_id,omitempty"`
+}
+
+var (
+	metricReplicationOps   = newMetricVec("target", "op", "result")
+	metricReplicationQueue = newMetricVec("target")
+	metricReplicationDiffs = newMetricVec("target", "kind")
+
+	replicatorsMu sync.Mutex
+	replicators   []*replicator
+
+	replicationNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+)
+
+// LoadReplicationTargets reads a JSON array of replication targets
+func LoadReplicationTargets(path string) ([]ReplicationTarget, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var targets []ReplicationTarget
+	if err := json.Unmarshal(content, &targets); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	seen := map[string]bool{}
+	for i, t := range targets {
+		if !replicationNamePattern.MatchString(t.Name) || seen[t.Name] {
+			return nil, fmt.Errorf("replication target %d: invalid or duplicate name %q", i, t.Name)
+		}
+		seen[t.Name] = true
+		if !strings.HasPrefix(t.AuthURL, "http://") && !strings.HasPrefix(t.AuthURL, "https://") {
+			return nil, fmt.Errorf("replication target %s: invalid auth_url %q", t.Name, t.AuthURL)
+		}
+	}
+	return targets, nil
+}
+
+// replicator sends changes to one target
+type replicator struct {
+	target ReplicationTarget
+	queue  *diskQueue
+	client *http.Client
+
+	mu         sync.Mutex
+	token      string
+	storageURL string
+	lastReport *ReconcileReport
+}
+
+// StartReplication queues every object and metadata change for each target and
+// replicates them in the background until ctx is cancelled. When reconcileEvery is
+// positive both sides are also compared at that interval.
+func StartReplication(ctx context.Context, targets []ReplicationTarget, reconcileEvery time.Duration) error {
+	for _, target := range targets {
+		q, err := openDiskQueue(filepath.Join(stateDir(), "replication", target.Name), ReplicationMaxAttempts)
+		if err != nil {
+			return err
+		}
+		rep := &replicator{target: target, queue: q, client: &http.Client{Timeout: 10 * time.Minute}}
+		q.failed = rep.giveUp
+		replicatorsMu.Lock()
+		replicators = append(replicators, rep)
+		replicatorsMu.Unlock()
+
+		SubscribeEvents(rep.enqueue)
+		go q.run(ctx, rep.handle)
+		if reconcileEvery > 0 {
+			go rep.reconcileLoop(ctx, reconcileEvery)
+		}
+		getLogger().Log(Info, "replication started", "target", target.Name, "auth_url", target.AuthURL, "queued", q.depth())
+		RegisterReadinessCheck("replication_queue "+target.Name, q.writable)
+		RegisterShutdownHook("replication queue "+target.Name, func(context.Context) error {
+			getLogger().Log(Info, "replication queue kept for the next start", "target", target.Name, "queued", q.depth())
+			return q.sync()
+		})
+	}
+	return nil
+}
+
+// enqueue turns a storage event into a replication task
+func (rep *replicator) enqueue(e Event) {
+	task := replicationTask{Path: e.Path, EventID: e.ID}
+	switch e.Type {
+	case EventObjectCreated:
+		task.Op = "put"
+	case EventMetadataUpdated:
+		task.Op = "post"
+	case EventObjectDeleted, EventObjectExpired:
+		task.Op = "delete"
+	default:
+		return
+	}
+	rep.push(task)
+}
+
+func (rep *replicator) push(task replicationTask) {
+	if err := rep.queue.push(task); err != nil {
+		getLogger().Log(Error, "failed to queue replication", "target", rep.target.Name, "path", task.Path, "error", err)
+		return
+	}
+	if task.Op != "delete" {
+		rep.setStatus(task.Path, ReplicationPending, "", "")
+	}
+}
+
+// handle replicates one queued task
+func (rep *replicator) handle(ctx context.Context, payload json.RawMessage) error {
+	var task replicationTask
+	if err := json.Unmarshal(payload, &task); err != nil {
+		return permanentError{err}
+	}
+	var err error
+	var etag string
+	switch task.Op {
+	case "put":
+		etag, err = rep.put(ctx, task.Path)
+	case "post":
+		etag, err = rep.post(ctx, task.Path)
+	case "delete":
+		err = rep.delete(ctx, task.Path)
+	default:
+		err = permanentError{fmt.Errorf("unknown replication op %q", task.Op)}
+	}
+
+	if err != nil {
+		metricReplicationOps.add(1, rep.target.Name, task.Op, "error")
+		var permanent permanentError
+		if errors.As(err, &permanent) {
+			rep.setStatus(task.Path, ReplicationFailed, "", err.Error())
+		} else if task.Op != "delete" {
+			rep.setStatus(task.Path, ReplicationRetrying, "", err.Error())
+		}
+		return err
+	}
+	metricReplicationOps.add(1, rep.target.Name, task.Op, "ok")
+	if task.Op != "delete" {
+		rep.setStatus(task.Path, ReplicationReplicated, etag, "")
+	}
+	getLogger().Log(Debug, "replicated", "target", rep.target.Name, "op", task.Op, "path", task.Path)
+	return nil
+}
+
+// giveUp records that a task ran out of attempts
+func (rep *replicator) giveUp(payload json.RawMessage, err error) {
+	var task replicationTask
+	if json.Unmarshal(payload, &task) == nil && task.Op != "delete" {
+		rep.setStatus(task.Path, ReplicationFailed, "", err.Error())
+	}
+}
+
+// Status keys in an object's system metadata
+func replicationStatusKey(target, field string) string {
+	return "replication." + target + "." + field
+}
+
+var replicationStatusMu sync.Mutex
+
+// setStatus records the replication state of an object; containers and the account have none
+func (rep *replicator) setStatus(path, state, etag, errMsg string) {
+	if !strings.Contains(path, "/") {
+		return
+	}
+	replicationStatusMu.Lock()
+	defer replicationStatusMu.Unlock()
+	fullPath := filepath.Join(LocalStoragePath, StorageAccount, path)
+	if info, err := os.Stat(fullPath); err != nil || info.IsDir() {
+		return
+	}
+	meta, err := readMetadata(fullPath + ".meta")
+	if err != nil {
+		return
+	}
+	name := rep.target.Name
+	meta.SysSet(replicationStatusKey(name, "state"), state)
+	meta.SysSet(replicationStatusKey(name, "time"), time.Now().UTC().Format(time.RFC3339))
+	if etag != "" {
+		meta.SysSet(replicationStatusKey(name, "etag"), etag)
+	}
+	meta.SysSet(replicationStatusKey(name, "error"), errMsg)
+	if err := writeMetadata(fullPath+".meta", meta); err != nil {
+		getLogger().Log(Warning, "failed to record replication status", "path", path, "target", name, "error", err)
+	}
+}
+
+// addReplicationHeader returns an object's replication states as X-Bodyworn-Replication
+func addReplicationHeader(w http.ResponseWriter, metaPath string) {
+	replicatorsMu.Lock()
+	reps := replicators
+	replicatorsMu.Unlock()
+	if len(reps) == 0 {
+		return
+	}
+	meta, err := readMetadata(metaPath)
+	if err != nil {
+		return
+	}
+	var states []string
+	for _, rep := range reps {
+		if state := meta.SysGet(replicationStatusKey(rep.target.Name, "state")); state != "" {
+			states = append(states, rep.target.Name+"="+state)
+		}
+	}
+	if len(states) > 0 {
+		w.Header().Set("X-Bodyworn-Replication", strings.Join(states, ", "))
+	}
+}
+
+// authenticate gets a token and storage URL from the target's auth endpoint
+func (rep *replicator) authenticate(ctx context.Context) (token, storageURL string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rep.target.AuthURL, nil)
+	if err != nil {
+		return "", "", permanentError{err}
+	}
+	req.Header.Set("X-Auth-User", rep.target.User)
+	req.Header.Set("X-Auth-Key", rep.target.Key)
+	resp, err := rep.client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return "", "", fmt.Errorf("authentication answered %s", resp.Status)
+	}
+	token, storageURL = resp.Header.Get("X-Auth-Token"), resp.Header.Get("X-Storage-Url")
+	if storageURL == "" {
+		return "", "", fmt.Errorf("authentication returned no X-Storage-Url")
+	}
+	rep.mu.Lock()
+	rep.token, rep.storageURL = token, strings.TrimSuffix(storageURL, "/")
+	rep.mu.Unlock()
+	return token, rep.storageURL, nil
+}
+
+// do sends a request for path on the target, authenticating first and again once
+// when the token is refused. body, when set, is called for every attempt.
+func (rep *replicator) do(ctx context.Context, method, path string, query url.Values, header http.Header, body func() (io.ReadCloser, int64, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		rep.mu.Lock()
+		token, storageURL := rep.token, rep.storageURL
+		rep.mu.Unlock()
+		if storageURL == "" {
+			var err error
+			if token, storageURL, err = rep.authenticate(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		target := storageURL
+		if path != "" {
+			target += "/" + escapeObjectPath(path)
+		}
+		if len(query) > 0 {
+			target += "?" + query.Encode()
+		}
+		req, err := http.NewRequestWithContext(ctx, method, target, nil)
+		if err != nil {
+			return nil, permanentError{err}
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if body != nil {
+			rc, size, err := body()
+			if err != nil {
+				return nil, err
+			}
+			req.Body, req.ContentLength = rc, size
+		}
+		if token != "" {
+			req.Header.Set("X-Auth-Token", token)
+		}
+		req.Header.Set("User-Agent", "bodyworn-replication")
+
+		resp, err := rep.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			resp.Body.Close()
+			rep.mu.Lock()
+			rep.storageURL = ""
+			rep.mu.Unlock()
+			continue
+		}
+		return resp, nil
+	}
+}
+
+// escapeObjectPath escapes each segment of an object path for a URL
+func escapeObjectPath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// checkResponse drains resp and turns unexpected answers into errors; 4xx answers
+// other than 408 and 429 are permanent
+func checkResponse(resp *http.Response, op string) error {
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		return permanentError{fmt.Errorf("%s answered %s", op, resp.Status)}
+	}
+	return fmt.Errorf("%s answered %s", op, resp.Status)
+}
+
+// metadataHeaders turns stored metadata into request headers, keeping the original
+// spelling of names and every value. Temp URL keys stay here: links signed with them
+// act as their setter on this server, which means nothing to the target.
+func metadataHeaders(meta *Metadata, prefix string) http.Header {
+	h := http.Header{}
+	for _, item := range meta.Items {
+		if prefix != "X-Object-Meta-" && isTempURLKey(item.Name) {
+			continue
+		}
+		h[prefix+item.Name] = append([]string(nil), item.Values...)
+	}
+	return h
+}
+
+// put copies an object, or creates a container, on the target and returns the object's ETag
+func (rep *replicator) put(ctx context.Context, path string) (string, error) {
+	fullPath := filepath.Join(LocalStoragePath, StorageAccount, path)
+	info, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		// Deleted since; the deletion is queued after this
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", rep.putContainer(ctx, path)
+	}
+	meta, err := readMetadata(fullPath + ".meta")
+	if err != nil {
+		return "", err
+	}
+
+	etag := cachedETag(fullPath)
+	header := metadataHeaders(meta, "X-Object-Meta-")
+	header.Set("ETag", etag)
+	header.Set("Content-Type", objectContentType(meta))
+	if at := deleteAt(meta); at > 0 {
+		header.Set("X-Delete-At", strconv.FormatInt(at, 10))
+	}
+	body := func() (io.ReadCloser, int64, error) {
+		f, err := os.Open(fullPath)
+		if err != nil {
+			return nil, 0, err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+		return f, info.Size(), nil
+	}
+
+	resp, err := rep.do(ctx, http.MethodPut, path, nil, header, body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		// Swift needs the container first
+		resp.Body.Close()
+		if err := rep.putContainer(ctx, containerOf(path)); err != nil {
+			return "", err
+		}
+		if resp, err = rep.do(ctx, http.MethodPut, path, nil, header, body); err != nil {
+			return "", err
+		}
+	}
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		// The object changed while it was sent; the next attempt sends the new version
+		resp.Body.Close()
+		return "", fmt.Errorf("PUT %s: ETag mismatch", path)
+	}
+	return etag, checkResponse(resp, "PUT "+path)
+}
+
+// putContainer creates a container on the target with its metadata
+func (rep *replicator) putContainer(ctx context.Context, container string) error {
+	meta, err := readMetadata(metaFilePath(container))
+	if err != nil {
+		return err
+	}
+	resp, err := rep.do(ctx, http.MethodPut, container, nil, metadataHeaders(meta, "X-Container-Meta-"), nil)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, "PUT "+container)
+}
+
+// post copies the metadata of an object, a container or the account
+func (rep *replicator) post(ctx context.Context, path string) (string, error) {
+	fullPath := filepath.Join(LocalStoragePath, StorageAccount, path)
+	info, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if path == "" || info.IsDir() {
+		return "", rep.postMerged(ctx, path)
+	}
+
+	meta, err := readMetadata(fullPath + ".meta")
+	if err != nil {
+		return "", err
+	}
+	// An object POST replaces all of its metadata, so it is sent as a whole
+	header := metadataHeaders(meta, "X-Object-Meta-")
+	if at := deleteAt(meta); at > 0 {
+		header.Set("X-Delete-At", strconv.FormatInt(at, 10))
+	} else {
+		header.Set("X-Remove-Delete-At", "1")
+	}
+	resp, err := rep.do(ctx, http.MethodPost, path, nil, header, nil)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return rep.put(ctx, path)
+	}
+	return cachedETag(fullPath), checkResponse(resp, "POST "+path)
+}
+
+// postMerged copies container or account metadata. Those POSTs merge into the
+// existing metadata, so keys the target has but this side doesn't are removed.
+func (rep *replicator) postMerged(ctx context.Context, path string) error {
+	prefix, remove := "X-Account-Meta-", "X-Remove-Account-Meta-"
+	if path != "" {
+		prefix, remove = "X-Container-Meta-", "X-Remove-Container-Meta-"
+	}
+	meta, err := readMetadata(metaFilePath(path))
+	if err != nil {
+		return err
+	}
+
+	resp, err := rep.do(ctx, http.MethodHead, path, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound && path != "" {
+		return rep.putContainer(ctx, path)
+	}
+	header := metadataHeaders(meta, prefix)
+	for name := range resp.Header {
+		if len(name) > len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+			key := name[len(prefix):]
+			if _, ok := meta.Get(key); !ok && !isTempURLKey(key) {
+				header.Set(remove+key, "1")
+			}
+		}
+	}
+	resp, err = rep.do(ctx, http.MethodPost, path, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	return checkResponse(resp, "POST "+path)
+}
+
+// delete removes an object or container from the target; already missing is fine
+func (rep *replicator) delete(ctx context.Context, path string) error {
+	if _, err := os.Stat(filepath.Join(LocalStoragePath, StorageAccount, path)); err == nil {
+		// Recreated since; its upload is queued after this
+		return nil
+	}
+	resp, err := rep.do(ctx, http.MethodDelete, path, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil
+	case http.StatusConflict:
+		// A container whose objects haven't all been deleted there yet
+		resp.Body.Close()
+		return fmt.Errorf("DELETE %s: container not empty on target", path)
+	}
+	return checkResponse(resp, "DELETE "+path)
+}
+
+// ReconcileReport is the result of comparing this server with a target
+type ReconcileReport struct {
+	Target     string    `json:"target"`
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	Objects    int       `json:"objects"`
+	Missing    int       `json:"missing"`
+	Mismatched int       `json:"mismatched"`
+	Extra      int       `json:"extra"` // only on the target, not removed
+	Queued     int       `json:"queued"`
+	Examples   []string  `json:"examples,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// reconcileExamples limits how many differing paths a report lists
+const reconcileExamples = 50
+
+func (r *ReconcileReport) example(kind, path string) {
+	if len(r.Examples) < reconcileExamples {
+		r.Examples = append(r.Examples, kind+": "+path)
+	}
+}
+
+func (rep *replicator) reconcileLoop(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rep.reconcile(ctx)
+		}
+	}
+}
+
+// remoteListing pages through a JSON listing of the target's account or a container
+func (rep *replicator) remoteListing(ctx context.Context, path string, fn func(name, hash string)) (found bool, err error) {
+	marker := ""
+	for {
+		query := url.Values{"format": {"json"}, "limit": {"10000"}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		resp, err := rep.do(ctx, http.MethodGet, path, query, nil, nil)
+		if err != nil {
+			return false, err
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			resp.Body.Close()
+			return false, nil
+		}
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+			return false, checkResponse(resp, "GET "+path)
+		}
+		var entries []struct {
+			Name   string `json:"name"`
+			Hash   string `json:"hash"`
+			Subdir string `json:"subdir"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&entries)
+		resp.Body.Close()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("GET %s: %w", path, err)
+		}
+		if len(entries) == 0 {
+			return true, nil
+		}
+		for _, e := range entries {
+			if e.Name != "" {
+				fn(e.Name, e.Hash)
+			}
+		}
+		marker = entries[len(entries)-1].Name
+	}
+}
+
+// reconcile compares every local object with the target by ETag and queues the
+// missing and different ones
+func (rep *replicator) reconcile(ctx context.Context) *ReconcileReport {
+	report := &ReconcileReport{Target: rep.target.Name, Started: time.Now().UTC()}
+	err := rep.compare(ctx, report)
+	if err != nil {
+		report.Error = err.Error()
+		getLogger().Log(Warning, "replication reconciliation failed", "target", rep.target.Name, "error", err)
+	} else {
+		getLogger().Log(Info, "replication reconciled", "target", rep.target.Name, "objects", report.Objects,
+			"missing", report.Missing, "mismatched", report.Mismatched, "extra", report.Extra, "queued", report.Queued)
+	}
+	report.Finished = time.Now().UTC()
+	metricReplicationDiffs.set(float64(report.Missing), rep.target.Name, "missing")
+	metricReplicationDiffs.set(float64(report.Mismatched), rep.target.Name, "mismatched")
+	metricReplicationDiffs.set(float64(report.Extra), rep.target.Name, "extra")
+	rep.mu.Lock()
+	rep.lastReport = report
+	rep.mu.Unlock()
+	return report
+}
+
+func (rep *replicator) compare(ctx context.Context, report *ReconcileReport) error {
+	containers, err := listContainers()
+	if err != nil {
+		return err
+	}
+	remoteContainers := map[string]bool{}
+	if _, err := rep.remoteListing(ctx, "", func(name, _ string) { remoteContainers[name] = true }); err != nil {
+		return err
+	}
+
+	for _, c := range containers {
+		local, err := listObjects(c.Name)
+		if err != nil {
+			return err
+		}
+		remote := map[string]string{}
+		if remoteContainers[c.Name] {
+			if _, err := rep.remoteListing(ctx, c.Name, func(name, hash string) { remote[name] = hash }); err != nil {
+				return err
+			}
+		} else {
+			rep.push(replicationTask{Op: "put", Path: c.Name})
+			report.Queued++
+			report.example("missing", c.Name)
+		}
+
+		for _, o := range local {
+			path := c.Name + "/" + o.Name
+			report.Objects++
+			hash, ok := remote[o.Name]
+			delete(remote, o.Name)
+			switch {
+			case !ok:
+				report.Missing++
+				report.example("missing", path)
+			case !strings.EqualFold(hash, cachedETag(filepath.Join(LocalStoragePath, StorageAccount, path))):
+				report.Mismatched++
+				report.example("mismatched", path)
+			default:
+				continue
+			}
+			rep.push(replicationTask{Op: "put", Path: path})
+			report.Queued++
+		}
+
+		extra := make([]string, 0, len(remote))
+		for name := range remote {
+			extra = append(extra, name)
+		}
+		sort.Strings(extra)
+		for _, name := range extra {
+			report.Extra++
+			report.example("extra", c.Name+"/"+name)
+		}
+	}
+	return nil
+}
+
+// replicationStatus is a target's entry in GET /api/replication
+type replicationStatus struct {
+	Name          string           `json:"name"`
+	AuthURL       string           `json:"auth_url"`
+	Queued        int              `json:"queued"`
+	LastReconcile *ReconcileReport `json:"last_reconcile"`
+}
+
+// ReplicationHandler serves GET /api/replication with the state of every target and
+// POST /api/replication/reconcile[?target=<name>], which reconciles and returns the reports
+func ReplicationHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLogger(r)
+	replicatorsMu.Lock()
+	reps := replicators
+	replicatorsMu.Unlock()
+
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/replication"), "/")
+	switch {
+	case action == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		statuses := []replicationStatus{}
+		for _, rep := range reps {
+			rep.mu.Lock()
+			report := rep.lastReport
+			rep.mu.Unlock()
+			statuses = append(statuses, replicationStatus{Name: rep.target.Name, AuthURL: rep.target.AuthURL, Queued: rep.queue.depth(), LastReconcile: report})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"targets": statuses})
+	case action == "reconcile" && r.Method == http.MethodPost:
+		name := r.URL.Query().Get("target")
+		reports := []*ReconcileReport{}
+		for _, rep := range reps {
+			if name == "" || rep.target.Name == name {
+				reports = append(reports, rep.reconcile(r.Context()))
+			}
+		}
+		if name != "" && len(reports) == 0 {
+			http.Error(w, "Unknown replication target", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"reports": reports})
+		log.Log(Info, "replication reconciled on request", "targets", len(reports))
+	case action == "" || action == "reconcile":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// writeReplicationMetrics adds replication counters and queue depths to a scrape
+func writeReplicationMetrics(w io.Writer) {
+	replicatorsMu.Lock()
+	reps := replicators
+	replicatorsMu.Unlock()
+	if len(reps) == 0 {
+		return
+	}
+	for _, rep := range reps {
+		metricReplicationQueue.set(float64(rep.queue.depth()), rep.target.Name)
+	}
+	metricReplicationOps.write(w, "bodyworn_replication_operations_total", "Replication requests sent to targets, by operation and result.", "counter")
+	metricReplicationQueue.write(w, "bodyworn_replication_queue_depth", "Changes waiting to be replicated, per target.", "gauge")
+	metricReplicationDiffs.write(w, "bodyworn_replication_reconcile_differences", "Objects found missing, mismatched or extra on the target by the last reconciliation.", "gauge")
+}
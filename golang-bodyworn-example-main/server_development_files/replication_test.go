@@ -0,0 +1,384 @@
+package server
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeSwift is an in-memory Swift account for replication to write to
+type fakeSwift struct {
+	url string
+
+	mu         sync.Mutex
+	token      string
+	auths      int
+	containers map[string]http.Header            // container metadata
+	objects    map[string]map[string]*fakeObject // container, then object name
+	fail       map[string]int                    // status to answer for a path
+}
+
+type fakeObject struct {
+	data []byte
+	etag string
+	meta http.Header
+}
+
+func startFakeSwift(t *testing.T) *fakeSwift {
+	t.Helper()
+	f := &fakeSwift{token: "t1", containers: map[string]http.Header{}, objects: map[string]map[string]*fakeObject{}, fail: map[string]int{}}
+	ts := httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(ts.Close)
+	f.url = ts.URL
+	return f
+}
+
+// metaHeaders returns the headers of h starting with prefix
+func metaHeaders(h http.Header, prefix string) http.Header {
+	meta := http.Header{}
+	for name, values := range h {
+		if strings.HasPrefix(name, prefix) {
+			meta[name] = values
+		}
+	}
+	return meta
+}
+
+func (f *fakeSwift) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/auth/v1.0" {
+		if r.Header.Get("X-Auth-User") != "replica" || r.Header.Get("X-Auth-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.auths++
+		w.Header().Set("X-Auth-Token", f.token)
+		w.Header().Set("X-Storage-Url", f.url+"/v1/AUTH_replica")
+		return
+	}
+	if r.Header.Get("X-Auth-Token") != f.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/AUTH_replica"), "/")
+	if status := f.fail[path]; status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+	container, object, _ := strings.Cut(path, "/")
+	switch {
+	case container == "":
+		var names []string
+		for name := range f.containers {
+			names = append(names, name)
+		}
+		f.list(w, r, names, nil)
+	case object == "":
+		f.serveContainer(w, r, container)
+	default:
+		f.serveObject(w, r, container, object)
+	}
+}
+
+// list writes a JSON listing of names after the marker
+func (f *fakeSwift) list(w http.ResponseWriter, r *http.Request, names []string, hash func(string) string) {
+	sort.Strings(names)
+	entries := []map[string]string{}
+	for _, name := range names {
+		if name > r.URL.Query().Get("marker") {
+			entry := map[string]string{"name": name}
+			if hash != nil {
+				entry["hash"] = hash(name)
+			}
+			entries = append(entries, entry)
+		}
+	}
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (f *fakeSwift) serveContainer(w http.ResponseWriter, r *http.Request, container string) {
+	meta, exists := f.containers[container]
+	switch r.Method {
+	case http.MethodPut:
+		if !exists {
+			f.containers[container] = http.Header{}
+			f.objects[container] = map[string]*fakeObject{}
+		}
+		for name, values := range metaHeaders(r.Header, "X-Container-Meta-") {
+			f.containers[container][name] = values
+		}
+		w.WriteHeader(http.StatusCreated)
+		return
+	case http.MethodDelete:
+		if exists && len(f.objects[container]) > 0 {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		delete(f.containers, container)
+		delete(f.objects, container)
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead:
+		for name, values := range meta {
+			w.Header()[name] = values
+		}
+	case http.MethodPost:
+		for name, values := range metaHeaders(r.Header, "X-Container-Meta-") {
+			meta[name] = values
+		}
+		for name := range metaHeaders(r.Header, "X-Remove-Container-Meta-") {
+			delete(meta, "X-Container-Meta-"+strings.TrimPrefix(name, "X-Remove-Container-Meta-"))
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		var names []string
+		for name := range f.objects[container] {
+			names = append(names, name)
+		}
+		f.list(w, r, names, func(name string) string { return f.objects[container][name].etag })
+	case http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeSwift) serveObject(w http.ResponseWriter, r *http.Request, container, name string) {
+	objects, exists := f.objects[container]
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodPut {
+		data, _ := io.ReadAll(r.Body)
+		sum := md5.Sum(data)
+		etag := hex.EncodeToString(sum[:])
+		if r.Header.Get("ETag") != etag {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			return
+		}
+		objects[name] = &fakeObject{data: data, etag: etag, meta: metaHeaders(r.Header, "X-Object-Meta-")}
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	o, exists := objects[name]
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		o.meta = metaHeaders(r.Header, "X-Object-Meta-")
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodDelete:
+		delete(objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeSwift) object(path string) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	container, name, _ := strings.Cut(path, "/")
+	return f.objects[container][name]
+}
+
+// newTestReplicator returns a replicator for f with its queue in a temporary directory
+func newTestReplicator(t *testing.T, f *fakeSwift) *replicator {
+	t.Helper()
+	q, err := openDiskQueue(filepath.Join(t.TempDir(), "replica"), ReplicationMaxAttempts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := &replicator{
+		target: ReplicationTarget{Name: "replica", AuthURL: f.url + "/auth/v1.0", User: "replica", Key: "secret"},
+		queue:  q,
+		client: http.DefaultClient,
+	}
+	q.failed = rep.giveUp
+	return rep
+}
+
+// replicate runs one task and returns its error
+func replicate(rep *replicator, op, path string) error {
+	payload, _ := json.Marshal(replicationTask{Op: op, Path: path})
+	return rep.handle(context.Background(), payload)
+}
+
+// replicationState returns an object's replication state for the replicator
+func replicationState(rep *replicator, path string) string {
+	meta, _ := readMetadata(filepath.Join(LocalStoragePath, StorageAccount, path) + ".meta")
+	return meta.SysGet(replicationStatusKey(rep.target.Name, "state"))
+}
+
+func TestReplication(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	f := startFakeSwift(t)
+	rep := newTestReplicator(t, f)
+
+	request(t, http.MethodPut, storage+"/CamA", admin, map[string]string{"X-Container-Meta-Site": "north"}, nil)
+	request(t, http.MethodPut, storage+"/CamA/1.mkv", admin, map[string]string{"X-Object-Meta-UserID": "u1"}, strings.NewReader("video"))
+
+	// The container is created on the target when the object finds it missing
+	if err := replicate(rep, "put", "CamA/1.mkv"); err != nil {
+		t.Fatal(err)
+	}
+	o := f.object("CamA/1.mkv")
+	if o == nil || string(o.data) != "video" || o.meta.Get("X-Object-Meta-Userid") != "u1" {
+		t.Fatalf("replica %+v", o)
+	}
+	if f.containers["CamA"].Get("X-Container-Meta-Site") != "north" {
+		t.Errorf("replica container metadata %v", f.containers["CamA"])
+	}
+	if state := replicationState(rep, "CamA/1.mkv"); state != ReplicationReplicated {
+		t.Errorf("state %q, want replicated", state)
+	}
+
+	// Object metadata is replaced as a whole, container metadata merged with the
+	// target's own keys removed
+	request(t, http.MethodPost, storage+"/CamA/1.mkv", admin, map[string]string{"X-Object-Meta-Case": "42"}, nil)
+	f.containers["CamA"].Set("X-Container-Meta-Old", "stale")
+	f.containers["CamA"].Set("X-Container-Meta-Temp-Url-Key", "target-secret")
+	request(t, http.MethodPost, storage+"/CamA", admin, map[string]string{"X-Container-Meta-Site": "south", "X-Container-Meta-Temp-URL-Key-2": "secret"}, nil)
+	f.token = "t2"
+	if err := replicate(rep, "post", "CamA/1.mkv"); err != nil {
+		t.Fatal(err)
+	}
+	if err := replicate(rep, "post", "CamA"); err != nil {
+		t.Fatal(err)
+	}
+	if meta := f.object("CamA/1.mkv").meta; meta.Get("X-Object-Meta-Case") != "42" || meta.Get("X-Object-Meta-Userid") != "" {
+		t.Errorf("replica object metadata %v", meta)
+	}
+	if meta := f.containers["CamA"]; meta.Get("X-Container-Meta-Site") != "south" || meta.Get("X-Container-Meta-Old") != "" {
+		t.Errorf("replica container metadata %v", meta)
+	}
+	// Temp URL keys are neither sent nor removed: links act as their setter here only
+	if meta := f.containers["CamA"]; meta.Get("X-Container-Meta-Temp-Url-Key-2") != "" || meta.Get("X-Container-Meta-Temp-Url-Key") != "target-secret" {
+		t.Errorf("replica temp URL keys %v", meta)
+	}
+	if f.auths != 2 {
+		t.Errorf("%d authentications, want 2 with the token refused once", f.auths)
+	}
+
+	// Refusals other than timeouts and throttling are not retried
+	request(t, http.MethodPut, storage+"/CamA/2.mkv", admin, nil, strings.NewReader("other"))
+	f.fail["CamA/2.mkv"] = http.StatusServiceUnavailable
+	if err := replicate(rep, "put", "CamA/2.mkv"); err == nil || replicationState(rep, "CamA/2.mkv") != ReplicationRetrying {
+		t.Errorf("unavailable: %v, state %q", err, replicationState(rep, "CamA/2.mkv"))
+	}
+	f.fail["CamA/2.mkv"] = http.StatusForbidden
+	if err := replicate(rep, "put", "CamA/2.mkv"); err == nil || replicationState(rep, "CamA/2.mkv") != ReplicationFailed {
+		t.Errorf("forbidden: %v, state %q", err, replicationState(rep, "CamA/2.mkv"))
+	}
+	delete(f.fail, "CamA/2.mkv")
+
+	// Deletions are skipped while the object exists and fine once it's gone on both sides
+	if err := replicate(rep, "delete", "CamA/1.mkv"); err != nil || f.object("CamA/1.mkv") == nil {
+		t.Errorf("delete of an existing object: %v", err)
+	}
+	request(t, http.MethodDelete, storage+"/CamA/1.mkv", admin, nil, nil)
+	for i := 0; i < 2; i++ {
+		if err := replicate(rep, "delete", "CamA/1.mkv"); err != nil || f.object("CamA/1.mkv") != nil {
+			t.Errorf("delete %d: %v", i, err)
+		}
+	}
+}
+
+func TestReplicationReconcile(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	f := startFakeSwift(t)
+	rep := newTestReplicator(t, f)
+	replicatorsMu.Lock()
+	replicators = []*replicator{rep}
+	replicatorsMu.Unlock()
+	defer func() {
+		replicatorsMu.Lock()
+		replicators = nil
+		replicatorsMu.Unlock()
+	}()
+
+	request(t, http.MethodPut, storage+"/CamA", admin, nil, nil)
+	for _, name := range []string{"same.mkv", "changed.mkv", "missing.mkv"} {
+		request(t, http.MethodPut, storage+"/CamA/"+name, admin, nil, strings.NewReader(name))
+	}
+	for _, name := range []string{"same.mkv", "changed.mkv"} {
+		if err := replicate(rep, "put", "CamA/"+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.object("CamA/changed.mkv").etag = "0123"
+	f.objects["CamA"]["extra.mkv"] = &fakeObject{etag: "4567"}
+
+	var result struct {
+		Reports []ReconcileReport `json:"reports"`
+	}
+	code, body := do(t, http.MethodPost, url+"/api/replication/reconcile", admin, "")
+	if code != http.StatusOK || json.Unmarshal([]byte(body), &result) != nil || len(result.Reports) != 1 {
+		t.Fatalf("reconcile: %d %s", code, body)
+	}
+	// System, Users, Devices and System/Capabilities.json are missing on the target as well
+	report := result.Reports[0]
+	if report.Objects != 4 || report.Missing != 2 || report.Mismatched != 1 || report.Extra != 1 || report.Queued != 6 || report.Error != "" {
+		t.Errorf("report %+v", report)
+	}
+	if rep.queue.depth() != 6 {
+		t.Errorf("%d queued, want 6", rep.queue.depth())
+	}
+	if state := replicationState(rep, "CamA/missing.mkv"); state != ReplicationPending {
+		t.Errorf("queued object state %q, want pending", state)
+	}
+
+	resp, _ := send(t, http.MethodHead, storage+"/CamA/same.mkv", admin, nil, "")
+	if got := resp.Header.Get("X-Bodyworn-Replication"); got != "replica=replicated" {
+		t.Errorf("X-Bodyworn-Replication %q", got)
+	}
+	code, body = do(t, http.MethodGet, url+"/api/replication", admin, "")
+	if code != http.StatusOK || !strings.Contains(body, `"queued":6`) || !strings.Contains(body, `"mismatched":1`) {
+		t.Errorf("status: %d %s", code, body)
+	}
+	if code, _ := do(t, http.MethodPost, url+"/api/replication/reconcile?target=other", admin, ""); code != http.StatusNotFound {
+		t.Errorf("unknown target: %d, want 404", code)
+	}
+}
+
+func TestReplicationEvents(t *testing.T) {
+	startTestServer(t)
+	rep := newTestReplicator(t, startFakeSwift(t))
+	for _, e := range []Event{
+		{Type: EventObjectCreated, Path: "CamA/1.mkv"},
+		{Type: EventMetadataUpdated, Path: "CamA"},
+		{Type: EventObjectExpired, Path: "CamA/2.mkv"},
+		{Type: EventUploadStarted, Path: "CamA/3.mkv"},
+	} {
+		rep.enqueue(e)
+	}
+	var ops []string
+	rep.queue.process(context.Background(), func(_ context.Context, payload json.RawMessage) error {
+		var task replicationTask
+		json.Unmarshal(payload, &task)
+		ops = append(ops, task.Op+" "+task.Path)
+		return nil
+	})
+	if got := strings.Join(ops, ", "); got != "put CamA/1.mkv, post CamA, delete CamA/2.mkv" {
+		t.Errorf("queued %q", got)
+	}
+}
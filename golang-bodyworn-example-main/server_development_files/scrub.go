@@ -0,0 +1,419 @@
+package server
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The scrubber re-reads every stored object and compares it with the MD5 (ETag) and
+// SHA-256 recorded in its system metadata when it was uploaded. It also reports objects
+// without a sidecar, sidecars without an object and zero-byte objects. Objects stored
+// before checksums were recorded, or without a sidecar, get their current checksums
+// recorded so later passes can check them.
+//
+// With ScrubQuarantine set, an object whose data no longer matches is moved with its
+// sidecar to .bodyworn/quarantine/<time>/<path> and an object.quarantined event is
+// published, so it is no longer served and replicas keep their good copy.
+
+// Kinds of problems the scrubber reports
+const (
+	ScrubChecksumMismatch = "checksum_mismatch"
+	ScrubMissingSidecar   = "missing_sidecar"
+	ScrubOrphanedSidecar  = "orphaned_sidecar"
+	ScrubZeroBytes        = "zero_bytes"
+	ScrubUnreadable       = "unreadable"
+)
+
+// EventObjectQuarantined is published when the scrubber moves a corrupted object aside
+const EventObjectQuarantined = "object.quarantined"
+
+// System metadata holding the checksums of an object's data
+const (
+	sysETag   = "etag"
+	sysSHA256 = "sha256"
+)
+
+var (
+	// ScrubQuarantine moves objects failing their checksums out of the account
+	ScrubQuarantine bool
+	// ScrubBytesPerSecond limits how fast the scrubber reads, 0 for no limit
+	ScrubBytesPerSecond int64 = 64 << 20
+)
+
+// ScrubIssue is one problem found by the scrubber
+type ScrubIssue struct {
+	Kind        string `json:"kind"`
+	Path        string `json:"path"`
+	Detail      string `json:"detail,omitempty"`
+	Quarantined string `json:"quarantined,omitempty"` // where the object was moved
+}
+
+// ScrubReport is the outcome of one pass
+type ScrubReport struct {
+	Started     time.Time      `json:"started"`
+	Finished    time.Time      `json:"finished,omitempty"`
+	Objects     int            `json:"objects"`
+	Bytes       int64          `json:"bytes"`
+	Verified    int            `json:"verified"`
+	Baselined   int            `json:"baselined"` // checksums recorded for the first time
+	Skipped     int            `json:"skipped"`   // changed while being read
+	Quarantined int            `json:"quarantined"`
+	Counts      map[string]int `json:"counts"`
+	Issues      []ScrubIssue   `json:"issues"`
+	Error       string         `json:"error,omitempty"`
+}
+
+var (
+	scrubMu      sync.Mutex
+	scrubRunning *ScrubReport
+	scrubLast    *ScrubReport
+
+	metricScrubIssues      = newMetricVec("kind")
+	metricScrubObjects     = newMetricVec()
+	metricScrubLastRun     = newMetricVec()
+	metricScrubQuarantined = newMetricVec()
+)
+
+func scrubReportPath() string {
+	return filepath.Join(stateDir(), "scrub.json")
+}
+
+// StartScrubber runs a scrub pass every interval, the first one interval after start,
+// and loads the report of the previous pass
+func StartScrubber(ctx context.Context, interval time.Duration) {
+	if content, err := os.ReadFile(scrubReportPath()); err == nil {
+		var report ScrubReport
+		if json.Unmarshal(content, &report) == nil {
+			scrubMu.Lock()
+			scrubLast = &report
+			scrubMu.Unlock()
+			setScrubMetrics(&report)
+		}
+	}
+	if interval <= 0 {
+		return
+	}
+	getLogger().Log(Info, "integrity scrubber started", "interval", interval, "quarantine", ScrubQuarantine)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				runScrub(ctx)
+			}
+		}
+	}()
+}
+
+// startScrub begins a pass in the background; it returns false if one is running
+func startScrub() bool {
+	scrubMu.Lock()
+	running := scrubRunning != nil
+	scrubMu.Unlock()
+	if running {
+		return false
+	}
+	go runScrub(context.Background())
+	return true
+}
+
+// runScrub checks every object of the account
+func runScrub(ctx context.Context) *ScrubReport {
+	report := &ScrubReport{Started: time.Now().UTC(), Counts: map[string]int{}, Issues: []ScrubIssue{}}
+	scrubMu.Lock()
+	if scrubRunning != nil {
+		scrubMu.Unlock()
+		return nil
+	}
+	scrubRunning = report
+	scrubMu.Unlock()
+
+	root := filepath.Join(LocalStoragePath, StorageAccount)
+	limiter := &scrubLimiter{rate: ScrubBytesPerSecond, start: time.Now()}
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if p == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || strings.HasSuffix(d.Name(), ".meta.tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		path := filepath.ToSlash(rel)
+		if objectPath, ok := strings.CutSuffix(p, ".meta"); ok {
+			// Container sidecars sit next to their directory. The sidecar itself may have
+			// gone since the directory was read, e.g. into quarantine with its object.
+			if _, err := os.Stat(objectPath); os.IsNotExist(err) {
+				if _, err := os.Stat(p); err == nil {
+					report.add(ScrubIssue{Kind: ScrubOrphanedSidecar, Path: path})
+				}
+			}
+			return nil
+		}
+		scrubObject(report, limiter, path, p)
+		return nil
+	})
+	if err != nil {
+		report.Error = err.Error()
+		getLogger().Log(Error, "integrity scrub failed", "error", err)
+	}
+	report.Finished = time.Now().UTC()
+
+	scrubMu.Lock()
+	scrubRunning = nil
+	scrubLast = report
+	scrubMu.Unlock()
+	setScrubMetrics(report)
+	if content, err := json.MarshalIndent(report, "", "  "); err == nil {
+		if err := os.MkdirAll(stateDir(), 0755); err == nil {
+			err = os.WriteFile(scrubReportPath(), content, 0644)
+		}
+		if err != nil {
+			getLogger().Log(Warning, "failed to save scrub report", "path", scrubReportPath(), "error", err)
+		}
+	}
+	level := Info
+	if len(report.Issues) > 0 {
+		level = Warning
+	}
+	getLogger().Log(level, "integrity scrub finished", "objects", report.Objects, "bytes", report.Bytes,
+		"issues", len(report.Issues), "quarantined", report.Quarantined, "duration", report.Finished.Sub(report.Started).Round(time.Millisecond))
+	return report
+}
+
+func (report *ScrubReport) add(issue ScrubIssue) {
+	report.Counts[issue.Kind]++
+	report.Issues = append(report.Issues, issue)
+	getLogger().Log(Warning, "integrity problem found", "kind", issue.Kind, "path", issue.Path, "detail", issue.Detail)
+}
+
+// scrubObject checks one object against its recorded checksums
+func scrubObject(report *ScrubReport, limiter *scrubLimiter, path, fullPath string) {
+	report.Objects++
+	before, err := os.Stat(fullPath)
+	if err != nil {
+		report.add(ScrubIssue{Kind: ScrubUnreadable, Path: path, Detail: err.Error()})
+		return
+	}
+	report.Bytes += before.Size()
+	if before.Size() == 0 {
+		report.add(ScrubIssue{Kind: ScrubZeroBytes, Path: path})
+	}
+	metaPath := fullPath + ".meta"
+	_, statErr := os.Stat(metaPath)
+	hasSidecar := statErr == nil
+	meta, err := readMetadata(metaPath)
+	if err != nil {
+		report.add(ScrubIssue{Kind: ScrubUnreadable, Path: path + ".meta", Detail: err.Error()})
+		return
+	}
+
+	etag, sum, err := hashObject(fullPath, limiter)
+	if err != nil {
+		report.add(ScrubIssue{Kind: ScrubUnreadable, Path: path, Detail: err.Error()})
+		return
+	}
+	// An upload or metadata change while the object was read makes the result meaningless
+	after, err := os.Stat(fullPath)
+	current, metaErr := readMetadata(metaPath)
+	if err != nil || metaErr != nil || !sameObject(before, after) ||
+		current.SysGet(sysETag) != meta.SysGet(sysETag) || current.SysGet(sysSHA256) != meta.SysGet(sysSHA256) {
+		report.Skipped++
+		return
+	}
+
+	wantETag, wantSum := meta.SysGet(sysETag), meta.SysGet(sysSHA256)
+	if !hasSidecar {
+		report.add(ScrubIssue{Kind: ScrubMissingSidecar, Path: path, Detail: "checksums recorded"})
+	}
+	if wantETag == "" && wantSum == "" {
+		// Stored before checksums were recorded: take the data as it is now
+		err := updateSysmeta(fullPath, func(m *Metadata) {
+			m.SysSet(sysETag, etag)
+			m.SysSet(sysSHA256, sum)
+		})
+		if err != nil {
+			getLogger().Log(Warning, "failed to record object checksums", "path", path, "error", err)
+		}
+		report.Baselined++
+		return
+	}
+
+	var mismatches []string
+	if wantETag != "" && wantETag != etag {
+		mismatches = append(mismatches, fmt.Sprintf("MD5 %s, expected %s", etag, wantETag))
+	}
+	if wantSum != "" && wantSum != sum {
+		mismatches = append(mismatches, fmt.Sprintf("SHA-256 %s, expected %s", sum, wantSum))
+	}
+	if len(mismatches) == 0 {
+		report.Verified++
+		return
+	}
+	issue := ScrubIssue{Kind: ScrubChecksumMismatch, Path: path, Detail: strings.Join(mismatches, "; ")}
+	if ScrubQuarantine {
+		if dest, err := quarantineObject(path, fullPath, meta, report.Started); err != nil {
+			getLogger().Log(Error, "failed to quarantine object", "path", path, "error", err)
+		} else {
+			issue.Quarantined = dest
+			report.Quarantined++
+			metricScrubQuarantined.add(1)
+		}
+	}
+	report.add(issue)
+}
+
+// hashObject returns the MD5 and SHA-256 of the file at path
+func hashObject(path string, limiter *scrubLimiter) (string, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+	md5sum, shasum := md5.New(), sha256.New()
+	w := io.MultiWriter(md5sum, shasum)
+	buf := make([]byte, 1<<20)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			w.Write(buf[:n])
+			limiter.wait(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return hex.EncodeToString(md5sum.Sum(nil)), hex.EncodeToString(shasum.Sum(nil)), nil
+}
+
+// quarantineObject moves a corrupted object and its sidecar under the state directory
+func quarantineObject(path, fullPath string, meta *Metadata, started time.Time) (string, error) {
+	dir := filepath.Join(stateDir(), "quarantine", started.Format("20060102T150405Z"))
+	dest := filepath.Join(dir, filepath.FromSlash(path))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", err
+	}
+	event := newEvent(EventObjectQuarantined, path, fullPath, meta)
+	event.Reason = ScrubChecksumMismatch
+	// A cold object's data is moved, not the link to it
+	source := fullPath
+	cold := coldPath(fullPath)
+	if cold != "" {
+		source = cold
+	}
+	if err := os.Rename(source, dest); err != nil {
+		return "", err
+	}
+	if cold != "" {
+		os.Remove(fullPath)
+	}
+	forgetObject(fullPath)
+	if err := os.Rename(fullPath+".meta", dest+".meta"); err != nil && !os.IsNotExist(err) {
+		getLogger().Log(Warning, "failed to quarantine metadata", "path", path, "error", err)
+	}
+	expiryMu.Lock()
+	delete(expiryIndex, path)
+	expiryMu.Unlock()
+	invalidateContainerStats(path)
+	publishEvent(event)
+	rel, _ := filepath.Rel(LocalStoragePath, dest)
+	return filepath.ToSlash(rel), nil
+}
+
+// scrubLimiter keeps the average read rate of a pass at or below rate bytes per second
+type scrubLimiter struct {
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (l *scrubLimiter) wait(n int) {
+	if l.rate <= 0 {
+		return
+	}
+	l.read += int64(n)
+	due := l.start.Add(time.Duration(float64(l.read) / float64(l.rate) * float64(time.Second)))
+	if d := time.Until(due); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func setScrubMetrics(report *ScrubReport) {
+	for _, kind := range []string{ScrubChecksumMismatch, ScrubMissingSidecar, ScrubOrphanedSidecar, ScrubZeroBytes, ScrubUnreadable} {
+		metricScrubIssues.set(float64(report.Counts[kind]), kind)
+	}
+	metricScrubObjects.set(float64(report.Objects))
+	metricScrubLastRun.set(float64(report.Finished.Unix()))
+}
+
+// ScrubHandler returns the last scrub report on GET /api/scrub and starts a pass on
+// POST /api/scrub/run
+func ScrubHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLogger(r)
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/scrub"), "/")
+	switch {
+	case action == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		scrubMu.Lock()
+		status := map[string]interface{}{"running": scrubRunning != nil, "quarantine": ScrubQuarantine, "last_run": scrubLast}
+		scrubMu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	case action == "run" && r.Method == http.MethodPost:
+		if !startScrub() {
+			http.Error(w, "A scrub is already running", http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		log.Log(Info, "integrity scrub started on request")
+	case action == "" || action == "run":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// writeScrubMetrics adds the results of the last scrub pass to a scrape
+func writeScrubMetrics(w io.Writer) {
+	scrubMu.Lock()
+	last := scrubLast
+	scrubMu.Unlock()
+	if last == nil {
+		return
+	}
+	metricScrubObjects.write(w, "bodyworn_scrub_objects", "Objects checked by the last integrity scrub.", "gauge")
+	metricScrubIssues.write(w, "bodyworn_scrub_issues", "Problems found by the last integrity scrub, by kind.", "gauge")
+	metricScrubLastRun.write(w, "bodyworn_scrub_last_run_timestamp_seconds", "When the last integrity scrub finished.", "gauge")
+	metricScrubQuarantined.write(w, "bodyworn_scrub_quarantined_total", "Corrupted objects moved to quarantine.", "counter")
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScrub(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	defer func(rate int64) { ScrubBytesPerSecond = rate }(ScrubBytesPerSecond)
+	ScrubBytesPerSecond = 0
+	// System/Capabilities.json is written without a sidecar; take its checksums first
+	if report := runScrub(context.Background()); report.Baselined != 1 || report.Counts[ScrubMissingSidecar] != 1 {
+		t.Errorf("first pass %+v", report)
+	}
+
+	request(t, http.MethodPut, storage+"/CamA", admin, nil, nil)
+	for _, name := range []string{"good.mkv", "corrupt.mkv", "empty.mkv"} {
+		content := "content of " + name
+		if name == "empty.mkv" {
+			content = ""
+		}
+		request(t, http.MethodPut, storage+"/CamA/"+name, admin, nil, strings.NewReader(content))
+	}
+	dir := filepath.Join(LocalStoragePath, StorageAccount, "CamA")
+	os.WriteFile(filepath.Join(dir, "corrupt.mkv"), []byte("CONTENT OF corrupt.mkv"), 0644)
+	os.WriteFile(filepath.Join(dir, "copied.mkv"), []byte("copied without the server"), 0644)
+	os.WriteFile(filepath.Join(dir, "gone.mkv.meta"), []byte(`{"Case":"1"}`), 0644)
+
+	report := runScrub(context.Background())
+	want := map[string]int{ScrubChecksumMismatch: 1, ScrubZeroBytes: 1, ScrubMissingSidecar: 1, ScrubOrphanedSidecar: 1}
+	for kind, n := range want {
+		if report.Counts[kind] != n {
+			t.Errorf("%d %s, want %d", report.Counts[kind], kind, n)
+		}
+	}
+	if report.Objects != 5 || report.Verified != 3 || report.Baselined != 1 || report.Quarantined != 0 || len(report.Issues) != 4 {
+		t.Errorf("report %+v", report)
+	}
+	for _, issue := range report.Issues {
+		if issue.Kind == ScrubChecksumMismatch && (issue.Path != "CamA/corrupt.mkv" || !strings.Contains(issue.Detail, "SHA-256")) {
+			t.Errorf("mismatch %+v", issue)
+		}
+	}
+	if _, content := send(t, http.MethodGet, storage+"/CamA/corrupt.mkv", admin, nil, ""); content != "CONTENT OF corrupt.mkv" {
+		t.Errorf("corrupt object served as %q without quarantine", content)
+	}
+
+	// The report survives restarts and is returned with the metrics
+	scrubMu.Lock()
+	scrubLast = nil
+	scrubMu.Unlock()
+	StartScrubber(context.Background(), 0)
+	var status struct {
+		Running bool         `json:"running"`
+		LastRun *ScrubReport `json:"last_run"`
+	}
+	code, body := do(t, http.MethodGet, url+"/api/scrub", admin, "")
+	if code != http.StatusOK || json.Unmarshal([]byte(body), &status) != nil || status.LastRun == nil || status.LastRun.Counts[ScrubOrphanedSidecar] != 1 {
+		t.Errorf("status: %d %s", code, body)
+	}
+	var metrics bytes.Buffer
+	writeScrubMetrics(&metrics)
+	for _, line := range []string{`bodyworn_scrub_issues{kind="checksum_mismatch"} 1`, `bodyworn_scrub_issues{kind="orphaned_sidecar"} 1`, "bodyworn_scrub_objects 5"} {
+		if !strings.Contains(metrics.String(), line+"\n") {
+			t.Errorf("metrics have no %q:\n%s", line, metrics.String())
+		}
+	}
+}
+
+func TestScrubQuarantine(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	defer func(quarantine bool, rate int64) { ScrubQuarantine, ScrubBytesPerSecond = quarantine, rate }(ScrubQuarantine, ScrubBytesPerSecond)
+	ScrubQuarantine, ScrubBytesPerSecond = true, 0
+	var quarantined []Event
+	SubscribeEvents(func(e Event) {
+		if e.Type == EventObjectQuarantined {
+			quarantined = append(quarantined, e)
+		}
+	})
+
+	request(t, http.MethodPut, storage+"/CamA", admin, nil, nil)
+	request(t, http.MethodPut, storage+"/CamA/clip.mkv", admin, map[string]string{"X-Object-Meta-Case": "9"}, strings.NewReader("video"))
+	os.WriteFile(filepath.Join(LocalStoragePath, StorageAccount, "CamA", "clip.mkv"), []byte("VIDEO"), 0644)
+
+	if code, _ := do(t, http.MethodPost, url+"/api/scrub/run", admin, ""); code != http.StatusAccepted {
+		t.Fatalf("run: %d", code)
+	}
+	var report *ScrubReport
+	deadline := time.Now().Add(5 * time.Second)
+	for report == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("scrub didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+		scrubMu.Lock()
+		report = scrubLast
+		scrubMu.Unlock()
+	}
+	// System/Capabilities.json, written without a sidecar, is reported after it
+	if report.Quarantined != 1 || len(report.Issues) != 2 || report.Issues[0].Path != "CamA/clip.mkv" || report.Issues[0].Quarantined == "" {
+		t.Fatalf("report %+v", report)
+	}
+	dest := filepath.Join(LocalStoragePath, filepath.FromSlash(report.Issues[0].Quarantined))
+	if content, err := os.ReadFile(dest); err != nil || string(content) != "VIDEO" {
+		t.Errorf("quarantined copy %q %v", content, err)
+	}
+	if meta, err := readMetadata(dest + ".meta"); err != nil || meta.Map()["Case"] != "9" {
+		t.Errorf("quarantined metadata %v %v", meta, err)
+	}
+	if code, _ := do(t, http.MethodGet, storage+"/CamA/clip.mkv", admin, ""); code != http.StatusNotFound {
+		t.Errorf("quarantined object: %d, want 404", code)
+	}
+	flushEvents(context.Background())
+	if len(quarantined) != 1 || quarantined[0].Path != "CamA/clip.mkv" || quarantined[0].Reason != ScrubChecksumMismatch {
+		t.Errorf("events %+v", quarantined)
+	}
+}
+
+func TestScrubLimiter(t *testing.T) {
+	l := &scrubLimiter{rate: 10000, start: time.Now()}
+	l.wait(500)
+	l.wait(500)
+	if elapsed := time.Since(l.start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("1000 bytes at 10000/s took %v", elapsed)
+	}
+	unlimited := &scrubLimiter{start: time.Now()}
+	unlimited.wait(1 << 30)
+	if elapsed := time.Since(unlimited.start); elapsed > 50*time.Millisecond {
+		t.Errorf("unlimited wait took %v", elapsed)
+	}
+}
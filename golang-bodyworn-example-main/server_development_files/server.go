@@ -5,13 +5,15 @@ package server
 
 import (
 	"fmt"
-	"log"
 	"net/http"
-
+	"strconv"
+	"time"
 )
 
-// AuthHandler validates credentials and returns a token if successful
+// AuthHandler validates credentials against the accounts and the connection credentials
+// and returns a token if successful
 func AuthHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLogger(r)
 	if r.Method != http.MethodGet {
 		http.Error(w, "Invalid method", http.StatusBadRequest)
 		return
@@ -22,16 +24,25 @@ func AuthHandler(w http.ResponseWriter, r *http.Request) {
 	password := r.Header.Get("X-Auth-Key")
 
 	// Validate username and password
-	if username != AuthUser || password != AuthPassword {
+	id, ok := authenticateKey(username, password)
+	if !ok {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		metricAuthFailures.add(1)
+		log.Log(Warning, "authentication failed", "user", username, "remote_addr", r.RemoteAddr)
+		return
+	}
+	token, expires, err := issueToken(id)
+	if err != nil {
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		log.Log(Error, "failed to issue token", "user", username, "error", err)
 		return
 	}
 
 	// Send token if authentication is successful
-	w.Header().Set("X-Auth-Token", "dummy-token")
+	w.Header().Set("X-Auth-Token", token)
+	w.Header().Set("X-Auth-Token-Expires", strconv.Itoa(int(time.Until(expires).Seconds())))
 	w.Header().Set("X-Storage-Url", fmt.Sprintf("http://%s/v1.0/%s", r.Host, StorageAccount))
 
 	w.WriteHeader(http.StatusOK)
-	log.Printf("Function AuthHandler being used to validates and returns token if authenticated successfully")
-	log.Printf("Authenticated user=%s from %s — token and storage URL returned", username, r.RemoteAddr)
+	log.Log(Info, "authenticated, token and storage URL returned", "user", username, "role", id.Role, "remote_addr", r.RemoteAddr)
 }
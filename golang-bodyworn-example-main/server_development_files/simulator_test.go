@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"BodyWornAPI/simulator"
+)
+
+// writeTestConnection writes the connection file a camera would load for url
+func writeTestConnection(t *testing.T, url string) string {
+	t.Helper()
+	content, err := json.Marshal(map[string]interface{}{
+		"ConnectionFileVersion":   "1.0",
+		"AuthenticationTokenURI":  []string{url + "/auth/v1.0"},
+		"BlobAPIUserName":         AuthUser,
+		"BlobAPIKey":              AuthPassword,
+		"ContainerType":           "mkv",
+		"FullStoreAndReadSupport": true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), ConnectionFile)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSimulatedSystem(t *testing.T) {
+	url := startTestServer(t)
+	conn, err := simulator.LoadConnection(writeTestConnection(t, url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := simulator.DefaultScenario
+	sc.Users, sc.Devices, sc.Recordings = 2, 2, 3
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	report, err := simulator.New(conn).Run(ctx, sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range report.Deviations {
+		t.Errorf("deviation: %s", d)
+	}
+	if len(report.Recordings) != sc.Recordings {
+		t.Fatalf("uploaded %d recordings, want %d", len(report.Recordings), sc.Recordings)
+	}
+
+	for _, object := range report.Recordings {
+		rec, err := LoadRecording(object)
+		if err != nil {
+			t.Fatalf("%s: %v", object, err)
+		}
+		if rec.DurationSeconds == nil || *rec.DurationSeconds != sc.Length.Seconds() {
+			t.Errorf("%s: duration %v, want %v", object, rec.DurationSeconds, sc.Length.Seconds())
+		}
+		if rec.Playlist == "" {
+			t.Errorf("%s: no HLS playlist", object)
+		}
+		if len(rec.Tracks) != 2 {
+			t.Errorf("%s: %d tracks, want 2", object, len(rec.Tracks))
+		}
+		if rec.Bearer == nil || !rec.Bearer.Found || rec.Device == nil || !rec.Device.Found || rec.System == nil || !rec.System.Found {
+			t.Errorf("%s: bearer, device or system not found: %+v %+v %+v", object, rec.Bearer, rec.Device, rec.System)
+		}
+		if len(rec.Bookmarks) != 1 || rec.GNSS == nil {
+			t.Errorf("%s: bookmarks %v, GNSS %v", object, rec.Bookmarks, rec.GNSS)
+		}
+	}
+
+	users, err := ListParties("Users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := map[string]bool{}
+	for _, u := range users {
+		active[u.ID] = u.Active
+	}
+	if active[report.Users[0]] || !active[report.Users[1]] {
+		t.Errorf("active users %v, want only %s deactivated", active, report.Users[0])
+	}
+}
+
+func TestSimulatorReportsDeviations(t *testing.T) {
+	url := startTestServer(t)
+	if err := os.Remove(filepath.Join(LocalStoragePath, StorageAccount, "System", "Capabilities.json")); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := simulator.LoadConnection(writeTestConnection(t, url))
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := simulator.New(conn).Run(context.Background(), simulator.Scenario{Users: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Deviations) != 1 || report.Deviations[0].Step != "capabilities" {
+		t.Fatalf("deviations %v, want the missing Capabilities.json only", report.Deviations)
+	}
+
+	conn.BlobAPIKey = "wrong"
+	if _, err := simulator.New(conn).Run(context.Background(), simulator.DefaultScenario); err == nil {
+		t.Fatal("run with a wrong key succeeded")
+	}
+}
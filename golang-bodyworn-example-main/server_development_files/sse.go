@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// /events streams storage events as Server-Sent Events. Each message's event name is
+// the event type and its id the event ID, so a reconnecting EventSource sends
+// Last-Event-ID and receives what it missed from the recent event history. When that
+// ID is no longer known a "resync" event is sent first, telling the client to reload.
+
+// EventStreamKeepAlive is how often an idle stream gets a comment line, so proxies
+// don't close it
+var EventStreamKeepAlive = 15 * time.Second
+
+// eventStreamBuffer is how many events a slow client may fall behind before its
+// stream is closed; it reconnects and resumes from the history
+const eventStreamBuffer = 256
+
+var (
+	eventStreamsMu     sync.Mutex
+	eventStreamsClosed = make(chan struct{})
+	eventStreamsDone   bool
+)
+
+// CloseEventStreams ends all open /events streams, e.g. from http.Server.RegisterOnShutdown
+// so long-lived streams don't hold up a graceful shutdown
+func CloseEventStreams() {
+	eventStreamsMu.Lock()
+	defer eventStreamsMu.Unlock()
+	if !eventStreamsDone {
+		eventStreamsDone = true
+		close(eventStreamsClosed)
+	}
+}
+
+// eventFilter selects events by ?types= (comma separated) and ?prefix=
+type eventFilter struct {
+	types  map[string]bool
+	prefix string
+}
+
+func newEventFilter(r *http.Request) eventFilter {
+	f := eventFilter{prefix: r.URL.Query().Get("prefix")}
+	if v := r.URL.Query().Get("types"); v != "" {
+		f.types = map[string]bool{}
+		for _, t := range strings.Split(v, ",") {
+			f.types[strings.TrimSpace(t)] = true
+		}
+	}
+	return f
+}
+
+func (f eventFilter) match(e Event) bool {
+	if f.types != nil && !f.types[e.Type] {
+		return false
+	}
+	return strings.HasPrefix(e.Path, f.prefix)
+}
+
+// writeSSE writes one event in the text/event-stream format
+func writeSSE(w http.ResponseWriter, e Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+// EventsHandler serves GET /events
+func EventsHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLogger(r)
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Only GET is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if checkNotShuttingDown() != nil {
+		http.Error(w, "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	// Subscribe before reading the history so nothing published in between is lost
+	live := make(chan Event, eventStreamBuffer)
+	overflow := make(chan struct{})
+	var overflowOnce sync.Once
+	cancel := SubscribeEvents(func(e Event) {
+		select {
+		case live <- e:
+		default:
+			overflowOnce.Do(func() { close(overflow) })
+		}
+	})
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	filter := newEventFilter(r)
+	var lastSeq uint64
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	if lastID != "" {
+		missed, found := eventsSince(lastID)
+		if !found {
+			fmt.Fprintf(w, "event: resync\ndata: {\"last_event_id\":%q}\n\n", lastID)
+		}
+		for _, e := range missed {
+			lastSeq = e.seq
+			if filter.match(e) {
+				if err := writeSSE(w, e); err != nil {
+					return
+				}
+			}
+		}
+		log.Log(Debug, "event stream resumed", "last_event_id", lastID, "found", found, "replayed", len(missed))
+	}
+	fmt.Fprintf(w, ": connected\n\n")
+	flusher.Flush()
+	log.Log(Info, "event stream opened", "types", r.URL.Query().Get("types"), "prefix", filter.prefix)
+
+	keepAlive := time.NewTicker(EventStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-live:
+			// Events already replayed from the history are skipped
+			if e.seq <= lastSeq || !filter.match(e) {
+				continue
+			}
+			lastSeq = e.seq
+			if err := writeSSE(w, e); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprintf(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-overflow:
+			log.Log(Warning, "event stream closed, client too slow", "buffer", eventStreamBuffer)
+			return
+		case <-eventStreamsClosed:
+			return
+		case <-r.Context().Done():
+			log.Log(Debug, "event stream closed by client")
+			return
+		}
+	}
+}
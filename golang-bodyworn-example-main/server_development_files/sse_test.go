@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseMessage is one message of an event stream; comments have only a comment
+type sseMessage struct {
+	id, event, comment string
+	data               Event
+}
+
+// openEventStream connects to /events with query and lastID and returns its messages
+func openEventStream(t *testing.T, url, token, query, lastID string) (<-chan sseMessage, func()) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, url+"/events?"+query, nil)
+	req.Header.Set("X-Auth-Token", token)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		resp.Body.Close()
+		t.Fatalf("open stream: %s %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+	messages := make(chan sseMessage, 100)
+	go func() {
+		defer close(messages)
+		scanner := bufio.NewScanner(resp.Body)
+		var m sseMessage
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				messages <- m
+				m = sseMessage{}
+			case strings.HasPrefix(line, ": "):
+				m.comment = line[2:]
+			case strings.HasPrefix(line, "id: "):
+				m.id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				m.event = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(line[6:]), &m.data)
+			}
+		}
+	}()
+	return messages, func() { resp.Body.Close() }
+}
+
+// nextEvents reads n messages that aren't comments
+func nextEvents(t *testing.T, messages <-chan sseMessage, n int) []sseMessage {
+	t.Helper()
+	var events []sseMessage
+	for len(events) < n {
+		select {
+		case m, ok := <-messages:
+			if !ok {
+				t.Fatalf("stream closed after %d of %d events", len(events), n)
+			}
+			if m.comment == "" {
+				events = append(events, m)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d of %d events received", len(events), n)
+		}
+	}
+	return events
+}
+
+// paths returns the paths of events as one string
+func paths(events []sseMessage) string {
+	var p []string
+	for _, e := range events {
+		p = append(p, e.data.Path)
+	}
+	return strings.Join(p, " ")
+}
+
+func TestEventStreamResume(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	put := func(name string) {
+		t.Helper()
+		if code := request(t, http.MethodPut, storage+"/"+name, admin, nil, strings.NewReader("video")); code != http.StatusCreated {
+			t.Fatalf("PUT %s: %d", name, code)
+		}
+	}
+	request(t, http.MethodPut, storage+"/CamA", admin, nil, nil)
+	request(t, http.MethodPut, storage+"/CamB", admin, nil, nil)
+
+	const query = "types=object.created&prefix=CamA/"
+	messages, disconnect := openEventStream(t, url, admin, query, "")
+	put("CamA/1.mkv")
+	first := nextEvents(t, messages, 1)[0]
+	if first.event != EventObjectCreated || first.id != first.data.ID || first.data.Path != "CamA/1.mkv" || first.data.ETag == "" {
+		t.Errorf("first event %+v", first)
+	}
+	disconnect()
+
+	// Missed while disconnected, and filtered like live events
+	put("CamA/2.mkv")
+	put("CamB/x.mkv")
+	put("CamA/3.mkv")
+	messages, disconnect = openEventStream(t, url, admin, query, first.id)
+	defer disconnect()
+	if got := paths(nextEvents(t, messages, 2)); got != "CamA/2.mkv CamA/3.mkv" {
+		t.Errorf("replayed %q", got)
+	}
+	put("CamA/4.mkv")
+	if got := paths(nextEvents(t, messages, 1)); got != "CamA/4.mkv" {
+		t.Errorf("live after resuming %q", got)
+	}
+
+	// An ID that has left the history asks the client to reload first
+	unknown, disconnectUnknown := openEventStream(t, url, admin, query, "gone")
+	defer disconnectUnknown()
+	if m := nextEvents(t, unknown, 1)[0]; m.event != "resync" {
+		t.Errorf("unknown Last-Event-ID: %+v, want resync", m)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, url+"/events", nil)
+	req.Header.Set("X-Auth-Token", admin)
+	if resp, err := http.DefaultClient.Do(req); err != nil || resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST /events: %v %v", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+}
+
+func TestEventHistoryLimit(t *testing.T) {
+	SetLogger(&DefaultLogger{Out: io.Discard, MinLevel: Error})
+	defer func(size int) { EventHistorySize = size }(EventHistorySize)
+	EventHistorySize = 3
+	var ids []string
+	for i := 0; i < 5; i++ {
+		e := Event{ID: newEventID(), Type: EventObjectCreated, Path: "CamA/x"}
+		ids = append(ids, e.ID)
+		publishEvent(e)
+	}
+	if _, found := eventsSince(ids[0]); found {
+		t.Error("event beyond the history still found")
+	}
+	missed, found := eventsSince(ids[2])
+	if !found || len(missed) != 2 || missed[0].ID != ids[3] || missed[1].ID != ids[4] {
+		t.Errorf("since the third event: %v, %v", missed, found)
+	}
+}
+
+func TestEventsHideSystemMetadata(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	reviewer := addTestAccount(t, url, admin, "judy", RoleReviewer)
+	system := addTestAccount(t, url, admin, "dems", RoleSystem)
+	request(t, http.MethodPut, storage+"/Recordings", admin, nil, nil)
+
+	messages, disconnect := openEventStream(t, url, reviewer, "types=object.created,metadata.updated,object.deleted", "")
+	defer disconnect()
+	request(t, http.MethodPut, storage+"/Recordings/a.mkv", system, map[string]string{"X-Object-Meta-Case": "7"}, strings.NewReader("video"))
+	fullPath := filepath.Join(LocalStoragePath, StorageAccount, "Recordings", "a.mkv")
+	err := updateSysmeta(fullPath, func(meta *Metadata) {
+		meta.SysSet(sysTier, TierCold)
+		meta.SysSet(sysTierPolicy, "archive")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request(t, http.MethodPost, storage+"/Recordings/a.mkv", system, map[string]string{"X-Object-Meta-Case": "8"}, nil)
+	meta, err := readMetadata(fullPath + ".meta")
+	if err != nil || meta.SysGet(sysOwner) != "dems" || meta.SysGet(sysTier) != TierCold {
+		t.Fatalf("system metadata %+v %v", meta, err)
+	}
+	request(t, http.MethodDelete, storage+"/Recordings/a.mkv", system, nil, nil)
+
+	// The owner, tier and checksums stay out of events, whoever stored the object
+	for _, e := range nextEvents(t, messages, 3) {
+		if _, ok := e.data.Metadata["Case"]; !ok || len(e.data.Metadata) != 1 {
+			t.Errorf("%s metadata %v, want only Case", e.data.Type, e.data.Metadata)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+package server
+
+import (
+	"testing"
+
+	"BodyWornAPI/swifttest"
+)
+
+func TestSwiftConformance(t *testing.T) {
+	url := startTestServer(t)
+	swifttest.Run(t, swifttest.Target{AuthURL: url + "/auth/v1.0", User: AuthUser, Key: AuthPassword})
+}
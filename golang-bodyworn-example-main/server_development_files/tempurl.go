@@ -0,0 +1,325 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Temporary URLs follow Swift's tempurl middleware: anyone holding a link signed with
+// one of the account's (X-Account-Meta-Temp-URL-Key, -Key-2) or the container's
+// (X-Container-Meta-Temp-URL-Key, -Key-2) keys may use it on one object until it
+// expires, without a token. The signature is an HMAC of
+//
+//	[ip=RANGE\n]METHOD\nEXPIRES\n/v1.0/<account>/<container>/<object>
+//
+// given as hex (SHA-1, SHA-256 or SHA-512 by length) or as "sha256:<base64>".
+// The keys are only shown to admins, who are also the only ones able to set them.
+//
+// A link acts with the rights the account that set its key has now, so it stops
+// working when that account is disabled or removed. Keys stored without a record of who
+// set them, e.g. from before setters were recorded, only give reviewer rights.
+
+const (
+	tempURLKey  = "temp-url-key"
+	tempURLKey2 = "temp-url-key-2"
+)
+
+// ErrNoTempURLKey is returned by TempURL when the account has no temp URL key
+var ErrNoTempURLKey = errors.New("the account has no Temp-URL-Key metadata")
+
+// isTempURLKey reports whether an account or container metadata key is a temp URL key
+func isTempURLKey(key string) bool {
+	return strings.EqualFold(key, tempURLKey) || strings.EqualFold(key, tempURLKey2)
+}
+
+// unrecordedTempURLIdentity is who links signed with a key of unknown setter act as
+var unrecordedTempURLIdentity = &Identity{Name: "temp_url", Role: RoleReviewer}
+
+// tempURLKeySetter is the system metadata naming who set a temp URL key
+func tempURLKeySetter(name string) string {
+	return name + ".set-by"
+}
+
+// recordTempURLKeySetters notes setBy as the setter of the temp URL keys set in meta,
+// and forgets the setters of keys that are gone
+func recordTempURLKeySetters(setBy string, meta, set *Metadata) {
+	for _, name := range []string{tempURLKey, tempURLKey2} {
+		if key, ok := meta.Get(name); !ok || key == "" {
+			meta.SysSet(tempURLKeySetter(name), "")
+		} else if _, ok := set.Get(name); ok {
+			meta.SysSet(tempURLKeySetter(name), setBy)
+		}
+	}
+}
+
+// withoutTempURLKeys drops the temp URL keys from flattened account or container metadata
+func withoutTempURLKeys(meta map[string]string) map[string]string {
+	for name := range meta {
+		if isTempURLKey(name) {
+			delete(meta, name)
+		}
+	}
+	return meta
+}
+
+// tempURLSigner is a temp URL key and the account that set it
+type tempURLSigner struct {
+	key   string
+	setBy string
+}
+
+var tempURLDigests = map[string]func() hash.Hash{"sha1": sha1.New, "sha256": sha256.New, "sha512": sha512.New}
+
+// isTempURLRequest reports whether r is signed rather than authenticated
+func isTempURLRequest(r *http.Request) bool {
+	q := r.URL.Query()
+	return q.Has("temp_url_sig") || q.Has("temp_url_expires")
+}
+
+// tempURLKeys returns the account's and the object's container's temp URL keys
+func tempURLKeys(path string) []tempURLSigner {
+	var keys []tempURLSigner
+	for _, metaPath := range []string{metaFilePath(""), metaFilePath(containerOf(path))} {
+		meta, err := readMetadata(metaPath)
+		if err != nil {
+			continue
+		}
+		for _, name := range []string{tempURLKey, tempURLKey2} {
+			if key, ok := meta.Get(name); ok && key != "" {
+				keys = append(keys, tempURLSigner{key: key, setBy: meta.SysGet(tempURLKeySetter(name))})
+			}
+		}
+	}
+	return keys
+}
+
+// tempURLBody returns the signed string of a temp URL
+func tempURLBody(method string, expires int64, urlPath, ipRange string) string {
+	body := fmt.Sprintf("%s\n%d\n%s", method, expires, urlPath)
+	if ipRange != "" {
+		body = "ip=" + ipRange + "\n" + body
+	}
+	return body
+}
+
+// signTempURL returns the hex HMAC-SHA256 signature of a temp URL
+func signTempURL(key, method string, expires int64, urlPath, ipRange string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(tempURLBody(method, expires, urlPath, ipRange)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// parseTempURLSig returns the digest and raw signature of temp_url_sig
+func parseTempURLSig(sig string) (func() hash.Hash, []byte, error) {
+	if name, encoded, ok := strings.Cut(sig, ":"); ok {
+		digest, known := tempURLDigests[name]
+		if !known {
+			return nil, nil, fmt.Errorf("unsupported digest %q", name)
+		}
+		encoded = strings.NewReplacer("+", "-", "/", "_").Replace(strings.TrimRight(encoded, "="))
+		raw, err := base64.RawURLEncoding.DecodeString(encoded)
+		return digest, raw, err
+	}
+	raw, err := hex.DecodeString(sig)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch len(raw) {
+	case sha1.Size:
+		return sha1.New, raw, nil
+	case sha256.Size:
+		return sha256.New, raw, nil
+	case sha512.Size:
+		return sha512.New, raw, nil
+	}
+	return nil, nil, errors.New("signature of unknown length")
+}
+
+// parseTempURLExpires accepts a Unix time or an ISO 8601 UTC time
+func parseTempURLExpires(value string) (int64, error) {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return n, nil
+	}
+	t, err := time.Parse("2006-01-02T15:04:05Z", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid temp_url_expires %q", value)
+	}
+	return t.Unix(), nil
+}
+
+// clientInRange reports whether the request comes from ipRange, an address or CIDR
+func clientInRange(r *http.Request, ipRange string) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if _, network, err := net.ParseCIDR(ipRange); err == nil {
+		return network.Contains(ip)
+	}
+	return ip.Equal(net.ParseIP(ipRange))
+}
+
+// checkTempURL validates the signature of a temp URL request to an object and returns
+// the identity of the account that set the key it is signed with
+func checkTempURL(r *http.Request, path string) (*Identity, error) {
+	q := r.URL.Query()
+	switch {
+	case !strings.Contains(strings.Trim(path, "/"), "/") || metaKindFor(path) != objectMeta:
+		return nil, errors.New("not an object")
+	case r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodPut:
+		return nil, fmt.Errorf("method %s not allowed", r.Method)
+	}
+	expires, err := parseTempURLExpires(q.Get("temp_url_expires"))
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() >= expires {
+		return nil, errors.New("expired")
+	}
+	ipRange := q.Get("temp_url_ip_range")
+	if ipRange != "" && !clientInRange(r, ipRange) {
+		return nil, fmt.Errorf("client outside %s", ipRange)
+	}
+	digest, sig, err := parseTempURLSig(q.Get("temp_url_sig"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid temp_url_sig: %w", err)
+	}
+
+	// As in Swift, a HEAD may use a link signed for GET or PUT too
+	methods := []string{r.Method}
+	if r.Method == http.MethodHead {
+		methods = append(methods, http.MethodGet, http.MethodPut)
+	}
+	for _, signer := range tempURLKeys(path) {
+		for _, method := range methods {
+			mac := hmac.New(digest, []byte(signer.key))
+			mac.Write([]byte(tempURLBody(method, expires, r.URL.Path, ipRange)))
+			if !hmac.Equal(mac.Sum(nil), sig) {
+				continue
+			}
+			if signer.setBy == "" {
+				return unrecordedTempURLIdentity, nil
+			}
+			id, _, ok := currentIdentity(signer.setBy)
+			if !ok {
+				return nil, fmt.Errorf("key set by %s, who can no longer sign in", signer.setBy)
+			}
+			return id, nil
+		}
+	}
+	return nil, errors.New("signature mismatch")
+}
+
+// authorizeTempURL answers 401 unless a temp URL request is validly signed; otherwise
+// it returns the request with the identity of the key's setter attached and, for
+// downloads, the Content-Disposition the link asks for
+func authorizeTempURL(w http.ResponseWriter, r *http.Request, path string) (*http.Request, bool) {
+	id, err := checkTempURL(r, path)
+	if err != nil {
+		http.Error(w, "Temp URL invalid", http.StatusUnauthorized)
+		metricAuthFailures.add(1)
+		requestLogger(r).Log(Info, "temp URL refused", "method", r.Method, "path", path, "reason", err, "remote_addr", r.RemoteAddr)
+		return r, false
+	}
+	if r.Method != http.MethodPut {
+		q := r.URL.Query()
+		filename := q.Get("filename")
+		disposition := "attachment"
+		if q.Has("inline") {
+			disposition = "inline"
+		} else if filename == "" {
+			filename = filepath.Base(path)
+		}
+		if filename != "" {
+			quoted := strings.NewReplacer(`"`, "", "\r", "", "\n", "").Replace(filename)
+			disposition += `; filename="` + quoted + `"; filename*=UTF-8''` + url.PathEscape(filename)
+		}
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	requestLogger(r).Log(Info, "temp URL accepted", "method", r.Method, "path", path, "key_set_by", id.Name, "remote_addr", r.RemoteAddr)
+	return r.WithContext(context.WithValue(r.Context(), identityKey{}, id)), true
+}
+
+// tempURLKeyHider drops temp URL keys from the headers of account and container
+// responses to anyone but admins
+type tempURLKeyHider struct {
+	http.ResponseWriter
+}
+
+func (h tempURLKeyHider) hide() {
+	for name := range h.Header() {
+		lower := strings.ToLower(name)
+		if strings.HasSuffix(lower, "-meta-"+tempURLKey) || strings.HasSuffix(lower, "-meta-"+tempURLKey2) {
+			delete(h.Header(), name)
+		}
+	}
+}
+
+func (h tempURLKeyHider) WriteHeader(code int) {
+	h.hide()
+	h.ResponseWriter.WriteHeader(code)
+}
+
+func (h tempURLKeyHider) Write(p []byte) (int, error) {
+	h.hide()
+	return h.ResponseWriter.Write(p)
+}
+
+// hideTempURLKeys wraps w for account and container requests of non-admins
+func hideTempURLKeys(w http.ResponseWriter, r *http.Request, path string) http.ResponseWriter {
+	if requestIdentity(r).Role == RoleAdmin || metaKindFor(path) == objectMeta {
+		return w
+	}
+	return tempURLKeyHider{w}
+}
+
+// TempURL returns a link for method on an object, valid until expires and, when
+// ipRange is set, only from there. It is signed with the account's temp URL key.
+// base is the server's URL, e.g. http://host:8080; when empty, the address
+// connection.json advertises is used.
+func TempURL(base, method, object string, expires time.Time, ipRange string) (string, error) {
+	meta, err := readMetadata(metaFilePath(""))
+	if err != nil {
+		return "", err
+	}
+	key, ok := meta.Get(tempURLKey)
+	if !ok || key == "" {
+		if key, ok = meta.Get(tempURLKey2); !ok || key == "" {
+			return "", ErrNoTempURLKey
+		}
+	}
+	if base == "" {
+		ip, err := getServerIP()
+		if err != nil {
+			return "", err
+		}
+		base = "http://" + ip + ":8080"
+	}
+	urlPath := fmt.Sprintf("/v1.0/%s/%s", StorageAccount, strings.Trim(object, "/"))
+	q := url.Values{}
+	q.Set("temp_url_sig", signTempURL(key, strings.ToUpper(method), expires.Unix(), urlPath, ipRange))
+	q.Set("temp_url_expires", strconv.FormatInt(expires.Unix(), 10))
+	if ipRange != "" {
+		q.Set("temp_url_ip_range", ipRange)
+	}
+	return strings.TrimRight(base, "/") + (&url.URL{Path: urlPath}).EscapedPath() + "?" + q.Encode(), nil
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTempURL(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+
+	if code := request(t, http.MethodPost, storage, admin, map[string]string{"X-Account-Meta-Temp-URL-Key": "account-secret"}, nil); code != http.StatusNoContent {
+		t.Fatalf("setting the key: %d", code)
+	}
+	do(t, http.MethodPut, storage+"/Recordings", admin, "")
+	if code, _ := do(t, http.MethodPut, storage+"/Recordings/a.mkv", admin, "video"); code != http.StatusCreated {
+		t.Fatalf("upload: %d", code)
+	}
+
+	expires := time.Now().Add(time.Hour)
+	link, err := TempURL(url, http.MethodGet, "Recordings/a.mkv", expires, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, _ := send(t, http.MethodGet, link, "", nil, "")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Disposition") != `attachment; filename="a.mkv"; filename*=UTF-8''a.mkv` {
+		t.Errorf("GET with a temp URL: %s, Content-Disposition %q", resp.Status, resp.Header.Get("Content-Disposition"))
+	}
+	for _, tc := range []struct {
+		method, link string
+		want         int
+	}{
+		{http.MethodHead, link, http.StatusOK},
+		{http.MethodPut, link, http.StatusUnauthorized},
+		{http.MethodDelete, link, http.StatusUnauthorized},
+		{http.MethodGet, strings.Replace(link, "a.mkv", "b.mkv", 1), http.StatusUnauthorized},
+		{http.MethodGet, strings.Replace(link, "temp_url_expires=", "temp_url_expires=1", 1), http.StatusUnauthorized},
+	} {
+		if code, _ := do(t, tc.method, tc.link, "", ""); code != tc.want {
+			t.Errorf("%s %s: %d, want %d", tc.method, tc.link, code, tc.want)
+		}
+	}
+
+	expired, _ := TempURL(url, http.MethodGet, "Recordings/a.mkv", time.Now().Add(-time.Second), "")
+	if code, _ := do(t, http.MethodGet, expired, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("expired temp URL: %d, want 401", code)
+	}
+	local, _ := TempURL(url, http.MethodGet, "Recordings/a.mkv", expires, "127.0.0.0/8")
+	remote, _ := TempURL(url, http.MethodGet, "Recordings/a.mkv", expires, "10.0.0.0/8")
+	if code, _ := do(t, http.MethodGet, local, "", ""); code != http.StatusOK {
+		t.Errorf("temp URL for the client's range: %d", code)
+	}
+	if code, _ := do(t, http.MethodGet, remote, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("temp URL for another range: %d, want 401", code)
+	}
+
+	resp, _ = send(t, http.MethodGet, link+"&inline&filename=case%201234.mkv", "", nil, "")
+	if got := resp.Header.Get("Content-Disposition"); got != `inline; filename="case 1234.mkv"; filename*=UTF-8''case%201234.mkv` {
+		t.Errorf("inline Content-Disposition %q", got)
+	}
+
+	// Links made by Swift's tools: SHA-1 hex, SHA-512 base64 and ISO 8601 expiry
+	path := "/v1.0/" + StorageAccount + "/Recordings/a.mkv"
+	body := fmt.Sprintf("GET\n%d\n%s", expires.Unix(), path)
+	mac := hmac.New(sha1.New, []byte("account-secret"))
+	mac.Write([]byte(body))
+	sha1Link := fmt.Sprintf("%s%s?temp_url_sig=%s&temp_url_expires=%s", url, path, hex.EncodeToString(mac.Sum(nil)), expires.UTC().Format("2006-01-02T15:04:05Z"))
+	mac = hmac.New(sha512.New, []byte("account-secret"))
+	mac.Write([]byte(body))
+	sha512Link := fmt.Sprintf("%s%s?temp_url_sig=sha512:%s&temp_url_expires=%d", url, path, base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), expires.Unix())
+	for _, l := range []string{sha1Link, sha512Link} {
+		if code, _ := do(t, http.MethodGet, l, "", ""); code != http.StatusOK {
+			t.Errorf("GET %s: %d", l, code)
+		}
+	}
+
+	// A container key signs links to that container's objects, and PUT links upload
+	if code := request(t, http.MethodPost, storage+"/Recordings", admin, map[string]string{"X-Container-Meta-Temp-URL-Key-2": "container-secret"}, nil); code != http.StatusNoContent {
+		t.Fatalf("setting the container key: %d", code)
+	}
+	putPath := "/v1.0/" + StorageAccount + "/Recordings/upload.mkv"
+	putLink := fmt.Sprintf("%s%s?temp_url_sig=%s&temp_url_expires=%d", url, putPath,
+		signTempURL("container-secret", http.MethodPut, expires.Unix(), putPath, ""), expires.Unix())
+	if code, _ := do(t, http.MethodPut, putLink, "", "uploaded"); code != http.StatusCreated {
+		t.Errorf("PUT with a container temp URL: %d", code)
+	}
+	if code, body := do(t, http.MethodGet, storage+"/Recordings/upload.mkv", admin, ""); code != http.StatusOK || body != "uploaded" {
+		t.Errorf("object uploaded with a temp URL: %d %q", code, body)
+	}
+	if code, _ := do(t, http.MethodGet, putLink, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("GET with a PUT temp URL: %d, want 401", code)
+	}
+
+	// Only admins see the keys
+	reviewer := addTestAccount(t, url, admin, "dave", RoleReviewer)
+	for _, tc := range []struct{ path, header string }{{storage, "X-Account-Meta-Temp-URL-Key"}, {storage + "/Recordings", "X-Container-Meta-Temp-URL-Key-2"}} {
+		for token, want := range map[string]bool{admin: true, reviewer: false} {
+			resp, _ := send(t, http.MethodHead, tc.path, token, nil, "")
+			if got := resp.Header.Get(tc.header) != ""; got != want {
+				t.Errorf("HEAD %s shows %s: %t, want %t", tc.path, tc.header, got, want)
+			}
+		}
+	}
+}
+
+func TestTempURLKeySetter(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	reviewer := addTestAccount(t, url, admin, "erin", RoleReviewer)
+	systemA := addTestAccount(t, url, admin, "system-a", RoleSystem)
+	systemB := addTestAccount(t, url, admin, "system-b", RoleSystem)
+	request(t, http.MethodPut, storage+"/Recordings", admin, nil, nil)
+	request(t, http.MethodPut, storage+"/Recordings/a.mkv", systemA, nil, strings.NewReader("a"))
+	request(t, http.MethodPut, storage+"/Recordings/b.mkv", systemB, nil, strings.NewReader("b"))
+
+	// Only admins set or remove keys
+	for _, tc := range []struct {
+		method, path, token string
+		header              map[string]string
+	}{
+		{http.MethodPost, storage, reviewer, map[string]string{"X-Account-Meta-Temp-URL-Key": "mine"}},
+		{http.MethodPost, storage + "/Recordings", reviewer, map[string]string{"X-Container-Meta-Temp-URL-Key": "mine"}},
+		{http.MethodPost, storage + "/Recordings", systemA, map[string]string{"X-Container-Meta-Temp-URL-Key-2": "mine"}},
+		{http.MethodPost, storage + "/Recordings", systemA, map[string]string{"X-Remove-Container-Meta-Temp-URL-Key": "x"}},
+		{http.MethodPut, storage + "/Recordings", systemA, map[string]string{"X-Container-Meta-Temp-URL-Key": "mine"}},
+		{http.MethodPut, storage + "/Other", systemA, map[string]string{"X-Container-Meta-Temp-URL-Key": "mine"}},
+	} {
+		if code := request(t, tc.method, tc.path, tc.token, tc.header, nil); code != http.StatusForbidden {
+			t.Errorf("%s %s with %v: %d, want 403", tc.method, tc.path, tc.header, code)
+		}
+	}
+	link := func(key, object string) string {
+		path := "/v1.0/" + StorageAccount + "/" + object
+		expires := time.Now().Add(time.Hour).Unix()
+		return fmt.Sprintf("%s%s?temp_url_sig=%s&temp_url_expires=%d", url, path, signTempURL(key, http.MethodGet, expires, path, ""), expires)
+	}
+
+	// A key set by a system signs links to that system's objects only
+	meta, _ := readMetadata(metaFilePath("Recordings"))
+	meta.Set("Temp-URL-Key", "system-secret")
+	meta.SysSet(tempURLKeySetter(tempURLKey), "system-a")
+	if err := writeMetadata(metaFilePath("Recordings"), meta); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := do(t, http.MethodGet, link("system-secret", "Recordings/a.mkv"), "", ""); code != http.StatusOK || body != "a" {
+		t.Errorf("system A's key on its own recording: %d %q", code, body)
+	}
+	if code, _ := do(t, http.MethodGet, link("system-secret", "Recordings/b.mkv"), "", ""); code != http.StatusForbidden {
+		t.Errorf("system A's key on system B's recording: %d, want 403", code)
+	}
+
+	// A key without a record of its setter only reads
+	meta.SysSet(tempURLKeySetter(tempURLKey), "")
+	writeMetadata(metaFilePath("Recordings"), meta)
+	if code, body := do(t, http.MethodGet, link("system-secret", "Recordings/b.mkv"), "", ""); code != http.StatusOK || body != "b" {
+		t.Errorf("GET with a key of unknown setter: %d %q", code, body)
+	}
+	putPath := "/v1.0/" + StorageAccount + "/Recordings/b.mkv"
+	expires := time.Now().Add(time.Hour).Unix()
+	putLink := fmt.Sprintf("%s%s?temp_url_sig=%s&temp_url_expires=%d", url, putPath, signTempURL("system-secret", http.MethodPut, expires, putPath, ""), expires)
+	if code, _ := do(t, http.MethodPut, putLink, "", "overwritten"); code != http.StatusForbidden {
+		t.Errorf("PUT with a key of unknown setter: %d, want 403", code)
+	}
+
+	// Keys set by admins are recorded as theirs, and stop working with their account
+	if code := request(t, http.MethodPost, storage+"/Recordings", admin, map[string]string{"X-Container-Meta-Temp-URL-Key": "admin-secret"}, nil); code != http.StatusNoContent {
+		t.Fatalf("setting the key: %d", code)
+	}
+	if meta, _ = readMetadata(metaFilePath("Recordings")); meta.SysGet(tempURLKeySetter(tempURLKey)) != AuthUser {
+		t.Errorf("key setter %v", meta.Sys)
+	}
+	if _, err := AddAccount("frank", RoleAdmin, "frank-key"); err != nil {
+		t.Fatal(err)
+	}
+	frank := signIn(t, url, "frank", "frank-key")
+	request(t, http.MethodPut, storage+"/Shared", frank, map[string]string{"X-Container-Meta-Temp-URL-Key": "frank-secret"}, nil)
+	request(t, http.MethodPut, storage+"/Shared/b.mkv", admin, nil, strings.NewReader("shared"))
+	if code, _ := do(t, http.MethodGet, link("frank-secret", "Shared/b.mkv"), "", ""); code != http.StatusOK {
+		t.Errorf("admin's key: %d", code)
+	}
+	if err := SetAccountDisabled("frank", true); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := do(t, http.MethodGet, link("frank-secret", "Shared/b.mkv"), "", ""); code != http.StatusUnauthorized {
+		t.Errorf("disabled admin's key: %d, want 401", code)
+	}
+
+	// bodyworn-admin meta sets keys as the connection credentials
+	if _, err := UpdateObjectMetadata("", &Metadata{Items: []MetaItem{{Name: "Temp-URL-Key-2", Values: []string{"cli-secret"}}}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if meta, _ = readMetadata(metaFilePath("")); meta.SysGet(tempURLKeySetter(tempURLKey2)) != currentCredentials().User {
+		t.Errorf("key set with bodyworn-admin: setter %v", meta.Sys)
+	}
+
+	// Removing a key forgets its setter
+	request(t, http.MethodPost, storage+"/Recordings", admin, map[string]string{"X-Remove-Container-Meta-Temp-URL-Key": "x"}, nil)
+	if meta, _ = readMetadata(metaFilePath("Recordings")); meta.SysGet(tempURLKeySetter(tempURLKey)) != "" {
+		t.Errorf("removed key's setter kept: %v", meta.Sys)
+	}
+}
+
+func TestTempURLKeysInEvents(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	reviewer := addTestAccount(t, url, admin, "judy", RoleReviewer)
+	system := addTestAccount(t, url, admin, "system", RoleSystem)
+	request(t, http.MethodPut, storage+"/Recordings", admin, nil, nil)
+
+	messages, disconnect := openEventStream(t, url, reviewer, "types=metadata.updated,object.created", "")
+	defer disconnect()
+	request(t, http.MethodPost, storage, admin, map[string]string{"X-Account-Meta-Temp-URL-Key": "supersecret", "X-Account-Meta-Site": "north"}, nil)
+	request(t, http.MethodPost, storage+"/Recordings", admin, map[string]string{"X-Container-Meta-Temp-URL-Key-2": "supersecret", "X-Container-Meta-Site": "south"}, nil)
+	request(t, http.MethodPut, storage+"/Recordings/a.mkv", system, map[string]string{"X-Object-Meta-Case": "7"}, strings.NewReader("video"))
+
+	// Reviewers see the other metadata, but neither the keys nor system metadata
+	events := nextEvents(t, messages, 3)
+	want := []map[string]string{{"Site": "north"}, {"Site": "south"}, {"Case": "7"}}
+	for i, e := range events {
+		if fmt.Sprint(e.data.Metadata) != fmt.Sprint(want[i]) {
+			t.Errorf("%s %q metadata %v, want %v", e.data.Type, e.data.Path, e.data.Metadata, want[i])
+		}
+	}
+}
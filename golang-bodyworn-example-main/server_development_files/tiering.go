@@ -0,0 +1,682 @@
+package server
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage tiering moves objects matching a policy, typically recordings older than
+// some days or not read for a while, to a cold tier: a second directory that can sit on
+// cheaper, slower storage. The object's data is moved and replaced by a symbolic link
+// to its cold copy, while the .meta sidecar stays where it was. Listings, quotas, GET,
+// HEAD, exports and playback therefore keep working unchanged, and HEAD and GET add
+// X-Object-Storage-Tier: hot or cold.
+//
+// A cold object is restored to the hot tier when it is read, if RestoreOnRead is set,
+// or through POST /api/tiering/restore. A restored object isn't moved again until
+// RestoreHold has passed, so a recording someone is working on stays hot.
+
+// TieringConfig is the cold tier location and the policies that move objects there
+type TieringConfig struct {
+	ColdPath      string       `json:"cold_path"`
+	RestoreOnRead bool         `json:"restore_on_read"`
+	RestoreHold   TierDuration `json:"restore_hold,omitempty"`
+	Policies      []TierPolicy `json:"policies"`
+}
+
+// TierPolicy selects objects by path and moves them once they are older than
+// OlderThan or weren't read for NotAccessedFor; with both set, both must hold
+type TierPolicy struct {
+	Name           string       `json:"name"`
+	Prefix         string       `json:"prefix,omitempty"` // object path prefix, e.g. "Recordings/"
+	Suffix         string       `json:"suffix,omitempty"` // e.g. ".mkv"
+	OlderThan      TierDuration `json:"older_than,omitempty"`
+	NotAccessedFor TierDuration `json:"not_accessed_for,omitempty"`
+}
+
+// TierDuration is a duration written as Go does ("36h") or in days ("30d")
+type TierDuration time.Duration
+
+func (d *TierDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := parseTierDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = TierDuration(v)
+	return nil
+}
+
+func (d TierDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func parseTierDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// Tiers reported in X-Object-Storage-Tier
+const (
+	TierHot  = "hot"
+	TierCold = "cold"
+)
+
+// TierAccessResolution is how often reads of one object update its last access time
+var TierAccessResolution = time.Hour
+
+// System metadata kept by tiering
+const (
+	sysTier         = "tier"          // "cold" while the data is in the cold tier
+	sysTierMoved    = "tier.moved"    // when it was moved there
+	sysTierPolicy   = "tier.policy"   // the policy that moved it
+	sysTierRestored = "tier.restored" // when it was last restored
+	sysAccessed     = "accessed"      // last read, at TierAccessResolution
+)
+
+var errTierChanged = errors.New("object changed while it was being moved")
+
+// TieringReport is the outcome of one pass over all objects
+type TieringReport struct {
+	Started    time.Time `json:"started"`
+	Finished   time.Time `json:"finished"`
+	Scanned    int       `json:"scanned"`
+	Moved      int       `json:"moved"`
+	MovedBytes int64     `json:"moved_bytes"`
+	Failed     int       `json:"failed"`
+	Cold       int       `json:"cold_objects"`
+	ColdBytes  int64     `json:"cold_bytes"`
+	Errors     []string  `json:"errors,omitempty"`
+}
+
+var (
+	tieringMu   sync.Mutex
+	tiering     *TieringConfig
+	tierLastRun *TieringReport
+	tierRunning bool
+	tierBusy    = map[string]bool{} // objects being moved or restored
+	sysmetaMu   sync.Mutex          // serialises background sidecar updates
+
+	metricTierMoves   = newMetricVec("direction", "result")
+	metricTierObjects = newMetricVec("tier")
+	metricTierBytes   = newMetricVec("tier")
+)
+
+// LoadTieringConfig reads the tiering configuration from a JSON file
+func LoadTieringConfig(path string) (*TieringConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg TieringConfig
+	if err := json.Unmarshal(content, &cfg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if cfg.ColdPath == "" {
+		return nil, fmt.Errorf("%s: cold_path is required", path)
+	}
+	// Links point at absolute paths so they resolve wherever the server runs from
+	if cfg.ColdPath, err = filepath.Abs(cfg.ColdPath); err != nil {
+		return nil, err
+	}
+	account, err := filepath.Abs(filepath.Join(LocalStoragePath, StorageAccount))
+	if err != nil {
+		return nil, err
+	}
+	if rel, err := filepath.Rel(account, cfg.ColdPath); err == nil && !strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("%s: cold_path must be outside the storage account", path)
+	}
+	if cfg.RestoreHold == 0 {
+		cfg.RestoreHold = TierDuration(7 * 24 * time.Hour)
+	}
+	for i, p := range cfg.Policies {
+		if p.Name == "" {
+			return nil, fmt.Errorf("tier policy %d: name is required", i)
+		}
+		if p.OlderThan <= 0 && p.NotAccessedFor <= 0 {
+			return nil, fmt.Errorf("tier policy %s: older_than or not_accessed_for is required", p.Name)
+		}
+	}
+	return &cfg, nil
+}
+
+// StartTiering applies the policies now and then every interval
+func StartTiering(ctx context.Context, cfg *TieringConfig, interval time.Duration) error {
+	if err := os.MkdirAll(filepath.Join(cfg.ColdPath, StorageAccount), 0755); err != nil {
+		return err
+	}
+	tieringMu.Lock()
+	tiering = cfg
+	tieringMu.Unlock()
+	getLogger().Log(Info, "storage tiering started", "cold_path", cfg.ColdPath, "policies", len(cfg.Policies), "interval", interval)
+	if interval <= 0 {
+		return nil
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			runTiering()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+func tieringConfig() *TieringConfig {
+	tieringMu.Lock()
+	defer tieringMu.Unlock()
+	return tiering
+}
+
+// coldPath returns where the data of the object at fullPath is kept in the cold tier,
+// or "" when it is stored in the hot tier
+func coldPath(fullPath string) string {
+	cfg := tieringConfig()
+	if cfg == nil {
+		return ""
+	}
+	info, err := os.Lstat(fullPath)
+	if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		return ""
+	}
+	target, err := os.Readlink(fullPath)
+	if err != nil || !strings.HasPrefix(target, cfg.ColdPath+string(filepath.Separator)) {
+		return ""
+	}
+	return target
+}
+
+// followLink returns the file info of the object a symbolic link found during a
+// directory walk points to, so cold objects are counted with their real size
+func followLink(p string, info fs.FileInfo) fs.FileInfo {
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return info
+	}
+	if target, err := os.Stat(p); err == nil {
+		return target
+	}
+	return info
+}
+
+// removeColdCopy deletes the cold data of an object whose link was removed or replaced
+func removeColdCopy(path, cold string) {
+	if cold == "" {
+		return
+	}
+	if err := os.Remove(cold); err != nil && !os.IsNotExist(err) {
+		getLogger().Log(Warning, "failed to remove cold copy", "path", path, "cold_path", cold, "error", err)
+	}
+}
+
+// addTierHeader reports the tier an object's data is in, when tiering is enabled
+func addTierHeader(w http.ResponseWriter, fullPath string) {
+	if tieringConfig() == nil {
+		return
+	}
+	tier := TierHot
+	if coldPath(fullPath) != "" {
+		tier = TierCold
+	}
+	w.Header().Set("X-Object-Storage-Tier", tier)
+}
+
+// objectRead notes that a client read an object, for not_accessed_for policies, and
+// starts restoring it when it is cold and RestoreOnRead is set
+func objectRead(fullPath string) {
+	cfg := tieringConfig()
+	if cfg == nil {
+		return
+	}
+	// Flattened recordings are served for their container path, so go by the file
+	rel, err := filepath.Rel(filepath.Join(LocalStoragePath, StorageAccount), fullPath)
+	if err != nil {
+		return
+	}
+	path := filepath.ToSlash(rel)
+	if cfg.RestoreOnRead && coldPath(fullPath) != "" {
+		go func() {
+			if _, err := restoreObject(path); err != nil {
+				getLogger().Log(Warning, "failed to restore object on read", "path", path, "error", err)
+			}
+		}()
+	}
+
+	sysmetaMu.Lock()
+	defer sysmetaMu.Unlock()
+	meta, err := readMetadata(fullPath + ".meta")
+	if err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	if last, err := time.Parse(time.RFC3339, meta.SysGet(sysAccessed)); err == nil && now.Sub(last) < TierAccessResolution {
+		return
+	}
+	meta.SysSet(sysAccessed, now.Format(time.RFC3339))
+	if err := writeMetadata(fullPath+".meta", meta); err != nil {
+		getLogger().Log(Warning, "failed to record object access", "path", path, "error", err)
+	}
+}
+
+// updateSysmeta applies fn to the system metadata of the object at fullPath, serialised
+// with the other background updates of sidecars
+func updateSysmeta(fullPath string, fn func(meta *Metadata)) error {
+	sysmetaMu.Lock()
+	defer sysmetaMu.Unlock()
+	meta, err := readMetadata(fullPath + ".meta")
+	if err != nil {
+		return err
+	}
+	fn(meta)
+	return writeMetadata(fullPath+".meta", meta)
+}
+
+// claimObject marks path as being moved; it returns false if it already is
+func claimObject(path string) bool {
+	tieringMu.Lock()
+	defer tieringMu.Unlock()
+	if tierBusy[path] {
+		return false
+	}
+	tierBusy[path] = true
+	return true
+}
+
+func releaseObject(path string) {
+	tieringMu.Lock()
+	delete(tierBusy, path)
+	tieringMu.Unlock()
+}
+
+// copyObjectData copies src to a hidden temporary file next to dst and returns the
+// temporary file's name and the MD5 of what was copied
+func copyObjectData(src, dst string, modTime time.Time) (string, string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", "", err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", "", err
+	}
+	out, err := os.CreateTemp(filepath.Dir(dst), ".tier-"+filepath.Base(dst)+".*")
+	if err != nil {
+		return "", "", err
+	}
+	hash := md5.New()
+	_, err = io.Copy(io.MultiWriter(out, hash), in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(out.Name(), modTime, modTime)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return "", "", err
+	}
+	return out.Name(), hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func sameObject(a, b fs.FileInfo) bool {
+	return a.Size() == b.Size() && a.ModTime().Equal(b.ModTime()) && a.Mode().Type() == b.Mode().Type()
+}
+
+// demoteObject moves the data of a hot object to the cold tier. It returns false
+// when the object isn't a plain file or is already being moved.
+func demoteObject(path, policy string) (bool, error) {
+	cfg := tieringConfig()
+	if cfg == nil {
+		return false, errors.New("storage tiering is not enabled")
+	}
+	if !claimObject(path) {
+		return false, nil
+	}
+	defer releaseObject(path)
+
+	fullPath := filepath.Join(LocalStoragePath, StorageAccount, path)
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() {
+		return false, nil
+	}
+	etag := cachedETag(fullPath)
+	cold := filepath.Join(cfg.ColdPath, StorageAccount, filepath.FromSlash(path))
+	temp, sum, err := copyObjectData(fullPath, cold, info.ModTime())
+	if err != nil {
+		return false, err
+	}
+	if sum != etag {
+		os.Remove(temp)
+		return false, errTierChanged
+	}
+	if err := os.Rename(temp, cold); err != nil {
+		os.Remove(temp)
+		return false, err
+	}
+
+	// Swap the object for a link to its cold copy, unless it was replaced meanwhile
+	link := filepath.Join(filepath.Dir(fullPath), ".tier-"+filepath.Base(fullPath))
+	os.Remove(link)
+	if err := os.Symlink(cold, link); err != nil {
+		os.Remove(cold)
+		return false, err
+	}
+	if now, err := os.Lstat(fullPath); err != nil || !sameObject(info, now) {
+		os.Remove(link)
+		os.Remove(cold)
+		return false, errTierChanged
+	}
+	if err := os.Rename(link, fullPath); err != nil {
+		os.Remove(link)
+		os.Remove(cold)
+		return false, err
+	}
+	err = updateSysmeta(fullPath, func(meta *Metadata) {
+		meta.SysSet(sysTier, TierCold)
+		meta.SysSet(sysTierMoved, time.Now().UTC().Format(time.RFC3339))
+		meta.SysSet(sysTierPolicy, policy)
+	})
+	if err != nil {
+		getLogger().Log(Warning, "failed to record object tier", "path", path, "error", err)
+	}
+	return true, nil
+}
+
+// restoreObject moves the data of a cold object back to the hot tier. It returns
+// false when the object wasn't cold or is already being moved.
+func restoreObject(path string) (bool, error) {
+	fullPath := filepath.Join(LocalStoragePath, StorageAccount, path)
+	cold := coldPath(fullPath)
+	if cold == "" {
+		if _, err := os.Stat(fullPath); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	if !claimObject(path) {
+		return false, nil
+	}
+	defer releaseObject(path)
+
+	info, err := os.Stat(cold)
+	if err != nil {
+		metricTierMoves.add(1, "restore", "error")
+		return false, err
+	}
+	etag := cachedETag(fullPath)
+	temp, sum, err := copyObjectData(cold, fullPath, info.ModTime())
+	if err == nil && sum != etag {
+		os.Remove(temp)
+		err = errTierChanged
+	}
+	if err == nil && coldPath(fullPath) != cold {
+		os.Remove(temp)
+		err = errTierChanged
+	}
+	if err == nil {
+		if err = os.Rename(temp, fullPath); err != nil {
+			os.Remove(temp)
+		}
+	}
+	if err != nil {
+		metricTierMoves.add(1, "restore", "error")
+		return false, err
+	}
+	removeColdCopy(path, cold)
+	err = updateSysmeta(fullPath, func(meta *Metadata) {
+		meta.SysSet(sysTier, "")
+		meta.SysSet(sysTierMoved, "")
+		meta.SysSet(sysTierPolicy, "")
+		meta.SysSet(sysTierRestored, time.Now().UTC().Format(time.RFC3339))
+	})
+	if err != nil {
+		getLogger().Log(Warning, "failed to record object tier", "path", path, "error", err)
+	}
+	metricTierMoves.add(1, "restore", "ok")
+	getLogger().Log(Info, "object restored from cold tier", "path", path, "bytes", info.Size())
+	return true, nil
+}
+
+// match reports whether policy p moves the object at path now
+func (p TierPolicy) match(path string, info fs.FileInfo, meta *Metadata, now time.Time) bool {
+	if !strings.HasPrefix(path, p.Prefix) || !strings.HasSuffix(path, p.Suffix) {
+		return false
+	}
+	if p.OlderThan > 0 && now.Sub(info.ModTime()) < time.Duration(p.OlderThan) {
+		return false
+	}
+	if p.NotAccessedFor > 0 {
+		accessed := info.ModTime()
+		if t, err := time.Parse(time.RFC3339, meta.SysGet(sysAccessed)); err == nil && t.After(accessed) {
+			accessed = t
+		}
+		if now.Sub(accessed) < time.Duration(p.NotAccessedFor) {
+			return false
+		}
+	}
+	return true
+}
+
+// runTiering moves every hot object a policy matches to the cold tier
+func runTiering() *TieringReport {
+	cfg := tieringConfig()
+	if cfg == nil {
+		return nil
+	}
+	tieringMu.Lock()
+	if tierRunning {
+		report := tierLastRun
+		tieringMu.Unlock()
+		return report
+	}
+	tierRunning = true
+	tieringMu.Unlock()
+	defer func() {
+		tieringMu.Lock()
+		tierRunning = false
+		tieringMu.Unlock()
+	}()
+
+	report := &TieringReport{Started: time.Now().UTC()}
+	root := filepath.Join(LocalStoragePath, StorageAccount)
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || strings.HasSuffix(d.Name(), ".meta") {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		path := filepath.ToSlash(rel)
+		report.Scanned++
+		if coldPath(p) != "" {
+			if info, err := os.Stat(p); err == nil {
+				report.Cold++
+				report.ColdBytes += info.Size()
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		meta, err := readMetadata(p + ".meta")
+		if err != nil {
+			return nil
+		}
+		now := time.Now()
+		if t, err := time.Parse(time.RFC3339, meta.SysGet(sysTierRestored)); err == nil && now.Sub(t) < time.Duration(cfg.RestoreHold) {
+			return nil
+		}
+		for _, policy := range cfg.Policies {
+			if !policy.match(path, info, meta, now) {
+				continue
+			}
+			moved, err := demoteObject(path, policy.Name)
+			if err != nil {
+				report.Failed++
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", path, err))
+				metricTierMoves.add(1, "demote", "error")
+				getLogger().Log(Warning, "failed to move object to cold tier", "path", path, "policy", policy.Name, "error", err)
+			} else if moved {
+				report.Moved++
+				report.MovedBytes += info.Size()
+				report.Cold++
+				report.ColdBytes += info.Size()
+				metricTierMoves.add(1, "demote", "ok")
+				getLogger().Log(Info, "object moved to cold tier", "path", path, "policy", policy.Name, "bytes", info.Size())
+			}
+			break
+		}
+		return nil
+	})
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		getLogger().Log(Error, "storage tiering pass failed", "error", err)
+	}
+	report.Finished = time.Now().UTC()
+	metricTierObjects.set(float64(report.Cold), TierCold)
+	metricTierBytes.set(float64(report.ColdBytes), TierCold)
+
+	tieringMu.Lock()
+	tierLastRun = report
+	tieringMu.Unlock()
+	if report.Moved > 0 || report.Failed > 0 {
+		getLogger().Log(Info, "storage tiering pass finished", "scanned", report.Scanned, "moved", report.Moved, "bytes", report.MovedBytes, "failed", report.Failed)
+	}
+	return report
+}
+
+// TierRestoreRequest names the objects POST /api/tiering/restore brings back
+type TierRestoreRequest struct {
+	Objects []string `json:"objects"`
+}
+
+// TierRestoreResult is the outcome of restoring one object
+type TierRestoreResult struct {
+	Object   string `json:"object"`
+	Restored bool   `json:"restored"`
+	Tier     string `json:"tier,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// TieringHandler serves the tiering configuration and last pass on GET /api/tiering,
+// runs the policies on POST /api/tiering/run and restores objects on
+// POST /api/tiering/restore
+func TieringHandler(w http.ResponseWriter, r *http.Request) {
+	log := requestLogger(r)
+	cfg := tieringConfig()
+	if cfg == nil {
+		http.Error(w, "Storage tiering is not enabled", http.StatusNotFound)
+		return
+	}
+
+	action := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/tiering"), "/")
+	switch {
+	case action == "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		tieringMu.Lock()
+		report := tierLastRun
+		tieringMu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"config": cfg, "last_run": report})
+	case action == "run" && r.Method == http.MethodPost:
+		report := runTiering()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+		log.Log(Info, "storage tiering run on request", "moved", report.Moved, "failed", report.Failed)
+	case action == "restore" && r.Method == http.MethodPost:
+		var req TierRestoreRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Objects) == 0 {
+			http.Error(w, "Bad Request: expected {\"objects\": [...]}", http.StatusBadRequest)
+			return
+		}
+		results := make([]TierRestoreResult, 0, len(req.Objects))
+		status := http.StatusOK
+		for _, object := range req.Objects {
+			object = strings.Trim(object, "/")
+			result := TierRestoreResult{Object: object}
+			if object == "" || strings.Contains(object, "..") || isContainerPath(object) {
+				result.Error = "invalid object path"
+				status = http.StatusBadRequest
+			} else if restored, err := restoreObject(object); os.IsNotExist(err) {
+				result.Error = "not found"
+				status = http.StatusNotFound
+			} else if err != nil {
+				result.Error = err.Error()
+				status = http.StatusInternalServerError
+			} else {
+				result.Restored = restored
+				result.Tier = TierHot
+				if coldPath(filepath.Join(LocalStoragePath, StorageAccount, object)) != "" {
+					result.Tier = TierCold // still being restored by another request
+				}
+			}
+			results = append(results, result)
+		}
+		if len(results) > 1 && status != http.StatusOK {
+			status = http.StatusMultiStatus
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+		log.Log(Info, "objects restored on request", "objects", len(results))
+	case action == "" || action == "run" || action == "restore":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// writeTieringMetrics adds tier moves and cold tier usage to a scrape
+func writeTieringMetrics(w io.Writer) {
+	if tieringConfig() == nil {
+		return
+	}
+	metricTierMoves.write(w, "bodyworn_tier_moves_total", "Objects moved between storage tiers, by direction and result.", "counter")
+	metricTierObjects.write(w, "bodyworn_tier_objects", "Objects in the cold tier at the last tiering pass.", "gauge")
+	metricTierBytes.write(w, "bodyworn_tier_bytes", "Bytes in the cold tier at the last tiering pass.", "gauge")
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTieringConfig(t *testing.T) {
+	LocalStoragePath = t.TempDir()
+	dir := t.TempDir()
+	load := func(content string) (*TieringConfig, error) {
+		path := filepath.Join(dir, "tiering.json")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return LoadTieringConfig(path)
+	}
+
+	cfg, err := load(`{"cold_path":"` + dir + `/cold","policies":[{"name":"old","older_than":"30d","not_accessed_for":"36h"}]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := cfg.Policies[0]
+	if time.Duration(p.OlderThan) != 30*24*time.Hour || time.Duration(p.NotAccessedFor) != 36*time.Hour || time.Duration(cfg.RestoreHold) != 7*24*time.Hour {
+		t.Errorf("durations %v %v %v", p.OlderThan, p.NotAccessedFor, cfg.RestoreHold)
+	}
+	for _, bad := range []string{
+		`{"policies":[]}`,
+		`{"cold_path":"` + filepath.Join(LocalStoragePath, StorageAccount, "cold") + `"}`,
+		`{"cold_path":"/cold","policies":[{"name":"never"}]}`,
+		`{"cold_path":"/cold","policies":[{"older_than":"1d"}]}`,
+		`{"cold_path":"/cold","policies":[{"name":"x","older_than":"-1d"}]}`,
+	} {
+		if _, err := load(bad); err == nil {
+			t.Errorf("%s accepted", bad)
+		}
+	}
+}
+
+func TestTierPolicyMatch(t *testing.T) {
+	now := time.Now()
+	info := fakeFileInfo{modTime: now.Add(-48 * time.Hour)}
+	read := &Metadata{}
+	read.SysSet(sysAccessed, now.Add(-time.Hour).UTC().Format(time.RFC3339))
+	day := TierDuration(24 * time.Hour)
+	for _, tc := range []struct {
+		policy TierPolicy
+		path   string
+		meta   *Metadata
+		want   bool
+	}{
+		{TierPolicy{OlderThan: day}, "CamA/1.mkv", &Metadata{}, true},
+		{TierPolicy{OlderThan: 3 * day}, "CamA/1.mkv", &Metadata{}, false},
+		{TierPolicy{Prefix: "CamB/", OlderThan: day}, "CamA/1.mkv", &Metadata{}, false},
+		{TierPolicy{Suffix: ".mkv", OlderThan: day}, "CamA/1.json", &Metadata{}, false},
+		{TierPolicy{NotAccessedFor: day}, "CamA/1.mkv", &Metadata{}, true},
+		{TierPolicy{NotAccessedFor: day}, "CamA/1.mkv", read, false},
+		{TierPolicy{OlderThan: day, NotAccessedFor: day}, "CamA/1.mkv", read, false},
+	} {
+		if got := tc.policy.match(tc.path, info, tc.meta, now); got != tc.want {
+			t.Errorf("%+v on %s: %v, want %v", tc.policy, tc.path, got, tc.want)
+		}
+	}
+}
+
+// fakeFileInfo is a file modified at modTime
+type fakeFileInfo struct {
+	os.FileInfo
+	modTime time.Time
+}
+
+func (f fakeFileInfo) ModTime() time.Time { return f.modTime }
+
+// startTestTiering enables tiering of .mkv objects older than a day into a temporary cold tier
+func startTestTiering(t *testing.T) *TieringConfig {
+	t.Helper()
+	cfg := &TieringConfig{
+		ColdPath:    t.TempDir(),
+		RestoreHold: TierDuration(time.Hour),
+		Policies:    []TierPolicy{{Name: "old", Suffix: ".mkv", OlderThan: TierDuration(24 * time.Hour)}},
+	}
+	if err := StartTiering(context.Background(), cfg, 0); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// ageObject makes a stored object look two days old
+func ageObject(t *testing.T, path string) {
+	t.Helper()
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(LocalStoragePath, StorageAccount, path), old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTiering(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	if code, _ := do(t, http.MethodGet, url+"/api/tiering", admin, ""); code != http.StatusNotFound {
+		t.Errorf("tiering API while disabled: %d, want 404", code)
+	}
+	cfg := startTestTiering(t)
+
+	request(t, http.MethodPut, storage+"/CamA", admin, nil, nil)
+	for _, object := range []string{"CamA/old.mkv", "CamA/new.mkv", "CamA/old.json"} {
+		request(t, http.MethodPut, storage+"/"+object, admin, map[string]string{"X-Object-Meta-Case": "7"}, strings.NewReader("content of "+object))
+	}
+	ageObject(t, "CamA/old.mkv")
+	ageObject(t, "CamA/old.json")
+	resp, _ := send(t, http.MethodHead, storage+"/CamA/old.mkv", admin, nil, "")
+	etag := resp.Header.Get("ETag")
+
+	var report TieringReport
+	code, body := do(t, http.MethodPost, url+"/api/tiering/run", admin, "")
+	if code != http.StatusOK || json.Unmarshal([]byte(body), &report) != nil || report.Moved != 1 || report.Cold != 1 || report.Failed != 0 {
+		t.Fatalf("run: %d %s", code, body)
+	}
+	fullPath := filepath.Join(LocalStoragePath, StorageAccount, "CamA", "old.mkv")
+	cold := filepath.Join(cfg.ColdPath, StorageAccount, "CamA", "old.mkv")
+	if coldPath(fullPath) != cold {
+		t.Fatalf("%s isn't a link to %s", fullPath, cold)
+	}
+
+	// Cold objects read as before, with their tier reported
+	resp, content := send(t, http.MethodGet, storage+"/CamA/old.mkv", admin, nil, "")
+	if content != "content of CamA/old.mkv" || resp.Header.Get("ETag") != etag || resp.Header.Get("X-Object-Meta-Case") != "7" || resp.Header.Get("X-Object-Storage-Tier") != TierCold {
+		t.Errorf("GET cold object: %q %v", content, resp.Header)
+	}
+	if resp, _ := send(t, http.MethodHead, storage+"/CamA/new.mkv", admin, nil, ""); resp.Header.Get("X-Object-Storage-Tier") != TierHot {
+		t.Errorf("hot object tier %q", resp.Header.Get("X-Object-Storage-Tier"))
+	}
+	var listing []ObjectInfo
+	_, body = do(t, http.MethodGet, storage+"/CamA?format=json", admin, "")
+	json.Unmarshal([]byte(body), &listing)
+	for _, o := range listing {
+		if o.Name == "old.mkv" && o.Bytes != int64(len("content of CamA/old.mkv")) {
+			t.Errorf("cold object listed with %d bytes", o.Bytes)
+		}
+	}
+
+	// Restored objects are held in the hot tier
+	code, body = do(t, http.MethodPost, url+"/api/tiering/restore", admin, `{"objects":["CamA/old.mkv"]}`)
+	if code != http.StatusOK || !strings.Contains(body, `"restored":true,"tier":"hot"`) {
+		t.Errorf("restore: %d %s", code, body)
+	}
+	if info, err := os.Lstat(fullPath); err != nil || !info.Mode().IsRegular() {
+		t.Errorf("restored object isn't a file: %v", err)
+	}
+	if _, err := os.Stat(cold); !os.IsNotExist(err) {
+		t.Errorf("cold copy kept after restoring: %v", err)
+	}
+	if report := runTiering(); report.Moved != 0 {
+		t.Errorf("restored object moved again: %+v", report)
+	}
+	code, body = do(t, http.MethodPost, url+"/api/tiering/restore", admin, `{"objects":["CamA/new.mkv","CamA/gone.mkv","CamA"]}`)
+	if code != http.StatusMultiStatus || !strings.Contains(body, `"restored":false,"tier":"hot"`) || !strings.Contains(body, `"not found"`) || !strings.Contains(body, `"invalid object path"`) {
+		t.Errorf("restore of hot, missing and container paths: %d %s", code, body)
+	}
+}
+
+func TestTieringColdCopies(t *testing.T) {
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	cfg := startTestTiering(t)
+	request(t, http.MethodPut, storage+"/CamA", admin, nil, nil)
+	for _, name := range []string{"replaced.mkv", "deleted.mkv", "read.mkv"} {
+		request(t, http.MethodPut, storage+"/CamA/"+name, admin, nil, strings.NewReader(name))
+		if moved, err := demoteObject("CamA/"+name, "test"); !moved || err != nil {
+			t.Fatalf("demote %s: %v %v", name, moved, err)
+		}
+	}
+	coldCopy := func(name string) string {
+		return filepath.Join(cfg.ColdPath, StorageAccount, "CamA", name)
+	}
+
+	// Replacing or deleting a cold object removes its cold copy
+	request(t, http.MethodPut, storage+"/CamA/replaced.mkv", admin, nil, strings.NewReader("new"))
+	request(t, http.MethodDelete, storage+"/CamA/deleted.mkv", admin, nil, nil)
+	for _, name := range []string{"replaced.mkv", "deleted.mkv"} {
+		if _, err := os.Stat(coldCopy(name)); !os.IsNotExist(err) {
+			t.Errorf("%s: cold copy kept: %v", name, err)
+		}
+	}
+	if _, content := send(t, http.MethodGet, storage+"/CamA/replaced.mkv", admin, nil, ""); content != "new" {
+		t.Errorf("replaced object reads %q", content)
+	}
+
+	// Reads restore cold objects when configured to
+	tieringMu.Lock()
+	cfg.RestoreOnRead = true
+	tieringMu.Unlock()
+	if _, content := send(t, http.MethodGet, storage+"/CamA/read.mkv", admin, nil, ""); content != "read.mkv" {
+		t.Errorf("cold object reads %q", content)
+	}
+	readPath := filepath.Join(LocalStoragePath, StorageAccount, "CamA", "read.mkv")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		meta, _ := readMetadata(readPath + ".meta")
+		if coldPath(readPath) == "" && meta.SysGet(sysAccessed) != "" && meta.SysGet(sysTierRestored) != "" {
+			if meta.SysGet(sysTier) != "" {
+				t.Errorf("restored object metadata %v", meta.Sys)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("object not restored after being read: %v", meta.Sys)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stateDir holds server bookkeeping (partial uploads, queues) outside the storage account
+func stateDir() string {
+	return filepath.Join(LocalStoragePath, ".bodyworn")
+}
+
+// uploadTempDir is where PUT bodies are staged before being renamed into place,
+// so an aborted upload never leaves a partial object behind
+func uploadTempDir() string {
+	return filepath.Join(stateDir(), "uploads")
+}
+
+// UploadStatus is a snapshot of an in-flight upload
+type UploadStatus struct {
+	RequestID  string    `json:"request_id"`
+	Path       string    `json:"path"`
+	RemoteAddr string    `json:"remote_addr"`
+	Started    time.Time `json:"started"`
+	Bytes      int64     `json:"bytes"`
+	Expected   int64     `json:"expected"`
+}
+
+// trackedUpload counts bytes as the request body is read
+type trackedUpload struct {
+	status UploadStatus
+	bytes  atomic.Int64
+	body   io.Reader
+}
+
+func (u *trackedUpload) Read(p []byte) (int, error) {
+	n, err := u.body.Read(p)
+	u.bytes.Add(int64(n))
+	return n, err
+}
+
+var (
+	uploadsMu     sync.Mutex
+	activeUploads = make(map[*trackedUpload]struct{})
+	uploadsDone   = sync.NewCond(&uploadsMu)
+	shuttingDown  atomic.Bool
+)
+
+// beginUpload registers r as in flight; the returned reader must be used for the body
+// and finishUpload called when the handler is done with it
+func beginUpload(r *http.Request, path string) *trackedUpload {
+	u := &trackedUpload{
+		status: UploadStatus{
+			RequestID:  RequestID(r.Context()),
+			Path:       path,
+			RemoteAddr: r.RemoteAddr,
+			Started:    time.Now(),
+			Expected:   r.ContentLength,
+		},
+		body: r.Body,
+	}
+	uploadsMu.Lock()
+	activeUploads[u] = struct{}{}
+	uploadsMu.Unlock()
+	return u
+}
+
+func finishUpload(u *trackedUpload) {
+	uploadsMu.Lock()
+	delete(activeUploads, u)
+	uploadsMu.Unlock()
+	uploadsDone.Broadcast()
+}
+
+// InFlightUploads returns the uploads currently being received, oldest first
+func InFlightUploads() []UploadStatus {
+	uploadsMu.Lock()
+	defer uploadsMu.Unlock()
+	result := make([]UploadStatus, 0, len(activeUploads))
+	for u := range activeUploads {
+		s := u.status
+		s.Bytes = u.bytes.Load()
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Started.Before(result[j].Started) })
+	return result
+}
+
+func inFlightUploadCount() int {
+	uploadsMu.Lock()
+	defer uploadsMu.Unlock()
+	return len(activeUploads)
+}
+
+// BeginShutdown marks the server as draining so /readyz fails and aborted
+// uploads are reported as such rather than as client errors
+func BeginShutdown() {
+	shuttingDown.Store(true)
+}
+
+func checkNotShuttingDown() error {
+	if shuttingDown.Load() {
+		return errors.New("server is shutting down")
+	}
+	return nil
+}
+
+// AbortInFlightUploads logs every upload still in progress once the drain
+// timeout has expired and returns them; their partial files are discarded
+// when the connection is closed
+func AbortInFlightUploads() []UploadStatus {
+	aborted := InFlightUploads()
+	for _, u := range aborted {
+		getLogger().Log(Warning, "upload aborted by shutdown",
+			"request_id", u.RequestID,
+			"path", u.Path,
+			"remote_addr", u.RemoteAddr,
+			"bytes", u.Bytes,
+			"expected", u.Expected,
+			"elapsed", time.Since(u.Started).Round(time.Millisecond),
+		)
+	}
+	return aborted
+}
+
+// WaitForUploads blocks until no uploads are in flight or ctx is done
+func WaitForUploads(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		uploadsMu.Lock()
+		for len(activeUploads) > 0 && ctx.Err() == nil {
+			uploadsDone.Wait()
+		}
+		uploadsMu.Unlock()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		uploadsDone.Broadcast()
+		return ctx.Err()
+	}
+}
+
+// cleanStaleUploads removes partial uploads left behind by a crash
+func cleanStaleUploads() error {
+	dir := uploadTempDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if err := os.Remove(path); err != nil {
+			getLogger().Log(Warning, "failed to remove stale partial upload", "path", path, "error", err)
+			continue
+		}
+		getLogger().Log(Warning, "removed stale partial upload", "path", path)
+	}
+	return nil
+}
+
+// Shutdown hooks
+
+type shutdownHook struct {
+	name string
+	fn   func(context.Context) error
+}
+
+var (
+	shutdownHooksMu sync.Mutex
+	shutdownHooks   []shutdownHook
+)
+
+// RegisterShutdownHook adds fn to the work done by RunShutdownHooks, e.g. syncing a queue or log
+func RegisterShutdownHook(name string, fn func(context.Context) error) {
+	shutdownHooksMu.Lock()
+	defer shutdownHooksMu.Unlock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name: name, fn: fn})
+}
+
+// RunShutdownHooks delivers the published events, runs registered hooks in reverse
+// order of registration and flushes the logger
+func RunShutdownHooks(ctx context.Context) error {
+	shutdownHooksMu.Lock()
+	hooks := append([]shutdownHook(nil), shutdownHooks...)
+	shutdownHooksMu.Unlock()
+
+	// The audit log and the webhook and replication queues register hooks to sync
+	// themselves, which must come after the last events reach them. The audit log is
+	// started first, so its hook runs last.
+	var errs []error
+	if err := flushEvents(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	for i := len(hooks) - 1; i >= 0; i-- {
+		if err := hooks[i].fn(ctx); err != nil {
+			getLogger().Log(Error, "shutdown hook failed", "hook", hooks[i].name, "error", err)
+			errs = append(errs, err)
+		}
+	}
+	if err := FlushLogger(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
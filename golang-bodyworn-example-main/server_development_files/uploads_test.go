@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startDrainTestServer serves the storage API from a server the test shuts down
+// itself, sharing the tokens of startTestServer's
+func startDrainTestServer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	url := startTestServer(t)
+	token := signIn(t, url, AuthUser, AuthPassword)
+	ts := httptest.NewServer(http.HandlerFunc(StorageHandler))
+	t.Cleanup(ts.Close)
+	t.Cleanup(func() { shuttingDown.Store(false) })
+	return ts, token
+}
+
+// startSlowUpload PUTs object with a body the test writes, returning the writer and
+// a channel with the response status
+func startSlowUpload(t *testing.T, url, token, object string) (*io.PipeWriter, <-chan int) {
+	t.Helper()
+	body, w := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPut, url+"/v1.0/"+StorageAccount+"/"+object, body)
+	req.Header.Set("X-Auth-Token", token)
+	req.ContentLength = 10
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	w.Write([]byte("part-"))
+	deadline := time.Now().Add(5 * time.Second)
+	for inFlightUploadCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("upload not in flight")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return w, status
+}
+
+func TestShutdownDrainsUploads(t *testing.T) {
+	ts, token := startDrainTestServer(t)
+	w, status := startSlowUpload(t, ts.URL, token, "System/drained.mkv")
+	if uploads := InFlightUploads(); len(uploads) != 1 || uploads[0].Path != "System/drained.mkv" || uploads[0].Expected != 10 {
+		t.Errorf("in-flight uploads %+v", uploads)
+	}
+
+	BeginShutdown()
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- ts.Config.Shutdown(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	w.Write([]byte("done!"))
+	w.Close()
+	if code := <-status; code != http.StatusCreated {
+		t.Errorf("upload finishing during the drain: %d", code)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("shutdown: %v", err)
+	}
+	if content, err := os.ReadFile(filepath.Join(LocalStoragePath, StorageAccount, "System", "drained.mkv")); string(content) != "part-done!" {
+		t.Errorf("drained object %q %v", content, err)
+	}
+	if len(InFlightUploads()) != 0 {
+		t.Errorf("uploads left %+v", InFlightUploads())
+	}
+}
+
+func TestShutdownAbortsUploads(t *testing.T) {
+	ts, token := startDrainTestServer(t)
+	w, status := startSlowUpload(t, ts.URL, token, "System/aborted.mkv")
+	defer w.Close()
+
+	BeginShutdown()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := ts.Config.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("shutdown with an upload running: %v", err)
+	}
+	aborted := AbortInFlightUploads()
+	if len(aborted) != 1 || aborted[0].Path != "System/aborted.mkv" || aborted[0].Bytes != 5 {
+		t.Errorf("aborted uploads %+v", aborted)
+	}
+	ts.CloseClientConnections()
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer waitCancel()
+	if err := WaitForUploads(waitCtx); err != nil {
+		t.Fatalf("uploads still running after close: %v", err)
+	}
+	w.CloseWithError(errors.New("connection closed"))
+	<-status
+
+	// The partial file is discarded rather than stored
+	if _, err := os.Stat(filepath.Join(LocalStoragePath, StorageAccount, "System", "aborted.mkv")); !os.IsNotExist(err) {
+		t.Errorf("aborted upload stored: %v", err)
+	}
+	if entries, _ := os.ReadDir(uploadTempDir()); len(entries) != 0 {
+		t.Errorf("partial uploads left: %v", entries)
+	}
+}
+
+func TestShutdownHooks(t *testing.T) {
+	startTestServer(t)
+	shutdownHooksMu.Lock()
+	saved := shutdownHooks
+	shutdownHooks = nil
+	shutdownHooksMu.Unlock()
+	t.Cleanup(func() {
+		shutdownHooksMu.Lock()
+		shutdownHooks = saved
+		shutdownHooksMu.Unlock()
+	})
+
+	q, err := openDiskQueue(filepath.Join(t.TempDir(), "queue"), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.push(map[string]string{"path": "CamA/1.mkv"})
+	recordAudit(AuditEntry{Action: "test.viewed", Path: "CamA/1.mkv"})
+
+	var ran []string
+	RegisterShutdownHook("audit log", func(ctx context.Context) error {
+		ran = append(ran, "audit log")
+		return closeAuditLog(ctx)
+	})
+	RegisterShutdownHook("queue", func(context.Context) error {
+		ran = append(ran, "queue")
+		return q.sync()
+	})
+	RegisterShutdownHook("failing", func(context.Context) error {
+		ran = append(ran, "failing")
+		return errors.New("broken")
+	})
+
+	// Hooks run last registered first, and failures don't stop the others
+	if err := RunShutdownHooks(context.Background()); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("RunShutdownHooks: %v", err)
+	}
+	if strings.Join(ran, ", ") != "failing, queue, audit log" {
+		t.Errorf("hooks ran as %v", ran)
+	}
+	auditMu.Lock()
+	closed := auditFile == nil
+	auditMu.Unlock()
+	if !closed {
+		t.Error("audit log left open")
+	}
+	if q.depth() != 1 {
+		t.Errorf("queue depth %d after syncing", q.depth())
+	}
+
+	// Entries recorded afterwards open the log again, keeping the chain
+	recordAudit(AuditEntry{Action: "test.viewed", Path: "CamA/2.mkv"})
+	lines, err := auditExcerpt(map[string]bool{"CamA/1.mkv": true, "CamA/2.mkv": true})
+	if err != nil || len(lines) != 2 || !strings.Contains(string(lines[1]), `"prev":"`+auditHash(lines[0])+`"`) {
+		t.Errorf("audit log after reopening: %q %v", lines, err)
+	}
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhooks POST storage events to downstream systems. Each webhook has its own
+// persistent queue under the state directory, so a slow or failing endpoint doesn't
+// delay the others and undelivered events survive restarts.
+//
+// Every delivery carries the event as its JSON body and these headers:
+//
+//	X-Bodyworn-Event:     event type, e.g. object.created
+//	X-Bodyworn-Delivery:  event ID, the same on every retry
+//	X-Bodyworn-Timestamp: Unix time of the attempt
+//	X-Bodyworn-Signature: sha256=<hex HMAC-SHA256 of "<timestamp>.<body>" keyed with the secret>
+//
+// A 2xx answer acknowledges the event. Other answers and network errors are retried
+// with exponential backoff; 4xx answers other than 408 and 429 are not retried.
+
+// Webhook is one configured endpoint
+type Webhook struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"` // empty for all events
+	Prefix string   `json:"prefix"` // only events for paths with this prefix
+}
+
+// WebhookMaxAttempts is how often an event is tried before it is moved to the failed queue
+var WebhookMaxAttempts = 15
+
+var (
+	metricWebhookDeliveries = newMetricVec("result")
+	metricWebhookQueue      = newMetricVec("url")
+
+	webhookQueues = map[string]*diskQueue{}
+)
+
+// LoadWebhooks reads a JSON array of webhooks
+func LoadWebhooks(path string) ([]Webhook, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []Webhook
+	if err := json.Unmarshal(content, &hooks); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for i, h := range hooks {
+		if !strings.HasPrefix(h.URL, "http://") && !strings.HasPrefix(h.URL, "https://") {
+			return nil, fmt.Errorf("webhook %d: invalid url %q", i, h.URL)
+		}
+	}
+	return hooks, nil
+}
+
+// wants reports whether the webhook subscribes to e
+func (h Webhook) wants(e Event) bool {
+	if h.Prefix != "" && !strings.HasPrefix(e.Path, h.Prefix) {
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, t := range h.Events {
+		if t == e.Type || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookSignature signs body for delivery at timestamp
+func webhookSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookQueueDir names a webhook's queue after its URL
+func webhookQueueDir(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(stateDir(), "webhooks", hex.EncodeToString(sum[:8]))
+}
+
+// StartWebhooks queues every published event for the webhooks that want it and
+// delivers them in the background until ctx is cancelled
+func StartWebhooks(ctx context.Context, hooks []Webhook) error {
+	client := &http.Client{Timeout: 30 * time.Second}
+	for _, hook := range hooks {
+		q, err := openDiskQueue(webhookQueueDir(hook.URL), WebhookMaxAttempts)
+		if err != nil {
+			return err
+		}
+		webhookQueues[hook.URL] = q
+		hook := hook
+		SubscribeEvents(func(e Event) {
+			if !hook.wants(e) {
+				return
+			}
+			if err := q.push(e); err != nil {
+				getLogger().Log(Error, "failed to queue webhook event", "url", hook.URL, "event_id", e.ID, "error", err)
+			}
+		})
+		go q.run(ctx, func(ctx context.Context, payload json.RawMessage) error {
+			return deliverWebhook(ctx, client, hook, payload)
+		})
+		getLogger().Log(Info, "webhook started", "url", hook.URL, "queued", q.depth())
+		RegisterReadinessCheck("webhook_queue "+hook.URL, q.writable)
+		RegisterShutdownHook("webhook queue "+hook.URL, func(context.Context) error {
+			getLogger().Log(Info, "webhook queue kept for the next start", "url", hook.URL, "queued", q.depth())
+			return q.sync()
+		})
+	}
+	return nil
+}
+
+// deliverWebhook POSTs one queued event
+func deliverWebhook(ctx context.Context, client *http.Client, hook Webhook, payload json.RawMessage) error {
+	var e Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return permanentError{err}
+	}
+	var body bytes.Buffer
+	if err := json.Compact(&body, payload); err != nil {
+		return permanentError{err}
+	}
+	payload = body.Bytes()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bodyworn-webhooks")
+	req.Header.Set("X-Bodyworn-Event", e.Type)
+	req.Header.Set("X-Bodyworn-Delivery", e.ID)
+	req.Header.Set("X-Bodyworn-Timestamp", timestamp)
+	if hook.Secret != "" {
+		req.Header.Set("X-Bodyworn-Signature", webhookSignature(hook.Secret, timestamp, payload))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		metricWebhookDeliveries.add(1, "error")
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		metricWebhookDeliveries.add(1, "delivered")
+		getLogger().Log(Debug, "webhook delivered", "url", hook.URL, "event_id", e.ID, "type", e.Type, "status", resp.StatusCode)
+		return nil
+	case resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests:
+		metricWebhookDeliveries.add(1, "rejected")
+		return permanentError{fmt.Errorf("webhook answered %s", resp.Status)}
+	}
+	metricWebhookDeliveries.add(1, "error")
+	return fmt.Errorf("webhook answered %s", resp.Status)
+}
+
+// writeWebhookMetrics adds the webhook delivery counters and queue depths to a scrape
+func writeWebhookMetrics(w io.Writer) {
+	if len(webhookQueues) == 0 {
+		return
+	}
+	for url, q := range webhookQueues {
+		metricWebhookQueue.set(float64(q.depth()), url)
+	}
+	metricWebhookDeliveries.write(w, "bodyworn_webhook_deliveries_total", "Webhook delivery attempts, by result.", "counter")
+	metricWebhookQueue.write(w, "bodyworn_webhook_queue_depth", "Events waiting to be delivered, per webhook URL.", "gauge")
+}
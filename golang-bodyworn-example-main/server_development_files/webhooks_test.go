@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueueRetries(t *testing.T) {
+	SetLogger(&DefaultLogger{Out: io.Discard, MinLevel: Error})
+	dir := t.TempDir()
+	q, err := openDiskQueue(dir, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.baseDelay, q.maxDelay = time.Millisecond, time.Millisecond
+	var failed []string
+	q.failed = func(payload json.RawMessage, err error) { failed = append(failed, string(payload)) }
+	for _, payload := range []string{"flaky", "broken", "rejected"} {
+		if err := q.push(payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Queued items survive reopening
+	if reopened, err := openDiskQueue(dir, 3); err != nil || reopened.depth() != 3 {
+		t.Fatalf("reopened queue: depth %d, %v", reopened.depth(), err)
+	}
+
+	attempts := map[string]int{}
+	handle := func(ctx context.Context, payload json.RawMessage) error {
+		var name string
+		json.Unmarshal(payload, &name)
+		attempts[name]++
+		switch {
+		case name == "flaky" && attempts[name] < 3:
+			return errors.New("unavailable")
+		case name == "broken":
+			return errors.New("unavailable")
+		case name == "rejected":
+			return permanentError{errors.New("bad request")}
+		}
+		return nil
+	}
+	for i := 0; i < 10 && q.depth() > 0; i++ {
+		time.Sleep(2 * time.Millisecond)
+		q.process(context.Background(), handle)
+	}
+
+	if q.depth() != 0 {
+		t.Fatalf("depth %d after processing", q.depth())
+	}
+	if attempts["flaky"] != 3 || attempts["broken"] != 3 || attempts["rejected"] != 1 {
+		t.Errorf("attempts %v, want flaky and broken 3, rejected 1", attempts)
+	}
+	if strings.Join(failed, " ") != `"rejected" "broken"` {
+		t.Errorf("failed callbacks: %v", failed)
+	}
+	entries, _ := os.ReadDir(filepath.Join(dir, "failed"))
+	if len(entries) != 2 {
+		t.Errorf("%d items in the failed directory, want 2", len(entries))
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	q := &diskQueue{baseDelay: time.Second, maxDelay: 8 * time.Second}
+	for attempts, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 10: 8 * time.Second} {
+		for i := 0; i < 20; i++ {
+			if d := q.backoff(attempts); d < max/2 || d > max {
+				t.Errorf("backoff(%d) = %v, want between %v and %v", attempts, d, max/2, max)
+			}
+		}
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	received := make(chan *http.Request, 10)
+	bodies := make(chan string, 10)
+	var status = http.StatusServiceUnavailable
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- string(body)
+		w.WriteHeader(status)
+	}))
+	defer hook.Close()
+	client := hook.Client()
+	h := Webhook{URL: hook.URL, Secret: "s3cret"}
+	payload, _ := json.Marshal(Event{ID: "ev1", Type: EventObjectCreated, Path: "CamA/1.mkv"})
+
+	// 5xx is retried, 4xx other than 408 and 429 isn't, 2xx acknowledges
+	err := deliverWebhook(context.Background(), client, h, payload)
+	var permanent permanentError
+	if err == nil || errors.As(err, &permanent) {
+		t.Errorf("503: %v, want a retryable error", err)
+	}
+	r, body := <-received, <-bodies
+	if r.Header.Get("X-Bodyworn-Event") != EventObjectCreated || r.Header.Get("X-Bodyworn-Delivery") != "ev1" {
+		t.Errorf("headers %v", r.Header)
+	}
+	if want := webhookSignature("s3cret", r.Header.Get("X-Bodyworn-Timestamp"), []byte(body)); r.Header.Get("X-Bodyworn-Signature") != want {
+		t.Errorf("signature %q, want %q", r.Header.Get("X-Bodyworn-Signature"), want)
+	}
+	for code, retry := range map[int]bool{http.StatusBadRequest: false, http.StatusTooManyRequests: true, http.StatusRequestTimeout: true} {
+		status = code
+		err := deliverWebhook(context.Background(), client, h, payload)
+		<-received
+		<-bodies
+		if err == nil || errors.As(err, &permanent) == retry {
+			t.Errorf("%d: %v, retry %v", code, err, retry)
+		}
+	}
+	status = http.StatusNoContent
+	if err := deliverWebhook(context.Background(), client, h, payload); err != nil {
+		t.Errorf("204: %v", err)
+	}
+	<-received
+	<-bodies
+	if err := deliverWebhook(context.Background(), client, h, json.RawMessage("not json")); !errors.As(err, &permanent) {
+		t.Errorf("invalid payload: %v, want a permanent error", err)
+	}
+}
+
+func TestWebhookEvents(t *testing.T) {
+	deliveries := make(chan string, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deliveries <- r.Header.Get("X-Bodyworn-Event") + " " + r.URL.Path
+	}))
+	defer hook.Close()
+
+	url := startTestServer(t)
+	storage := url + "/v1.0/" + StorageAccount
+	admin := signIn(t, url, AuthUser, AuthPassword)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hooks := []Webhook{{URL: hook.URL + "/created", Events: []string{EventObjectCreated}, Prefix: "CamA/"}}
+	if err := StartWebhooks(ctx, hooks); err != nil {
+		t.Fatal(err)
+	}
+	defer delete(webhookQueues, hooks[0].URL)
+
+	request(t, http.MethodPut, storage+"/CamA", admin, nil, nil)
+	request(t, http.MethodPut, storage+"/CamB", admin, nil, nil)
+	request(t, http.MethodPut, storage+"/CamB/1.mkv", admin, nil, strings.NewReader("video"))
+	request(t, http.MethodPut, storage+"/CamA/1.mkv", admin, nil, strings.NewReader("video"))
+	select {
+	case got := <-deliveries:
+		if got != EventObjectCreated+" /created" {
+			t.Errorf("delivered %q", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not delivered")
+	}
+	select {
+	case got := <-deliveries:
+		t.Errorf("unwanted delivery %q", got)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestEventDispatch(t *testing.T) {
+	SetLogger(&DefaultLogger{Out: io.Discard, MinLevel: Error})
+	release := make(chan struct{})
+	var got []string
+	cancel := SubscribeEvents(func(e Event) {
+		<-release
+		got = append(got, e.Path)
+	})
+	defer cancel()
+
+	// A slow subscriber holds up neither publishers nor readers of the history
+	published := make(chan struct{})
+	go func() {
+		for _, path := range []string{"a", "b", "c"} {
+			publishEvent(Event{ID: newEventID(), Path: path})
+		}
+		eventsSince("")
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatal("publishing blocked on a subscriber")
+	}
+
+	close(release)
+	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+	if err := flushEvents(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, "") != "abc" {
+		t.Errorf("delivered %v, want a b c in order", got)
+	}
+}
@@ -0,0 +1,75 @@
+package simulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"BodyWornAPI/mkv"
+)
+
+const (
+	videoFrameRate   = 25
+	keyframeInterval = 2 * time.Second // as the cameras record
+	audioPacket      = 20 * time.Millisecond
+)
+
+// Recording returns a Matroska recording of the given length with H.264 video and Opus
+// audio laid out as a body worn camera writes it. The frames hold placeholder data
+// rather than decodable pictures and sound, which is enough for everything the server
+// reads from a recording: duration, tracks, keyframes and timing.
+func Recording(length time.Duration, started time.Time, title string) ([]byte, error) {
+	if length <= 0 {
+		return nil, fmt.Errorf("recording length %v must be positive", length)
+	}
+	frame := time.Second / videoFrameRate
+	// avcC for High profile level 3.1 with a single placeholder SPS and PPS
+	avcC := []byte{0x01, 0x64, 0x00, 0x1f, 0xff, 0xe1, 0x00, 0x04, 'g', 'A', 'A', 'A', 0x01, 0x00, 0x02, 'h', 'B'}
+	opusHead := []byte("OpusHead\x01\x02")
+	opusHead = binary.LittleEndian.AppendUint16(opusHead, 312)
+	opusHead = binary.LittleEndian.AppendUint32(opusHead, 48000)
+	opusHead = append(opusHead, 0, 0, 0)
+
+	f := &mkv.File{
+		TimecodeScale: 1000000,
+		Duration:      length,
+		Title:         title,
+		MuxingApp:     "bodyworn-sim",
+		WritingApp:    "bodyworn-sim",
+		DateUTC:       started.UTC(),
+		Tracks: []mkv.Track{
+			{Number: 1, Type: mkv.TrackVideo, CodecID: "V_MPEG4/ISO/AVC", CodecPrivate: avcC, DefaultDuration: frame, Width: 640, Height: 480},
+			{Number: 2, Type: mkv.TrackAudio, CodecID: "A_OPUS", CodecPrivate: opusHead, SamplingFrequency: 48000, Channels: 2},
+		},
+	}
+
+	var blocks []mkv.Block
+	ms := func(d time.Duration) int64 { return int64(d / time.Millisecond) }
+	video, audio := time.Duration(0), time.Duration(0)
+	for n := 0; video < length || audio < length; {
+		if video < length && video <= audio {
+			key := video%keyframeInterval == 0
+			nal := byte(0x41) // non-IDR slice
+			if key {
+				nal = 0x65 // IDR slice
+			}
+			payload := append([]byte{nal}, fmt.Sprintf("frame %d", n)...)
+			data := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+			blocks = append(blocks, mkv.Block{Track: 1, Timecode: ms(video), Keyframe: key, Data: append(data, payload...)})
+			video += frame
+			n++
+			continue
+		}
+		// TOC byte: CELT fullband 20ms, stereo, one frame
+		data := append([]byte{0xfc}, bytes.Repeat([]byte{0}, 8)...)
+		blocks = append(blocks, mkv.Block{Track: 2, Timecode: ms(audio), Keyframe: true, Data: data})
+		audio += audioPacket
+	}
+
+	var out bytes.Buffer
+	if err := mkv.Write(&out, f, blocks); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,520 @@
+// Package simulator behaves like an Axis body worn system controller talking to a
+// content destination: it loads connection.json, authenticates, reads the System
+// container and Capabilities.json, and uploads users, devices and recordings the way
+// the system does. Every answer is checked against what the system expects, and
+// anything else is reported as a deviation rather than stopping the run, so one pass
+// shows all of a destination's protocol problems.
+package simulator
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Connection is the connection file a content destination hands to the system
+type Connection struct {
+	ConnectionFileVersion   string   `json:"ConnectionFileVersion"`
+	SiteName                string   `json:"SiteName"`
+	ApplicationName         string   `json:"ApplicationName"`
+	ApplicationVersion      string   `json:"ApplicationVersion"`
+	AuthenticationTokenURI  []string `json:"AuthenticationTokenURI"`
+	BlobAPIKey              string   `json:"BlobAPIKey"`
+	BlobAPIUserName         string   `json:"BlobAPIUserName"`
+	ContainerType           string   `json:"ContainerType"`
+	WantEncryption          bool     `json:"WantEncryption"`
+	FullStoreAndReadSupport bool     `json:"FullStoreAndReadSupport"`
+}
+
+// LoadConnection reads and checks a connection file
+func LoadConnection(path string) (*Connection, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var c Connection
+	if err := json.Unmarshal(content, &c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if len(c.AuthenticationTokenURI) == 0 {
+		return nil, fmt.Errorf("%s: no AuthenticationTokenURI", path)
+	}
+	if c.BlobAPIUserName == "" || c.BlobAPIKey == "" {
+		return nil, fmt.Errorf("%s: BlobAPIUserName and BlobAPIKey are required", path)
+	}
+	return &c, nil
+}
+
+// capabilityKeys are the StoreAndRead capabilities the system reads from Capabilities.json
+var capabilityKeys = []string{
+	"StoreReadSystemID",
+	"StoreUserIDKey",
+	"StoreBookmarks",
+	"StoreSignedVideo",
+	"StoreGNSSTrackRecording",
+	"StoreRejectedContent",
+}
+
+// Scenario is what a run uploads
+type Scenario struct {
+	Users      int
+	Devices    int
+	Recordings int
+	// Length of each recording
+	Length time.Duration
+	// Container the recordings are uploaded to
+	Container string
+	// Deactivate sets the first user and device inactive at the end, as when an
+	// officer leaves or a camera is taken out of service
+	Deactivate bool
+}
+
+// DefaultScenario is one user, one device and two short recordings
+var DefaultScenario = Scenario{Users: 1, Devices: 1, Recordings: 2, Length: 6 * time.Second, Container: "Recordings", Deactivate: true}
+
+// Deviation is an answer that differs from what the system expects
+type Deviation struct {
+	Step    string `json:"step"`
+	Method  string `json:"method,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Problem string `json:"problem"`
+}
+
+func (d Deviation) String() string {
+	if d.Method == "" {
+		return fmt.Sprintf("%s: %s", d.Step, d.Problem)
+	}
+	return fmt.Sprintf("%s: %s %s: %s", d.Step, d.Method, d.Path, d.Problem)
+}
+
+// Report is the outcome of a run
+type Report struct {
+	StorageURL   string          `json:"storage_url"`
+	SystemID     string          `json:"system_id"`
+	Capabilities map[string]bool `json:"capabilities"`
+	Users        []string        `json:"users"`
+	Devices      []string        `json:"devices"`
+	Recordings   []string        `json:"recordings"`
+	Requests     int             `json:"requests"`
+	Deviations   []Deviation     `json:"deviations"`
+}
+
+// OK reports whether the destination behaved as the system expects
+func (r *Report) OK() bool {
+	return len(r.Deviations) == 0
+}
+
+// Simulator is one system controller connected to a content destination
+type Simulator struct {
+	Connection *Connection
+	Client     *http.Client
+	// Logf, when set, is called for every request made
+	Logf func(format string, args ...interface{})
+
+	token      string
+	storageURL string
+	report     *Report
+	// uploaded is the metadata and bodies of the objects stored so far
+	uploaded map[string]map[string]string
+	bodies   map[string][]byte
+}
+
+// New returns a simulator for the destination described by c
+func New(c *Connection) *Simulator {
+	return &Simulator{Connection: c, Client: &http.Client{Timeout: time.Minute}}
+}
+
+// errAborted stops a run when the destination can't be used at all
+var errAborted = errors.New("run aborted")
+
+// Run authenticates and plays the scenario. The error is only set when the run could
+// not continue, for example when authentication fails; the report holds what was
+// found up to that point either way.
+func (s *Simulator) Run(ctx context.Context, sc Scenario) (*Report, error) {
+	s.report = &Report{Capabilities: map[string]bool{}, Deviations: []Deviation{}}
+	s.uploaded, s.bodies = map[string]map[string]string{}, map[string][]byte{}
+	if sc.Container == "" {
+		sc.Container = DefaultScenario.Container
+	}
+	if sc.Length <= 0 {
+		sc.Length = DefaultScenario.Length
+	}
+	for _, step := range []func(context.Context, Scenario) error{
+		s.authenticate,
+		s.checkSystem,
+		s.readCapabilities,
+		s.registerSystem,
+		s.uploadParties,
+		s.uploadRecordings,
+		s.deactivate,
+	} {
+		if err := step(ctx, sc); err != nil {
+			return s.report, err
+		}
+	}
+	return s.report, nil
+}
+
+func (s *Simulator) deviate(step, method, path, format string, args ...interface{}) {
+	s.report.Deviations = append(s.report.Deviations, Deviation{Step: step, Method: method, Path: path, Problem: fmt.Sprintf(format, args...)})
+}
+
+// request sends a request to the storage account and returns the answer with its body.
+// A status other than one of want is recorded as a deviation and returns ok false.
+func (s *Simulator) request(ctx context.Context, step, method, path string, header http.Header, body []byte, want ...int) (*http.Response, []byte, bool) {
+	target := s.storageURL
+	if path != "" {
+		target += "/" + escapePath(path)
+	}
+	return s.send(ctx, step, method, target, path, header, body, want...)
+}
+
+func (s *Simulator) send(ctx context.Context, step, method, target, path string, header http.Header, body []byte, want ...int) (*http.Response, []byte, bool) {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		s.deviate(step, method, path, "%v", err)
+		return nil, nil, false
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if s.token != "" {
+		req.Header.Set("X-Auth-Token", s.token)
+	}
+	s.report.Requests++
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		s.deviate(step, method, path, "request failed: %v", err)
+		return nil, nil, false
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		s.deviate(step, method, path, "reading the answer failed: %v", err)
+		return resp, nil, false
+	}
+	if s.Logf != nil {
+		s.Logf("%s %s -> %d", method, target, resp.StatusCode)
+	}
+	for _, code := range want {
+		if resp.StatusCode == code {
+			return resp, content, true
+		}
+	}
+	s.deviate(step, method, path, "status %d, expected %s", resp.StatusCode, statusList(want))
+	return resp, content, false
+}
+
+func statusList(codes []int) string {
+	list := make([]string, len(codes))
+	for i, code := range codes {
+		list[i] = strconv.Itoa(code)
+	}
+	return strings.Join(list, " or ")
+}
+
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// authenticate tries each AuthenticationTokenURI in turn, as the system does, and
+// checks that a wrong key is refused
+func (s *Simulator) authenticate(ctx context.Context, sc Scenario) error {
+	const step = "authenticate"
+	c := s.Connection
+	for _, uri := range c.AuthenticationTokenURI {
+		header := http.Header{"X-Auth-User": {c.BlobAPIUserName}, "X-Auth-Key": {c.BlobAPIKey}}
+		resp, _, ok := s.send(ctx, step, http.MethodGet, uri, uri, header, nil, http.StatusOK, http.StatusNoContent)
+		if !ok {
+			continue
+		}
+		token, storage := resp.Header.Get("X-Auth-Token"), resp.Header.Get("X-Storage-Url")
+		if token == "" {
+			s.deviate(step, http.MethodGet, uri, "no X-Auth-Token")
+			continue
+		}
+		if u, err := url.Parse(storage); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			s.deviate(step, http.MethodGet, uri, "X-Storage-Url %q is not an absolute http(s) URL", storage)
+			continue
+		}
+		s.token, s.storageURL = token, strings.TrimSuffix(storage, "/")
+		s.report.StorageURL = s.storageURL
+
+		wrong := http.Header{"X-Auth-User": {c.BlobAPIUserName}, "X-Auth-Key": {c.BlobAPIKey + "-wrong"}}
+		token, s.token = s.token, ""
+		s.send(ctx, step, http.MethodGet, uri, uri, wrong, nil, http.StatusUnauthorized)
+		s.token = token
+		return nil
+	}
+	return fmt.Errorf("authentication failed at every AuthenticationTokenURI: %w", errAborted)
+}
+
+// checkSystem is the HEAD on the System container the system makes after authenticating
+func (s *Simulator) checkSystem(ctx context.Context, sc Scenario) error {
+	resp, _, ok := s.request(ctx, "system", http.MethodHead, "System", nil, nil, http.StatusNoContent, http.StatusOK)
+	if !ok {
+		if resp == nil {
+			return fmt.Errorf("storage URL %s unreachable: %w", s.storageURL, errAborted)
+		}
+		return nil
+	}
+	if _, err := strconv.Atoi(resp.Header.Get("X-Container-Object-Count")); err != nil {
+		s.deviate("system", http.MethodHead, "System", "X-Container-Object-Count missing or not a number: %q", resp.Header.Get("X-Container-Object-Count"))
+	}
+	return nil
+}
+
+func (s *Simulator) readCapabilities(ctx context.Context, sc Scenario) error {
+	const step, path = "capabilities", "System/Capabilities.json"
+	_, content, ok := s.request(ctx, step, http.MethodGet, path, nil, nil, http.StatusOK)
+	if !ok {
+		return nil
+	}
+	var capabilities struct {
+		StoreAndRead map[string]interface{}
+	}
+	if err := json.Unmarshal(content, &capabilities); err != nil {
+		s.deviate(step, http.MethodGet, path, "not valid JSON: %v", err)
+		return nil
+	}
+	if capabilities.StoreAndRead == nil {
+		s.deviate(step, http.MethodGet, path, "no StoreAndRead object")
+		return nil
+	}
+	for _, key := range capabilityKeys {
+		switch v := capabilities.StoreAndRead[key].(type) {
+		case bool:
+			s.report.Capabilities[key] = v
+		case nil:
+			s.deviate(step, http.MethodGet, path, "StoreAndRead.%s missing", key)
+		default:
+			s.deviate(step, http.MethodGet, path, "StoreAndRead.%s is %T, not a boolean", key, v)
+		}
+	}
+	return nil
+}
+
+// randomID returns n random bytes in upper case hex
+func randomID(n int) string {
+	raw := make([]byte, n)
+	rand.Read(raw)
+	return strings.ToUpper(hex.EncodeToString(raw))
+}
+
+// registerSystem stores the system object with the connection ID, and reads it back
+// when the connection file claims full store and read support
+func (s *Simulator) registerSystem(ctx context.Context, sc Scenario) error {
+	s.report.SystemID = randomID(8)
+	path := "System/" + s.report.SystemID
+	meta := map[string]string{"ConnectionID": randomID(16), "Name": "bodyworn-sim"}
+	s.putObject(ctx, "system", path, "application/octet-stream", nil, meta)
+	if s.Connection.FullStoreAndReadSupport {
+		s.checkObject(ctx, "system", path, nil, meta)
+	}
+	return nil
+}
+
+func (s *Simulator) uploadParties(ctx context.Context, sc Scenario) error {
+	for i := 0; i < sc.Users; i++ {
+		id := fmt.Sprintf("%06d", 100001+i)
+		meta := map[string]string{"Active": "true", "Name": fmt.Sprintf("Officer %d", i+1), "UserID": id}
+		body, _ := json.Marshal(meta)
+		if s.putObject(ctx, "users", "Users/"+id, "application/json", body, meta) {
+			s.report.Users = append(s.report.Users, id)
+			s.checkObject(ctx, "users", "Users/"+id, body, meta)
+		}
+	}
+	for i := 0; i < sc.Devices; i++ {
+		serial := fmt.Sprintf("B8A44F%06X", 0x100000+i)
+		meta := map[string]string{"Active": "true", "Model": "AXIS W110", "SerialNumber": serial}
+		body, _ := json.Marshal(meta)
+		if s.putObject(ctx, "devices", "Devices/"+serial, "application/json", body, meta) {
+			s.report.Devices = append(s.report.Devices, serial)
+			s.checkObject(ctx, "devices", "Devices/"+serial, body, meta)
+		}
+	}
+	return nil
+}
+
+func (s *Simulator) uploadRecordings(ctx context.Context, sc Scenario) error {
+	const step = "recordings"
+	if sc.Recordings == 0 {
+		return nil
+	}
+	s.request(ctx, step, http.MethodPut, sc.Container, nil, nil, http.StatusCreated, http.StatusAccepted)
+
+	started := time.Now().UTC().Truncate(time.Second).Add(-time.Duration(sc.Recordings) * (sc.Length + time.Minute))
+	for i := 0; i < sc.Recordings; i++ {
+		meta := map[string]string{"StartTime": started.Format(time.RFC3339), "EndTime": started.Add(sc.Length).Format(time.RFC3339), "SystemID": s.report.SystemID}
+		device := ""
+		if len(s.report.Users) > 0 {
+			meta["UserID"] = s.report.Users[i%len(s.report.Users)]
+		}
+		if len(s.report.Devices) > 0 {
+			device = s.report.Devices[i%len(s.report.Devices)]
+			meta["DeviceID"] = device
+		}
+		name := fmt.Sprintf("%s_%s", started.Format("20060102_150405"), device)
+		path := sc.Container + "/" + strings.TrimSuffix(name, "_") + ".mkv"
+
+		video, err := Recording(sc.Length, started, name)
+		if err != nil {
+			return err
+		}
+		if s.putObject(ctx, step, path, "video/x-matroska", video, meta) {
+			s.report.Recordings = append(s.report.Recordings, path)
+			s.checkObject(ctx, step, path, video, meta)
+			s.uploadCompanions(ctx, path, started, sc.Length)
+		}
+		started = started.Add(sc.Length + time.Minute)
+	}
+	s.checkListing(ctx, sc.Container)
+	return nil
+}
+
+// uploadCompanions stores the bookmarks and GNSS track of a recording next to it,
+// when the destination announced it stores them
+func (s *Simulator) uploadCompanions(ctx context.Context, path string, started time.Time, length time.Duration) {
+	base := strings.TrimSuffix(path, ".mkv")
+	if s.report.Capabilities["StoreBookmarks"] {
+		bookmarks, _ := json.Marshal([]map[string]interface{}{
+			{"label": "Incident", "time": started.Add(length / 2).Format(time.RFC3339), "offset_seconds": (length / 2).Seconds()},
+		})
+		s.putObject(ctx, "bookmarks", base+".bookmarks.json", "application/json", bookmarks, nil)
+	}
+	if s.report.Capabilities["StoreGNSSTrackRecording"] {
+		var fixes []map[string]interface{}
+		for t := time.Duration(0); t <= length; t += time.Second {
+			fixes = append(fixes, map[string]interface{}{
+				"lat":  55.6050 + float64(t/time.Second)*0.0001,
+				"lon":  13.0038 + float64(t/time.Second)*0.0001,
+				"time": started.Add(t).Format(time.RFC3339),
+			})
+		}
+		track, _ := json.Marshal(fixes)
+		s.putObject(ctx, "gnss", base+".gnss.json", "application/json", track, nil)
+	}
+}
+
+func metaHeader(meta map[string]string) http.Header {
+	header := http.Header{}
+	for name, value := range meta {
+		header["X-Object-Meta-"+name] = []string{value}
+	}
+	return header
+}
+
+// putObject uploads an object with its MD5 as ETag, which the destination must check
+// and return
+func (s *Simulator) putObject(ctx context.Context, step, path, contentType string, body []byte, meta map[string]string) bool {
+	header := metaHeader(meta)
+	sum := md5.Sum(body)
+	etag := hex.EncodeToString(sum[:])
+	header.Set("Content-Type", contentType)
+	header.Set("ETag", etag)
+	resp, _, ok := s.request(ctx, step, http.MethodPut, path, header, body, http.StatusCreated)
+	if !ok {
+		return false
+	}
+	if got := strings.Trim(resp.Header.Get("ETag"), `"`); !strings.EqualFold(got, etag) {
+		s.deviate(step, http.MethodPut, path, "ETag %q, expected %q", got, etag)
+	}
+	s.uploaded[path], s.bodies[path] = meta, body
+	return true
+}
+
+// checkObject reads an object's headers back and compares them with what was uploaded
+func (s *Simulator) checkObject(ctx context.Context, step, path string, body []byte, meta map[string]string) {
+	resp, _, ok := s.request(ctx, step, http.MethodHead, path, nil, nil, http.StatusOK, http.StatusNoContent)
+	if !ok {
+		return
+	}
+	if got := resp.Header.Get("Content-Length"); got != strconv.Itoa(len(body)) {
+		s.deviate(step, http.MethodHead, path, "Content-Length %q, expected %d", got, len(body))
+	}
+	sum := md5.Sum(body)
+	if got := strings.Trim(resp.Header.Get("ETag"), `"`); !strings.EqualFold(got, hex.EncodeToString(sum[:])) {
+		s.deviate(step, http.MethodHead, path, "ETag %q doesn't match the uploaded data", got)
+	}
+	for name, value := range meta {
+		if got := resp.Header.Values("X-Object-Meta-" + name); len(got) != 1 || got[0] != value {
+			s.deviate(step, http.MethodHead, path, "X-Object-Meta-%s is %q, expected %q", name, got, value)
+		}
+	}
+}
+
+// checkListing looks for the uploaded recordings in the JSON listing of container
+func (s *Simulator) checkListing(ctx context.Context, container string) {
+	const step = "listing"
+	path := container + "?format=json"
+	req := s.storageURL + "/" + escapePath(container) + "?format=json"
+	_, content, ok := s.send(ctx, step, http.MethodGet, req, path, nil, nil, http.StatusOK)
+	if !ok {
+		return
+	}
+	var listing []struct {
+		Name  string `json:"name"`
+		Hash  string `json:"hash"`
+		Bytes int64  `json:"bytes"`
+	}
+	if err := json.Unmarshal(content, &listing); err != nil {
+		s.deviate(step, http.MethodGet, path, "not a JSON listing: %v", err)
+		return
+	}
+	listed := map[string]bool{}
+	for _, o := range listing {
+		listed[container+"/"+o.Name] = true
+		if o.Hash == "" {
+			s.deviate(step, http.MethodGet, path, "%s listed without a hash", o.Name)
+		}
+	}
+	for _, recording := range s.report.Recordings {
+		if !listed[recording] {
+			s.deviate(step, http.MethodGet, path, "%s not listed", recording)
+		}
+	}
+}
+
+// deactivate sets the first user and device inactive. An object POST replaces all of
+// its metadata, so the other items are sent again.
+func (s *Simulator) deactivate(ctx context.Context, sc Scenario) error {
+	const step = "deactivate"
+	if !sc.Deactivate {
+		return nil
+	}
+	var targets []string
+	if len(s.report.Users) > 0 {
+		targets = append(targets, "Users/"+s.report.Users[0])
+	}
+	if len(s.report.Devices) > 0 {
+		targets = append(targets, "Devices/"+s.report.Devices[0])
+	}
+	for _, path := range targets {
+		meta := map[string]string{}
+		for name, value := range s.uploaded[path] {
+			meta[name] = value
+		}
+		meta["Active"] = "false"
+		if _, _, ok := s.request(ctx, step, http.MethodPost, path, metaHeader(meta), nil, http.StatusAccepted); ok {
+			s.uploaded[path] = meta
+			s.checkObject(ctx, step, path, s.bodies[path], meta)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,591 @@
+// Package swifttest is a conformance suite for the parts of the OpenStack Swift object
+// storage API that body worn systems and the tools around them use: authentication,
+// account, container and object PUT, GET, HEAD, POST and DELETE, listings, metadata
+// round-trips and expiry, with the status codes and headers Swift documents. Run it
+// from a test against any backend:
+//
+//	func TestSwift(t *testing.T) {
+//		swifttest.Run(t, swifttest.Target{AuthURL: url + "/auth/v1.0", User: user, Key: key})
+//	}
+//
+// The suite only touches containers whose names start with "swifttest-" and the
+// account metadata items it sets itself, and removes them again.
+package swifttest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Target is the account under test
+type Target struct {
+	// AuthURL, User and Key authenticate with X-Auth-User and X-Auth-Key, as Swift's
+	// TempAuth does. Without AuthURL, AccountURL and Token are used as they are.
+	AuthURL string
+	User    string
+	Key     string
+
+	AccountURL string
+	Token      string
+	// Client defaults to http.DefaultClient
+	Client *http.Client
+}
+
+// Run runs the whole suite against target, each group of checks as a subtest
+func Run(t *testing.T, target Target) {
+	c := &client{target: target}
+	if c.target.Client == nil {
+		c.target.Client = http.DefaultClient
+	}
+	if target.AuthURL != "" {
+		if !t.Run("Auth", c.testAuth) {
+			t.Fatal("authentication failed, skipping the other checks")
+		}
+	}
+	if c.target.AccountURL == "" {
+		t.Fatal("no account URL")
+	}
+	c.target.AccountURL = strings.TrimSuffix(c.target.AccountURL, "/")
+
+	t.Run("Account", c.testAccount)
+	t.Run("Container", c.testContainer)
+	t.Run("Object", c.testObject)
+	t.Run("ObjectMetadata", c.testObjectMetadata)
+	t.Run("Listing", c.testListing)
+	t.Run("Delete", c.testDelete)
+	t.Run("Expiry", c.testExpiry)
+}
+
+type client struct {
+	target Target
+}
+
+// response is an answer with its body read
+type response struct {
+	method, path string
+	Status       int
+	Header       http.Header
+	Body         []byte
+}
+
+// do sends a request for path below the account; path may carry a query string
+func (c *client) do(t *testing.T, method, path string, header http.Header, body []byte) *response {
+	t.Helper()
+	target := c.target.AccountURL
+	if path != "" {
+		query := ""
+		if i := strings.Index(path, "?"); i >= 0 {
+			path, query = path[:i], path[i:]
+		}
+		target += "/" + escapePath(path) + query
+	}
+	return c.send(t, method, target, header, body)
+}
+
+func (c *client) send(t *testing.T, method, target string, header http.Header, body []byte) *response {
+	t.Helper()
+	req, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if c.target.Token != "" && req.Header.Get("X-Auth-Token") == "" {
+		req.Header.Set("X-Auth-Token", c.target.Token)
+	}
+	resp, err := c.target.Client.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, target, err)
+	}
+	defer resp.Body.Close()
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: reading the answer: %v", method, target, err)
+	}
+	return &response{method: method, path: target, Status: resp.StatusCode, Header: resp.Header, Body: content}
+}
+
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// expect fails the test unless the status is one of want
+func (r *response) expect(t *testing.T, want ...int) bool {
+	t.Helper()
+	for _, code := range want {
+		if r.Status == code {
+			return true
+		}
+	}
+	t.Errorf("%s %s: status %d, want %v (body %q)", r.method, r.path, r.Status, want, truncate(r.Body))
+	return false
+}
+
+// header fails the test unless header name is value
+func (r *response) header(t *testing.T, name, value string) {
+	t.Helper()
+	if got := r.Header.Values(name); len(got) != 1 || got[0] != value {
+		t.Errorf("%s %s: %s is %q, want %q", r.method, r.path, name, got, value)
+	}
+}
+
+// absent fails the test when header name is set
+func (r *response) absent(t *testing.T, name string) {
+	t.Helper()
+	if got := r.Header.Values(name); len(got) > 0 {
+		t.Errorf("%s %s: %s is %q, want none", r.method, r.path, name, got)
+	}
+}
+
+// count returns a header that must be a non-negative integer
+func (r *response) count(t *testing.T, name string) int64 {
+	t.Helper()
+	n, err := strconv.ParseInt(r.Header.Get(name), 10, 64)
+	if err != nil || n < 0 {
+		t.Errorf("%s %s: %s is %q, want a count", r.method, r.path, name, r.Header.Get(name))
+	}
+	return n
+}
+
+func truncate(body []byte) string {
+	if len(body) > 200 {
+		return string(body[:200]) + "..."
+	}
+	return string(body)
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func randomName() string {
+	raw := make([]byte, 6)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+// container creates a container for one test and removes it, with whatever objects
+// are left in it, when the test ends
+func (c *client) container(t *testing.T) string {
+	t.Helper()
+	name := "swifttest-" + randomName()
+	c.do(t, http.MethodPut, name, nil, nil).expect(t, http.StatusCreated)
+	t.Cleanup(func() {
+		listing := c.do(t, http.MethodGet, name+"?format=json", nil, nil)
+		var objects []struct {
+			Name string `json:"name"`
+		}
+		json.Unmarshal(listing.Body, &objects)
+		for _, o := range objects {
+			c.do(t, http.MethodDelete, name+"/"+o.Name, nil, nil)
+		}
+		c.do(t, http.MethodDelete, name, nil, nil)
+	})
+	return name
+}
+
+// put uploads an object with its ETag and fails the test unless it is stored
+func (c *client) put(t *testing.T, path string, body []byte, header http.Header) {
+	t.Helper()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("ETag", md5Hex(body))
+	resp := c.do(t, http.MethodPut, path, header, body)
+	if resp.expect(t, http.StatusCreated) {
+		resp.header(t, "ETag", md5Hex(body))
+	}
+}
+
+func (c *client) testAuth(t *testing.T) {
+	resp := c.send(t, http.MethodGet, c.target.AuthURL, http.Header{"X-Auth-User": {c.target.User}, "X-Auth-Key": {c.target.Key + "-wrong"}}, nil)
+	resp.expect(t, http.StatusUnauthorized)
+	resp.absent(t, "X-Auth-Token")
+
+	resp = c.send(t, http.MethodGet, c.target.AuthURL, http.Header{"X-Auth-User": {c.target.User}, "X-Auth-Key": {c.target.Key}}, nil)
+	if !resp.expect(t, http.StatusOK, http.StatusNoContent) {
+		return
+	}
+	token, storage := resp.Header.Get("X-Auth-Token"), resp.Header.Get("X-Storage-Url")
+	if token == "" {
+		t.Error("no X-Auth-Token")
+	}
+	if u, err := url.Parse(storage); err != nil || u.Host == "" || !strings.HasPrefix(u.Scheme, "http") {
+		t.Errorf("X-Storage-Url %q is not an absolute URL", storage)
+		return
+	}
+	c.target.Token, c.target.AccountURL = token, storage
+}
+
+func (c *client) testAccount(t *testing.T) {
+	container := c.container(t)
+	c.put(t, container+"/object", []byte("account usage"), nil)
+
+	resp := c.do(t, http.MethodHead, "", nil, nil)
+	resp.expect(t, http.StatusNoContent, http.StatusOK)
+	if resp.count(t, "X-Account-Container-Count") < 1 || resp.count(t, "X-Account-Object-Count") < 1 || resp.count(t, "X-Account-Bytes-Used") < int64(len("account usage")) {
+		t.Errorf("account usage %s/%s/%s doesn't include the stored object", resp.Header.Get("X-Account-Container-Count"),
+			resp.Header.Get("X-Account-Object-Count"), resp.Header.Get("X-Account-Bytes-Used"))
+	}
+
+	resp = c.do(t, http.MethodGet, "?format=json", nil, nil)
+	resp.expect(t, http.StatusOK)
+	var containers []struct {
+		Name  string `json:"name"`
+		Count *int64 `json:"count"`
+		Bytes *int64 `json:"bytes"`
+	}
+	if err := json.Unmarshal(resp.Body, &containers); err != nil {
+		t.Fatalf("account listing: %v", err)
+	}
+	found := false
+	for _, listed := range containers {
+		if listed.Name == container {
+			found = true
+			if listed.Count == nil || *listed.Count != 1 || listed.Bytes == nil || *listed.Bytes != int64(len("account usage")) {
+				t.Errorf("account listing entry %s: count %v, bytes %v, want 1 and %d", container, listed.Count, listed.Bytes, len("account usage"))
+			}
+		}
+	}
+	if !found {
+		t.Errorf("account listing doesn't include %s", container)
+	}
+
+	resp = c.do(t, http.MethodGet, "?prefix="+container, nil, nil)
+	resp.expect(t, http.StatusOK)
+	if got := strings.TrimSpace(string(resp.Body)); got != container {
+		t.Errorf("plain account listing with prefix %s is %q", container, got)
+	}
+
+	// Account POSTs merge; empty values and X-Remove-Account-Meta-* delete
+	name := "Swifttest-" + randomName()
+	t.Cleanup(func() {
+		c.do(t, http.MethodPost, "", http.Header{"X-Remove-Account-Meta-" + name: {"x"}, "X-Account-Meta-" + name + "-2": {""}}, nil)
+	})
+	c.do(t, http.MethodPost, "", http.Header{"X-Account-Meta-" + name: {"one"}}, nil).expect(t, http.StatusNoContent)
+	c.do(t, http.MethodPost, "", http.Header{"X-Account-Meta-" + name + "-2": {"two"}}, nil).expect(t, http.StatusNoContent)
+	resp = c.do(t, http.MethodHead, "", nil, nil)
+	resp.header(t, "X-Account-Meta-"+name, "one")
+	resp.header(t, "X-Account-Meta-"+name+"-2", "two")
+	c.do(t, http.MethodPost, "", http.Header{"X-Remove-Account-Meta-" + name: {"x"}, "X-Account-Meta-" + name + "-2": {""}}, nil).expect(t, http.StatusNoContent)
+	resp = c.do(t, http.MethodHead, "", nil, nil)
+	resp.absent(t, "X-Account-Meta-"+name)
+	resp.absent(t, "X-Account-Meta-"+name+"-2")
+}
+
+func (c *client) testContainer(t *testing.T) {
+	container := c.container(t)
+	c.do(t, http.MethodPut, container, nil, nil).expect(t, http.StatusAccepted)
+
+	resp := c.do(t, http.MethodHead, container, nil, nil)
+	resp.expect(t, http.StatusNoContent, http.StatusOK)
+	if resp.count(t, "X-Container-Object-Count") != 0 || resp.count(t, "X-Container-Bytes-Used") != 0 {
+		t.Error("new container isn't empty")
+	}
+
+	// Container PUTs and POSTs merge metadata
+	c.do(t, http.MethodPut, container, http.Header{"X-Container-Meta-Colour": {"blue"}}, nil).expect(t, http.StatusAccepted)
+	c.do(t, http.MethodPost, container, http.Header{"X-Container-Meta-Size": {"large"}}, nil).expect(t, http.StatusNoContent)
+	resp = c.do(t, http.MethodHead, container, nil, nil)
+	resp.header(t, "X-Container-Meta-Colour", "blue")
+	resp.header(t, "X-Container-Meta-Size", "large")
+	c.do(t, http.MethodPost, container, http.Header{"X-Remove-Container-Meta-Colour": {"x"}}, nil).expect(t, http.StatusNoContent)
+	c.do(t, http.MethodPost, container, http.Header{"X-Container-Meta-Size": {""}}, nil).expect(t, http.StatusNoContent)
+	resp = c.do(t, http.MethodHead, container, nil, nil)
+	resp.absent(t, "X-Container-Meta-Colour")
+	resp.absent(t, "X-Container-Meta-Size")
+
+	// The other kinds' metadata headers don't apply to containers
+	c.do(t, http.MethodPost, container, http.Header{"X-Object-Meta-Colour": {"red"}}, nil).expect(t, http.StatusNoContent)
+	c.do(t, http.MethodHead, container, nil, nil).absent(t, "X-Container-Meta-Colour")
+
+	// Listings of an empty container
+	c.do(t, http.MethodGet, container, nil, nil).expect(t, http.StatusNoContent)
+	resp = c.do(t, http.MethodGet, container+"?format=json", nil, nil)
+	resp.expect(t, http.StatusOK)
+	if got := strings.TrimSpace(string(resp.Body)); got != "[]" {
+		t.Errorf("JSON listing of an empty container is %q, want []", got)
+	}
+
+	missing := "swifttest-" + randomName()
+	c.do(t, http.MethodHead, missing, nil, nil).expect(t, http.StatusNotFound)
+	c.do(t, http.MethodGet, missing, nil, nil).expect(t, http.StatusNotFound)
+	c.do(t, http.MethodPost, missing, http.Header{"X-Container-Meta-Colour": {"blue"}}, nil).expect(t, http.StatusNotFound)
+}
+
+func (c *client) testObject(t *testing.T) {
+	container := c.container(t)
+	path := container + "/clip.txt"
+	body := []byte("recorded at 12:00")
+	c.put(t, path, body, http.Header{"Content-Type": {"text/plain"}, "X-Object-Meta-Camera": {"B8A44F100000"}})
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		resp := c.do(t, method, path, nil, nil)
+		if !resp.expect(t, http.StatusOK) {
+			continue
+		}
+		resp.header(t, "Content-Length", strconv.Itoa(len(body)))
+		resp.header(t, "ETag", md5Hex(body))
+		resp.header(t, "Content-Type", "text/plain")
+		resp.header(t, "X-Object-Meta-Camera", "B8A44F100000")
+		if _, err := http.ParseTime(resp.Header.Get("Last-Modified")); err != nil {
+			t.Errorf("%s: Last-Modified %q is not an HTTP date", method, resp.Header.Get("Last-Modified"))
+		}
+		if method == http.MethodGet && !bytes.Equal(resp.Body, body) {
+			t.Errorf("GET returned %q, want %q", resp.Body, body)
+		}
+		if method == http.MethodHead && len(resp.Body) != 0 {
+			t.Errorf("HEAD returned a body of %d bytes", len(resp.Body))
+		}
+	}
+
+	// An ETag that doesn't match the body is refused and the object kept
+	resp := c.do(t, http.MethodPut, path, http.Header{"ETag": {md5Hex([]byte("other"))}}, []byte("corrupted"))
+	resp.expect(t, http.StatusUnprocessableEntity)
+	if got := c.do(t, http.MethodGet, path, nil, nil).Body; !bytes.Equal(got, body) {
+		t.Errorf("object is %q after a refused PUT, want %q", got, body)
+	}
+
+	// A PUT replaces the object and all of its metadata
+	replaced := []byte("replaced")
+	c.put(t, path, replaced, nil)
+	resp = c.do(t, http.MethodGet, path, nil, nil)
+	if !bytes.Equal(resp.Body, replaced) {
+		t.Errorf("object is %q after a PUT, want %q", resp.Body, replaced)
+	}
+	resp.absent(t, "X-Object-Meta-Camera")
+	resp.header(t, "Content-Type", "application/octet-stream")
+
+	// Empty objects, nested names and names that need escaping
+	for _, name := range []string{"empty", "2024/06/01/clip.mkv", "with space & symbols +%.txt", "unicodé/名前.txt"} {
+		var data []byte
+		if name != "empty" {
+			data = []byte(name)
+		}
+		c.put(t, container+"/"+name, data, nil)
+		resp := c.do(t, http.MethodGet, container+"/"+name, nil, nil)
+		if resp.expect(t, http.StatusOK) && !bytes.Equal(resp.Body, data) {
+			t.Errorf("%s: GET returned %q, want %q", name, resp.Body, data)
+		}
+		resp.header(t, "Content-Length", strconv.Itoa(len(data)))
+	}
+
+	c.do(t, http.MethodGet, container+"/missing", nil, nil).expect(t, http.StatusNotFound)
+	c.do(t, http.MethodHead, container+"/missing", nil, nil).expect(t, http.StatusNotFound)
+}
+
+func (c *client) testObjectMetadata(t *testing.T) {
+	container := c.container(t)
+	path := container + "/object"
+	c.put(t, path, []byte("metadata"), http.Header{
+		"Content-Type":        {"application/json"},
+		"X-Object-Meta-Color": {"blue"},
+		"X-Object-Meta-Name":  {"café ☕"},
+	})
+	resp := c.do(t, http.MethodHead, path, nil, nil)
+	resp.header(t, "X-Object-Meta-Color", "blue")
+	resp.header(t, "X-Object-Meta-Name", "café ☕")
+
+	// An object POST replaces all metadata but keeps the data and its Content-Type
+	c.do(t, http.MethodPost, path, http.Header{"X-Object-Meta-Size": {"large"}}, nil).expect(t, http.StatusAccepted)
+	resp = c.do(t, http.MethodGet, path, nil, nil)
+	resp.header(t, "X-Object-Meta-Size", "large")
+	resp.absent(t, "X-Object-Meta-Color")
+	resp.absent(t, "X-Object-Meta-Name")
+	resp.header(t, "Content-Type", "application/json")
+	resp.header(t, "ETag", md5Hex([]byte("metadata")))
+	if string(resp.Body) != "metadata" {
+		t.Errorf("object is %q after a POST", resp.Body)
+	}
+
+	// A POST can change the Content-Type
+	c.do(t, http.MethodPost, path, http.Header{"Content-Type": {"text/plain"}, "X-Object-Meta-Size": {"large"}}, nil).expect(t, http.StatusAccepted)
+	c.do(t, http.MethodHead, path, nil, nil).header(t, "Content-Type", "text/plain")
+
+	// Container and account metadata headers don't apply to objects
+	c.do(t, http.MethodPost, path, http.Header{"X-Container-Meta-Colour": {"red"}}, nil).expect(t, http.StatusAccepted)
+	resp = c.do(t, http.MethodHead, path, nil, nil)
+	resp.absent(t, "X-Container-Meta-Colour")
+	resp.absent(t, "X-Object-Meta-Colour")
+
+	// Swift's default limits: names up to 128 bytes, values up to 256, 90 items, 4096 bytes
+	for desc, header := range map[string]http.Header{
+		"name too long":  {"X-Object-Meta-" + strings.Repeat("n", 129): {"v"}},
+		"value too long": {"X-Object-Meta-Long": {strings.Repeat("v", 257)}},
+		"too many items": manyItems(91, 1),
+		"too large":      manyItems(20, 250),
+	} {
+		if resp := c.do(t, http.MethodPost, path, header, nil); resp.Status != http.StatusBadRequest {
+			t.Errorf("POST with metadata %s: status %d, want 400", desc, resp.Status)
+		}
+		if resp := c.do(t, http.MethodPut, container+"/limits", header, []byte("x")); resp.Status != http.StatusBadRequest {
+			t.Errorf("PUT with metadata %s: status %d, want 400", desc, resp.Status)
+		}
+	}
+	resp = c.do(t, http.MethodPost, path, http.Header{"X-Object-Meta-" + strings.Repeat("n", 128): {strings.Repeat("v", 256)}}, nil)
+	resp.expect(t, http.StatusAccepted)
+
+	c.do(t, http.MethodPost, container+"/missing", http.Header{"X-Object-Meta-Color": {"blue"}}, nil).expect(t, http.StatusNotFound)
+}
+
+// manyItems returns n metadata headers with values of size bytes
+func manyItems(n, size int) http.Header {
+	header := http.Header{}
+	for i := 0; i < n; i++ {
+		header.Set("X-Object-Meta-Item"+strconv.Itoa(i), strings.Repeat("v", size))
+	}
+	return header
+}
+
+func (c *client) testListing(t *testing.T) {
+	container := c.container(t)
+	names := []string{"a.mkv", "b.mkv", "c/1.mkv", "c/2.mkv", "d.json"}
+	var total int64
+	for _, name := range names {
+		c.put(t, container+"/"+name, []byte("data of "+name), http.Header{"Content-Type": {"video/x-matroska"}})
+		total += int64(len("data of " + name))
+	}
+
+	resp := c.do(t, http.MethodHead, container, nil, nil)
+	if got := resp.count(t, "X-Container-Object-Count"); got != int64(len(names)) {
+		t.Errorf("X-Container-Object-Count is %d, want %d", got, len(names))
+	}
+	if got := resp.count(t, "X-Container-Bytes-Used"); got != total {
+		t.Errorf("X-Container-Bytes-Used is %d, want %d", got, total)
+	}
+
+	resp = c.do(t, http.MethodGet, container+"?format=json", nil, nil)
+	resp.expect(t, http.StatusOK)
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+		t.Errorf("JSON listing Content-Type is %q", ct)
+	}
+	var objects []map[string]interface{}
+	if err := json.Unmarshal(resp.Body, &objects); err != nil {
+		t.Fatalf("JSON listing: %v", err)
+	}
+	if len(objects) != len(names) {
+		t.Fatalf("JSON listing has %d entries, want %d", len(objects), len(names))
+	}
+	for i, o := range objects {
+		data := []byte("data of " + names[i])
+		if o["name"] != names[i] || o["hash"] != md5Hex(data) || o["bytes"] != float64(len(data)) || o["content_type"] != "video/x-matroska" {
+			t.Errorf("JSON listing entry %d is %v, want %s with hash %s, %d bytes and video/x-matroska", i, o, names[i], md5Hex(data), len(data))
+		}
+		if modified, _ := o["last_modified"].(string); !validListingTime(modified) {
+			t.Errorf("JSON listing entry %d has last_modified %q, want e.g. 2024-06-01T12:00:00.000000", i, o["last_modified"])
+		}
+	}
+
+	// Accept: application/json selects JSON too
+	resp = c.do(t, http.MethodGet, container, http.Header{"Accept": {"application/json"}}, nil)
+	if !json.Valid(resp.Body) {
+		t.Errorf("listing with Accept: application/json is not JSON: %q", truncate(resp.Body))
+	}
+
+	for query, want := range map[string]string{
+		"":                             "a.mkv b.mkv c/1.mkv c/2.mkv d.json",
+		"?prefix=c/":                   "c/1.mkv c/2.mkv",
+		"?delimiter=/":                 "a.mkv b.mkv c/ d.json",
+		"?prefix=c/&delimiter=/":       "c/1.mkv c/2.mkv",
+		"?marker=b.mkv":                "c/1.mkv c/2.mkv d.json",
+		"?end_marker=c/1.mkv":          "a.mkv b.mkv",
+		"?marker=a.mkv&limit=2":        "b.mkv c/1.mkv",
+		"?reverse=true":                "d.json c/2.mkv c/1.mkv b.mkv a.mkv",
+		"?reverse=true&marker=c/1.mkv": "b.mkv a.mkv",
+		"?limit=0":                     "",
+		"?prefix=x":                    "",
+	} {
+		resp := c.do(t, http.MethodGet, container+query, nil, nil)
+		got := strings.Join(strings.Fields(string(resp.Body)), " ")
+		if got != want {
+			t.Errorf("listing%s is %q, want %q", query, got, want)
+		}
+		if want == "" {
+			resp.expect(t, http.StatusNoContent)
+		} else {
+			resp.expect(t, http.StatusOK)
+		}
+	}
+
+	resp = c.do(t, http.MethodGet, container+"?delimiter=/&format=json", nil, nil)
+	var entries []map[string]interface{}
+	json.Unmarshal(resp.Body, &entries)
+	if len(entries) != 4 || entries[2]["subdir"] != "c/" || len(entries[2]) != 1 {
+		t.Errorf("JSON listing with delimiter is %v, want c/ as a subdir entry of its own", entries)
+	}
+
+	c.do(t, http.MethodGet, container+"?limit=10001", nil, nil).expect(t, http.StatusPreconditionFailed)
+}
+
+// validListingTime reports whether s is a listing timestamp: UTC without a zone, with
+// microseconds
+func validListingTime(s string) bool {
+	_, err := time.Parse("2006-01-02T15:04:05.000000", s)
+	return err == nil
+}
+
+func (c *client) testDelete(t *testing.T) {
+	container := c.container(t)
+	path := container + "/object"
+	c.put(t, path, []byte("to be deleted"), nil)
+
+	c.do(t, http.MethodDelete, container, nil, nil).expect(t, http.StatusConflict)
+	c.do(t, http.MethodDelete, path, nil, nil).expect(t, http.StatusNoContent)
+	c.do(t, http.MethodGet, path, nil, nil).expect(t, http.StatusNotFound)
+	c.do(t, http.MethodHead, path, nil, nil).expect(t, http.StatusNotFound)
+	c.do(t, http.MethodDelete, path, nil, nil).expect(t, http.StatusNotFound)
+	if got := c.do(t, http.MethodHead, container, nil, nil).count(t, "X-Container-Object-Count"); got != 0 {
+		t.Errorf("X-Container-Object-Count is %d after the delete, want 0", got)
+	}
+
+	c.do(t, http.MethodDelete, container, nil, nil).expect(t, http.StatusNoContent)
+	c.do(t, http.MethodHead, container, nil, nil).expect(t, http.StatusNotFound)
+	c.do(t, http.MethodDelete, container, nil, nil).expect(t, http.StatusNotFound)
+}
+
+func (c *client) testExpiry(t *testing.T) {
+	container := c.container(t)
+	path := container + "/expiring"
+
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	c.do(t, http.MethodPut, path, http.Header{"X-Delete-At": {past}}, []byte("x")).expect(t, http.StatusBadRequest)
+	c.do(t, http.MethodPut, path, http.Header{"X-Delete-After": {"soon"}}, []byte("x")).expect(t, http.StatusBadRequest)
+
+	before := time.Now().Unix()
+	c.put(t, path, []byte("expiring"), http.Header{"X-Delete-After": {"3600"}})
+	at, err := strconv.ParseInt(c.do(t, http.MethodHead, path, nil, nil).Header.Get("X-Delete-At"), 10, 64)
+	if err != nil || at < before+3600 || at > time.Now().Unix()+3600 {
+		t.Errorf("X-Delete-At is %d (%v), want about an hour from now", at, err)
+	}
+
+	// A POST without expiry headers keeps the expiry; X-Remove-Delete-At clears it
+	c.do(t, http.MethodPost, path, http.Header{"X-Object-Meta-Color": {"blue"}}, nil).expect(t, http.StatusAccepted)
+	if c.do(t, http.MethodHead, path, nil, nil).Header.Get("X-Delete-At") == "" {
+		t.Error("a POST without expiry headers cleared X-Delete-At")
+	}
+	c.do(t, http.MethodPost, path, http.Header{"X-Remove-Delete-At": {"x"}}, nil).expect(t, http.StatusAccepted)
+	c.do(t, http.MethodHead, path, nil, nil).absent(t, "X-Delete-At")
+
+	// Expired objects are gone at once, whenever the backend actually removes them
+	c.do(t, http.MethodPost, path, http.Header{"X-Delete-After": {"1"}}, nil).expect(t, http.StatusAccepted)
+	time.Sleep(2 * time.Second)
+	c.do(t, http.MethodGet, path, nil, nil).expect(t, http.StatusNotFound)
+	c.do(t, http.MethodHead, path, nil, nil).expect(t, http.StatusNotFound)
+	c.do(t, http.MethodPost, path, http.Header{"X-Object-Meta-Color": {"blue"}}, nil).expect(t, http.StatusNotFound)
+}